@@ -10,11 +10,25 @@ require (
 	github.com/Laisky/go-utils v1.14.6
 	github.com/Laisky/zap v1.12.2
 	github.com/Shopify/sarama v1.26.4
+	github.com/alicebob/miniredis/v2 v2.17.0
 	github.com/cespare/xxhash v1.1.0
+	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/gin-contrib/pprof v1.3.0
 	github.com/gin-gonic/gin v1.7.0
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/golang/snappy v0.0.1
+	github.com/google/uuid v1.1.2
 	github.com/json-iterator/go v1.1.11
+	github.com/klauspost/compress v1.11.4
+	github.com/lib/pq v1.10.4
+	github.com/minio/minio-go/v7 v7.0.14
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pkg/errors v0.9.1
+	github.com/rabbitmq/amqp091-go v1.1.0
 	github.com/spf13/cobra v1.0.0
 	github.com/tinylib/msgp v1.1.2
+	go.opentelemetry.io/proto/otlp v0.19.0
+	google.golang.org/grpc v1.42.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -9,6 +9,7 @@ import (
 type AcceptorFilterItf interface {
 	SetUpstream(chan *library.FluentMsg)
 	SetMsgPool(*sync.Pool)
+	SetPersistNotifier(*library.PersistNotifier)
 
 	Filter(*library.FluentMsg) *library.FluentMsg
 	DiscardMsg(*library.FluentMsg)
@@ -17,6 +18,8 @@ type AcceptorFilterItf interface {
 type BaseFilter struct {
 	upstreamChan chan *library.FluentMsg
 	msgPool      *sync.Pool
+	// persistNotifier could be nil
+	persistNotifier *library.PersistNotifier
 }
 
 func (f *BaseFilter) SetUpstream(upChan chan *library.FluentMsg) {
@@ -27,7 +30,16 @@ func (f *BaseFilter) SetMsgPool(msgPool *sync.Pool) {
 	f.msgPool = msgPool
 }
 
+func (f *BaseFilter) SetPersistNotifier(notifier *library.PersistNotifier) {
+	f.persistNotifier = notifier
+}
+
+// DiscardMsg discard msg on purpose,
+// msg is treated as persisted since there is nothing need to be persisted.
 func (f *BaseFilter) DiscardMsg(msg *library.FluentMsg) {
+	if f.persistNotifier != nil {
+		f.persistNotifier.Notify(msg.ID, true)
+	}
 	msg.ExtIds = nil
 	f.msgPool.Put(msg)
 }
@@ -19,6 +19,8 @@ type AcceptorPipelineCfg struct {
 	OutChanSize, ReEnterChanSize, NFork int
 	IsThrottle                          bool
 	ThrottleNPerSec, ThrottleMax        int
+	// PersistNotifier: notify msg is not persisted if discarded by pipeline, could be nil
+	PersistNotifier *library.PersistNotifier
 }
 
 type AcceptorPipeline struct {
@@ -44,6 +46,7 @@ func NewAcceptorPipeline(ctx context.Context, cfg *AcceptorPipelineCfg, filters
 	for _, filter := range a.filters {
 		filter.SetUpstream(a.reEnterChan)
 		filter.SetMsgPool(a.MsgPool)
+		filter.SetPersistNotifier(a.PersistNotifier)
 	}
 
 	if a.IsThrottle {
@@ -118,6 +121,9 @@ func (f *AcceptorPipeline) registerMonitor() {
 }
 
 func (f *AcceptorPipeline) DiscardMsg(msg *library.FluentMsg) {
+	if f.PersistNotifier != nil {
+		f.PersistNotifier.Notify(msg.ID, false)
+	}
 	msg.ExtIds = nil
 	f.MsgPool.Put(msg)
 }
@@ -175,7 +181,7 @@ func (f *AcceptorPipeline) Wrap(ctx context.Context, asyncInChan, syncInChan cha
 					case skipDumpChan <- msg: // baidu has low disk performance
 					default:
 						log.Logger.Error("discard msg since disk & downstream are busy", zap.String("tag", msg.Tag))
-						f.MsgPool.Put(msg)
+						f.DiscardMsg(msg)
 					}
 				}
 			}
@@ -19,6 +19,8 @@ type AcceptorCfg struct {
 	Journal                           *Journal
 	AsyncOutChanSize, SyncOutChanSize int
 	MaxRotateID                       int64
+	// PersistNotifier: notify recvs whether msgs are persisted, could be nil
+	PersistNotifier *library.PersistNotifier
 }
 
 // Acceptor listening tcp connection, and decode messages
@@ -90,6 +92,7 @@ func (a *Acceptor) Run(ctx context.Context) {
 		recv.SetSyncOutChan(a.syncOutChan)
 		recv.SetMsgPool(a.MsgPool)
 		recv.SetCounter(couter.GetChild())
+		recv.SetPersistNotifier(a.PersistNotifier)
 		go recv.Run(ctx)
 	}
 }
@@ -3,6 +3,7 @@ package controller
 import (
 	"context"
 	"encoding/hex"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"sync"
@@ -25,7 +26,8 @@ import (
 
 // Controllor is an IoC that manage all roles
 type Controllor struct {
-	msgPool *sync.Pool
+	msgPool         *sync.Pool
+	persistNotifier *library.PersistNotifier
 }
 
 // NewControllor create new Controllor
@@ -46,9 +48,22 @@ func NewControllor() (c *Controllor) {
 	return c
 }
 
+// initPersistNotifier notify recvs whether msgs are persisted by journal,
+// so recvs could ack upstream after msgs are persisted.
+func (c *Controllor) initPersistNotifier(ctx context.Context) {
+	timeout := gutils.Settings.GetDuration("settings.journal.persist_timeout_sec") * time.Second
+	if timeout <= 0 {
+		timeout = defaultPersistTimeout
+		log.Logger.Info("reset persist_timeout_sec", zap.Duration("persist_timeout_sec", timeout))
+	}
+
+	c.persistNotifier = library.NewPersistNotifier(ctx, timeout)
+}
+
 func (c *Controllor) initJournal(ctx context.Context) *Journal {
 	return NewJournal(ctx, &JournalCfg{
 		MsgPool:                   c.msgPool,
+		PersistNotifier:           c.persistNotifier,
 		BufDirPath:                gutils.Settings.GetString("settings.journal.buf_dir_path"),
 		BufSizeBytes:              gutils.Settings.GetInt64("settings.journal.buf_file_bytes"),
 		JournalOutChanLen:         gutils.Settings.GetInt("settings.journal.journal_out_chan_len"),
@@ -98,16 +113,20 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 				}))
 			case "rsyslog":
 				receivers = append(receivers, recvs.NewRsyslogRecv(&recvs.RsyslogCfg{
-					Name:          name,
-					RewriteTags:   gutils.Settings.GetStringMapString("settings.acceptor.recvs.plugins." + name + ".rewrite_tags"),
-					Addr:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
-					Tag:           library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
-					TagKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
-					MsgKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
-					TimeShift:     gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".time_shift_sec") * time.Second,
-					NewTimeFormat: gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".new_time_format"),
-					TimeKey:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
-					NewTimeKey:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".new_time_key"),
+					Name:                name,
+					RewriteTags:         gutils.Settings.GetStringMapString("settings.acceptor.recvs.plugins." + name + ".rewrite_tags"),
+					Addr:                gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					Tag:                 library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:              gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:              gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TimeShift:           gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".time_shift_sec") * time.Second,
+					NewTimeFormat:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".new_time_format"),
+					TimeKey:             gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
+					NewTimeKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".new_time_key"),
+					SDKey:               gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".sd_key"),
+					IsFlattenSD:         gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_flatten_sd"),
+					IsRFC3164NoHostname: gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_rfc3164_no_hostname"),
+					RFC3164TimeZone:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".rfc3164_time_zone"),
 				}))
 			case "http":
 				receivers = append(receivers, recvs.NewHTTPRecv(&recvs.HTTPRecvCfg{ // wechat mini program
@@ -121,6 +140,8 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 					Path:               gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path"),
 					SigKey:             gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".signature_key"),
 					SigSalt:            []byte(gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".signature_salt")),
+					SigScheme:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".signature_scheme"),
+					HMACKeys:           loadHMACKeys("settings.acceptor.recvs.plugins." + name + ".hmac_keys"),
 					MaxBodySize:        gutils.Settings.GetInt64("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
 					TSRegexp:           regexp.MustCompile(gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".ts_regexp")),
 					TimeKey:            gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
@@ -128,6 +149,168 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 					MaxAllowedDelaySec: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".max_allowed_delay_sec") * time.Second,
 					MaxAllowedAheadSec: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".max_allowed_ahead_sec") * time.Second,
 				}))
+			case "http-json":
+				receivers = append(receivers, recvs.NewHTTPJSONRecv(&recvs.HTTPJSONRecvCfg{
+					Name:            name,
+					HTTPSrv:         server,
+					Path:            gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path"),
+					TagHeader:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_header"),
+					Tag:             library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TagRegexp:       loadOptionalRegexp(gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_regexp")),
+					MaxBodySize:     gutils.Settings.GetInt64("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+					BearerTokens:    gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".bearer_tokens"),
+					HMACKeys:        loadHMACKeys("settings.acceptor.recvs.plugins." + name + ".hmac_keys"),
+					MaxAllowedDelay: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".max_allowed_delay_sec") * time.Second,
+					MaxAllowedAhead: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".max_allowed_ahead_sec") * time.Second,
+					AllowOrigins:    gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".allow_origins"),
+				}))
+			case "es-bulk":
+				receivers = append(receivers, recvs.NewESBulkRecv(&recvs.ESBulkRecvCfg{
+					Name:        name,
+					Addr:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					Tag:         library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					IndexKey:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".index_key"),
+					Version:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".version"),
+					IndexRegexp: loadOptionalRegexp(gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".index_regexp")),
+					MaxBodySize: gutils.Settings.GetInt64("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+				}))
+			case "beats":
+				receivers = append(receivers, recvs.NewBeatsRecv(&recvs.BeatsRecvCfg{
+					Name:              name,
+					Addr:              gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					Tag:               library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:            gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					TLSCertFile:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tls_cert_file"),
+					TLSKeyFile:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tls_key_file"),
+					MaxWindowSize:     gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_window_size"),
+					MaxFrameSize:      gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_frame_byte"),
+					IdleTimeout:       gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".idle_timeout_sec") * time.Second,
+					KeepaliveInterval: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".keepalive_interval_sec") * time.Second,
+				}))
+			case "gelf":
+				receivers = append(receivers, recvs.NewGELFRecv(&recvs.GELFRecvCfg{
+					Name:           name,
+					Addr:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					Protocol:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".protocol"),
+					Tag:            library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					MaxMessageSize: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_message_byte"),
+					ChunkTimeout:   gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".chunk_timeout_sec") * time.Second,
+				}))
+			case "otlp":
+				receivers = append(receivers, recvs.NewOTLPRecv(&recvs.OTLPRecvCfg{
+					Name:        name,
+					HTTPSrv:     server,
+					GRPCAddr:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".grpc_addr"),
+					HTTPPath:    gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".http_path"),
+					Tag:         library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					MaxBodySize: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+				}))
+			case "loki":
+				receivers = append(receivers, recvs.NewLokiRecv(&recvs.LokiRecvCfg{
+					Name:        name,
+					HTTPSrv:     server,
+					Path:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path"),
+					Tag:         library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TimeKey:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
+					TenantKey:   gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tenant_key"),
+					MaxBodySize: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+				}))
+			case "hec":
+				tokens := map[string]string{}
+				for token, tag := range gutils.Settings.GetStringMapString("settings.acceptor.recvs.plugins." + name + ".tokens") {
+					tokens[token] = library.LoadTagReplaceEnv(env, tag)
+				}
+				receivers = append(receivers, recvs.NewHECRecv(&recvs.HECRecvCfg{
+					Name:           name,
+					HTTPSrv:        server,
+					Path:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path"),
+					TagKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TimeKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".time_key"),
+					Tokens:         tokens,
+					MaxBodySize:    gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_body_byte"),
+					IsAckEnabled:   gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_ack_enabled"),
+					AckIdleTimeout: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".ack_idle_timeout_sec") * time.Second,
+				}))
+			case "unix":
+				receivers = append(receivers, recvs.NewUnixRecv(&recvs.UnixRecvCfg{
+					Name:           name,
+					Path:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path"),
+					Network:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".network"),
+					Format:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".format"),
+					FileMode:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".file_mode"),
+					Tag:            library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					MaxMessageSize: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_message_byte"),
+				}))
+			case "stdin":
+				receivers = append(receivers, recvs.NewStdinRecv(&recvs.StdinRecvCfg{
+					Name:        name,
+					Format:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".format"),
+					Tag:         library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:      gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					MaxLineSize: gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".max_line_byte"),
+				}))
+			case "redis":
+				receivers = append(receivers, recvs.NewRedisRecv(&recvs.RedisRecvCfg{
+					Name:         name,
+					Addr:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".addr"),
+					Password:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".password"),
+					DB:           gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".db"),
+					DataType:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".data_type"),
+					Keys:         gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".keys"),
+					Group:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".group"),
+					Consumer:     gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".consumer"),
+					Format:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".format"),
+					Tag:          library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					BatchSize:    gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".batch_size"),
+					BlockTimeout: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".block_timeout_sec") * time.Second,
+				}))
+			case "amqp":
+				receivers = append(receivers, recvs.NewAMQPRecv(&recvs.AMQPRecvCfg{
+					Name:          name,
+					URL:           gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".url"),
+					Queues:        gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".queues"),
+					Prefetch:      gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".prefetch"),
+					Format:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".format"),
+					Tag:           library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:        gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					RoutingKeyKey: gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".routing_key_key"),
+				}))
+			case "mqtt":
+				qos := 1 // at least once, 0 is also a valid value so could not reset in recv
+				if gutils.Settings.IsSet("settings.acceptor.recvs.plugins." + name + ".qos") {
+					qos = gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".qos")
+				}
+				receivers = append(receivers, recvs.NewMQTTRecv(&recvs.MQTTRecvCfg{
+					Name:           name,
+					Brokers:        gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".brokers"),
+					ClientID:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".client_id"),
+					Username:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".username"),
+					Password:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".password"),
+					Topics:         gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".topics"),
+					QoS:            qos,
+					IsCleanSession: gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_clean_session"),
+					Format:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".format"),
+					Tag:            library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					TopicKey:       gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".topic_key"),
+				}))
 			case "kafka":
 				kafkaCfg := &recvs.KafkaCfg{
 					KMsgPool:          sharingKMsgPool,
@@ -147,6 +330,38 @@ func (c *Controllor) initRecvs(env string) []recvs.AcceptorRecvItf {
 				kafkaCfg.IntervalNum = gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".interval_num")
 				kafkaCfg.IntervalDuration = gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".interval_sec") * time.Second
 				receivers = append(receivers, recvs.NewKafkaRecv(kafkaCfg))
+			case "file":
+				receivers = append(receivers, recvs.NewFileRecv(&recvs.FileRecvCfg{
+					Name:            name,
+					Paths:           gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".paths"),
+					PosFilePath:     loadPosFilePath(name),
+					Tag:             library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					PathKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path_key"),
+					PathRegexp:      loadOptionalRegexp(gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path_regexp")),
+					HeadRegexp:      loadOptionalRegexp(gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".head_regexp")),
+					ConcatMaxLen:    gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".concat_max_len"),
+					ConcatorWait:    gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".concat_with_sec") * time.Second,
+					RefreshInterval: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".refresh_interval_sec") * time.Second,
+					PollInterval:    gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".poll_interval_sec") * time.Second,
+					IsReadFromHead:  gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_read_from_head"),
+				}))
+			case "container-logs":
+				receivers = append(receivers, recvs.NewContainerLogsRecv(&recvs.ContainerLogsRecvCfg{
+					Name:            name,
+					Paths:           gutils.Settings.GetStringSlice("settings.acceptor.recvs.plugins." + name + ".paths"),
+					PosFilePath:     loadPosFilePath(name),
+					Tag:             library.LoadTagReplaceEnv(env, gutils.Settings.GetString("settings.acceptor.recvs.plugins."+name+".tag")),
+					TagKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".tag_key"),
+					MsgKey:          gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".msg_key"),
+					PathKey:         gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".path_key"),
+					ConcatMaxLen:    gutils.Settings.GetInt("settings.acceptor.recvs.plugins." + name + ".concat_max_len"),
+					ConcatorWait:    gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".concat_with_sec") * time.Second,
+					RefreshInterval: gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".refresh_interval_sec") * time.Second,
+					PollInterval:    gutils.Settings.GetDuration("settings.acceptor.recvs.plugins."+name+".poll_interval_sec") * time.Second,
+					IsReadFromHead:  gutils.Settings.GetBool("settings.acceptor.recvs.plugins." + name + ".is_read_from_head"),
+				}))
 			default:
 				log.Logger.Panic("unknown recv type",
 					zap.String("type", t),
@@ -169,6 +384,7 @@ func (c *Controllor) initAcceptor(ctx context.Context, journal *Journal, receive
 	acceptor := NewAcceptor(&AcceptorCfg{
 		MsgPool:          c.msgPool,
 		Journal:          journal,
+		PersistNotifier:  c.persistNotifier,
 		MaxRotateID:      gutils.Settings.GetInt64("settings.acceptor.max_rotate_id"),
 		AsyncOutChanSize: gutils.Settings.GetInt("settings.acceptor.async_out_chan_size"),
 		SyncOutChanSize:  gutils.Settings.GetInt("settings.acceptor.sync_out_chan_size"),
@@ -239,6 +455,7 @@ func (c *Controllor) initAcceptorPipeline(ctx context.Context, env string) (*acc
 		IsThrottle:      gutils.Settings.GetBool("settings.acceptor_filters.is_throttle"),
 		ThrottleMax:     gutils.Settings.GetInt("settings.acceptor_filters.throttle_max"),
 		ThrottleNPerSec: gutils.Settings.GetInt("settings.acceptor_filters.throttle_per_sec"),
+		PersistNotifier: c.persistNotifier,
 	},
 		afs...,
 	)
@@ -386,6 +603,35 @@ func (c *Controllor) initPostPipeline(env string, waitCommitChan chan<- *library
 	}, fs...)
 }
 
+// loadOptionalRegexp compile regexp, return nil if pattern is empty
+func loadOptionalRegexp(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+
+	return regexp.MustCompile(pattern)
+}
+
+// loadHMACKeys load `map[keyID]key` from settings
+func loadHMACKeys(key string) map[string][]byte {
+	keys := map[string][]byte{}
+	for id, k := range gutils.Settings.GetStringMapString(key) {
+		keys[id] = []byte(k)
+	}
+
+	return keys
+}
+
+// loadPosFilePath load `pos_file` of recv,
+// default to `<journal.buf_dir_path>/<name>.pos`
+func loadPosFilePath(name string) string {
+	if fpath := gutils.Settings.GetString("settings.acceptor.recvs.plugins." + name + ".pos_file"); fpath != "" {
+		return fpath
+	}
+
+	return filepath.Join(gutils.Settings.GetString("settings.journal.buf_dir_path"), name+".pos")
+}
+
 func StringListContains(ls []string, v string) bool {
 	for _, vi := range ls {
 		if vi == v {
@@ -445,6 +691,286 @@ func (c *Controllor) initSenders(env string) []senders.SenderItf {
 					TagIndexMap:          senders.LoadESTagIndexMap(env, gutils.Settings.Get("settings.producer.plugins."+name+".indices")),
 					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
 				}))
+			case "redis":
+				ss = append(ss, senders.NewRedisSender(&senders.RedisSenderCfg{
+					Name:                 name,
+					Addr:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					Password:             gutils.Settings.GetString("settings.producer.plugins." + name + ".password"),
+					DB:                   gutils.Settings.GetInt("settings.producer.plugins." + name + ".db"),
+					DataType:             gutils.Settings.GetString("settings.producer.plugins." + name + ".data_type"),
+					Key:                  gutils.Settings.GetString("settings.producer.plugins." + name + ".key"),
+					MaxLen:               gutils.Settings.GetInt64("settings.producer.plugins." + name + ".max_len"),
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "amqp":
+				ss = append(ss, senders.NewAMQPSender(&senders.AMQPSenderCfg{
+					Name:                 name,
+					URL:                  gutils.Settings.GetString("settings.producer.plugins." + name + ".url"),
+					Exchange:             gutils.Settings.GetString("settings.producer.plugins." + name + ".exchange"),
+					RoutingKey:           gutils.Settings.GetString("settings.producer.plugins." + name + ".routing_key"),
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					ConfirmTimeout:       gutils.Settings.GetDuration("settings.producer.plugins."+name+".confirm_timeout_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "http":
+				ss = append(ss, senders.NewHTTPSender(&senders.HTTPSenderCfg{
+					Name:                 name,
+					Addr:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					Method:               gutils.Settings.GetString("settings.producer.plugins." + name + ".method"),
+					Encoding:             gutils.Settings.GetString("settings.producer.plugins." + name + ".encoding"),
+					IsGzip:               gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_gzip"),
+					Headers:              gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".headers"),
+					AuthType:             gutils.Settings.GetString("settings.producer.plugins." + name + ".auth_type"),
+					Username:             gutils.Settings.GetString("settings.producer.plugins." + name + ".username"),
+					Password:             gutils.Settings.GetString("settings.producer.plugins." + name + ".password"),
+					Token:                gutils.Settings.GetString("settings.producer.plugins." + name + ".token"),
+					HMACKey:              gutils.Settings.GetString("settings.producer.plugins." + name + ".hmac_key"),
+					HMACKeyID:            gutils.Settings.GetString("settings.producer.plugins." + name + ".hmac_key_id"),
+					SuccessCodes:         gutils.Settings.GetStringSlice("settings.producer.plugins." + name + ".success_codes"),
+					Timeout:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "file":
+				ss = append(ss, senders.NewFileSender(&senders.FileSenderCfg{
+					Name:                 name,
+					Path:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".path"),
+					Format:               gutils.Settings.GetString("settings.producer.plugins." + name + ".format"),
+					MsgKey:               gutils.Settings.GetString("settings.producer.plugins." + name + ".msg_key"),
+					TimeKey:              gutils.Settings.GetString("settings.producer.plugins." + name + ".time_key"),
+					TimeFormat:           gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					Compress:             gutils.Settings.GetString("settings.producer.plugins." + name + ".compress"),
+					FileMode:             gutils.Settings.GetString("settings.producer.plugins." + name + ".file_mode"),
+					MaxSize:              gutils.Settings.GetInt64("settings.producer.plugins."+name+".max_size_mb") * 1024 * 1024,
+					RotateInterval:       gutils.Settings.GetDuration("settings.producer.plugins."+name+".rotate_interval_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "s3":
+				ss = append(ss, senders.NewS3Sender(&senders.S3SenderCfg{
+					Name:                 name,
+					Endpoint:             gutils.Settings.GetString("settings.producer.plugins." + name + ".endpoint"),
+					IsSecure:             gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_secure"),
+					AccessKey:            gutils.Settings.GetString("settings.producer.plugins." + name + ".access_key"),
+					SecretKey:            gutils.Settings.GetString("settings.producer.plugins." + name + ".secret_key"),
+					Region:               gutils.Settings.GetString("settings.producer.plugins." + name + ".region"),
+					Bucket:               gutils.Settings.GetString("settings.producer.plugins." + name + ".bucket"),
+					Key:                  gutils.Settings.GetString("settings.producer.plugins." + name + ".key"),
+					BufDir:               gutils.Settings.GetString("settings.producer.plugins." + name + ".buf_dir"),
+					ChunkSize:            gutils.Settings.GetInt64("settings.producer.plugins."+name+".chunk_size_mb") * 1024 * 1024,
+					PartSize:             uint64(gutils.Settings.GetInt64("settings.producer.plugins."+name+".part_size_mb")) * 1024 * 1024,
+					ChunkInterval:        gutils.Settings.GetDuration("settings.producer.plugins."+name+".chunk_interval_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "loki":
+				ss = append(ss, senders.NewLokiSender(&senders.LokiSenderCfg{
+					Name:                 name,
+					Addr:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					TenantID:             gutils.Settings.GetString("settings.producer.plugins." + name + ".tenant_id"),
+					Format:               gutils.Settings.GetString("settings.producer.plugins." + name + ".format"),
+					MsgKey:               gutils.Settings.GetString("settings.producer.plugins." + name + ".msg_key"),
+					TimeKey:              gutils.Settings.GetString("settings.producer.plugins." + name + ".time_key"),
+					TimeFormat:           gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					LabelFields:          gutils.Settings.GetStringSlice("settings.producer.plugins." + name + ".label_fields"),
+					Timeout:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "clickhouse":
+				tables := map[string]string{}
+				for tag, table := range gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".tables") {
+					tables[library.LoadTagReplaceEnv(env, tag)] = library.LoadTagReplaceEnv(env, table)
+				}
+				ss = append(ss, senders.NewClickHouseSender(&senders.ClickHouseSenderCfg{
+					Name:                 name,
+					Addr:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					Username:             gutils.Settings.GetString("settings.producer.plugins." + name + ".username"),
+					Password:             gutils.Settings.GetString("settings.producer.plugins." + name + ".password"),
+					Database:             gutils.Settings.GetString("settings.producer.plugins." + name + ".database"),
+					Table:                gutils.Settings.GetString("settings.producer.plugins." + name + ".table"),
+					TagTableMap:          tables,
+					Columns:              gutils.Settings.GetStringSlice("settings.producer.plugins." + name + ".columns"),
+					TimeColumns:          gutils.Settings.GetStringSlice("settings.producer.plugins." + name + ".time_columns"),
+					TimePrecision:        gutils.Settings.GetInt("settings.producer.plugins." + name + ".time_precision"),
+					TimeFormat:           gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					Timeout:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "syslog":
+				ss = append(ss, senders.NewSyslogSender(&senders.SyslogSenderCfg{
+					Name:                    name,
+					Addr:                    gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					Network:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".network"),
+					Format:                  gutils.Settings.GetString("settings.producer.plugins." + name + ".format"),
+					Framing:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".framing"),
+					AppName:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".app_name"),
+					Hostname:                gutils.Settings.GetString("settings.producer.plugins." + name + ".hostname"),
+					Severity:                gutils.Settings.GetString("settings.producer.plugins." + name + ".severity"),
+					Facility:                gutils.Settings.GetString("settings.producer.plugins." + name + ".facility"),
+					MsgKey:                  gutils.Settings.GetString("settings.producer.plugins." + name + ".msg_key"),
+					TimeKey:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".time_key"),
+					TimeFormat:              gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					TLSCAFile:               gutils.Settings.GetString("settings.producer.plugins." + name + ".tls_ca_file"),
+					IsTLSInsecureSkipVerify: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_tls_insecure_skip_verify"),
+					Timeout:                 gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:               gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:                 gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:              gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                   gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                    library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked:    gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "hec":
+				tokens := map[string]string{}
+				for tag, token := range gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".tokens") {
+					tokens[library.LoadTagReplaceEnv(env, tag)] = token
+				}
+				ss = append(ss, senders.NewHECSender(&senders.HECSenderCfg{
+					Name:                 name,
+					Addr:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					Token:                gutils.Settings.GetString("settings.producer.plugins." + name + ".token"),
+					TagTokenMap:          tokens,
+					Channel:              gutils.Settings.GetString("settings.producer.plugins." + name + ".channel"),
+					Format:               gutils.Settings.GetString("settings.producer.plugins." + name + ".format"),
+					MsgKey:               gutils.Settings.GetString("settings.producer.plugins." + name + ".msg_key"),
+					TimeKey:              gutils.Settings.GetString("settings.producer.plugins." + name + ".time_key"),
+					TimeFormat:           gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					Host:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".host"),
+					Source:               gutils.Settings.GetString("settings.producer.plugins." + name + ".source"),
+					SourceType:           gutils.Settings.GetString("settings.producer.plugins." + name + ".sourcetype"),
+					Index:                gutils.Settings.GetString("settings.producer.plugins." + name + ".index"),
+					Fields:               gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".fields"),
+					IsAckEnabled:         gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_ack_enabled"),
+					AckInterval:          gutils.Settings.GetDuration("settings.producer.plugins."+name+".ack_interval_sec") * time.Second,
+					AckTimeout:           gutils.Settings.GetDuration("settings.producer.plugins."+name+".ack_timeout_sec") * time.Second,
+					IsGzip:               gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_gzip"),
+					Timeout:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "gelf":
+				ss = append(ss, senders.NewGELFSender(&senders.GELFSenderCfg{
+					Name:                 name,
+					Addr:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					Network:              gutils.Settings.GetString("settings.producer.plugins." + name + ".network"),
+					Compress:             gutils.Settings.GetString("settings.producer.plugins." + name + ".compress"),
+					ChunkSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".chunk_size"),
+					Host:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".host"),
+					Level:                gutils.Settings.GetString("settings.producer.plugins." + name + ".level"),
+					MsgKey:               gutils.Settings.GetString("settings.producer.plugins." + name + ".msg_key"),
+					FullMsgKey:           gutils.Settings.GetString("settings.producer.plugins." + name + ".full_msg_key"),
+					TimeKey:              gutils.Settings.GetString("settings.producer.plugins." + name + ".time_key"),
+					TimeFormat:           gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					Fields:               gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".fields"),
+					Timeout:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "otlp":
+				ss = append(ss, senders.NewOTLPSender(&senders.OTLPSenderCfg{
+					Name:                 name,
+					Addr:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					Protocol:             gutils.Settings.GetString("settings.producer.plugins." + name + ".protocol"),
+					Severity:             gutils.Settings.GetString("settings.producer.plugins." + name + ".severity"),
+					MsgKey:               gutils.Settings.GetString("settings.producer.plugins." + name + ".msg_key"),
+					TraceIDKey:           gutils.Settings.GetString("settings.producer.plugins." + name + ".trace_id_key"),
+					SpanIDKey:            gutils.Settings.GetString("settings.producer.plugins." + name + ".span_id_key"),
+					TimeKey:              gutils.Settings.GetString("settings.producer.plugins." + name + ".time_key"),
+					TimeFormat:           gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					ResourceAttributes:   gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".resource_attributes"),
+					Headers:              gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".headers"),
+					IsTLS:                gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_tls"),
+					IsGzip:               gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_gzip"),
+					Timeout:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "sql":
+				tables := map[string]string{}
+				for tag, table := range gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".tables") {
+					tables[library.LoadTagReplaceEnv(env, tag)] = library.LoadTagReplaceEnv(env, table)
+				}
+				ss = append(ss, senders.NewSQLSender(&senders.SQLSenderCfg{
+					Name:                 name,
+					Driver:               gutils.Settings.GetString("settings.producer.plugins." + name + ".driver"),
+					DSN:                  gutils.Settings.GetString("settings.producer.plugins." + name + ".dsn"),
+					Table:                gutils.Settings.GetString("settings.producer.plugins." + name + ".table"),
+					TagTableMap:          tables,
+					Mode:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".mode"),
+					MsgIDColumn:          gutils.Settings.GetString("settings.producer.plugins." + name + ".msgid_column"),
+					Columns:              gutils.Settings.GetStringSlice("settings.producer.plugins." + name + ".columns"),
+					TimeColumns:          gutils.Settings.GetStringSlice("settings.producer.plugins." + name + ".time_columns"),
+					TimeFormat:           gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					Timeout:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
+			case "metrics":
+				ss = append(ss, senders.NewMetricsSender(&senders.MetricsSenderCfg{
+					Name:                 name,
+					Addr:                 gutils.Settings.GetString("settings.producer.plugins." + name + ".addr"),
+					Protocol:             gutils.Settings.GetString("settings.producer.plugins." + name + ".protocol"),
+					Measurement:          gutils.Settings.GetString("settings.producer.plugins." + name + ".measurement"),
+					TimeKey:              gutils.Settings.GetString("settings.producer.plugins." + name + ".time_key"),
+					TimeFormat:           gutils.Settings.GetString("settings.producer.plugins." + name + ".time_format"),
+					TagFields:            gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".tag_fields"),
+					ValueFields:          gutils.Settings.GetStringSlice("settings.producer.plugins." + name + ".value_fields"),
+					Headers:              gutils.Settings.GetStringMapString("settings.producer.plugins." + name + ".headers"),
+					Timeout:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".timeout_sec") * time.Second,
+					BatchSize:            gutils.Settings.GetInt("settings.producer.plugins." + name + ".msg_batch_size"),
+					MaxWait:              gutils.Settings.GetDuration("settings.producer.plugins."+name+".max_wait_sec") * time.Second,
+					InChanSize:           gutils.Settings.GetInt("settings.producer.sender_inchan_size"),
+					NFork:                gutils.Settings.GetInt("settings.producer.plugins." + name + ".forks"),
+					Tags:                 library.LoadTagsReplaceEnv(env, gutils.Settings.GetStringSlice("settings.producer.plugins."+name+".tags")),
+					IsDiscardWhenBlocked: gutils.Settings.GetBool("settings.producer.plugins." + name + ".is_discard_when_blocked"),
+				}))
 			case "stdout":
 				ss = append(ss, senders.NewStdoutSender(&senders.StdoutSenderCfg{
 					Name:                 name,
@@ -515,6 +1041,7 @@ func (c *Controllor) Run(ctx context.Context) {
 	log.Logger.Info("running...")
 	env := gutils.Settings.GetString("env")
 
+	c.initPersistNotifier(ctx)
 	journal := c.initJournal(ctx)
 
 	receivers := c.initRecvs(env)
@@ -26,6 +26,7 @@ const (
 	intervalToStartingLegacy  = 3 * time.Second
 	defaultJournalLegacyWait  = 1 * time.Second
 	defaultIntervalSecForceGC = 1 * time.Minute
+	defaultPersistTimeout     = 1 * time.Minute
 )
 
 type JournalCfg struct {
@@ -39,6 +40,8 @@ type JournalCfg struct {
 	IsCompress     bool
 	MsgPool        *sync.Pool
 	CommittedIDTTL time.Duration
+	// PersistNotifier: notify whether msg is persisted into journal, could be nil
+	PersistNotifier *library.PersistNotifier
 }
 
 // Journal dumps all messages to files,
@@ -470,6 +473,8 @@ func (j *Journal) createJournalRunner(ctx context.Context, tag string) {
 					zap.String("tag", msg.Tag),
 				)
 			}
+			// data is flushed into file after written
+			j.notifyPersisted(msg.ID, err == nil)
 
 			select {
 			case j.outChan <- msg:
@@ -482,6 +487,13 @@ func (j *Journal) createJournalRunner(ctx context.Context, tag string) {
 	}()
 }
 
+// notifyPersisted notify recvs whether msg is persisted
+func (j *Journal) notifyPersisted(id int64, isPersisted bool) {
+	if j.PersistNotifier != nil {
+		j.PersistNotifier.Notify(id, isPersisted)
+	}
+}
+
 func (j *Journal) GetOutChan() chan *library.FluentMsg {
 	return j.outChan
 }
@@ -541,6 +553,7 @@ func (j *Journal) DumpMsgFlow(ctx context.Context, msgPool *sync.Pool, dumpChan,
 					return
 				}
 
+				j.notifyPersisted(msg.ID, false)
 				j.outChan <- msg
 			}
 		}
@@ -577,6 +590,7 @@ func (j *Journal) DumpMsgFlow(ctx context.Context, msgPool *sync.Pool, dumpChan,
 				select {
 				case jji.(chan *library.FluentMsg) <- msg:
 				default:
+					j.notifyPersisted(msg.ID, false)
 					select {
 					case j.outChan <- msg:
 						log.Logger.Warn("skip dump since journal is busy", zap.String("tag", msg.Tag))
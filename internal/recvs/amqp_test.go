@@ -0,0 +1,151 @@
+package recvs
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestAMQPRecvParseDelivery(t *testing.T) {
+	r := NewAMQPRecv(&AMQPRecvCfg{
+		Name:          "amqp-test",
+		URL:           "amqp://127.0.0.1:5672",
+		Queues:        []string{"logs"},
+		Tag:           "iot.${device}",
+		RoutingKeyKey: "routing_key",
+	})
+	r.SetCounter(counter)
+	r.SetMsgPool(msgPool)
+
+	msg, err := r.parseDelivery(&amqp.Delivery{RoutingKey: "device.d-1", Body: []byte(`{"device":"d-1","log":"hello"}`)})
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if msg.Tag != "iot.d-1" || msg.Message["tag"] != "iot.d-1" || msg.Message["routing_key"] != "device.d-1" || msg.Message["log"] != "hello" {
+		t.Fatalf("got %+v", msg)
+	}
+
+	if _, err = r.parseDelivery(&amqp.Delivery{Body: []byte(`not json`)}); err == nil {
+		t.Fatal("should be invalid")
+	}
+
+	r.Format = "raw"
+	if msg, err = r.parseDelivery(&amqp.Delivery{Body: []byte(`hello`)}); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if string(msg.Message["log"].([]byte)) != "hello" || msg.Tag != "iot." {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+type mockAcknowledger struct {
+	sync.Mutex
+	acked, requeued []uint64
+}
+
+func (a *mockAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.Lock()
+	defer a.Unlock()
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *mockAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.Lock()
+	defer a.Unlock()
+	if requeue {
+		a.requeued = append(a.requeued, tag)
+	}
+	return nil
+}
+
+func (a *mockAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func (a *mockAcknowledger) load() (acked, requeued []uint64) {
+	a.Lock()
+	defer a.Unlock()
+	return append([]uint64(nil), a.acked...), append([]uint64(nil), a.requeued...)
+}
+
+func TestAMQPRecvProcess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		syncOutChan = make(chan *library.FluentMsg, 1)
+		notifier    = library.NewPersistNotifier(ctx, time.Minute)
+		acker       = &mockAcknowledger{}
+		unsettled   = &amqpUnsettled{settles: map[uint64]func(bool){}}
+	)
+	r := NewAMQPRecv(&AMQPRecvCfg{
+		Name:   "amqp-test",
+		URL:    "amqp://127.0.0.1:5672",
+		Queues: []string{"logs"},
+		Tag:    "iot",
+	})
+	r.SetCounter(counter)
+	r.SetMsgPool(msgPool)
+	r.SetSyncOutChan(syncOutChan)
+	r.SetPersistNotifier(notifier)
+	delivery := func(tag uint64) amqp.Delivery {
+		return amqp.Delivery{Acknowledger: acker, DeliveryTag: tag, Body: []byte(`{"log":"hello"}`)}
+	}
+	expect := func(acked, requeued []uint64) {
+		for i := 0; i < 100; i++ {
+			gotAcked, gotRequeued := acker.load()
+			if reflect.DeepEqual(gotAcked, acked) && reflect.DeepEqual(gotRequeued, requeued) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		gotAcked, gotRequeued := acker.load()
+		t.Fatalf("got acked %v, requeued %v", gotAcked, gotRequeued)
+	}
+
+	// not acked before persisted
+	r.process(ctx, delivery(1), unsettled)
+	msg := <-syncOutChan
+	expect(nil, nil)
+	notifier.Notify(msg.ID, true)
+	expect([]uint64{1}, nil)
+
+	// requeued if not persisted
+	r.process(ctx, delivery(2), unsettled)
+	msg = <-syncOutChan
+	notifier.Notify(msg.ID, false)
+	expect([]uint64{1}, []uint64{2})
+
+	// requeued on shutdown, both handed off and blocked deliveries
+	r.process(ctx, delivery(3), unsettled)
+	msg = <-syncOutChan
+	r.process(ctx, delivery(4), unsettled)
+	done := make(chan struct{})
+	go func() {
+		r.process(ctx, delivery(5), unsettled)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	unsettled.nackAll()
+	acked, requeued := acker.load()
+	sort.Slice(requeued, func(i, j int) bool { return requeued[i] < requeued[j] })
+	if !reflect.DeepEqual(acked, []uint64{1}) || !reflect.DeepEqual(requeued, []uint64{2, 3, 4, 5}) {
+		t.Fatalf("got acked %v, requeued %v", acked, requeued)
+	}
+
+	// settled at most once
+	notifier.Notify(msg.ID, true)
+	time.Sleep(50 * time.Millisecond)
+	if acked, _ = acker.load(); len(acked) != 1 {
+		t.Fatalf("got acked %v", acked)
+	}
+}
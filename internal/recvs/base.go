@@ -21,6 +21,7 @@ type AcceptorRecvItf interface {
 	SetAsyncOutChan(chan<- *library.FluentMsg)
 	SetMsgPool(*sync.Pool)
 	SetCounter(library.CounterIft)
+	SetPersistNotifier(*library.PersistNotifier)
 	Run(context.Context)
 	GetName() string
 }
@@ -30,6 +31,8 @@ type BaseRecv struct {
 	asyncOutChan chan<- *library.FluentMsg
 	msgPool      *sync.Pool
 	counter      library.CounterIft
+	// persistNotifier could be nil
+	persistNotifier *library.PersistNotifier
 }
 
 func (r *BaseRecv) SetSyncOutChan(outchan chan<- *library.FluentMsg) {
@@ -47,3 +50,21 @@ func (r *BaseRecv) SetMsgPool(msgPool *sync.Pool) {
 func (r *BaseRecv) SetCounter(counter library.CounterIft) {
 	r.counter = counter
 }
+
+func (r *BaseRecv) SetPersistNotifier(notifier *library.PersistNotifier) {
+	r.persistNotifier = notifier
+}
+
+// waitPersisted register cb for msgs with ids, cb will be called once
+// after all msgs are persisted by journal, or any msg failed.
+//
+// cb is called with true immediately if persist notifier is not set.
+// should be called before msgs are put into out chan.
+func (r *BaseRecv) waitPersisted(ids []int64, cb func(isPersisted bool)) {
+	if r.persistNotifier == nil {
+		cb(true)
+		return
+	}
+
+	r.persistNotifier.WaitAll(ids, cb)
+}
@@ -0,0 +1,479 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultBeatsAddr              = "0.0.0.0:5044"
+	defaultBeatsMaxWindowSize     = 10000
+	defaultBeatsMaxFrameSize      = 10 * 1024 * 1024
+	defaultBeatsIdleTimeout       = 5 * time.Minute
+	defaultBeatsKeepaliveInterval = 3 * time.Second
+)
+
+// lumberjack frame types
+const (
+	lumberjackVersion1      byte = '1'
+	lumberjackVersion2      byte = '2'
+	lumberjackTypeWindow    byte = 'W'
+	lumberjackTypeCompress  byte = 'C'
+	lumberjackTypeJSON      byte = 'J'
+	lumberjackTypeData      byte = 'D'
+	lumberjackTypeAck       byte = 'A'
+	lumberjackFrameHeadSize      = 2
+)
+
+// BeatsRecvCfg configuration of BeatsRecv
+type BeatsRecvCfg struct {
+	Name,
+	// Addr: listening address, like `0.0.0.0:5044`
+	Addr,
+	// Tag: template of `msg.Tag`, `${<field>}` will be replaced by field of event,
+	// nested field is separated by `.`, like `${fields.app}` & `${@metadata.beat}`
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// TLSCertFile & TLSKeyFile: enable TLS if not empty
+	TLSCertFile,
+	TLSKeyFile string
+
+	MaxWindowSize,
+	MaxFrameSize int
+	// IdleTimeout: close connection if no new batch in this duration
+	IdleTimeout,
+	// KeepaliveInterval: send partial ACK of persisted events when blocked by downstream or journal,
+	// avoid beats resend whole batch because of timeout
+	KeepaliveInterval time.Duration
+}
+
+// BeatsRecv recv events from Filebeat/Winlogbeat by lumberjack v2 protocol
+type BeatsRecv struct {
+	*BaseRecv
+	*BeatsRecvCfg
+	logger    *utils.LoggerType
+	tlsConfig *tls.Config
+}
+
+// NewBeatsRecv create new BeatsRecv
+func NewBeatsRecv(cfg *BeatsRecvCfg) (r *BeatsRecv) {
+	r = &BeatsRecv{
+		BaseRecv:     &BaseRecv{},
+		BeatsRecvCfg: cfg,
+		logger:       log.Logger.Named(cfg.Name),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("beats recv invalid", zap.Error(err))
+	}
+
+	r.logger.Info("create beats recv",
+		zap.String("addr", r.Addr),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.Bool("tls", r.tlsConfig != nil),
+		zap.Int("max_window_size", r.MaxWindowSize),
+		zap.Int("max_frame_byte", r.MaxFrameSize),
+		zap.Duration("idle_timeout_sec", r.IdleTimeout),
+		zap.Duration("keepalive_interval_sec", r.KeepaliveInterval),
+	)
+	return r
+}
+
+func (r *BeatsRecv) valid() error {
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	if r.Addr == "" {
+		r.Addr = defaultBeatsAddr
+		r.logger.Info("reset addr", zap.String("addr", r.Addr))
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MaxWindowSize <= 0 {
+		r.MaxWindowSize = defaultBeatsMaxWindowSize
+		r.logger.Info("reset max_window_size", zap.Int("max_window_size", r.MaxWindowSize))
+	}
+
+	if r.MaxFrameSize <= 0 {
+		r.MaxFrameSize = defaultBeatsMaxFrameSize
+		r.logger.Info("reset max_frame_byte", zap.Int("max_frame_byte", r.MaxFrameSize))
+	}
+
+	if r.IdleTimeout <= 0 {
+		r.IdleTimeout = defaultBeatsIdleTimeout
+		r.logger.Info("reset idle_timeout_sec", zap.Duration("idle_timeout_sec", r.IdleTimeout))
+	}
+
+	if r.KeepaliveInterval <= 0 {
+		r.KeepaliveInterval = defaultBeatsKeepaliveInterval
+		r.logger.Info("reset keepalive_interval_sec", zap.Duration("keepalive_interval_sec", r.KeepaliveInterval))
+	}
+
+	if r.TLSCertFile != "" || r.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.TLSCertFile, r.TLSKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "load tls cert")
+		}
+		r.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *BeatsRecv) GetName() string {
+	return r.Name
+}
+
+// Run starting to listen
+func (r *BeatsRecv) Run(ctx context.Context) {
+	r.logger.Info("run BeatsRecv")
+	defer r.logger.Info("beats recv exit")
+
+	var (
+		ln  net.Listener
+		err error
+	)
+	if r.tlsConfig != nil {
+		ln, err = tls.Listen("tcp", r.Addr, r.tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", r.Addr)
+	}
+	if err != nil {
+		r.logger.Panic("try to bind addr got error", zap.Error(err), zap.String("addr", r.Addr))
+	}
+	r.logger.Info("listening on tcp...", zap.String("addr", r.Addr))
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			r.logger.Error("try to accept connection got error", zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		r.logger.Info("accept new connection", zap.String("remote", conn.RemoteAddr().String()))
+		go r.handleConn(ctx, conn)
+	}
+}
+
+// lumberjackEvent is one event with its sequence number
+type lumberjackEvent struct {
+	seq   uint32
+	event map[string]interface{}
+}
+
+// lumberjackReader decode frames of lumberjack protocol
+type lumberjackReader struct {
+	maxWindowSize,
+	maxFrameSize int
+}
+
+// ReadBatch read window frame and all events in window
+func (lr *lumberjackReader) ReadBatch(reader io.Reader) (events []*lumberjackEvent, err error) {
+	head := make([]byte, lumberjackFrameHeadSize)
+	if _, err = io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+	if head[1] != lumberjackTypeWindow {
+		return nil, fmt.Errorf("expect window frame, got `%c`", head[1])
+	}
+
+	windowSize, err := readUint32(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read window size")
+	}
+	if int(windowSize) > lr.maxWindowSize {
+		return nil, fmt.Errorf("window size %d exceeds %d", windowSize, lr.maxWindowSize)
+	}
+
+	events = make([]*lumberjackEvent, 0, windowSize)
+	for len(events) < int(windowSize) {
+		if events, err = lr.readFrame(reader, events); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// readFrame read one data or compressed frame, append events into `events`
+func (lr *lumberjackReader) readFrame(reader io.Reader, events []*lumberjackEvent) ([]*lumberjackEvent, error) {
+	head := make([]byte, lumberjackFrameHeadSize)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+	if head[0] != lumberjackVersion1 && head[0] != lumberjackVersion2 {
+		return nil, fmt.Errorf("unknown protocol version `%c`", head[0])
+	}
+
+	switch head[1] {
+	case lumberjackTypeJSON:
+		seq, err := readUint32(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "read seq")
+		}
+		payload, err := lr.readPayload(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		event := map[string]interface{}{}
+		if err = json.Unmarshal(payload, &event); err != nil {
+			return nil, errors.Wrap(err, "unmarshal json frame")
+		}
+		return append(events, &lumberjackEvent{seq: seq, event: event}), nil
+	case lumberjackTypeData:
+		return lr.readDataFrame(reader, events)
+	case lumberjackTypeCompress:
+		payload, err := lr.readPayload(reader)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, errors.Wrap(err, "read compressed frame")
+		}
+		defer zr.Close()
+		// limit decompressed size, avoid zlib bomb
+		data, err := ioutil.ReadAll(io.LimitReader(zr, int64(lr.maxFrameSize)+1))
+		if err != nil {
+			return nil, errors.Wrap(err, "decompress frame")
+		}
+		if len(data) > lr.maxFrameSize {
+			return nil, fmt.Errorf("decompressed frame size exceeds %d", lr.maxFrameSize)
+		}
+
+		inner := bytes.NewReader(data)
+		for inner.Len() != 0 {
+			if events, err = lr.readFrame(inner, events); err != nil {
+				return nil, err
+			}
+		}
+		return events, nil
+	default:
+		return nil, fmt.Errorf("unknown frame type `%c`", head[1])
+	}
+}
+
+// readDataFrame read v1 data frame that contains key-value pairs
+func (lr *lumberjackReader) readDataFrame(reader io.Reader, events []*lumberjackEvent) ([]*lumberjackEvent, error) {
+	seq, err := readUint32(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read seq")
+	}
+	nPairs, err := readUint32(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read pairs count")
+	}
+
+	event := map[string]interface{}{}
+	var k, v []byte
+	for i := uint32(0); i < nPairs; i++ {
+		if k, err = lr.readPayload(reader); err != nil {
+			return nil, err
+		}
+		if v, err = lr.readPayload(reader); err != nil {
+			return nil, err
+		}
+		event[string(k)] = string(v)
+	}
+
+	return append(events, &lumberjackEvent{seq: seq, event: event}), nil
+}
+
+// readPayload read `<uint32 length><payload>`
+func (lr *lumberjackReader) readPayload(reader io.Reader) ([]byte, error) {
+	size, err := readUint32(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "read payload size")
+	}
+	if int(size) > lr.maxFrameSize {
+		return nil, fmt.Errorf("payload size %d exceeds %d", size, lr.maxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		return nil, errors.Wrap(err, "read payload")
+	}
+	return payload, nil
+}
+
+func readUint32(reader io.Reader) (uint32, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// writeLumberjackAck write ACK frame
+func writeLumberjackAck(writer io.Writer, seq uint32) error {
+	buf := make([]byte, lumberjackFrameHeadSize+4)
+	buf[0] = lumberjackVersion2
+	buf[1] = lumberjackTypeAck
+	binary.BigEndian.PutUint32(buf[2:], seq)
+	_, err := writer.Write(buf)
+	return err
+}
+
+// handleConn read batches from connection,
+// ACK after all events of batch are persisted by journal.
+// connection is closed without ACK if any event is not persisted,
+// then beats will resend the batch.
+func (r *BeatsRecv) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	logger := r.logger.With(zap.String("remote", conn.RemoteAddr().String()))
+	defer logger.Info("close connection")
+
+	var (
+		reader = bufio.NewReader(conn)
+		lr     = &lumberjackReader{maxWindowSize: r.MaxWindowSize, maxFrameSize: r.MaxFrameSize}
+		events []*lumberjackEvent
+		err    error
+	)
+	for {
+		if err = conn.SetReadDeadline(utils.Clock.GetUTCNow().Add(r.IdleTimeout)); err != nil {
+			logger.Error("set read deadline", zap.Error(err))
+			return
+		}
+		if events, err = lr.ReadBatch(reader); err == io.EOF {
+			logger.Info("remote closed")
+			return
+		} else if err != nil {
+			logger.Warn("read batch", zap.Error(err))
+			return
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		if err = r.sendBatch(ctx, conn, events); err != nil {
+			logger.Warn("send batch", zap.Error(err))
+			return
+		}
+		if err = writeLumberjackAck(conn, events[len(events)-1].seq); err != nil {
+			logger.Warn("write ack", zap.Error(err))
+			return
+		}
+	}
+}
+
+// sendBatch put events into syncOutChan and wait until all of them are persisted,
+// send partial ACK of persisted events periodically if blocked.
+func (r *BeatsRecv) sendBatch(ctx context.Context, conn net.Conn, events []*lumberjackEvent) (err error) {
+	ticker := time.NewTicker(r.KeepaliveInterval)
+	defer ticker.Stop()
+
+	type persistResult struct {
+		idx         int
+		isPersisted bool
+	}
+	var (
+		// each event is notified at most once, so callbacks never block
+		resultChan = make(chan persistResult, len(events))
+		persisted  = make([]bool, len(events))
+		// events[:nPersisted] are all persisted
+		nPersisted int
+		// seq of the last persisted event of prefix, 0 is keepalive
+		persistedSeq uint32
+	)
+	onResult := func(ret persistResult) error {
+		if !ret.isPersisted {
+			return fmt.Errorf("event `%d` not persisted", events[ret.idx].seq)
+		}
+
+		persisted[ret.idx] = true
+		for nPersisted < len(events) && persisted[nPersisted] {
+			persistedSeq = events[nPersisted].seq
+			nPersisted++
+		}
+		return nil
+	}
+
+	for i, e := range events {
+		msg := r.msgPool.Get().(*library.FluentMsg)
+		msg.ID = r.counter.Count()
+		msg.Tag = library.TemplateWithNestedFields(r.Tag, e.event)
+		msg.Message = e.event
+		delete(msg.Message, "@metadata")
+		msg.Message[r.TagKey] = msg.Tag
+		r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+
+		idx := i
+		r.waitPersisted([]int64{msg.ID}, func(isPersisted bool) {
+			resultChan <- persistResult{idx: idx, isPersisted: isPersisted}
+		})
+
+	SEND_LOOP:
+		for {
+			select {
+			case <-ctx.Done():
+				r.msgPool.Put(msg)
+				return ctx.Err()
+			case r.syncOutChan <- msg: // blockable
+				break SEND_LOOP
+			case ret := <-resultChan:
+				if err = onResult(ret); err != nil {
+					// msg is not sent yet
+					r.msgPool.Put(msg)
+					return err
+				}
+			case <-ticker.C:
+				if err = writeLumberjackAck(conn, persistedSeq); err != nil {
+					r.msgPool.Put(msg)
+					return errors.Wrap(err, "write partial ack")
+				}
+			}
+		}
+	}
+
+	for nPersisted < len(events) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ret := <-resultChan:
+			if err = onResult(ret); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err = writeLumberjackAck(conn, persistedSeq); err != nil {
+				return errors.Wrap(err, "write partial ack")
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func lumberjackJSONFrame(seq uint32, payload string) []byte {
+	buf := []byte{lumberjackVersion2, lumberjackTypeJSON, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[2:], seq)
+	binary.BigEndian.PutUint32(buf[6:], uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func lumberjackWindowFrame(size uint32) []byte {
+	buf := []byte{lumberjackVersion2, lumberjackTypeWindow, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[2:], size)
+	return buf
+}
+
+func lumberjackCompressFrame(t *testing.T, frames ...[]byte) []byte {
+	zbuf := &bytes.Buffer{}
+	zw := zlib.NewWriter(zbuf)
+	for _, f := range frames {
+		if _, err := zw.Write(f); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+	zw.Close()
+
+	buf := []byte{lumberjackVersion2, lumberjackTypeCompress, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[2:], uint32(zbuf.Len()))
+	return append(buf, zbuf.Bytes()...)
+}
+
+func TestBeatsRecv(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	syncOutChan := make(chan *library.FluentMsg, 1000)
+	notifier := library.NewPersistNotifier(ctx, time.Minute)
+	recv := NewBeatsRecv(&BeatsRecvCfg{
+		Name:              "test-beats",
+		Tag:               "${fields.app}.${@metadata.beat}.sit",
+		KeepaliveInterval: 100 * time.Millisecond,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(syncOutChan)
+	recv.SetPersistNotifier(notifier)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go recv.handleConn(ctx, server)
+
+	go func() {
+		batch := lumberjackWindowFrame(3)
+		batch = append(batch, lumberjackCompressFrame(t,
+			lumberjackJSONFrame(1, `{"message":"a","fields":{"app":"nginx"},"@metadata":{"beat":"filebeat"}}`),
+			lumberjackJSONFrame(2, `{"message":"b","fields":{"app":"nginx"},"@metadata":{"beat":"filebeat"}}`),
+		)...)
+		batch = append(batch, lumberjackJSONFrame(3, `{"message":"c"}`)...)
+		if _, err := client.Write(batch); err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+	}()
+
+	readAck := func() (uint32, error) {
+		ack := make([]byte, 6)
+		if err := client.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if _, err := io.ReadFull(client, ack); err != nil {
+			return 0, err
+		}
+		if ack[0] != lumberjackVersion2 || ack[1] != lumberjackTypeAck {
+			t.Fatalf("got ack %v", ack)
+		}
+		return binary.BigEndian.Uint32(ack[2:]), nil
+	}
+	// read acks until got seq, acks should never exceed persisted events
+	waitAck := func(expect uint32) {
+		for {
+			seq, err := readAck()
+			if err != nil {
+				t.Fatalf("got error: %+v", err)
+			}
+			if seq == expect {
+				return
+			}
+			if seq > expect {
+				t.Fatalf("got ack %d, expect %d", seq, expect)
+			}
+		}
+	}
+
+	var msgs []*library.FluentMsg
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, <-syncOutChan)
+	}
+	msg := msgs[0]
+	if msg.Tag != "nginx.filebeat.sit" || msg.Message["message"] != "a" || msg.Message["tag"] != "nginx.filebeat.sit" {
+		t.Fatalf("got %+v", msg)
+	}
+	if _, ok := msg.Message["@metadata"]; ok {
+		t.Fatal("@metadata should be removed")
+	}
+	if msgs[2].Tag != "..sit" {
+		t.Fatalf("got %+v", msgs[2].Tag)
+	}
+
+	// keepalive before any event persisted
+	waitAck(0)
+	// partial ack only covers persisted prefix
+	notifier.Notify(msgs[0].ID, true)
+	notifier.Notify(msgs[2].ID, true)
+	waitAck(1)
+	notifier.Notify(msgs[1].ID, true)
+	waitAck(3)
+
+	// connection is closed without ack if event not persisted
+	go func() {
+		batch := lumberjackWindowFrame(1)
+		batch = append(batch, lumberjackJSONFrame(4, `{"message":"d"}`)...)
+		if _, err := client.Write(batch); err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+	}()
+	msg = <-syncOutChan
+	notifier.Notify(msg.ID, false)
+	for {
+		seq, err := readAck()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if seq != 0 {
+			t.Fatalf("got ack %d", seq)
+		}
+	}
+}
+
+func TestLumberjackReaderLimits(t *testing.T) {
+	lr := &lumberjackReader{maxWindowSize: 10, maxFrameSize: 10}
+	if _, err := lr.ReadBatch(bytes.NewReader(lumberjackWindowFrame(11))); err == nil {
+		t.Fatal("window size should be limited")
+	}
+
+	batch := append(lumberjackWindowFrame(1), lumberjackJSONFrame(1, `{"message":"too long"}`)...)
+	if _, err := lr.ReadBatch(bytes.NewReader(batch)); err == nil {
+		t.Fatal("frame size should be limited")
+	}
+}
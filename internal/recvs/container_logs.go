@@ -0,0 +1,206 @@
+package recvs
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"time"
+
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+)
+
+const defaultContainerLogsPath = "/var/log/containers/*.log"
+
+// containerLogPathRegexp parse kubelet's log symlink name:
+//
+//	/var/log/containers/<pod_name>_<namespace>_<container_name>-<container_id>.log
+var containerLogPathRegexp = regexp.MustCompile(`(?:^|/)(?P<pod_name>[^_/]+)_(?P<namespace>[^_/]+)_(?P<container_name>[^/]+)-(?P<container_id>[0-9a-f]{64})\.log$`)
+
+// ContainerLogsRecvCfg configuration of ContainerLogsRecv
+type ContainerLogsRecvCfg struct {
+	Name,
+	// PosFilePath: file to persist read offsets of all tailing files
+	PosFilePath,
+	// Tag: template of `msg.Tag`, support `${pod_name}`, `${namespace}`,
+	// `${container_name}`, `${container_id}`, `${path}` & `${filename}`
+	Tag,
+	TagKey,
+	MsgKey,
+	PathKey string
+
+	// Paths: glob patterns of container log files, default is `/var/log/containers/*.log`
+	Paths []string
+
+	// ConcatMaxLen: max length of reassembled log
+	ConcatMaxLen int
+	// ConcatorWait: emit partial log if its remains not arrived after this duration
+	ConcatorWait,
+	RefreshInterval,
+	PollInterval time.Duration
+	IsReadFromHead bool
+}
+
+// ContainerLogsRecv tail container logs written by docker json-file driver or CRI runtimes,
+// reassemble partial lines, and load pod/namespace/container from file name.
+type ContainerLogsRecv struct {
+	*FileRecv
+}
+
+// NewContainerLogsRecv create new ContainerLogsRecv
+func NewContainerLogsRecv(cfg *ContainerLogsRecvCfg) (r *ContainerLogsRecv) {
+	if len(cfg.Paths) == 0 {
+		cfg.Paths = []string{defaultContainerLogsPath}
+		log.Logger.Named(cfg.Name).Info("reset paths", zap.Strings("paths", cfg.Paths))
+	}
+
+	r = &ContainerLogsRecv{
+		FileRecv: NewFileRecv(&FileRecvCfg{
+			Name:            cfg.Name,
+			PosFilePath:     cfg.PosFilePath,
+			Tag:             cfg.Tag,
+			TagKey:          cfg.TagKey,
+			MsgKey:          cfg.MsgKey,
+			PathKey:         cfg.PathKey,
+			Paths:           cfg.Paths,
+			PathRegexp:      containerLogPathRegexp,
+			ConcatMaxLen:    cfg.ConcatMaxLen,
+			ConcatorWait:    cfg.ConcatorWait,
+			RefreshInterval: cfg.RefreshInterval,
+			PollInterval:    cfg.PollInterval,
+			IsReadFromHead:  cfg.IsReadFromHead,
+		}),
+	}
+	r.newLineParser = func(path string, emit func(*fileLine)) fileLineParser {
+		return newContainerLogParser(r.ConcatMaxLen, r.ConcatorWait, emit)
+	}
+	r.loadFields = func(path string) map[string]interface{} {
+		return loadPathGroups(containerLogPathRegexp, path)
+	}
+
+	r.logger.Info("create container-logs recv")
+	return r
+}
+
+// dockerJSONLog is one line of docker json-file log driver
+type dockerJSONLog struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// containerLogParser parse docker json-file & CRI log lines.
+//
+// docker split long log into 16KB lines, only the last one ends with `\n`.
+// CRI split long log into lines tagged `P`, and the last one is tagged `F`.
+// partial lines are reassembled per stream.
+type containerLogParser struct {
+	maxLen int
+	wait   time.Duration
+	emit   func(*fileLine)
+
+	// pending partial logs by stream
+	pending map[string]*containerPartialLog
+}
+
+type containerPartialLog struct {
+	*fileLine
+	// startOffset position in file before the first part
+	startOffset int64
+}
+
+func newContainerLogParser(maxLen int, wait time.Duration, emit func(*fileLine)) *containerLogParser {
+	return &containerLogParser{
+		maxLen:  maxLen,
+		wait:    wait,
+		emit:    emit,
+		pending: map[string]*containerPartialLog{},
+	}
+}
+
+// parseLine extract log, stream, time & whether log is partial from line
+func (p *containerLogParser) parseLine(line []byte) (content []byte, stream, ts string, isPartial bool, err error) {
+	if len(line) != 0 && line[0] == '{' { // docker json-file
+		l := &dockerJSONLog{}
+		if err = json.Unmarshal(line, l); err != nil {
+			return nil, "", "", false, err
+		}
+
+		if len(l.Log) != 0 && l.Log[len(l.Log)-1] == '\n' {
+			return []byte(l.Log[:len(l.Log)-1]), l.Stream, l.Time, false, nil
+		}
+		return []byte(l.Log), l.Stream, l.Time, true, nil
+	}
+
+	// CRI: `<time> <stream> <tags> <log>`, tags are separated by `:`, the first one is `P` or `F`
+	parts := bytes.SplitN(line, []byte(" "), 4)
+	if len(parts) < 3 {
+		return nil, "", "", false, fmt.Errorf("unknown container log format")
+	}
+	if len(parts) == 3 { // empty log
+		parts = append(parts, []byte{})
+	}
+
+	isPartial = bytes.Equal(bytes.SplitN(parts[2], []byte(":"), 2)[0], []byte("P"))
+	return parts[3], string(parts[1]), string(parts[0]), isPartial, nil
+}
+
+// Parse consume one line, emit log if it is completed
+func (p *containerLogParser) Parse(line []byte, startOffset, offset int64) {
+	content, stream, ts, isPartial, err := p.parseLine(line)
+	if err != nil { // send unknown line as it is
+		p.emitLine(&fileLine{log: line, offset: offset})
+		return
+	}
+
+	l, ok := p.pending[stream]
+	if !ok {
+		l = &containerPartialLog{
+			fileLine: &fileLine{
+				log: content,
+				fields: map[string]interface{}{
+					"stream": stream,
+					"time":   ts,
+				},
+			},
+			startOffset: startOffset,
+		}
+	} else {
+		l.log = append(l.log, content...)
+	}
+	l.offset = offset
+	l.lastT = utils.Clock.GetUTCNow()
+
+	if isPartial && len(l.log) < p.maxLen {
+		p.pending[stream] = l
+		return
+	}
+
+	delete(p.pending, stream)
+	p.emitLine(l.fileLine)
+}
+
+// emitLine emit log, position should not go beyond any pending partial log,
+// otherwise the partial log will lost after restart.
+func (p *containerLogParser) emitLine(l *fileLine) {
+	for _, pl := range p.pending {
+		if pl.startOffset < l.offset {
+			l.offset = pl.startOffset
+		}
+	}
+
+	p.emit(l)
+}
+
+// Flush emit partial logs that wait too long, or all partial logs if force
+func (p *containerLogParser) Flush(force bool) {
+	now := utils.Clock.GetUTCNow()
+	for stream, l := range p.pending {
+		if force || now.Sub(l.lastT) > p.wait {
+			delete(p.pending, stream)
+			p.emitLine(l.fileLine)
+		}
+	}
+}
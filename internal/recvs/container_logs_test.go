@@ -0,0 +1,133 @@
+package recvs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContainerLogParser(t *testing.T) {
+	var lines []*fileLine
+	p := newContainerLogParser(100, time.Minute, func(l *fileLine) {
+		lines = append(lines, l)
+	})
+
+	for i, line := range []string{
+		`{"log":"docker 1\n","stream":"stdout","time":"2020-01-01T00:00:00.000000001Z"}`,
+		`{"log":"docker ","stream":"stdout","time":"2020-01-01T00:00:00.000000002Z"}`,
+		`{"log":"stderr\n","stream":"stderr","time":"2020-01-01T00:00:00.000000003Z"}`,
+		`{"log":"2\n","stream":"stdout","time":"2020-01-01T00:00:00.000000004Z"}`,
+		`2020-01-01T00:00:00.000000005Z stdout P cri `,
+		`2020-01-01T00:00:00.000000006Z stdout F 1`,
+		`2020-01-01T00:00:00.000000007Z stderr F`,
+		`unknown`,
+	} {
+		p.Parse([]byte(line), int64(i)*100, int64(i+1)*100)
+	}
+
+	expects := []struct {
+		log, stream string
+		offset      int64
+	}{
+		{"docker 1", "stdout", 100},
+		// position should not go beyond pending partial log
+		{"stderr", "stderr", 100},
+		{"docker 2", "stdout", 400},
+		{"cri 1", "stdout", 600},
+		{"", "stderr", 700},
+		{"unknown", "", 800},
+	}
+	if len(lines) != len(expects) {
+		t.Fatalf("got %d lines", len(lines))
+	}
+	for i, expect := range expects {
+		if string(lines[i].log) != expect.log {
+			t.Fatalf("[%d] got log %q", i, string(lines[i].log))
+		}
+		if expect.stream != "" && lines[i].fields["stream"] != expect.stream {
+			t.Fatalf("[%d] got stream %v", i, lines[i].fields["stream"])
+		}
+		if lines[i].offset != expect.offset {
+			t.Fatalf("[%d] got offset %v", i, lines[i].offset)
+		}
+	}
+	if lines[0].fields["time"] != "2020-01-01T00:00:00.000000001Z" {
+		t.Fatalf("got time %v", lines[0].fields["time"])
+	}
+
+	// partial log flushed when force
+	p.Parse([]byte(`2020-01-01T00:00:00.000000008Z stdout P partial`), 800, 900)
+	p.Flush(false)
+	if len(lines) != len(expects) {
+		t.Fatalf("got %d lines", len(lines))
+	}
+	p.Flush(true)
+	if string(lines[len(lines)-1].log) != "partial" {
+		t.Fatalf("got %q", string(lines[len(lines)-1].log))
+	}
+}
+
+func TestContainerLogParserCRLF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofluentd-container-logs")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		fpath   = filepath.Join(dir, "app.log")
+		first   = "2020-01-01T00:00:00.000000001Z stdout F first\r\n"
+		partial = "2020-01-01T00:00:00.000000002Z stdout P part\r\n"
+		stderr  = "2020-01-01T00:00:00.000000003Z stderr F err\r\n"
+		lines   []*fileLine
+	)
+	appendFile(t, fpath, first+partial+stderr)
+
+	tailer := &fileTailer{path: fpath}
+	if err = tailer.open(0); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer tailer.close()
+	p := newContainerLogParser(100, time.Minute, func(l *fileLine) {
+		lines = append(lines, l)
+	})
+	for {
+		start := tailer.offset
+		line, err := tailer.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		p.Parse(line, start, tailer.offset)
+	}
+
+	// position of stderr log should stop at the start of pending partial log
+	if len(lines) != 2 ||
+		string(lines[0].log) != "first" || lines[0].offset != int64(len(first)) ||
+		string(lines[1].log) != "err" || lines[1].offset != int64(len(first)) {
+		t.Fatalf("got %+v", lines)
+	}
+}
+
+func TestContainerLogPathRegexp(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	fields := loadPathGroups(containerLogPathRegexp, "/var/log/containers/app-7d9c_default_app-sidecar-"+id+".log")
+	for k, v := range map[string]string{
+		"pod_name":       "app-7d9c",
+		"namespace":      "default",
+		"container_name": "app-sidecar",
+		"container_id":   id,
+	} {
+		if fields[k] != v {
+			t.Fatalf("got %v: %v", k, fields[k])
+		}
+	}
+
+	if len(loadPathGroups(containerLogPathRegexp, "/var/log/containers/app.log")) != 0 {
+		t.Fatal("should not match")
+	}
+}
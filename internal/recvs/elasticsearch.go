@@ -0,0 +1,380 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultESBulkAddr        = "0.0.0.0:9200"
+	defaultESBulkVersion     = "7.10.2"
+	defaultESBulkMaxBodySize = 100 * 1024 * 1024
+	defaultESBulkGraceWait   = 3 * time.Second
+)
+
+// ESBulkRecvCfg configuration of ESBulkRecv
+type ESBulkRecvCfg struct {
+	Name,
+	// Addr: listening address, like `0.0.0.0:9200`
+	Addr,
+	// Tag: template of `msg.Tag`, `${index}` will be replaced by `_index`,
+	// `${<group>}` will be replaced by named groups of `IndexRegexp`
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// IndexKey: set `msg.Message[IndexKey] = _index` if not empty
+	IndexKey,
+	// Version: elasticsearch version number responsed by info endpoint,
+	// some clients will check it
+	Version string
+	// IndexRegexp: only accept index that matched if not nil
+	IndexRegexp *regexp.Regexp
+	MaxBodySize int64
+}
+
+// ESBulkRecv recv documents by elasticsearch compatible `_bulk` API
+type ESBulkRecv struct {
+	*BaseRecv
+	*ESBulkRecvCfg
+	logger *utils.LoggerType
+	srv    *gin.Engine
+}
+
+// NewESBulkRecv create new ESBulkRecv
+func NewESBulkRecv(cfg *ESBulkRecvCfg) (r *ESBulkRecv) {
+	r = &ESBulkRecv{
+		BaseRecv:      &BaseRecv{},
+		ESBulkRecvCfg: cfg,
+		logger:        log.Logger.Named(cfg.Name),
+		srv:           gin.New(),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("es-bulk recv invalid", zap.Error(err))
+	}
+
+	// clients may request `/_bulk` or `/<index>/_bulk`,
+	// which are conflicted in gin's router, so route by ourselves.
+	r.srv.Use(gin.Recovery())
+	r.srv.Any("/*path", r.handle)
+
+	indexReg := ""
+	if r.IndexRegexp != nil {
+		indexReg = r.IndexRegexp.String()
+	}
+	r.logger.Info("create es-bulk recv",
+		zap.String("addr", r.Addr),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("index_key", r.IndexKey),
+		zap.String("index_regexp", indexReg),
+		zap.String("version", r.Version),
+		zap.Int64("max_body_byte", r.MaxBodySize),
+	)
+	return r
+}
+
+func (r *ESBulkRecv) valid() error {
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	if r.Addr == "" {
+		r.Addr = defaultESBulkAddr
+		r.logger.Info("reset addr", zap.String("addr", r.Addr))
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.Version == "" {
+		r.Version = defaultESBulkVersion
+		r.logger.Info("reset version", zap.String("version", r.Version))
+	}
+
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultESBulkMaxBodySize
+		r.logger.Info("reset max_body_byte", zap.Int64("max_body_byte", r.MaxBodySize))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *ESBulkRecv) GetName() string {
+	return r.Name
+}
+
+// Run starting http server
+func (r *ESBulkRecv) Run(ctx context.Context) {
+	r.logger.Info("run ESBulkRecv")
+	httpSrv := &http.Server{
+		Addr:    r.Addr,
+		Handler: r.srv,
+	}
+
+	go func() {
+		r.logger.Info("listening on http", zap.String("addr", r.Addr))
+		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			r.logger.Panic("es-bulk server exit", zap.Error(err))
+		}
+	}()
+
+	<-ctx.Done()
+	srvCtx, cancel := context.WithTimeout(context.Background(), defaultESBulkGraceWait)
+	defer cancel()
+	if err := httpSrv.Shutdown(srvCtx); err != nil {
+		r.logger.Error("shutdown es-bulk server", zap.Error(err))
+	}
+	r.logger.Info("es-bulk recv exit")
+}
+
+func (r *ESBulkRecv) handle(ctx *gin.Context) {
+	ctx.Header("X-Elastic-Product", "Elasticsearch")
+	path := strings.Trim(ctx.Request.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "" && (ctx.Request.Method == http.MethodGet || ctx.Request.Method == http.MethodHead):
+		r.handleInfo(ctx)
+	case parts[len(parts)-1] == "_bulk" && len(parts) <= 2 &&
+		(ctx.Request.Method == http.MethodPost || ctx.Request.Method == http.MethodPut):
+		defaultIndex := ""
+		if len(parts) == 2 {
+			defaultIndex = parts[0]
+		}
+		r.handleBulk(ctx, defaultIndex)
+	default:
+		r.errResp(ctx, http.StatusNotFound, "invalid_index_name_exception",
+			fmt.Sprintf("%v %v is not supported", ctx.Request.Method, ctx.Request.URL.Path))
+	}
+}
+
+// handleInfo response like elasticsearch's `GET /`
+func (r *ESBulkRecv) handleInfo(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, map[string]interface{}{
+		"name":         r.Name,
+		"cluster_name": "go-fluentd",
+		"cluster_uuid": "go-fluentd",
+		"version": map[string]interface{}{
+			"number":                              r.Version,
+			"build_flavor":                        "default",
+			"lucene_version":                      "8.7.0",
+			"minimum_wire_compatibility_version":  "6.8.0",
+			"minimum_index_compatibility_version": "6.0.0-beta1",
+		},
+		"tagline": "You Know, for Search",
+	})
+}
+
+func (r *ESBulkRecv) errResp(ctx *gin.Context, status int, errType, reason string) {
+	r.logger.Warn("bad request",
+		zap.String("type", errType),
+		zap.String("reason", reason),
+		zap.String("remote", ctx.ClientIP()))
+	ctx.AbortWithStatusJSON(status, map[string]interface{}{
+		"error": &esBulkError{
+			Type:   errType,
+			Reason: reason,
+		},
+		"status": status,
+	})
+}
+
+type esBulkError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type esBulkItem struct {
+	Index   string       `json:"_index"`
+	Type    string       `json:"_type"`
+	ID      string       `json:"_id"`
+	Version int          `json:"_version,omitempty"`
+	Result  string       `json:"result,omitempty"`
+	Status  int          `json:"status"`
+	Error   *esBulkError `json:"error,omitempty"`
+}
+
+type esBulkResp struct {
+	Took   int64                    `json:"took"`
+	Errors bool                     `json:"errors"`
+	Items  []map[string]*esBulkItem `json:"items"`
+}
+
+// readBody read body, decompress if gzip
+func (r *ESBulkRecv) readBody(ctx *gin.Context) (body []byte, err error) {
+	var reader io.Reader = ctx.Request.Body
+	if strings.Contains(ctx.GetHeader("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(ctx.Request.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "read gzip body")
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	if body, err = ioutil.ReadAll(io.LimitReader(reader, r.MaxBodySize+1)); err != nil {
+		return nil, errors.Wrap(err, "read body")
+	}
+	if int64(len(body)) > r.MaxBodySize {
+		return nil, fmt.Errorf("content size must less than %d bytes", r.MaxBodySize)
+	}
+
+	return body, nil
+}
+
+// loadTag generate tag by index
+func (r *ESBulkRecv) loadTag(index string) (string, error) {
+	if index == "" {
+		return "", fmt.Errorf("_index is missing")
+	}
+
+	vars := map[string]interface{}{"index": index}
+	if r.IndexRegexp != nil {
+		if !r.IndexRegexp.MatchString(index) {
+			return "", fmt.Errorf("_index `%v` not allowed", index)
+		}
+		for k, v := range loadPathGroups(r.IndexRegexp, index) {
+			vars[k] = v
+		}
+	}
+
+	return library.TemplateWithMap(r.Tag, vars), nil
+}
+
+// handleBulk process `_bulk` request,
+// only `index` & `create` are supported, `update` & `delete` will be rejected.
+func (r *ESBulkRecv) handleBulk(ctx *gin.Context, defaultIndex string) {
+	startAt := utils.Clock.GetUTCNow()
+	body, err := r.readBody(ctx)
+	if err != nil {
+		r.errResp(ctx, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	// parse whole body before sending, otherwise documents that already sent
+	// will be duplicated when client retries the rejected request
+	var (
+		resp    = &esBulkResp{Items: []map[string]*esBulkItem{}}
+		scanner = bufio.NewScanner(bytes.NewReader(body))
+		line    []byte
+		items   []*esBulkItem
+		sources [][]byte
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	nextLine := func() bool {
+		for scanner.Scan() {
+			if line = bytes.TrimSpace(scanner.Bytes()); len(line) != 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for nextLine() {
+		action := map[string]map[string]interface{}{}
+		if err = json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			r.errResp(ctx, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("malformed action line: %s", line))
+			return
+		}
+
+		for op, meta := range action {
+			item := &esBulkItem{Index: defaultIndex, Type: "_doc"}
+			resp.Items = append(resp.Items, map[string]*esBulkItem{op: item})
+			if v, ok := meta["_index"].(string); ok && v != "" {
+				item.Index = v
+			}
+			if v, ok := meta["_id"].(string); ok {
+				item.ID = v
+			}
+
+			switch op {
+			case "index", "create":
+			case "update":
+				nextLine() // skip doc
+				fallthrough
+			case "delete":
+				item.Status = http.StatusBadRequest
+				item.Error = &esBulkError{Type: "illegal_argument_exception", Reason: "operation `" + op + "` is not supported"}
+				resp.Errors = true
+				continue
+			default:
+				r.errResp(ctx, http.StatusBadRequest, "illegal_argument_exception", "unknown action `"+op+"`")
+				return
+			}
+
+			if !nextLine() {
+				r.errResp(ctx, http.StatusBadRequest, "illegal_argument_exception", "source is missing")
+				return
+			}
+			items = append(items, item)
+			sources = append(sources, append([]byte{}, line...))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		r.errResp(ctx, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	for i, item := range items {
+		if err = r.processDoc(item, sources[i]); err != nil {
+			item.Status = http.StatusBadRequest
+			item.Error = &esBulkError{Type: "mapper_parsing_exception", Reason: err.Error()}
+			resp.Errors = true
+		}
+	}
+
+	resp.Took = utils.Clock.GetUTCNow().Sub(startAt).Milliseconds()
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// processDoc put document into downstream
+func (r *ESBulkRecv) processDoc(item *esBulkItem, source []byte) error {
+	tag, err := r.loadTag(item.Index)
+	if err != nil {
+		return err
+	}
+
+	doc := map[string]interface{}{}
+	if err = json.Unmarshal(source, &doc); err != nil {
+		return errors.Wrap(err, "unmarshal source")
+	}
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Tag = tag
+	msg.Message = doc
+	msg.Message[r.TagKey] = tag
+	if r.IndexKey != "" {
+		msg.Message[r.IndexKey] = item.Index
+	}
+	if item.ID == "" {
+		item.ID = strconv.FormatInt(msg.ID, 10)
+	}
+	item.Version = 1
+	item.Result = "created"
+	item.Status = http.StatusCreated
+
+	r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.syncOutChan <- msg // blockable
+	return nil
+}
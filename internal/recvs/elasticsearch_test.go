@@ -0,0 +1,97 @@
+package recvs
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"gofluentd/library"
+)
+
+func TestESBulkRecv(t *testing.T) {
+	syncOutChan := make(chan *library.FluentMsg, 1000)
+	recv := NewESBulkRecv(&ESBulkRecvCfg{
+		Name:        "test-es-bulk",
+		Tag:         "${app}.sit",
+		IndexKey:    "index",
+		IndexRegexp: regexp.MustCompile(`^(?P<app>[a-z]+)-\d{4}\.\d{2}\.\d{2}$`),
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(syncOutChan)
+
+	request := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		recv.srv.ServeHTTP(w, req)
+		return w
+	}
+
+	// info
+	if w := request(http.MethodGet, "/", nil); w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"number":"7.10.2"`)) {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+
+	body := []byte(`{"index":{"_index":"filebeat-2020.01.01","_id":"1"}}
+{"message":"hello","a":{"b":1}}
+{"create":{}}
+{"message":"world"}
+{"index":{"_index":"Unknown"}}
+{"message":"x"}
+{"delete":{"_index":"filebeat-2020.01.01","_id":"1"}}
+`)
+	w := request(http.MethodPost, "/nginx-2020.01.02/_bulk", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+	resp := &esBulkResp{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if !resp.Errors || len(resp.Items) != 4 {
+		t.Fatalf("got %+v", w.Body.String())
+	}
+	for i, expect := range []struct {
+		op     string
+		status int
+	}{
+		{"index", 201},
+		{"create", 201},
+		{"index", 400},
+		{"delete", 400},
+	} {
+		if resp.Items[i][expect.op] == nil || resp.Items[i][expect.op].Status != expect.status {
+			t.Fatalf("[%d] got %+v", i, resp.Items[i])
+		}
+	}
+
+	msg := <-syncOutChan
+	if msg.Tag != "filebeat.sit" || msg.Message["index"] != "filebeat-2020.01.01" || msg.Message["message"] != "hello" {
+		t.Fatalf("got %+v", msg)
+	}
+	msg = <-syncOutChan
+	if msg.Tag != "nginx.sit" || msg.Message["tag"] != "nginx.sit" {
+		t.Fatalf("got %+v", msg)
+	}
+
+	// malformed
+	if w = request(http.MethodPost, "/_bulk", []byte("not json\n")); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %v", w.Code)
+	}
+	// nothing is sent if request is rejected
+	body = []byte(`{"index":{"_index":"filebeat-2020.01.01"}}
+{"message":"hello"}
+{"index":{"_index":"filebeat-2020.01.01"}}
+`)
+	if w = request(http.MethodPost, "/_bulk", body); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %v", w.Code)
+	}
+	if len(syncOutChan) != 0 {
+		t.Fatalf("got %d msgs", len(syncOutChan))
+	}
+	if w = request(http.MethodGet, "/_cat/indices", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("got %v", w.Code)
+	}
+}
@@ -0,0 +1,730 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFileRefreshInterval  = 5 * time.Second
+	defaultFilePollInterval     = 1 * time.Second
+	defaultFilePosFlushInterval = 1 * time.Second
+	defaultFileReaderBufSize    = 64 * 1024
+)
+
+// FileRecvCfg configuration of FileRecv
+type FileRecvCfg struct {
+	Name,
+	// PosFilePath: file to persist read offsets of all tailing files
+	PosFilePath,
+	// Tag: template of `msg.Tag`, `${<group>}` will be replaced by
+	// named groups of `PathRegexp`, `${path}` & `${filename}` are always available
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: put line into `msg.Message[MsgKey]`
+	MsgKey,
+	// PathKey: set `msg.Message[PathKey] = path` if not empty
+	PathKey string
+
+	// Paths: glob patterns of files to tail, like `/var/log/*.log`
+	Paths []string
+	// PathRegexp: load named groups from file path
+	PathRegexp *regexp.Regexp
+
+	// HeadRegexp: line matched is the first line of a new log,
+	// lines not matched will be appended to the previous one.
+	// disable multiline if nil.
+	HeadRegexp   *regexp.Regexp
+	ConcatMaxLen int
+	ConcatorWait time.Duration
+
+	// RefreshInterval: interval to glob `Paths` to find new files
+	RefreshInterval,
+	// PollInterval: interval to check tailing files for new lines
+	PollInterval time.Duration
+
+	// IsReadFromHead: read files found at startup without stored position from head,
+	// otherwise read from tail. files created after startup always read from head.
+	IsReadFromHead bool
+}
+
+// FileRecv tail local files
+type FileRecv struct {
+	*BaseRecv
+	*FileRecvCfg
+	logger *utils.LoggerType
+
+	positions *filePositions
+	tailing   *sync.Map // map[path]struct{}
+
+	// newLineParser create parser for each tailing file
+	newLineParser func(path string, emit func(*fileLine)) fileLineParser
+	// loadFields load extra fields into every msg of file
+	loadFields func(path string) map[string]interface{}
+}
+
+// NewFileRecv create new FileRecv
+func NewFileRecv(cfg *FileRecvCfg) (r *FileRecv) {
+	r = &FileRecv{
+		BaseRecv:    &BaseRecv{},
+		FileRecvCfg: cfg,
+		logger:      log.Logger.Named(cfg.Name),
+		tailing:     &sync.Map{},
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("file recv invalid", zap.Error(err))
+	}
+
+	r.newLineParser = func(path string, emit func(*fileLine)) fileLineParser {
+		return newMultilineParser(r.HeadRegexp, r.ConcatMaxLen, r.ConcatorWait, emit)
+	}
+	r.loadFields = func(path string) map[string]interface{} {
+		return nil
+	}
+
+	r.logger.Info("create file recv",
+		zap.Strings("paths", r.Paths),
+		zap.String("pos_file", r.PosFilePath),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.String("path_key", r.PathKey),
+		zap.Duration("refresh_interval_sec", r.RefreshInterval),
+		zap.Duration("poll_interval_sec", r.PollInterval),
+		zap.Bool("is_read_from_head", r.IsReadFromHead),
+	)
+	return r
+}
+
+func (r *FileRecv) valid() error {
+	if len(r.Paths) == 0 {
+		return fmt.Errorf("paths should not be empty")
+	}
+
+	if r.PosFilePath == "" {
+		return fmt.Errorf("pos_file should not be empty")
+	}
+
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.RefreshInterval <= 0 {
+		r.RefreshInterval = defaultFileRefreshInterval
+		r.logger.Info("reset refresh_interval_sec", zap.Duration("refresh_interval_sec", r.RefreshInterval))
+	}
+
+	if r.PollInterval <= 0 {
+		r.PollInterval = defaultFilePollInterval
+		r.logger.Info("reset poll_interval_sec", zap.Duration("poll_interval_sec", r.PollInterval))
+	}
+
+	if r.ConcatMaxLen <= 0 {
+		r.ConcatMaxLen = 300000
+		r.logger.Info("reset concat_max_len", zap.Int("concat_max_len", r.ConcatMaxLen))
+	}
+
+	if r.ConcatorWait <= 0 {
+		r.ConcatorWait = defaultConcatorWait
+		r.logger.Info("reset concat_with_sec", zap.Duration("concat_with_sec", r.ConcatorWait))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *FileRecv) GetName() string {
+	return r.Name
+}
+
+// Run starting to tail files
+func (r *FileRecv) Run(ctx context.Context) {
+	r.logger.Info("run FileRecv")
+	defer r.logger.Info("file recv exit")
+
+	var err error
+	if r.positions, err = loadFilePositions(r.PosFilePath); err != nil {
+		r.logger.Error("load positions, will read files without positions",
+			zap.Error(err),
+			zap.String("pos_file", r.PosFilePath))
+		r.positions = newFilePositions(r.PosFilePath)
+	}
+	go r.runPositionsFlusher(ctx)
+
+	var (
+		isInitial = true
+		ticker    = time.NewTicker(r.RefreshInterval)
+		matches   []string
+		fi        os.FileInfo
+	)
+	defer ticker.Stop()
+
+	for {
+		for _, pattern := range r.Paths {
+			if matches, err = filepath.Glob(pattern); err != nil {
+				r.logger.Error("glob files", zap.Error(err), zap.String("pattern", pattern))
+				continue
+			}
+
+			for _, path := range matches {
+				if fi, err = os.Stat(path); err != nil || fi.IsDir() {
+					continue
+				}
+
+				if _, ok := r.tailing.LoadOrStore(path, struct{}{}); ok {
+					continue
+				}
+
+				go r.tailFile(ctx, path, isInitial)
+			}
+		}
+		isInitial = false
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *FileRecv) runPositionsFlusher(ctx context.Context) {
+	ticker := time.NewTicker(defaultFilePosFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.positions.Flush(); err != nil {
+				r.logger.Error("flush positions", zap.Error(err))
+			}
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.positions.Flush(); err != nil {
+			r.logger.Error("flush positions", zap.Error(err))
+		}
+	}
+}
+
+// renderTag generate tag by path
+func (r *FileRecv) renderTag(path string) string {
+	vars := map[string]interface{}{
+		"path":     path,
+		"filename": filepath.Base(path),
+	}
+	for k, v := range loadPathGroups(r.PathRegexp, path) {
+		vars[k] = v
+	}
+
+	return library.TemplateWithMap(r.Tag, vars)
+}
+
+// loadPathGroups load named groups of regexp from path
+func loadPathGroups(reg *regexp.Regexp, path string) map[string]interface{} {
+	groups := map[string]interface{}{}
+	if reg == nil {
+		return groups
+	}
+
+	matches := reg.FindStringSubmatch(path)
+	if matches == nil {
+		return groups
+	}
+
+	for i, name := range reg.SubexpNames() {
+		if i != 0 && name != "" && matches[i] != "" {
+			groups[name] = matches[i]
+		}
+	}
+
+	return groups
+}
+
+func (r *FileRecv) tailFile(ctx context.Context, path string, isInitial bool) {
+	defer r.tailing.Delete(path)
+	logger := r.logger.With(zap.String("path", path))
+	logger.Info("start tailing file")
+	defer logger.Info("stop tailing file")
+
+	var (
+		err    error
+		line   []byte
+		offset int64
+		start  int64
+		ino    uint64
+		ok     bool
+		fi     os.FileInfo
+
+		tag    = r.renderTag(path)
+		fields = r.loadFields(path)
+		t      = &fileTailer{path: path}
+		parser = r.newLineParser(path, func(l *fileLine) {
+			r.send(t, tag, fields, l)
+		})
+		ticker = time.NewTicker(r.PollInterval)
+	)
+	defer ticker.Stop()
+
+	if fi, err = os.Stat(path); err != nil {
+		logger.Error("stat file", zap.Error(err))
+		return
+	}
+	if ino, offset, ok = r.positions.Get(path); !ok || ino != fileInode(fi) {
+		offset = 0
+		if isInitial && !r.IsReadFromHead {
+			offset = fi.Size()
+		}
+	}
+
+	if err = t.open(offset); err != nil {
+		logger.Error("open file", zap.Error(err))
+		return
+	}
+	defer t.close()
+	logger.Info("open file", zap.Int64("offset", t.offset), zap.Uint64("inode", t.ino))
+	r.positions.Set(path, t.ino, t.offset)
+
+	for {
+		for {
+			start = t.offset
+			if line, err = t.readLine(); err != nil {
+				break
+			}
+
+			parser.Parse(line, start, t.offset)
+		}
+		if err != io.EOF {
+			logger.Error("read file", zap.Error(err))
+			return
+		}
+		parser.Flush(false)
+
+		switch t.checkRotation() {
+		case fileStatusTruncated:
+			logger.Info("file truncated, read from head")
+			parser.Flush(true)
+			if err = t.seek(0); err != nil {
+				logger.Error("seek file", zap.Error(err))
+				return
+			}
+			r.positions.Set(path, t.ino, t.offset)
+			continue
+		case fileStatusRotated, fileStatusRemoved:
+			// drain the rest lines of the old file
+			for {
+				start = t.offset
+				if line, err = t.readLine(); err != nil {
+					break
+				}
+				parser.Parse(line, start, t.offset)
+			}
+			start = t.offset
+			if line = t.flushPartial(); len(line) != 0 {
+				parser.Parse(line, start, t.offset)
+			}
+			parser.Flush(true)
+			t.close()
+
+			if err = t.open(0); err != nil {
+				if os.IsNotExist(err) {
+					logger.Info("file removed")
+					r.positions.Delete(path)
+					return
+				}
+
+				logger.Error("reopen rotated file", zap.Error(err))
+				return
+			}
+			logger.Info("file rotated, reopen", zap.Uint64("inode", t.ino))
+			r.positions.Set(path, t.ino, t.offset)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			parser.Flush(true)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// send put line into downstream and update position
+func (r *FileRecv) send(t *fileTailer, tag string, fields map[string]interface{}, l *fileLine) {
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	msg.ID = r.counter.Count()
+	msg.Tag = tag
+	msg.Message = map[string]interface{}{
+		r.MsgKey: l.log,
+		r.TagKey: tag,
+	}
+	for k, v := range fields {
+		msg.Message[k] = v
+	}
+	for k, v := range l.fields {
+		msg.Message[k] = v
+	}
+	if r.PathKey != "" {
+		msg.Message[r.PathKey] = t.path
+	}
+
+	r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.syncOutChan <- msg // blockable
+	r.positions.Set(t.path, t.ino, l.offset)
+}
+
+type fileStatus int
+
+const (
+	fileStatusNormal fileStatus = iota
+	fileStatusTruncated
+	fileStatusRotated
+	fileStatusRemoved
+)
+
+// fileTailer read lines from file
+type fileTailer struct {
+	path   string
+	file   *os.File
+	reader *bufio.Reader
+	ino    uint64
+	// offset position in file after the last completed line
+	offset int64
+	// buf partial line that wait for `\n`
+	buf []byte
+}
+
+func (t *fileTailer) open(offset int64) (err error) {
+	if t.file, err = os.Open(t.path); err != nil {
+		return err
+	}
+
+	fi, err := t.file.Stat()
+	if err != nil {
+		t.close()
+		return errors.Wrap(err, "stat file")
+	}
+	t.ino = fileInode(fi)
+	if offset > fi.Size() { // truncated when we are away
+		offset = 0
+	}
+
+	return t.seek(offset)
+}
+
+func (t *fileTailer) seek(offset int64) (err error) {
+	if _, err = t.file.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "seek to %d", offset)
+	}
+
+	t.offset = offset
+	t.buf = t.buf[:0]
+	if t.reader == nil {
+		t.reader = bufio.NewReaderSize(t.file, defaultFileReaderBufSize)
+	} else {
+		t.reader.Reset(t.file)
+	}
+
+	return nil
+}
+
+func (t *fileTailer) close() {
+	if t.file == nil {
+		return
+	}
+
+	if err := t.file.Close(); err != nil {
+		log.Logger.Error("close file", zap.Error(err), zap.String("path", t.path))
+	}
+	t.file = nil
+}
+
+// readLine return next completed line without `\n`,
+// return `io.EOF` if there is no completed line.
+func (t *fileTailer) readLine() (line []byte, err error) {
+	var chunk []byte
+	for {
+		chunk, err = t.reader.ReadSlice('\n')
+		t.buf = append(t.buf, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		t.offset += int64(len(t.buf))
+		line = append([]byte{}, bytes.TrimRight(t.buf, "\r\n")...)
+		t.buf = t.buf[:0]
+		return line, nil
+	}
+}
+
+// flushPartial return the partial line that has no `\n`
+func (t *fileTailer) flushPartial() (line []byte) {
+	if len(t.buf) == 0 {
+		return nil
+	}
+
+	t.offset += int64(len(t.buf))
+	line = append([]byte{}, t.buf...)
+	t.buf = t.buf[:0]
+	return line
+}
+
+// checkRotation compare opened file with the file on path
+func (t *fileTailer) checkRotation() fileStatus {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		return fileStatusRemoved
+	}
+	if fileInode(fi) != t.ino {
+		return fileStatusRotated
+	}
+
+	// copytruncate
+	if ofi, err := t.file.Stat(); err == nil &&
+		ofi.Size() < t.offset+int64(len(t.buf)) {
+		return fileStatusTruncated
+	}
+
+	return fileStatusNormal
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+
+	return 0
+}
+
+// fileLine is one log read from file
+type fileLine struct {
+	log []byte
+	// fields extra fields set into msg
+	fields map[string]interface{}
+	// offset position in file after this log
+	offset int64
+	lastT  time.Time
+}
+
+// fileLineParser convert lines of file into logs
+type fileLineParser interface {
+	// Parse consume one line, emit logs that are completed,
+	// startOffset and offset are positions in file before and after the line (including `\r\n`)
+	Parse(line []byte, startOffset, offset int64)
+	// Flush emit pending logs that wait too long, or all pending logs if force
+	Flush(force bool)
+}
+
+// multilineParser concat lines by head regexp, like concator in FluentdRecv
+type multilineParser struct {
+	headRegexp *regexp.Regexp
+	maxLen     int
+	wait       time.Duration
+	emit       func(*fileLine)
+	pending    *fileLine
+}
+
+func newMultilineParser(headRegexp *regexp.Regexp, maxLen int, wait time.Duration, emit func(*fileLine)) *multilineParser {
+	return &multilineParser{
+		headRegexp: headRegexp,
+		maxLen:     maxLen,
+		wait:       wait,
+		emit:       emit,
+	}
+}
+
+func (p *multilineParser) Parse(line []byte, startOffset, offset int64) {
+	if p.headRegexp == nil {
+		p.emit(&fileLine{log: line, offset: offset})
+		return
+	}
+
+	now := utils.Clock.GetUTCNow()
+	if p.pending == nil {
+		if !p.headRegexp.Match(line) { // no head yet, send directly
+			p.emit(&fileLine{log: line, offset: offset})
+			return
+		}
+
+		p.pending = &fileLine{log: line, offset: offset, lastT: now}
+		return
+	}
+
+	if p.headRegexp.Match(line) || now.Sub(p.pending.lastT) > p.wait { // new log
+		p.emit(p.pending)
+		p.pending = &fileLine{log: line, offset: offset, lastT: now}
+		return
+	}
+
+	p.pending.log = append(append(p.pending.log, '\n'), line...)
+	p.pending.offset = offset
+	p.pending.lastT = now
+	if len(p.pending.log) >= p.maxLen {
+		p.emit(p.pending)
+		p.pending = nil
+	}
+}
+
+func (p *multilineParser) Flush(force bool) {
+	if p.pending == nil {
+		return
+	}
+
+	if force || utils.Clock.GetUTCNow().Sub(p.pending.lastT) > p.wait {
+		p.emit(p.pending)
+		p.pending = nil
+	}
+}
+
+type filePosition struct {
+	ino    uint64
+	offset int64
+}
+
+// filePositions persist read offsets of files,
+// file format is compatible with fluentd's pos_file:
+//
+//	<path>\t<offset in hex>\t<inode in hex>
+type filePositions struct {
+	sync.Mutex
+	fpath     string
+	isChanged bool
+	positions map[string]*filePosition
+}
+
+func newFilePositions(fpath string) *filePositions {
+	return &filePositions{
+		fpath:     fpath,
+		positions: map[string]*filePosition{},
+	}
+}
+
+func loadFilePositions(fpath string) (*filePositions, error) {
+	p := newFilePositions(fpath)
+	cnt, err := ioutil.ReadFile(fpath)
+	if os.IsNotExist(err) {
+		return p, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "read file `%s`", fpath)
+	}
+
+	for _, line := range bytes.Split(cnt, []byte("\n")) {
+		items := bytes.Split(line, []byte("\t"))
+		if len(items) != 3 {
+			continue
+		}
+
+		offset, err := strconv.ParseInt(string(items[1]), 16, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse offset `%s`", items[1])
+		}
+		ino, err := strconv.ParseUint(string(items[2]), 16, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse inode `%s`", items[2])
+		}
+		p.positions[string(items[0])] = &filePosition{ino: ino, offset: offset}
+	}
+
+	return p, nil
+}
+
+// Get load position of path
+func (p *filePositions) Get(path string) (ino uint64, offset int64, ok bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	pos, ok := p.positions[path]
+	if !ok {
+		return 0, 0, false
+	}
+
+	return pos.ino, pos.offset, true
+}
+
+// Set update position of path
+func (p *filePositions) Set(path string, ino uint64, offset int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.positions[path] = &filePosition{ino: ino, offset: offset}
+	p.isChanged = true
+}
+
+// Delete remove position of path
+func (p *filePositions) Delete(path string) {
+	p.Lock()
+	defer p.Unlock()
+
+	delete(p.positions, path)
+	p.isChanged = true
+}
+
+// Flush write positions into file if changed,
+// positions are kept changed if failed, so will be flushed again next time
+func (p *filePositions) Flush() (err error) {
+	p.Lock()
+	if !p.isChanged {
+		p.Unlock()
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	for path, pos := range p.positions {
+		fmt.Fprintf(buf, "%s\t%016x\t%016x\n", path, pos.offset, pos.ino)
+	}
+	// clear before writing, so positions changed during writing are not lost
+	p.isChanged = false
+	p.Unlock()
+
+	defer func() {
+		if err != nil {
+			p.Lock()
+			p.isChanged = true
+			p.Unlock()
+		}
+	}()
+
+	if err = os.MkdirAll(filepath.Dir(p.fpath), os.ModePerm); err != nil {
+		return errors.Wrap(err, "create directory for pos_file")
+	}
+
+	// write to tmp file then rename, avoid broken pos_file
+	tmpFpath := p.fpath + ".tmp"
+	if err = ioutil.WriteFile(tmpFpath, buf.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "write file `%s`", tmpFpath)
+	}
+
+	return os.Rename(tmpFpath, p.fpath)
+}
@@ -0,0 +1,180 @@
+package recvs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func appendFile(t *testing.T, fpath, cnt string) {
+	f, err := os.OpenFile(fpath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(cnt); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+}
+
+func loadMsgLogs(t *testing.T, outChan chan *library.FluentMsg, n int) (logs []string) {
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-outChan:
+			logs = append(logs, string(msg.Message["log"].([]byte)))
+		case <-time.After(3 * time.Second):
+			t.Fatalf("can not load msg, got %v", logs)
+		}
+	}
+
+	return logs
+}
+
+func TestFileRecv(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir, err := ioutil.TempDir("", "gofluentd-file-recv")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		fpath       = filepath.Join(dir, "app.log")
+		posFpath    = filepath.Join(dir, "data", "file.pos")
+		syncOutChan = make(chan *library.FluentMsg, 1000)
+	)
+	appendFile(t, fpath, "line 1\nline 2\n")
+
+	recv := NewFileRecv(&FileRecvCfg{
+		Name:            "file-test",
+		Paths:           []string{filepath.Join(dir, "*.log")},
+		PosFilePath:     posFpath,
+		Tag:             "${app}.sit",
+		PathRegexp:      regexp.MustCompile(`/(?P<app>[^/]+)\.log$`),
+		PathKey:         "path",
+		RefreshInterval: 50 * time.Millisecond,
+		PollInterval:    50 * time.Millisecond,
+		IsReadFromHead:  true,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(syncOutChan)
+	go recv.Run(ctx)
+
+	logs := loadMsgLogs(t, syncOutChan, 2)
+	if logs[0] != "line 1" || logs[1] != "line 2" {
+		t.Fatalf("got %v", logs)
+	}
+
+	// partial line should wait for `\n`
+	appendFile(t, fpath, "line ")
+	time.Sleep(200 * time.Millisecond)
+	appendFile(t, fpath, "3\n")
+	msg := <-syncOutChan
+	if string(msg.Message["log"].([]byte)) != "line 3" {
+		t.Fatalf("got %v", string(msg.Message["log"].([]byte)))
+	}
+	if msg.Tag != "app.sit" || msg.Message["tag"] != "app.sit" {
+		t.Fatalf("got tag %v", msg.Tag)
+	}
+	if msg.Message["path"] != fpath {
+		t.Fatalf("got path %v", msg.Message["path"])
+	}
+
+	// rotate by rename
+	appendFile(t, fpath, "line 4\n")
+	if err = os.Rename(fpath, fpath+".1"); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	appendFile(t, fpath, "line 5\n")
+	logs = loadMsgLogs(t, syncOutChan, 2)
+	if logs[0] != "line 4" || logs[1] != "line 5" {
+		t.Fatalf("got %v", logs)
+	}
+
+	// copytruncate
+	if err = os.Truncate(fpath, 0); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	appendFile(t, fpath, "line 6\n")
+	logs = loadMsgLogs(t, syncOutChan, 1)
+	if logs[0] != "line 6" {
+		t.Fatalf("got %v", logs)
+	}
+
+	// positions
+	time.Sleep(1500 * time.Millisecond)
+	pos, err := loadFilePositions(posFpath)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if _, offset, ok := pos.Get(fpath); !ok || offset != int64(len("line 6\n")) {
+		t.Fatalf("got offset %v", offset)
+	}
+}
+
+func TestMultilineParser(t *testing.T) {
+	var logs []string
+	p := newMultilineParser(regexp.MustCompile(`^\d{4}-`), 100, time.Minute, func(l *fileLine) {
+		logs = append(logs, string(l.log))
+	})
+
+	for i, line := range []string{
+		"orphan",
+		"2020-01-01 a",
+		"  at b",
+		"2020-01-02 c",
+	} {
+		p.Parse([]byte(line), int64(i), int64(i+1))
+	}
+	if len(logs) != 2 || logs[0] != "orphan" || logs[1] != "2020-01-01 a\n  at b" {
+		t.Fatalf("got %v", logs)
+	}
+
+	p.Flush(true)
+	if len(logs) != 3 || logs[2] != "2020-01-02 c" {
+		t.Fatalf("got %v", logs)
+	}
+}
+
+func TestFilePositionsFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofluentd-file-pos")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// parent of pos_file is a regular file, so flush will fail
+	appendFile(t, filepath.Join(dir, "blocked"), "")
+	p := newFilePositions(filepath.Join(dir, "blocked", "test.pos"))
+	p.Set("/var/log/a.log", 1, 10)
+	if err = p.Flush(); err == nil {
+		t.Fatal("should got error")
+	}
+	if !p.isChanged {
+		t.Fatal("positions should be kept changed after failed flush")
+	}
+
+	p.fpath = filepath.Join(dir, "test.pos")
+	if err = p.Flush(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if p.isChanged {
+		t.Fatal("positions should not be changed after flushed")
+	}
+	p2, err := loadFilePositions(p.fpath)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if ino, offset, ok := p2.Get("/var/log/a.log"); !ok || ino != 1 || offset != 10 {
+		t.Fatalf("got %v, %v, %v", ino, offset, ok)
+	}
+}
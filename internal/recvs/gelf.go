@@ -0,0 +1,428 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultGELFAddr           = "0.0.0.0:12201"
+	defaultGELFChunkTimeout   = 5 * time.Second
+	defaultGELFMaxMessageSize = 10 * 1024 * 1024
+	gelfMaxChunks             = 128
+	gelfChunkHeadSize         = 12
+	gelfUDPBufSize            = 65536
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// GELFRecvCfg configuration of GELFRecv
+type GELFRecvCfg struct {
+	Name,
+	// Addr: listening address, like `0.0.0.0:12201`
+	Addr,
+	// Protocol: `udp` or `tcp`
+	Protocol,
+	// Tag: template of `msg.Tag`, `${<field>}` will be replaced by field in message,
+	// additional fields are without prefix `_`, like `${app}` for `_app`
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = short_message`
+	MsgKey string
+	MaxMessageSize int
+	// ChunkTimeout: discard incomplete chunked message after this duration
+	ChunkTimeout time.Duration
+}
+
+// GELFRecv recv GELF messages by UDP or TCP
+type GELFRecv struct {
+	*BaseRecv
+	*GELFRecvCfg
+	logger  *utils.LoggerType
+	chunker *gelfChunker
+}
+
+// NewGELFRecv create new GELFRecv
+func NewGELFRecv(cfg *GELFRecvCfg) (r *GELFRecv) {
+	r = &GELFRecv{
+		BaseRecv:    &BaseRecv{},
+		GELFRecvCfg: cfg,
+		logger:      log.Logger.Named(cfg.Name),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("gelf recv invalid", zap.Error(err))
+	}
+	r.chunker = newGELFChunker(r.ChunkTimeout, r.MaxMessageSize)
+
+	r.logger.Info("create gelf recv",
+		zap.String("addr", r.Addr),
+		zap.String("protocol", r.Protocol),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.Int("max_message_byte", r.MaxMessageSize),
+		zap.Duration("chunk_timeout_sec", r.ChunkTimeout),
+	)
+	return r
+}
+
+func (r *GELFRecv) valid() error {
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	if r.Addr == "" {
+		r.Addr = defaultGELFAddr
+		r.logger.Info("reset addr", zap.String("addr", r.Addr))
+	}
+
+	switch r.Protocol {
+	case "":
+		r.Protocol = "udp"
+		r.logger.Info("reset protocol", zap.String("protocol", r.Protocol))
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("unknown protocol `%v`", r.Protocol)
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.MaxMessageSize <= 0 {
+		r.MaxMessageSize = defaultGELFMaxMessageSize
+		r.logger.Info("reset max_message_byte", zap.Int("max_message_byte", r.MaxMessageSize))
+	}
+
+	if r.ChunkTimeout <= 0 {
+		r.ChunkTimeout = defaultGELFChunkTimeout
+		r.logger.Info("reset chunk_timeout_sec", zap.Duration("chunk_timeout_sec", r.ChunkTimeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *GELFRecv) GetName() string {
+	return r.Name
+}
+
+// Run starting to listen
+func (r *GELFRecv) Run(ctx context.Context) {
+	r.logger.Info("run GELFRecv")
+	defer r.logger.Info("gelf recv exit")
+
+	switch r.Protocol {
+	case "udp":
+		r.runUDP(ctx)
+	case "tcp":
+		r.runTCP(ctx)
+	}
+}
+
+func (r *GELFRecv) runUDP(ctx context.Context) {
+	conn, err := net.ListenPacket("udp", r.Addr)
+	if err != nil {
+		r.logger.Panic("try to bind addr got error", zap.Error(err), zap.String("addr", r.Addr))
+	}
+	r.logger.Info("listening on udp...", zap.String("addr", r.Addr))
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go r.chunker.runPurger(ctx)
+
+	var (
+		buf     = make([]byte, gelfUDPBufSize)
+		n       int
+		payload []byte
+	)
+	for {
+		if n, _, err = conn.ReadFrom(buf); err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			r.logger.Error("read udp", zap.Error(err))
+			continue
+		}
+
+		if payload, err = r.chunker.Feed(buf[:n]); err != nil {
+			r.logger.Warn("discard invalid chunk", zap.Error(err))
+			continue
+		} else if payload == nil { // wait for other chunks
+			continue
+		}
+
+		r.process(payload)
+	}
+}
+
+func (r *GELFRecv) runTCP(ctx context.Context) {
+	ln, err := net.Listen("tcp", r.Addr)
+	if err != nil {
+		r.logger.Panic("try to bind addr got error", zap.Error(err), zap.String("addr", r.Addr))
+	}
+	r.logger.Info("listening on tcp...", zap.String("addr", r.Addr))
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			r.logger.Error("try to accept connection got error", zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		r.logger.Info("accept new connection", zap.String("remote", conn.RemoteAddr().String()))
+		go r.handleTCPConn(conn)
+	}
+}
+
+// handleTCPConn read null-delimited messages
+func (r *GELFRecv) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+	logger := r.logger.With(zap.String("remote", conn.RemoteAddr().String()))
+	defer logger.Info("close connection")
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), r.MaxMessageSize)
+	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) != 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		if payload := bytes.TrimSpace(scanner.Bytes()); len(payload) != 0 {
+			r.process(payload)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Warn("read connection", zap.Error(err))
+	}
+}
+
+// process decompress & parse payload, then put into downstream
+func (r *GELFRecv) process(payload []byte) {
+	payload, err := decompressGELF(payload, r.MaxMessageSize)
+	if err != nil {
+		r.logger.Warn("decompress gelf message", zap.Error(err))
+		return
+	}
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	if msg.Message, err = parseGELF(payload, r.MsgKey); err != nil {
+		r.logger.Warn("parse gelf message", zap.Error(err), zap.ByteString("payload", payload))
+		r.msgPool.Put(msg)
+		return
+	}
+	msg.ID = r.counter.Count()
+	msg.Tag = library.TemplateWithNestedFields(r.Tag, msg.Message)
+	msg.Message[r.TagKey] = msg.Tag
+
+	r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.syncOutChan <- msg // blockable
+}
+
+// decompressGELF detect gzip or zlib by magic bytes, return payload directly if not compressed
+func decompressGELF(payload []byte, maxSize int) ([]byte, error) {
+	var (
+		reader io.ReadCloser
+		err    error
+	)
+	switch {
+	case len(payload) > 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) > 2 && payload[0] == 0x78:
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "create decompressor")
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress")
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("decompressed message size exceeds %d", maxSize)
+	}
+
+	return data, nil
+}
+
+// parseGELF parse GELF JSON into message,
+// `short_message` is moved to `msgKey`, prefix `_` of additional fields is removed.
+func parseGELF(payload []byte, msgKey string) (map[string]interface{}, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, errors.Wrap(err, "unmarshal gelf")
+	}
+
+	shortMsg, ok := raw["short_message"].(string)
+	if !ok {
+		return nil, fmt.Errorf("short_message is missing")
+	}
+	delete(raw, "short_message")
+
+	m := make(map[string]interface{}, len(raw)+1)
+	for k, v := range raw {
+		if strings.HasPrefix(k, "_") && len(k) > 1 {
+			k = k[1:]
+		}
+		m[k] = v
+	}
+	m[msgKey] = []byte(shortMsg)
+
+	return m, nil
+}
+
+// gelfChunkedMsg chunks of one message that are waiting for reassembly
+type gelfChunkedMsg struct {
+	chunks    [][]byte
+	nReceived int
+	size      int
+	createdAt time.Time
+}
+
+// gelfChunker reassemble chunked GELF messages over UDP
+type gelfChunker struct {
+	sync.Mutex
+	timeout time.Duration
+	maxSize int
+	msgs    map[string]*gelfChunkedMsg // map[msgID]chunks
+}
+
+func newGELFChunker(timeout time.Duration, maxSize int) *gelfChunker {
+	return &gelfChunker{
+		timeout: timeout,
+		maxSize: maxSize,
+		msgs:    map[string]*gelfChunkedMsg{},
+	}
+}
+
+// Feed consume one UDP packet, return the whole payload if completed,
+// return nil if waiting for other chunks.
+func (c *gelfChunker) Feed(packet []byte) ([]byte, error) {
+	if !bytes.HasPrefix(packet, gelfChunkMagic) {
+		return packet, nil
+	}
+	if len(packet) < gelfChunkHeadSize {
+		return nil, fmt.Errorf("chunk too short")
+	}
+
+	var (
+		id    = string(packet[2:10])
+		seq   = int(packet[10])
+		count = int(packet[11])
+		data  = packet[gelfChunkHeadSize:]
+	)
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		return nil, fmt.Errorf("invalid chunk sequence %d/%d", seq, count)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	m, ok := c.msgs[id]
+	if !ok {
+		m = &gelfChunkedMsg{
+			chunks:    make([][]byte, count),
+			createdAt: utils.Clock.GetUTCNow(),
+		}
+		c.msgs[id] = m
+	}
+	if len(m.chunks) != count {
+		delete(c.msgs, id)
+		return nil, fmt.Errorf("chunk count mismatch")
+	}
+	if m.chunks[seq] != nil { // duplicated
+		return nil, nil
+	}
+
+	m.size += len(data)
+	if m.size > c.maxSize {
+		delete(c.msgs, id)
+		return nil, fmt.Errorf("chunked message size exceeds %d", c.maxSize)
+	}
+	// packet buffer will be reused
+	m.chunks[seq] = append([]byte{}, data...)
+	m.nReceived++
+	if m.nReceived < count {
+		return nil, nil
+	}
+
+	delete(c.msgs, id)
+	return bytes.Join(m.chunks, nil), nil
+}
+
+// Purge discard expired incomplete messages, return the number of discarded
+func (c *gelfChunker) Purge(now time.Time) (n int) {
+	c.Lock()
+	defer c.Unlock()
+	for id, m := range c.msgs {
+		if now.Sub(m.createdAt) > c.timeout {
+			delete(c.msgs, id)
+			n++
+		}
+	}
+
+	return n
+}
+
+func (c *gelfChunker) runPurger(ctx context.Context) {
+	ticker := time.NewTicker(c.timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if n := c.Purge(utils.Clock.GetUTCNow()); n != 0 {
+			log.Logger.Warn("discard incomplete chunked gelf messages", zap.Int("n", n))
+		}
+	}
+}
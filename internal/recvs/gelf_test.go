@@ -0,0 +1,104 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"net"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func TestGELFChunker(t *testing.T) {
+	c := newGELFChunker(time.Second, 100)
+	chunk := func(id string, seq, count byte, data string) []byte {
+		return append(append(append([]byte{0x1e, 0x0f}, id...), seq, count), data...)
+	}
+
+	if payload, err := c.Feed([]byte(`{"a":1}`)); err != nil || string(payload) != `{"a":1}` {
+		t.Fatalf("got %s, %+v", payload, err)
+	}
+
+	// out of order & duplicated
+	for _, p := range [][]byte{
+		chunk("aaaaaaaa", 2, 3, "c"),
+		chunk("aaaaaaaa", 0, 3, "a"),
+		chunk("aaaaaaaa", 0, 3, "a"),
+	} {
+		if payload, err := c.Feed(p); err != nil || payload != nil {
+			t.Fatalf("got %s, %+v", payload, err)
+		}
+	}
+	if payload, err := c.Feed(chunk("aaaaaaaa", 1, 3, "b")); err != nil || string(payload) != "abc" {
+		t.Fatalf("got %s, %+v", payload, err)
+	}
+
+	// invalid
+	if _, err := c.Feed(chunk("bbbbbbbb", 3, 3, "x")); err == nil {
+		t.Fatal("should be invalid")
+	}
+	if _, err := c.Feed(chunk("bbbbbbbb", 0, 129, "x")); err == nil {
+		t.Fatal("should be invalid")
+	}
+
+	// timeout
+	if _, err := c.Feed(chunk("cccccccc", 0, 2, "x")); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if n := c.Purge(time.Now().Add(2 * time.Second)); n != 1 || len(c.msgs) != 0 {
+		t.Fatalf("got %d", n)
+	}
+}
+
+func TestDecompressGELF(t *testing.T) {
+	raw := []byte(`{"short_message":"hello"}`)
+	gzBuf := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzBuf)
+	gz.Write(raw)
+	gz.Close()
+	zBuf := &bytes.Buffer{}
+	zw := zlib.NewWriter(zBuf)
+	zw.Write(raw)
+	zw.Close()
+
+	for _, payload := range [][]byte{raw, gzBuf.Bytes(), zBuf.Bytes()} {
+		if data, err := decompressGELF(payload, 100); err != nil || !bytes.Equal(data, raw) {
+			t.Fatalf("got %s, %+v", data, err)
+		}
+	}
+	if _, err := decompressGELF(gzBuf.Bytes(), 10); err == nil {
+		t.Fatal("size should be limited")
+	}
+}
+
+func TestGELFRecvTCP(t *testing.T) {
+	syncOutChan := make(chan *library.FluentMsg, 1000)
+	recv := NewGELFRecv(&GELFRecvCfg{
+		Name:     "test-gelf",
+		Protocol: "tcp",
+		Tag:      "${app}.sit",
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(syncOutChan)
+
+	client, server := net.Pipe()
+	go recv.handleTCPConn(server)
+	go func() {
+		client.Write([]byte(`{"version":"1.1","host":"h","short_message":"a","full_message":"a\nb","level":3,"_app":"java"}` + "\x00" +
+			`{"version":"1.1","host":"h"}` + "\x00" +
+			`{"short_message":"b"}` + "\x00"))
+		client.Close()
+	}()
+
+	msg := <-syncOutChan
+	if msg.Tag != "java.sit" || string(msg.Message["log"].([]byte)) != "a" ||
+		msg.Message["full_message"] != "a\nb" || msg.Message["app"] != "java" || msg.Message["level"] != 3.0 {
+		t.Fatalf("got %+v", msg)
+	}
+	if msg = <-syncOutChan; string(msg.Message["log"].([]byte)) != "b" || msg.Tag != ".sit" {
+		t.Fatalf("got %+v", msg)
+	}
+}
@@ -18,6 +18,16 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	defaultHTTPMaxAllowedDelay = 5 * time.Minute
+	defaultHTTPMaxAllowedAhead = 1 * time.Minute
+
+	// HTTPSigSchemeMD5 legacy signature `md5(ts + salt)`
+	HTTPSigSchemeMD5 = "md5"
+	// HTTPSigSchemeHMACSHA256 HMAC-SHA256 signature of timestamp, nonce & raw body
+	HTTPSigSchemeHMACSHA256 = "hmac-sha256"
+)
+
 // HTTPRecvCfg is the configuration for HTTPRecv
 type HTTPRecvCfg struct {
 	HTTPSrv     *gin.Engine
@@ -36,11 +46,21 @@ type HTTPRecvCfg struct {
 	TimeKey, TimeFormat string
 	TSRegexp            *regexp.Regexp
 
+	// SigScheme: `md5` or `hmac-sha256`,
+	// default to `hmac-sha256` if HMACKeys is not empty, otherwise `md5`
+	SigScheme string
+
 	// SigKey: load signature from `msg.Message[SigKey].([]byte)`
-	// SigSalt: calculate signature by `md5(ts + SigSalt)`
+	// SigSalt: calculate signature by `md5(ts + SigSalt)`, legacy
 	SigKey  string
 	SigSalt []byte
 
+	// HMACKeys: verify HMAC-SHA256 signature of raw body in headers, map[keyID]key,
+	// see library.HTTPHMACValidator for details
+	HMACKeys map[string][]byte
+
+	// MaxAllowedDelaySec & MaxAllowedAheadSec: allowed window of timestamp,
+	// default to 5min & 1min
 	MaxAllowedDelaySec, MaxAllowedAheadSec time.Duration
 }
 
@@ -48,10 +68,23 @@ type HTTPRecvCfg struct {
 type HTTPRecv struct {
 	*BaseRecv
 	*HTTPRecvCfg
+	validator *library.HTTPHMACValidator
 }
 
 // NewHTTPRecv return new HTTPRecv
 func NewHTTPRecv(cfg *HTTPRecvCfg) *HTTPRecv {
+	if cfg.Path == "" {
+		log.Logger.Panic("path should not be emqty")
+	}
+	if cfg.MaxAllowedDelaySec <= 0 {
+		cfg.MaxAllowedDelaySec = defaultHTTPMaxAllowedDelay
+		log.Logger.Info("reset max_allowed_delay_sec", zap.Duration("max_allowed_delay_sec", cfg.MaxAllowedDelaySec))
+	}
+	if cfg.MaxAllowedAheadSec <= 0 {
+		cfg.MaxAllowedAheadSec = defaultHTTPMaxAllowedAhead
+		log.Logger.Info("reset max_allowed_ahead_sec", zap.Duration("max_allowed_ahead_sec", cfg.MaxAllowedAheadSec))
+	}
+
 	log.Logger.Info("create HTTPRecv",
 		zap.String("tag", cfg.Tag),
 		zap.String("path", cfg.Path),
@@ -59,14 +92,29 @@ func NewHTTPRecv(cfg *HTTPRecvCfg) *HTTPRecv {
 		zap.Duration("MaxAllowedDelaySec", cfg.MaxAllowedDelaySec),
 	)
 
-	if cfg.Path == "" {
-		log.Logger.Panic("path should not be emqty")
-	}
-
 	r := &HTTPRecv{
 		BaseRecv:    &BaseRecv{},
 		HTTPRecvCfg: cfg,
 	}
+
+	if r.SigScheme == "" {
+		r.SigScheme = HTTPSigSchemeMD5
+		if len(r.HMACKeys) != 0 {
+			r.SigScheme = HTTPSigSchemeHMACSHA256
+		}
+		log.Logger.Info("reset signature_scheme", zap.String("signature_scheme", r.SigScheme))
+	}
+	switch r.SigScheme {
+	case HTTPSigSchemeMD5:
+		log.Logger.Warn("md5 signature is legacy, body is not protected and signature can be replayed, use hmac-sha256 instead")
+	case HTTPSigSchemeHMACSHA256:
+		var err error
+		if r.validator, err = library.NewHTTPHMACValidator(r.HMACKeys, r.MaxAllowedDelaySec, r.MaxAllowedAheadSec); err != nil {
+			log.Logger.Panic("create hmac validator", zap.Error(err))
+		}
+	default:
+		log.Logger.Panic("unknown signature_scheme", zap.String("signature_scheme", r.SigScheme))
+	}
 	r.HTTPSrv.POST(r.Path, r.HTTPLogHandler)
 	r.HTTPSrv.GET(r.Path, func(ctx *gin.Context) {
 		ctx.String(200, "HTTPrecv")
@@ -84,6 +132,8 @@ func (r *HTTPRecv) Run(ctx context.Context) {
 	log.Logger.Info("run HTTPRecv")
 }
 
+// validate check timestamp & legacy md5 signature in msg,
+// signature is skipped if request already verified by hmac validator
 func (r *HTTPRecv) validate(ctx *gin.Context, msg *library.FluentMsg) bool {
 	switch msg.Message[r.TimeKey].(type) {
 	case nil:
@@ -105,6 +155,11 @@ func (r *HTTPRecv) validate(ctx *gin.Context, msg *library.FluentMsg) bool {
 		return false
 	}
 
+	if r.validator != nil {
+		// signature & expiration already checked by hmac validator
+		return true
+	}
+
 	// signature
 	switch msg.Message[r.SigKey].(type) {
 	case nil:
@@ -189,6 +244,15 @@ func (r *HTTPRecv) HTTPLogHandler(ctx *gin.Context) {
 		return
 	}
 
+	if r.validator != nil {
+		if err = r.validator.Validate(ctx.Request.Header, msgData); err != nil {
+			log.Logger.Warn("validate signature", zap.Error(err))
+			r.msgPool.Put(msg)
+			r.BadRequest(ctx, "signature error")
+			return
+		}
+	}
+
 	msg.Tag = r.Tag + "." + r.Env // forward-xxx.sit
 	msg.Message = map[string]interface{}{}
 	if err = json.Unmarshal(msgData, &msg.Message); err != nil {
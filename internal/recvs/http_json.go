@@ -0,0 +1,361 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const defaultHTTPJSONMaxBodySize = 10 * 1024 * 1024
+
+var defaultHTTPJSONTagRegexp = regexp.MustCompile(`^[\w\-.]+$`)
+
+// HTTPJSONRecvCfg is the configuration for HTTPJSONRecv
+type HTTPJSONRecvCfg struct {
+	HTTPSrv *gin.Engine
+	Name,
+	// Path: url endpoint, tag can be loaded from param `:tag`, like `/api/v1/logs/:tag`
+	Path,
+	// TagHeader: load tag from this header if `:tag` not in path
+	TagHeader,
+	// Tag: template of `msg.Tag`, `${tag}` will be replaced by tag in request
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: put element that is not JSON object into `msg.Message[MsgKey]`
+	MsgKey string
+	// TagRegexp: only accept tag in request that matched
+	TagRegexp   *regexp.Regexp
+	MaxBodySize int64
+
+	// BearerTokens: accept request with header `Authorization: Bearer <token>`
+	BearerTokens []string
+	// HMACKeys: accept request signed by any key, map[keyID]key,
+	// see library.HTTPHMACValidator for details
+	HMACKeys map[string][]byte
+	MaxAllowedDelay,
+	MaxAllowedAhead time.Duration
+
+	// AllowOrigins: CORS origins allowed for browsers, `*` means any
+	AllowOrigins []string
+}
+
+// HTTPJSONRecv recv JSON array or NDJSON logs by HTTP
+type HTTPJSONRecv struct {
+	*BaseRecv
+	*HTTPJSONRecvCfg
+	logger    *utils.LoggerType
+	validator *library.HTTPHMACValidator
+}
+
+// NewHTTPJSONRecv create new HTTPJSONRecv
+func NewHTTPJSONRecv(cfg *HTTPJSONRecvCfg) (r *HTTPJSONRecv) {
+	r = &HTTPJSONRecv{
+		BaseRecv:        &BaseRecv{},
+		HTTPJSONRecvCfg: cfg,
+		logger:          log.Logger.Named(cfg.Name),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("http-json recv invalid", zap.Error(err))
+	}
+
+	r.HTTPSrv.POST(r.Path, r.HTTPLogHandler)
+	if len(r.AllowOrigins) != 0 {
+		r.HTTPSrv.OPTIONS(r.Path, r.HTTPPreflightHandler)
+	}
+
+	r.logger.Info("create http-json recv",
+		zap.String("path", r.Path),
+		zap.String("tag_header", r.TagHeader),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.String("tag_regexp", r.TagRegexp.String()),
+		zap.Int64("max_body_byte", r.MaxBodySize),
+		zap.Int("bearer_tokens", len(r.BearerTokens)),
+		zap.Int("hmac_keys", len(r.HMACKeys)),
+		zap.Strings("allow_origins", r.AllowOrigins),
+	)
+	return r
+}
+
+func (r *HTTPJSONRecv) valid() error {
+	if r.Path == "" {
+		return fmt.Errorf("path should not be empty")
+	}
+
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.TagRegexp == nil {
+		r.TagRegexp = defaultHTTPJSONTagRegexp
+		r.logger.Info("reset tag_regexp", zap.String("tag_regexp", r.TagRegexp.String()))
+	}
+
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultHTTPJSONMaxBodySize
+		r.logger.Info("reset max_body_byte", zap.Int64("max_body_byte", r.MaxBodySize))
+	}
+
+	if len(r.HMACKeys) != 0 {
+		if r.MaxAllowedDelay <= 0 {
+			r.MaxAllowedDelay = defaultHTTPMaxAllowedDelay
+			r.logger.Info("reset max_allowed_delay_sec", zap.Duration("max_allowed_delay_sec", r.MaxAllowedDelay))
+		}
+		if r.MaxAllowedAhead <= 0 {
+			r.MaxAllowedAhead = defaultHTTPMaxAllowedAhead
+			r.logger.Info("reset max_allowed_ahead_sec", zap.Duration("max_allowed_ahead_sec", r.MaxAllowedAhead))
+		}
+
+		var err error
+		if r.validator, err = library.NewHTTPHMACValidator(r.HMACKeys, r.MaxAllowedDelay, r.MaxAllowedAhead); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetName get current HTTPJSONRecv instance's name
+func (r *HTTPJSONRecv) GetName() string {
+	return r.Name
+}
+
+// Run useless, just capatable for RecvItf
+func (r *HTTPJSONRecv) Run(ctx context.Context) {
+	r.logger.Info("run HTTPJSONRecv")
+}
+
+// loadTag load tag from path param or header
+func (r *HTTPJSONRecv) loadTag(ctx *gin.Context) (string, error) {
+	tag := ctx.Param("tag")
+	if tag == "" && r.TagHeader != "" {
+		tag = ctx.GetHeader(r.TagHeader)
+	}
+	if tag == "" {
+		return "", fmt.Errorf("tag not found in request")
+	}
+	if !r.TagRegexp.MatchString(tag) {
+		return "", fmt.Errorf("tag `%v` not allowed", tag)
+	}
+
+	return library.TemplateWithMap(r.Tag, map[string]interface{}{"tag": tag}), nil
+}
+
+// isAuthEnabled whether need to authenticate request
+func (r *HTTPJSONRecv) isAuthEnabled() bool {
+	return len(r.BearerTokens) != 0 || r.validator != nil
+}
+
+// authenticate check bearer token or HMAC signature
+func (r *HTTPJSONRecv) authenticate(ctx *gin.Context, body []byte) error {
+	if auth := ctx.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, t := range r.BearerTokens {
+			if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid bearer token")
+	}
+
+	if r.validator == nil {
+		return fmt.Errorf("authorization required")
+	}
+
+	return r.validator.Validate(ctx.Request.Header, body)
+}
+
+// readBody read body, decompress if gzip
+func (r *HTTPJSONRecv) readBody(ctx *gin.Context) (raw, body []byte, err error) {
+	if ctx.Request.ContentLength > r.MaxBodySize {
+		return nil, nil, fmt.Errorf("content size must less than %d bytes", r.MaxBodySize)
+	}
+	if raw, err = ioutil.ReadAll(io.LimitReader(ctx.Request.Body, r.MaxBodySize+1)); err != nil {
+		return nil, nil, errors.Wrap(err, "read body")
+	}
+	if int64(len(raw)) > r.MaxBodySize {
+		return nil, nil, fmt.Errorf("content size must less than %d bytes", r.MaxBodySize)
+	}
+
+	if !strings.Contains(ctx.GetHeader("Content-Encoding"), "gzip") {
+		return raw, raw, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read gzip body")
+	}
+	defer gz.Close()
+	// limit decompressed size too, avoid gzip bomb
+	if body, err = ioutil.ReadAll(io.LimitReader(gz, r.MaxBodySize+1)); err != nil {
+		return nil, nil, errors.Wrap(err, "decompress gzip body")
+	}
+	if int64(len(body)) > r.MaxBodySize {
+		return nil, nil, fmt.Errorf("decompressed content size must less than %d bytes", r.MaxBodySize)
+	}
+
+	return raw, body, nil
+}
+
+// parseBody parse JSON array or NDJSON into logs,
+// return the number of lines that can not be parsed.
+func (r *HTTPJSONRecv) parseBody(body []byte) (logs []interface{}, rejected int, err error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, 0, nil
+	}
+
+	if body[0] == '[' {
+		if err = json.Unmarshal(body, &logs); err != nil {
+			return nil, 0, errors.Wrap(err, "unmarshal JSON array")
+		}
+		return logs, 0, nil
+	}
+
+	// NDJSON, single JSON object is also a valid NDJSON
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var v interface{}
+		if err = json.Unmarshal(line, &v); err != nil {
+			r.logger.Debug("unmarshal ndjson line", zap.Error(err), zap.ByteString("line", line))
+			rejected++
+			continue
+		}
+		logs = append(logs, v)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "scan NDJSON")
+	}
+
+	return logs, rejected, nil
+}
+
+// setCORS set CORS headers if origin is allowed
+func (r *HTTPJSONRecv) setCORS(ctx *gin.Context) {
+	origin := ctx.GetHeader("Origin")
+	if origin == "" {
+		return
+	}
+
+	for _, o := range r.AllowOrigins {
+		if o == "*" || o == origin {
+			ctx.Header("Access-Control-Allow-Origin", origin)
+			ctx.Header("Vary", "Origin")
+			return
+		}
+	}
+}
+
+// HTTPPreflightHandler response CORS preflight request
+func (r *HTTPJSONRecv) HTTPPreflightHandler(ctx *gin.Context) {
+	r.setCORS(ctx)
+	ctx.Header("Access-Control-Allow-Methods", "POST, OPTIONS")
+	ctx.Header("Access-Control-Allow-Headers", strings.Join([]string{
+		"Authorization",
+		"Content-Type",
+		"Content-Encoding",
+		library.HTTPSignTimestampHeader,
+		library.HTTPSignNonceHeader,
+		library.HTTPSignKeyIDHeader,
+		library.HTTPSignSignatureHeader,
+		r.TagHeader,
+	}, ", "))
+	ctx.Status(http.StatusNoContent)
+}
+
+// badRequest set bad http response
+func (r *HTTPJSONRecv) badRequest(ctx *gin.Context, code int, err error) {
+	r.logger.Warn("bad request", zap.Error(err), zap.String("remote", ctx.ClientIP()))
+	ctx.AbortWithStatusJSON(code, map[string]interface{}{"error": err.Error()})
+}
+
+// HTTPLogHandler process logs received by HTTP,
+// response number of accepted & rejected logs.
+func (r *HTTPJSONRecv) HTTPLogHandler(ctx *gin.Context) {
+	r.setCORS(ctx)
+	tag, err := r.loadTag(ctx)
+	if err != nil {
+		r.badRequest(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	raw, body, err := r.readBody(ctx)
+	if err != nil {
+		r.badRequest(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if r.isAuthEnabled() {
+		if err = r.authenticate(ctx, raw); err != nil {
+			r.badRequest(ctx, http.StatusUnauthorized, err)
+			return
+		}
+	}
+
+	logs, rejected, err := r.parseBody(body)
+	if err != nil {
+		r.badRequest(ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	accepted := 0
+	for _, l := range logs {
+		msg := r.msgPool.Get().(*library.FluentMsg)
+		switch v := l.(type) {
+		case map[string]interface{}:
+			msg.Message = v
+			library.FlattenMap(msg.Message, "__")
+		case string:
+			msg.Message = map[string]interface{}{r.MsgKey: []byte(v)}
+		default:
+			msg.Message = map[string]interface{}{r.MsgKey: v}
+		}
+		msg.ID = r.counter.Count()
+		msg.Tag = tag
+		msg.Message[r.TagKey] = tag
+
+		r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+		r.syncOutChan <- msg // blockable
+		accepted++
+	}
+
+	ctx.JSON(http.StatusOK, map[string]int{
+		"accepted": accepted,
+		"rejected": rejected,
+	})
+}
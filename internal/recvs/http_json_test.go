@@ -0,0 +1,109 @@
+package recvs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/Laisky/go-utils"
+	"github.com/gin-gonic/gin"
+)
+
+func TestHTTPJSONRecv(t *testing.T) {
+	var (
+		srv         = gin.New()
+		syncOutChan = make(chan *library.FluentMsg, 1000)
+		hmacKey     = []byte("f32jf9j32f")
+		oldHMACKey  = []byte("fj0329jf23")
+	)
+	recv := NewHTTPJSONRecv(&HTTPJSONRecvCfg{
+		Name:         "test-http-json",
+		HTTPSrv:      srv,
+		Path:         "/api/v1/logs/:tag",
+		Tag:          "app.${tag}.sit",
+		BearerTokens: []string{"abc"},
+		HMACKeys:     map[string][]byte{"v2": hmacKey, "v1": oldHMACKey},
+		AllowOrigins: []string{"https://example.com"},
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(syncOutChan)
+
+	post := func(path string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	// no auth
+	if w := post("/api/v1/logs/web", []byte(`{"a":1}`), nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %v", w.Code)
+	}
+
+	// bearer & ndjson
+	w := post("/api/v1/logs/web", []byte("{\"a\":{\"b\":1}}\nnot json\n\"raw\"\n"), map[string]string{
+		"Authorization": "Bearer abc",
+		"Origin":        "https://example.com",
+	})
+	if w.Code != http.StatusOK || w.Body.String() != `{"accepted":2,"rejected":1}` {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Fatalf("got cors %v", w.Header())
+	}
+	msg := <-syncOutChan
+	if msg.Tag != "app.web.sit" || msg.Message["tag"] != "app.web.sit" || msg.Message["a__b"] != 1.0 {
+		t.Fatalf("got %+v", msg)
+	}
+	msg = <-syncOutChan
+	if string(msg.Message["log"].([]byte)) != "raw" {
+		t.Fatalf("got %+v", msg)
+	}
+
+	// hmac & gzip json array
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write([]byte(`[{"a":1},{"a":2}]`)); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	gz.Close()
+	ts := strconv.FormatInt(utils.Clock.GetUTCNow().Unix(), 10)
+	headers := map[string]string{
+		"Content-Encoding":              "gzip",
+		library.HTTPSignTimestampHeader: ts,
+		library.HTTPSignNonceHeader:     "n1",
+		library.HTTPSignSignatureHeader: hex.EncodeToString(library.SignHTTPBody(hmacKey, ts, "n1", buf.Bytes())),
+	}
+	if w = post("/api/v1/logs/web", buf.Bytes(), headers); w.Code != http.StatusOK || w.Body.String() != `{"accepted":2,"rejected":0}` {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-syncOutChan:
+		case <-time.After(time.Second):
+			t.Fatal("msg not received")
+		}
+	}
+
+	// signature mismatch
+	headers[library.HTTPSignSignatureHeader] = hex.EncodeToString([]byte("wrong"))
+	if w = post("/api/v1/logs/web", buf.Bytes(), headers); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %v", w.Code)
+	}
+
+	// invalid tag
+	if w = post("/api/v1/logs/we*b", []byte(`{}`), map[string]string{"Authorization": "Bearer abc"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %v", w.Code)
+	}
+}
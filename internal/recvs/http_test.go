@@ -4,7 +4,11 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -106,6 +110,72 @@ func TestHTTPRecv(t *testing.T) {
 
 }
 
+func TestHTTPRecvHMAC(t *testing.T) {
+	asyncOutChan := make(chan *library.FluentMsg, 1000)
+	srv := gin.New()
+	key := []byte("hmac-key")
+	// max_allowed_delay_sec & max_allowed_ahead_sec use default
+	httprecv := NewHTTPRecv(&HTTPRecvCfg{
+		Name:        "test-http-hmac-srv",
+		HTTPSrv:     srv,
+		Env:         "sit",
+		MsgKey:      "log",
+		TagKey:      "tag",
+		OrigTag:     "wechat",
+		Tag:         "forward-wechat",
+		Path:        "/api/v2/log/wechat/:env",
+		HMACKeys:    map[string][]byte{"v1": key},
+		MaxBodySize: 1000,
+		TSRegexp:    regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}.\d{3}Z$`),
+		TimeKey:     "@timestamp",
+		TimeFormat:  "2006-01-02T15:04:05.000Z",
+	})
+	httprecv.SetCounter(counter)
+	httprecv.SetMsgPool(msgPool)
+	httprecv.SetAsyncOutChan(asyncOutChan)
+
+	post := func(body, nonce string) int {
+		ts := strconv.FormatInt(utils.Clock.GetUTCNow().Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/log/wechat/sit", strings.NewReader(body))
+		req.Header.Set(library.HTTPSignTimestampHeader, ts)
+		req.Header.Set(library.HTTPSignNonceHeader, nonce)
+		req.Header.Set(library.HTTPSignSignatureHeader, hex.EncodeToString(library.SignHTTPBody(key, ts, nonce, []byte(body))))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// body without `sig`
+	ts := utils.Clock.GetUTCNow().Format("2006-01-02T15:04:05.000Z")
+	body := `{"@timestamp": "` + ts + `", "url": "abc"}`
+	if code := post(body, "n1"); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	var msg *library.FluentMsg
+	select {
+	case msg = <-asyncOutChan:
+	default:
+		t.Fatalf("can not load msg")
+	}
+	if string(msg.Message["@timestamp"].([]byte)) != ts ||
+		msg.Message["url"] != "abc" ||
+		msg.Message["tag"] != "wechat.sit" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	// replay
+	if code := post(body, "n1"); code != http.StatusBadRequest {
+		t.Fatalf("got %d", code)
+	}
+	// timestamp in body still be validated
+	if code := post(`{"@timestamp": "yesterday"}`, "n2"); code != http.StatusBadRequest {
+		t.Fatalf("got %d", code)
+	}
+	if len(asyncOutChan) != 0 {
+		t.Fatalf("got %d msgs", len(asyncOutChan))
+	}
+}
+
 func fakeReq() map[string]string {
 	ts := utils.UTCNow().Format("2006-01-02T15:04:05.000Z")
 	hash := md5.Sum(append([]byte(ts), salt...))
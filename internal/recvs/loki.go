@@ -0,0 +1,437 @@
+package recvs
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultLokiPath        = "/loki/api/v1/push"
+	defaultLokiMaxBodySize = 10 * 1024 * 1024
+	lokiTenantHeader       = "X-Scope-OrgID"
+)
+
+// LokiRecvCfg configuration of LokiRecv
+type LokiRecvCfg struct {
+	HTTPSrv *gin.Engine
+	Name,
+	// Path: url endpoint, default is `/loki/api/v1/push`
+	Path,
+	// Tag: template of `msg.Tag`, `${<label>}` will be replaced by stream label
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = line`
+	MsgKey,
+	// TimeKey: set `msg.Message[TimeKey] = <unix nano timestamp>`
+	TimeKey,
+	// TenantKey: set `msg.Message[TenantKey] = <X-Scope-OrgID>` if not empty
+	TenantKey string
+	MaxBodySize int
+}
+
+// LokiRecv recv logs by Loki's push API
+type LokiRecv struct {
+	*BaseRecv
+	*LokiRecvCfg
+	logger *utils.LoggerType
+}
+
+// NewLokiRecv create new LokiRecv
+func NewLokiRecv(cfg *LokiRecvCfg) (r *LokiRecv) {
+	r = &LokiRecv{
+		BaseRecv:    &BaseRecv{},
+		LokiRecvCfg: cfg,
+		logger:      log.Logger.Named(cfg.Name),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("loki recv invalid", zap.Error(err))
+	}
+
+	r.HTTPSrv.POST(r.Path, r.HTTPLogHandler)
+	r.logger.Info("create loki recv",
+		zap.String("path", r.Path),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.String("time_key", r.TimeKey),
+		zap.String("tenant_key", r.TenantKey),
+		zap.Int("max_body_byte", r.MaxBodySize),
+	)
+	return r
+}
+
+func (r *LokiRecv) valid() error {
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	if r.Path == "" {
+		r.Path = defaultLokiPath
+		r.logger.Info("reset path", zap.String("path", r.Path))
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.TimeKey == "" {
+		r.TimeKey = "time_unix_nano"
+		r.logger.Info("reset time_key", zap.String("time_key", r.TimeKey))
+	}
+
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultLokiMaxBodySize
+		r.logger.Info("reset max_body_byte", zap.Int("max_body_byte", r.MaxBodySize))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *LokiRecv) GetName() string {
+	return r.Name
+}
+
+// Run useless, just capatable for RecvItf
+func (r *LokiRecv) Run(ctx context.Context) {
+	r.logger.Info("run LokiRecv")
+}
+
+// lokiEntry is one log line of stream
+type lokiEntry struct {
+	ts       int64 // unix nano
+	line     string
+	metadata map[string]string
+}
+
+// lokiStream is logs with the same labels
+type lokiStream struct {
+	labels  map[string]string
+	entries []*lokiEntry
+}
+
+// HTTPLogHandler process push request, support snappy protobuf & JSON
+func (r *LokiRecv) HTTPLogHandler(ctx *gin.Context) {
+	var reader io.Reader = ctx.Request.Body
+	if strings.Contains(ctx.GetHeader("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(ctx.Request.Body)
+		if err != nil {
+			r.badRequest(ctx, errors.Wrap(err, "read gzip body"))
+			return
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(r.MaxBodySize)+1))
+	if err != nil {
+		r.badRequest(ctx, errors.Wrap(err, "read body"))
+		return
+	}
+	if len(body) > r.MaxBodySize {
+		r.badRequest(ctx, fmt.Errorf("content size must less than %d bytes", r.MaxBodySize))
+		return
+	}
+
+	var streams []*lokiStream
+	if strings.HasPrefix(ctx.ContentType(), "application/json") {
+		streams, err = parseLokiJSON(body)
+	} else {
+		if n, err := snappy.DecodedLen(body); err != nil {
+			r.badRequest(ctx, errors.Wrap(err, "decode snappy"))
+			return
+		} else if n > r.MaxBodySize {
+			r.badRequest(ctx, fmt.Errorf("decoded size must less than %d bytes", r.MaxBodySize))
+			return
+		}
+		if body, err = snappy.Decode(nil, body); err != nil {
+			r.badRequest(ctx, errors.Wrap(err, "decode snappy"))
+			return
+		}
+		streams, err = parseLokiProtobuf(body)
+	}
+	if err != nil {
+		r.badRequest(ctx, err)
+		return
+	}
+
+	tenant := ctx.GetHeader(lokiTenantHeader)
+	for _, stream := range streams {
+		for _, e := range stream.entries {
+			msg := r.msgPool.Get().(*library.FluentMsg)
+			msg.ID = r.counter.Count()
+			msg.Message = make(map[string]interface{}, len(stream.labels)+len(e.metadata)+4)
+			for k, v := range stream.labels {
+				msg.Message[k] = v
+			}
+			for k, v := range e.metadata {
+				msg.Message[k] = v
+			}
+			msg.Message[r.MsgKey] = []byte(e.line)
+			msg.Message[r.TimeKey] = e.ts
+			if r.TenantKey != "" && tenant != "" {
+				msg.Message[r.TenantKey] = tenant
+			}
+			msg.Tag = library.TemplateWithNestedFields(r.Tag, msg.Message)
+			msg.Message[r.TagKey] = msg.Tag
+
+			r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+			r.syncOutChan <- msg // blockable
+		}
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (r *LokiRecv) badRequest(ctx *gin.Context, err error) {
+	r.logger.Warn("bad request", zap.Error(err), zap.String("remote", ctx.ClientIP()))
+	ctx.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{"message": err.Error()})
+}
+
+// parseLokiJSON parse JSON push request:
+//
+//	{"streams": [{"stream": {"<label>": "<value>"}, "values": [["<unix nano>", "<line>", {"<key>": "<metadata>"}]]}]}
+func parseLokiJSON(body []byte) (streams []*lokiStream, err error) {
+	req := &struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"streams"`
+	}{}
+	if err = json.Unmarshal(body, req); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json")
+	}
+
+	for _, s := range req.Streams {
+		stream := &lokiStream{labels: s.Stream}
+		for _, v := range s.Values {
+			if len(v) < 2 {
+				return nil, fmt.Errorf("value should be [<ts>, <line>]")
+			}
+			tsStr, ok := v[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("timestamp should be string")
+			}
+			e := &lokiEntry{}
+			if e.ts, err = strconv.ParseInt(tsStr, 10, 64); err != nil {
+				return nil, errors.Wrapf(err, "parse timestamp `%v`", tsStr)
+			}
+			if e.line, ok = v[1].(string); !ok {
+				return nil, fmt.Errorf("line should be string")
+			}
+			if len(v) > 2 {
+				if meta, ok := v[2].(map[string]interface{}); ok {
+					e.metadata = map[string]string{}
+					for mk, mv := range meta {
+						e.metadata[mk] = fmt.Sprint(mv)
+					}
+				}
+			}
+			stream.entries = append(stream.entries, e)
+		}
+		streams = append(streams, stream)
+	}
+
+	return streams, nil
+}
+
+// parseLokiProtobuf parse protobuf push request:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; uint64 hash = 3; }
+//	message EntryAdapter { Timestamp timestamp = 1; string line = 2; repeated LabelPairAdapter structuredMetadata = 3; }
+//	message LabelPairAdapter { string name = 1; string value = 2; }
+func parseLokiProtobuf(body []byte) (streams []*lokiStream, err error) {
+	err = walkProtobuf(body, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+
+		stream, err := parseLokiStreamProtobuf(v)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, stream)
+		return nil
+	})
+
+	return streams, err
+}
+
+func parseLokiStreamProtobuf(body []byte) (stream *lokiStream, err error) {
+	stream = &lokiStream{}
+	err = walkProtobuf(body, func(num protowire.Number, typ protowire.Type, v []byte) (err error) {
+		if typ != protowire.BytesType {
+			return nil
+		}
+
+		switch num {
+		case 1:
+			stream.labels, err = parseLokiLabels(string(v))
+		case 2:
+			var e *lokiEntry
+			if e, err = parseLokiEntryProtobuf(v); err == nil {
+				stream.entries = append(stream.entries, e)
+			}
+		}
+		return err
+	})
+
+	return stream, err
+}
+
+func parseLokiEntryProtobuf(body []byte) (e *lokiEntry, err error) {
+	e = &lokiEntry{}
+	err = walkProtobuf(body, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+
+		switch num {
+		case 1: // google.protobuf.Timestamp
+			var sec, nsec int64
+			if err := walkProtobuf(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if typ != protowire.VarintType {
+					return nil
+				}
+				n, _ := protowire.ConsumeVarint(v)
+				switch num {
+				case 1:
+					sec = int64(n)
+				case 2:
+					nsec = int64(int32(n))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			e.ts = sec*1e9 + nsec
+		case 2:
+			e.line = string(v)
+		case 3:
+			var name, value string
+			if err := walkProtobuf(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch num {
+				case 1:
+					name = string(v)
+				case 2:
+					value = string(v)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if e.metadata == nil {
+				e.metadata = map[string]string{}
+			}
+			e.metadata[name] = value
+		}
+		return nil
+	})
+
+	return e, err
+}
+
+// walkProtobuf iterate fields of protobuf message,
+// `v` is the raw varint bytes for varint field, and the content for bytes field.
+func walkProtobuf(body []byte, f func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(body) != 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "parse protobuf tag")
+		}
+		body = body[n:]
+
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(body)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(body)
+			if n >= 0 {
+				v = body[:n]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, body)
+		}
+		if n < 0 {
+			return errors.Wrap(protowire.ParseError(n), "parse protobuf field")
+		}
+		body = body[n:]
+
+		if err := f(num, typ, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseLokiLabels parse labels string like `{app="foo", env="b\"ar"}`
+func parseLokiLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("labels should be wrapped by `{}`: %v", s)
+	}
+	s = s[1 : len(s)-1]
+
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return labels, nil
+		}
+
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid label `%v`", s)
+		}
+		name := strings.TrimSpace(s[:i])
+		s = strings.TrimSpace(s[i+1:])
+
+		// find the end quote that is not escaped
+		end := -1
+		if strings.HasPrefix(s, `"`) {
+			for j := 1; j < len(s); j++ {
+				if s[j] == '\\' {
+					j++
+				} else if s[j] == '"' {
+					end = j
+					break
+				}
+			}
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("invalid value of label `%v`", name)
+		}
+
+		var err error
+		if labels[name], err = strconv.Unquote(s[:end+1]); err != nil {
+			return nil, errors.Wrapf(err, "invalid value of label `%v`", name)
+		}
+		s = s[end+1:]
+	}
+}
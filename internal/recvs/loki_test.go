@@ -0,0 +1,99 @@
+package recvs
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gofluentd/library"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestParseLokiLabels(t *testing.T) {
+	labels, err := parseLokiLabels(`{app="nginx", msg="a \"quoted\", value"}`)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if len(labels) != 2 || labels["app"] != "nginx" || labels["msg"] != `a "quoted", value` {
+		t.Fatalf("got %+v", labels)
+	}
+
+	for _, s := range []string{`app="nginx"`, `{app=nginx}`, `{app="nginx}`} {
+		if _, err = parseLokiLabels(s); err == nil {
+			t.Fatalf("should be invalid: %v", s)
+		}
+	}
+}
+
+func TestLokiRecv(t *testing.T) {
+	var (
+		srv         = gin.New()
+		syncOutChan = make(chan *library.FluentMsg, 1000)
+	)
+	recv := NewLokiRecv(&LokiRecvCfg{
+		Name:      "test-loki",
+		HTTPSrv:   srv,
+		Tag:       "${app}.sit",
+		TenantKey: "tenant",
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(syncOutChan)
+
+	push := func(contentType string, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Scope-OrgID", "team-a")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("got %v: %v", w.Code, w.Body.String())
+		}
+	}
+	check := func(msg *library.FluentMsg) {
+		if msg.Tag != "nginx.sit" || msg.Message["app"] != "nginx" || msg.Message["tenant"] != "team-a" ||
+			string(msg.Message["log"].([]byte)) != "hello" || msg.Message["time_unix_nano"] != int64(1600000000123456789) ||
+			msg.Message["trace_id"] != "abc" {
+			t.Fatalf("got %+v", msg.Message)
+		}
+	}
+
+	// json
+	push("application/json", []byte(`{"streams":[{"stream":{"app":"nginx"},"values":[["1600000000123456789","hello",{"trace_id":"abc"}]]}]}`))
+	check(<-syncOutChan)
+
+	// snappy protobuf
+	var ts, meta, entry, stream, req []byte
+	ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, 1600000000)
+	ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+	ts = protowire.AppendVarint(ts, 123456789)
+	meta = protowire.AppendTag(meta, 1, protowire.BytesType)
+	meta = protowire.AppendString(meta, "trace_id")
+	meta = protowire.AppendTag(meta, 2, protowire.BytesType)
+	meta = protowire.AppendString(meta, "abc")
+	entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, ts)
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendString(entry, "hello")
+	entry = protowire.AppendTag(entry, 3, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, meta)
+	stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+	stream = protowire.AppendString(stream, `{app="nginx"}`)
+	for i := 0; i < 2; i++ {
+		stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+		stream = protowire.AppendBytes(stream, entry)
+	}
+	stream = protowire.AppendTag(stream, 3, protowire.VarintType)
+	stream = protowire.AppendVarint(stream, 12345)
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendBytes(req, stream)
+
+	push("application/x-protobuf", snappy.Encode(nil, req))
+	check(<-syncOutChan)
+	check(<-syncOutChan)
+}
@@ -0,0 +1,312 @@
+package recvs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+var mqttTopicFieldRegexp = regexp.MustCompile(`^\$\{([^}]+)\}$`)
+
+// MQTTRecvCfg configuration of MQTTRecv
+type MQTTRecvCfg struct {
+	Name,
+	// ClientID: should be stable to resume persistent session,
+	// default is `gofluentd-<hostname>-<name>`
+	ClientID,
+	Username,
+	Password,
+	// Format: `json` or `raw` for payload
+	Format,
+	// Tag: template of `msg.Tag`, `${<field>}` will be replaced by field in message
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = payload` for `raw`
+	MsgKey,
+	// TopicKey: set `msg.Message[TopicKey] = topic` if not empty
+	TopicKey string
+	// Brokers: like `tcp://127.0.0.1:1883`, `ssl://127.0.0.1:8883`
+	Brokers []string
+	// Topics: topic filters, level like `${device_id}` will be subscribed as `+`,
+	// and the matched level will be set into `msg.Message["device_id"]`
+	Topics []string
+	// QoS: 0, 1 or 2, controller use 1 if not configured,
+	// QoS 0 message will not be redelivered by broker
+	QoS int
+	// IsCleanSession: discard session (subscriptions and queued messages) when disconnected
+	IsCleanSession bool
+}
+
+// MQTTRecv subscribe topics from MQTT broker,
+// QoS 1/2 message is acked after persisted by journal,
+// message not acked will be redelivered by broker after reconnected (persistent session).
+type MQTTRecv struct {
+	*BaseRecv
+	*MQTTRecvCfg
+	logger *utils.LoggerType
+	// filters topic filter -> level index -> field name
+	filters map[string]map[int]string
+}
+
+// NewMQTTRecv create new MQTTRecv
+func NewMQTTRecv(cfg *MQTTRecvCfg) (r *MQTTRecv) {
+	r = &MQTTRecv{
+		BaseRecv:    &BaseRecv{},
+		MQTTRecvCfg: cfg,
+		logger:      log.Logger.Named(cfg.Name),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("mqtt recv invalid", zap.Error(err))
+	}
+
+	r.logger.Info("create mqtt recv",
+		zap.Strings("brokers", r.Brokers),
+		zap.String("client_id", r.ClientID),
+		zap.Strings("topics", r.Topics),
+		zap.Int("qos", r.QoS),
+		zap.Bool("is_clean_session", r.IsCleanSession),
+		zap.String("format", r.Format),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.String("topic_key", r.TopicKey),
+	)
+	return r
+}
+
+func (r *MQTTRecv) valid() (err error) {
+	if len(r.Brokers) == 0 {
+		return fmt.Errorf("brokers should not be empty")
+	}
+	if len(r.Topics) == 0 {
+		return fmt.Errorf("topics should not be empty")
+	}
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	r.filters = map[string]map[int]string{}
+	for _, topic := range r.Topics {
+		filter, fields, err := parseMQTTTopic(topic)
+		if err != nil {
+			return errors.Wrapf(err, "parse topic `%v`", topic)
+		}
+		r.filters[filter] = fields
+	}
+
+	if r.QoS < 0 || r.QoS > 2 {
+		return fmt.Errorf("qos should be 0, 1 or 2")
+	}
+	if r.QoS == 0 {
+		r.logger.Warn("qos 0 message will not be redelivered, persistent session is useless")
+	}
+
+	if r.ClientID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "load hostname as client_id")
+		}
+		r.ClientID = "gofluentd-" + hostname + "-" + r.Name
+		r.logger.Info("reset client_id", zap.String("client_id", r.ClientID))
+	}
+
+	switch r.Format {
+	case "":
+		r.Format = "json"
+		r.logger.Info("reset format", zap.String("format", r.Format))
+	case "json", "raw":
+	default:
+		return fmt.Errorf("unknown format `%v`", r.Format)
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	return nil
+}
+
+// parseMQTTTopic convert topic like `devices/${device_id}/logs` to
+// filter `devices/+/logs` and fields `{1: "device_id"}`
+func parseMQTTTopic(topic string) (filter string, fields map[int]string, err error) {
+	fields = map[int]string{}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if matched := mqttTopicFieldRegexp.FindStringSubmatch(level); matched != nil {
+			fields[i] = matched[1]
+			levels[i] = "+"
+			continue
+		}
+
+		if strings.ContainsAny(level, "${}") {
+			return "", nil, fmt.Errorf("field should occupy the whole level, got `%v`", level)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return "", nil, fmt.Errorf("`#` should be the last level")
+		}
+	}
+
+	return strings.Join(levels, "/"), fields, nil
+}
+
+// GetName return the name of this recv
+func (r *MQTTRecv) GetName() string {
+	return r.Name
+}
+
+// Run connect to broker and block until ctx done,
+// client will reconnect and resubscribe automatically.
+func (r *MQTTRecv) Run(ctx context.Context) {
+	r.logger.Info("run MQTTRecv")
+	defer r.logger.Info("mqtt recv exit")
+
+	opts := mqtt.NewClientOptions().
+		SetClientID(r.ClientID).
+		SetUsername(r.Username).
+		SetPassword(r.Password).
+		SetCleanSession(r.IsCleanSession).
+		// handler is running in its own goroutine,
+		// so handler could block until message accepted by syncOutChan
+		SetOrderMatters(false).
+		// message is acked after persisted by journal
+		SetAutoAckDisabled(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(defaultRetryWait).
+		SetOnConnectHandler(func(cli mqtt.Client) {
+			r.logger.Info("connected to mqtt broker")
+			r.subscribe(ctx, cli)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			r.logger.Error("lost connection to mqtt broker, try to reconnect", zap.Error(err))
+		})
+	for _, broker := range r.Brokers {
+		opts.AddBroker(broker)
+	}
+
+	cli := mqtt.NewClient(opts)
+	// will retry in background with ConnectRetry
+	cli.Connect()
+	<-ctx.Done()
+	cli.Disconnect(1000) // ms to wait for in-flight work
+}
+
+// subscribe (re)subscribe all topics,
+// broker will resume queued messages of persistent session after subscribed.
+func (r *MQTTRecv) subscribe(ctx context.Context, cli mqtt.Client) {
+	filters := make(map[string]byte, len(r.filters))
+	for filter := range r.filters {
+		filters[filter] = byte(r.QoS)
+	}
+
+	go func() {
+		for cli.IsConnectionOpen() {
+			token := cli.SubscribeMultiple(filters, func(_ mqtt.Client, m mqtt.Message) {
+				r.process(ctx, m)
+			})
+			if token.Wait(); token.Error() == nil {
+				r.logger.Info("subscribed mqtt topics", zap.Strings("topics", r.Topics))
+				return
+			}
+
+			r.logger.Error("subscribe topics, retry later", zap.Error(token.Error()))
+			time.Sleep(defaultRetryWait)
+		}
+	}()
+}
+
+// process put message into downstream, ack it after persisted by journal,
+// invalid message will be acked and discarded
+func (r *MQTTRecv) process(ctx context.Context, m mqtt.Message) {
+	msg, err := r.parseMessage(m.Topic(), m.Payload())
+	if err != nil {
+		r.logger.Warn("discard invalid message",
+			zap.Error(err),
+			zap.String("topic", m.Topic()),
+			zap.ByteString("payload", m.Payload()))
+		m.Ack()
+		return
+	}
+
+	topic := m.Topic()
+	r.waitPersisted([]int64{msg.ID}, func(isPersisted bool) {
+		if !isPersisted {
+			// mqtt could not nack message
+			r.logger.Warn("message not persisted, will be redelivered after reconnected",
+				zap.String("topic", topic))
+			return
+		}
+		m.Ack()
+	})
+
+	r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	select {
+	case <-ctx.Done():
+		// not acked, will be redelivered
+		r.msgPool.Put(msg)
+	case r.syncOutChan <- msg: // blockable
+	}
+}
+
+func (r *MQTTRecv) parseMessage(topic string, payload []byte) (msg *library.FluentMsg, err error) {
+	msg = r.msgPool.Get().(*library.FluentMsg)
+	if msg.Message, err = parseLineMsg(r.Format, payload, r.MsgKey); err != nil {
+		r.msgPool.Put(msg)
+		return nil, err
+	}
+
+	levels := strings.Split(topic, "/")
+	for filter, fields := range r.filters {
+		if !matchMQTTTopic(filter, levels) {
+			continue
+		}
+		for i, field := range fields {
+			msg.Message[field] = levels[i]
+		}
+		break
+	}
+	if r.TopicKey != "" {
+		msg.Message[r.TopicKey] = topic
+	}
+
+	msg.ID = r.counter.Count()
+	msg.Tag = library.TemplateWithNestedFields(r.Tag, msg.Message)
+	msg.Message[r.TagKey] = msg.Tag
+	return msg, nil
+}
+
+// matchMQTTTopic check whether topic levels match filter with `+` and `#`
+func matchMQTTTopic(filter string, levels []string) bool {
+	filterLevels := strings.Split(filter, "/")
+	for i, fl := range filterLevels {
+		if fl == "#" {
+			return true
+		}
+		if i >= len(levels) {
+			return false
+		}
+		if fl != "+" && fl != levels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(levels)
+}
@@ -0,0 +1,137 @@
+package recvs
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func TestParseMQTTTopic(t *testing.T) {
+	filter, fields, err := parseMQTTTopic("vehicles/${vin}/logs/${level}/#")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if filter != "vehicles/+/logs/+/#" || len(fields) != 2 || fields[1] != "vin" || fields[3] != "level" {
+		t.Fatalf("got %v, %+v", filter, fields)
+	}
+
+	for _, topic := range []string{"devices/id-${id}/logs", "devices/#/logs"} {
+		if _, _, err = parseMQTTTopic(topic); err == nil {
+			t.Fatalf("%v should be invalid", topic)
+		}
+	}
+}
+
+func TestMQTTRecvParseMessage(t *testing.T) {
+	r := NewMQTTRecv(&MQTTRecvCfg{
+		Name:     "mqtt-test",
+		Brokers:  []string{"tcp://127.0.0.1:1883"},
+		Topics:   []string{"vehicles/${vin}/logs", "devices/${device_id}/#"},
+		Tag:      "iot.${device_id}",
+		TopicKey: "topic",
+	})
+	r.SetCounter(counter)
+	r.SetMsgPool(msgPool)
+
+	msg, err := r.parseMessage("vehicles/LSGABC123/logs", []byte(`{"log":"hello"}`))
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if msg.Message["vin"] != "LSGABC123" ||
+		msg.Message["log"] != "hello" ||
+		msg.Message["topic"] != "vehicles/LSGABC123/logs" {
+		t.Fatalf("got %+v", msg.Message)
+	}
+
+	msg, err = r.parseMessage("devices/d1/a/b", []byte(`{"log":"hello"}`))
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if msg.Message["device_id"] != "d1" || msg.Tag != "iot.d1" || msg.Message["tag"] != "iot.d1" {
+		t.Fatalf("got %+v", msg)
+	}
+
+	if _, err = r.parseMessage("devices/d1", []byte(`not json`)); err == nil {
+		t.Fatal("should be error")
+	}
+
+	for filter, topic := range map[string]string{
+		"devices/+/logs": "devices/d1/logs/x",
+		"devices/+":      "devices",
+		"a/b":            "a/c",
+	} {
+		if matchMQTTTopic(filter, strings.Split(topic, "/")) {
+			t.Fatalf("%v should not match %v", topic, filter)
+		}
+	}
+}
+
+type mockMQTTMessage struct {
+	topic   string
+	payload []byte
+	acked   int32
+}
+
+func (m *mockMQTTMessage) Duplicate() bool   { return false }
+func (m *mockMQTTMessage) Qos() byte         { return 1 }
+func (m *mockMQTTMessage) Retained() bool    { return false }
+func (m *mockMQTTMessage) Topic() string     { return m.topic }
+func (m *mockMQTTMessage) MessageID() uint16 { return 1 }
+func (m *mockMQTTMessage) Payload() []byte   { return m.payload }
+func (m *mockMQTTMessage) Ack()              { atomic.AddInt32(&m.acked, 1) }
+
+func TestMQTTRecvProcess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		syncOutChan = make(chan *library.FluentMsg, 1)
+		notifier    = library.NewPersistNotifier(ctx, time.Minute)
+	)
+	r := NewMQTTRecv(&MQTTRecvCfg{
+		Name:    "mqtt-test",
+		Brokers: []string{"tcp://127.0.0.1:1883"},
+		Topics:  []string{"devices/${device_id}/logs"},
+		Tag:     "iot.${device_id}",
+	})
+	r.SetCounter(counter)
+	r.SetMsgPool(msgPool)
+	r.SetSyncOutChan(syncOutChan)
+	r.SetPersistNotifier(notifier)
+	waitAcked := func(m *mockMQTTMessage, expect int32) {
+		for i := 0; i < 100 && atomic.LoadInt32(&m.acked) != expect; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := atomic.LoadInt32(&m.acked); n != expect {
+			t.Fatalf("got %d acks", n)
+		}
+	}
+
+	// not acked before persisted
+	m := &mockMQTTMessage{topic: "devices/d1/logs", payload: []byte(`{"log":"hello"}`)}
+	r.process(ctx, m)
+	msg := <-syncOutChan
+	time.Sleep(50 * time.Millisecond)
+	waitAcked(m, 0)
+	notifier.Notify(msg.ID, true)
+	waitAcked(m, 1)
+
+	// not acked if not persisted
+	m = &mockMQTTMessage{topic: "devices/d1/logs", payload: []byte(`{"log":"hello"}`)}
+	r.process(ctx, m)
+	msg = <-syncOutChan
+	notifier.Notify(msg.ID, false)
+	time.Sleep(50 * time.Millisecond)
+	waitAcked(m, 0)
+
+	// invalid message is acked and discarded
+	m = &mockMQTTMessage{topic: "devices/d1/logs", payload: []byte(`not json`)}
+	r.process(ctx, m)
+	waitAcked(m, 1)
+	if len(syncOutChan) != 0 {
+		t.Fatalf("got %d msgs", len(syncOutChan))
+	}
+}
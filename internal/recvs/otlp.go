@@ -0,0 +1,395 @@
+package recvs
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultOTLPGRPCAddr    = "0.0.0.0:4317"
+	defaultOTLPHTTPPath    = "/v1/logs"
+	defaultOTLPMaxBodySize = 10 * 1024 * 1024
+
+	otlpResourcePrefix = "resource."
+	otlpScopePrefix    = "scope."
+)
+
+// OTLPRecvCfg configuration of OTLPRecv
+type OTLPRecvCfg struct {
+	// HTTPSrv: serve OTLP/HTTP on this server if not nil
+	HTTPSrv *gin.Engine
+	Name,
+	// GRPCAddr: listening address of OTLP/gRPC, like `0.0.0.0:4317`
+	GRPCAddr,
+	// HTTPPath: url endpoint of OTLP/HTTP, like `/v1/logs`
+	HTTPPath,
+	// Tag: template of `msg.Tag`, `${<field>}` will be replaced by field in message,
+	// like `${resource.service.name}`
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = body`
+	MsgKey string
+	MaxBodySize int
+}
+
+// OTLPRecv recv logs by OpenTelemetry protocol over gRPC & HTTP.
+//
+// each log record is converted to one msg:
+//
+//	resource attributes -> `resource.<key>`
+//	scope name, version & attributes -> `scope.name`, `scope.version`, `scope.<key>`
+//	log attributes -> `<key>`
+//	body -> `<MsgKey>`
+//	severity -> `severity` & `severity_number`
+//	trace & span -> `trace_id`, `span_id` & `trace_flags` in hex
+//	time -> `time_unix_nano` & `observed_time_unix_nano`
+type OTLPRecv struct {
+	*BaseRecv
+	*OTLPRecvCfg
+	collogspb.UnimplementedLogsServiceServer
+	logger *utils.LoggerType
+}
+
+// NewOTLPRecv create new OTLPRecv
+func NewOTLPRecv(cfg *OTLPRecvCfg) (r *OTLPRecv) {
+	r = &OTLPRecv{
+		BaseRecv:    &BaseRecv{},
+		OTLPRecvCfg: cfg,
+		logger:      log.Logger.Named(cfg.Name),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("otlp recv invalid", zap.Error(err))
+	}
+
+	if r.HTTPSrv != nil {
+		r.HTTPSrv.POST(r.HTTPPath, r.HTTPLogHandler)
+	}
+
+	r.logger.Info("create otlp recv",
+		zap.String("grpc_addr", r.GRPCAddr),
+		zap.String("http_path", r.HTTPPath),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.Int("max_body_byte", r.MaxBodySize),
+	)
+	return r
+}
+
+func (r *OTLPRecv) valid() error {
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	if r.GRPCAddr == "" {
+		r.GRPCAddr = defaultOTLPGRPCAddr
+		r.logger.Info("reset grpc_addr", zap.String("grpc_addr", r.GRPCAddr))
+	}
+
+	if r.HTTPPath == "" {
+		r.HTTPPath = defaultOTLPHTTPPath
+		r.logger.Info("reset http_path", zap.String("http_path", r.HTTPPath))
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultOTLPMaxBodySize
+		r.logger.Info("reset max_body_byte", zap.Int("max_body_byte", r.MaxBodySize))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *OTLPRecv) GetName() string {
+	return r.Name
+}
+
+// Run starting gRPC server
+func (r *OTLPRecv) Run(ctx context.Context) {
+	r.logger.Info("run OTLPRecv")
+	defer r.logger.Info("otlp recv exit")
+
+	ln, err := net.Listen("tcp", r.GRPCAddr)
+	if err != nil {
+		r.logger.Panic("try to bind addr got error", zap.Error(err), zap.String("grpc_addr", r.GRPCAddr))
+	}
+
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(r.MaxBodySize))
+	collogspb.RegisterLogsServiceServer(srv, r)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+
+	r.logger.Info("listening on grpc...", zap.String("grpc_addr", r.GRPCAddr))
+	if err = srv.Serve(ln); err != nil {
+		r.logger.Error("grpc server exit", zap.Error(err))
+	}
+}
+
+// Export implement OTLP/gRPC logs service
+func (r *OTLPRecv) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	if err := r.process(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+// HTTPLogHandler implement OTLP/HTTP, support protobuf & JSON
+func (r *OTLPRecv) HTTPLogHandler(ctx *gin.Context) {
+	var reader io.Reader = ctx.Request.Body
+	if strings.Contains(ctx.GetHeader("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(ctx.Request.Body)
+		if err != nil {
+			r.badRequest(ctx, errors.Wrap(err, "read gzip body"))
+			return
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(r.MaxBodySize)+1))
+	if err != nil {
+		r.badRequest(ctx, errors.Wrap(err, "read body"))
+		return
+	}
+	if len(body) > r.MaxBodySize {
+		r.badRequest(ctx, fmt.Errorf("content size must less than %d bytes", r.MaxBodySize))
+		return
+	}
+
+	var (
+		req    = &collogspb.ExportLogsServiceRequest{}
+		isJSON = strings.HasPrefix(ctx.ContentType(), "application/json")
+	)
+	if isJSON {
+		err = unmarshalOTLPJSON(body, req)
+	} else {
+		err = proto.Unmarshal(body, req)
+	}
+	if err != nil {
+		r.badRequest(ctx, errors.Wrap(err, "unmarshal request"))
+		return
+	}
+
+	if err = r.process(ctx.Request.Context(), req); err != nil {
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := &collogspb.ExportLogsServiceResponse{}
+	if isJSON {
+		data, _ := protojson.Marshal(resp)
+		ctx.Data(http.StatusOK, "application/json", data)
+		return
+	}
+	data, _ := proto.Marshal(resp)
+	ctx.Data(http.StatusOK, "application/x-protobuf", data)
+}
+
+func (r *OTLPRecv) badRequest(ctx *gin.Context, err error) {
+	r.logger.Warn("bad request", zap.Error(err), zap.String("remote", ctx.ClientIP()))
+	ctx.AbortWithStatusJSON(http.StatusBadRequest, map[string]interface{}{"message": err.Error()})
+}
+
+// process convert log records into msgs and put into downstream
+func (r *OTLPRecv) process(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	for _, rl := range req.GetResourceLogs() {
+		resourceFields := map[string]interface{}{}
+		loadOTLPAttributes(resourceFields, otlpResourcePrefix, rl.GetResource().GetAttributes())
+
+		for _, sl := range rl.GetScopeLogs() {
+			scopeFields := map[string]interface{}{}
+			if scope := sl.GetScope(); scope != nil {
+				if scope.GetName() != "" {
+					scopeFields[otlpScopePrefix+"name"] = scope.GetName()
+				}
+				if scope.GetVersion() != "" {
+					scopeFields[otlpScopePrefix+"version"] = scope.GetVersion()
+				}
+				loadOTLPAttributes(scopeFields, otlpScopePrefix, scope.GetAttributes())
+			}
+
+			for _, lr := range sl.GetLogRecords() {
+				msg := r.msgPool.Get().(*library.FluentMsg)
+				msg.ID = r.counter.Count()
+				msg.Message = r.convertRecord(lr, resourceFields, scopeFields)
+				msg.Tag = library.TemplateWithNestedFields(r.Tag, msg.Message)
+				msg.Message[r.TagKey] = msg.Tag
+
+				r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+				select {
+				case <-ctx.Done():
+					r.msgPool.Put(msg)
+					return ctx.Err()
+				case r.syncOutChan <- msg: // blockable
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// convertRecord flatten log record into message
+func (r *OTLPRecv) convertRecord(lr *logspb.LogRecord, resourceFields, scopeFields map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(resourceFields)+len(scopeFields)+len(lr.GetAttributes())+8)
+	for k, v := range resourceFields {
+		m[k] = v
+	}
+	for k, v := range scopeFields {
+		m[k] = v
+	}
+	loadOTLPAttributes(m, "", lr.GetAttributes())
+
+	switch body := convertOTLPValue(lr.GetBody()).(type) {
+	case nil:
+		m[r.MsgKey] = []byte{}
+	case string:
+		m[r.MsgKey] = []byte(body)
+	default:
+		m[r.MsgKey] = body
+	}
+
+	if lr.GetSeverityText() != "" {
+		m["severity"] = lr.GetSeverityText()
+	}
+	if lr.GetSeverityNumber() != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+		m["severity_number"] = int64(lr.GetSeverityNumber())
+	}
+	if len(lr.GetTraceId()) != 0 {
+		m["trace_id"] = hex.EncodeToString(lr.GetTraceId())
+	}
+	if len(lr.GetSpanId()) != 0 {
+		m["span_id"] = hex.EncodeToString(lr.GetSpanId())
+	}
+	if lr.GetFlags() != 0 {
+		m["trace_flags"] = int64(lr.GetFlags())
+	}
+	if lr.GetTimeUnixNano() != 0 {
+		m["time_unix_nano"] = int64(lr.GetTimeUnixNano())
+	}
+	if lr.GetObservedTimeUnixNano() != 0 {
+		m["observed_time_unix_nano"] = int64(lr.GetObservedTimeUnixNano())
+	}
+
+	return m
+}
+
+// loadOTLPAttributes set attributes into m with prefix
+func loadOTLPAttributes(m map[string]interface{}, prefix string, attrs []*commonpb.KeyValue) {
+	for _, kv := range attrs {
+		m[prefix+kv.GetKey()] = convertOTLPValue(kv.GetValue())
+	}
+}
+
+// convertOTLPValue convert AnyValue into go value
+func convertOTLPValue(v *commonpb.AnyValue) interface{} {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return val.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return val.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return val.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return val.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return val.BytesValue
+	case *commonpb.AnyValue_ArrayValue:
+		arr := make([]interface{}, 0, len(val.ArrayValue.GetValues()))
+		for _, item := range val.ArrayValue.GetValues() {
+			arr = append(arr, convertOTLPValue(item))
+		}
+		return arr
+	case *commonpb.AnyValue_KvlistValue:
+		m := make(map[string]interface{}, len(val.KvlistValue.GetValues()))
+		loadOTLPAttributes(m, "", val.KvlistValue.GetValues())
+		return m
+	default:
+		return nil
+	}
+}
+
+// unmarshalOTLPJSON unmarshal OTLP/JSON request.
+// trace & span id are hex encoded in OTLP/JSON instead of base64 in protojson,
+// so convert them before unmarshal.
+func unmarshalOTLPJSON(body []byte, req *collogspb.ExportLogsServiceRequest) error {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+
+	for _, rl := range otlpJSONList(raw, "resourceLogs", "resource_logs") {
+		for _, sl := range otlpJSONList(rl, "scopeLogs", "scope_logs") {
+			for _, lr := range otlpJSONList(sl, "logRecords", "log_records") {
+				for _, k := range []string{"traceId", "trace_id", "spanId", "span_id"} {
+					if id, ok := lr[k].(string); ok {
+						b, err := hex.DecodeString(id)
+						if err != nil {
+							return errors.Wrapf(err, "decode %v", k)
+						}
+						lr[k] = base64.StdEncoding.EncodeToString(b)
+					}
+				}
+			}
+		}
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, req)
+}
+
+// otlpJSONList load list of objects by camel case or snake case key
+func otlpJSONList(m map[string]interface{}, keys ...string) (list []map[string]interface{}) {
+	for _, k := range keys {
+		items, ok := m[k].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, item := range items {
+			if obj, ok := item.(map[string]interface{}); ok {
+				list = append(list, obj)
+			}
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,111 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gofluentd/library"
+
+	"github.com/gin-gonic/gin"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func otlpStr(v string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+}
+
+func TestOTLPRecv(t *testing.T) {
+	var (
+		srv         = gin.New()
+		syncOutChan = make(chan *library.FluentMsg, 1000)
+	)
+	recv := NewOTLPRecv(&OTLPRecvCfg{
+		Name:    "test-otlp",
+		HTTPSrv: srv,
+		Tag:     "${resource.service.name}.sit",
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(syncOutChan)
+
+	req := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				{Key: "service.name", Value: otlpStr("order")},
+			}},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope: &commonpb.InstrumentationScope{Name: "logger", Version: "1.0"},
+				LogRecords: []*logspb.LogRecord{{
+					TimeUnixNano:   1600000000000000001,
+					SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+					SeverityText:   "ERROR",
+					Body:           otlpStr("hello"),
+					Attributes: []*commonpb.KeyValue{
+						{Key: "user", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+							Values: []*commonpb.KeyValue{{Key: "id", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 3}}}},
+						}}}},
+					},
+					TraceId: []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c},
+					SpanId:  []byte{0xee, 0xe1, 0x9b, 0x7e, 0xc3, 0xc1, 0xb1, 0x74},
+				}},
+			}},
+		}},
+	}
+
+	check := func(msg *library.FluentMsg) {
+		if msg.Tag != "order.sit" || string(msg.Message["log"].([]byte)) != "hello" ||
+			msg.Message["resource.service.name"] != "order" ||
+			msg.Message["scope.name"] != "logger" ||
+			msg.Message["severity"] != "ERROR" ||
+			msg.Message["severity_number"] != int64(17) ||
+			msg.Message["trace_id"] != "5b8efff798038103d269b633813fc60c" ||
+			msg.Message["span_id"] != "eee19b7ec3c1b174" ||
+			msg.Message["time_unix_nano"] != int64(1600000000000000001) ||
+			msg.Message["user"].(map[string]interface{})["id"] != int64(3) {
+			t.Fatalf("got %+v", msg.Message)
+		}
+	}
+
+	// grpc
+	if _, err := recv.Export(context.Background(), req); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	check(<-syncOutChan)
+
+	// http protobuf
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	httpReq := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(body))
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httpReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+	check(<-syncOutChan)
+
+	// http json
+	httpReq = httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader([]byte(`{"resourceLogs":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"order"}}]},
+		"scopeLogs":[{"scope":{"name":"logger","version":"1.0"},"logRecords":[{
+			"timeUnixNano":"1600000000000000001","severityNumber":17,"severityText":"ERROR",
+			"body":{"stringValue":"hello"},
+			"attributes":[{"key":"user","value":{"kvlistValue":{"values":[{"key":"id","value":{"intValue":"3"}}]}}}],
+			"traceId":"5b8efff798038103d269b633813fc60c","spanId":"eee19b7ec3c1b174"}]}]}]}`)))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httpReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+	check(<-syncOutChan)
+}
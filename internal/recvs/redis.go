@@ -0,0 +1,375 @@
+package recvs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRedisBatchSize    = 100
+	defaultRedisBlockTimeout = 5 * time.Second
+)
+
+// RedisRecvCfg configuration of RedisRecv
+type RedisRecvCfg struct {
+	Name,
+	// Addr: like `127.0.0.1:6379`
+	Addr,
+	Password,
+	// DataType: `list` (BLPOP) or `stream` (XREADGROUP)
+	DataType,
+	// Group: consumer group of stream, will be created if not exists
+	Group,
+	// Consumer: consumer name in group, default is hostname
+	Consumer,
+	// Format: `json` or `raw` for list element,
+	// fields of stream entry will be set into message directly
+	Format,
+	// Tag: template of `msg.Tag`, `${<field>}` will be replaced by field in message
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = element` for `raw`
+	MsgKey string
+	DB   int
+	Keys []string
+	// BatchSize: max entries of each XREADGROUP
+	BatchSize int
+	// BlockTimeout: timeout of each BLPOP or XREADGROUP
+	BlockTimeout time.Duration
+}
+
+// RedisRecv recv messages from redis list or stream.
+//
+// element of list is removed once popped,
+// entry of stream is acked after persisted by journal,
+// entries not persisted are kept pending and will be consumed again after restart.
+type RedisRecv struct {
+	*BaseRecv
+	*RedisRecvCfg
+	logger *utils.LoggerType
+}
+
+// NewRedisRecv create new RedisRecv
+func NewRedisRecv(cfg *RedisRecvCfg) (r *RedisRecv) {
+	r = &RedisRecv{
+		BaseRecv:     &BaseRecv{},
+		RedisRecvCfg: cfg,
+		logger:       log.Logger.Named(cfg.Name),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("redis recv invalid", zap.Error(err))
+	}
+
+	r.logger.Info("create redis recv",
+		zap.String("addr", r.Addr),
+		zap.Int("db", r.DB),
+		zap.String("data_type", r.DataType),
+		zap.Strings("keys", r.Keys),
+		zap.String("group", r.Group),
+		zap.String("consumer", r.Consumer),
+		zap.String("format", r.Format),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.Int("batch_size", r.BatchSize),
+		zap.Duration("block_timeout_sec", r.BlockTimeout),
+	)
+	return r
+}
+
+func (r *RedisRecv) valid() error {
+	if r.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+	if len(r.Keys) == 0 {
+		return fmt.Errorf("keys should not be empty")
+	}
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	switch r.DataType {
+	case "":
+		r.DataType = "list"
+		r.logger.Info("reset data_type", zap.String("data_type", r.DataType))
+	case "list":
+	case "stream":
+		if r.Group == "" {
+			return fmt.Errorf("group should not be empty for stream")
+		}
+		if r.Consumer == "" {
+			var err error
+			if r.Consumer, err = os.Hostname(); err != nil {
+				return errors.Wrap(err, "load hostname as consumer")
+			}
+			r.logger.Info("reset consumer", zap.String("consumer", r.Consumer))
+		}
+	default:
+		return fmt.Errorf("unknown data_type `%v`", r.DataType)
+	}
+
+	switch r.Format {
+	case "":
+		r.Format = "json"
+		r.logger.Info("reset format", zap.String("format", r.Format))
+	case "json", "raw":
+	default:
+		return fmt.Errorf("unknown format `%v`", r.Format)
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.BatchSize <= 0 {
+		r.BatchSize = defaultRedisBatchSize
+		r.logger.Info("reset batch_size", zap.Int("batch_size", r.BatchSize))
+	}
+
+	if r.BlockTimeout <= 0 {
+		r.BlockTimeout = defaultRedisBlockTimeout
+		r.logger.Info("reset block_timeout_sec", zap.Duration("block_timeout_sec", r.BlockTimeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *RedisRecv) GetName() string {
+	return r.Name
+}
+
+// Run starting to consume
+func (r *RedisRecv) Run(ctx context.Context) {
+	r.logger.Info("run RedisRecv")
+	defer r.logger.Info("redis recv exit")
+
+	cli := redis.NewClient(&redis.Options{
+		Addr:        r.Addr,
+		Password:    r.Password,
+		DB:          r.DB,
+		ReadTimeout: r.BlockTimeout + 10*time.Second,
+	})
+	defer cli.Close()
+
+	switch r.DataType {
+	case "list":
+		r.runList(ctx, cli)
+	case "stream":
+		r.runStream(ctx, cli)
+	}
+}
+
+func (r *RedisRecv) runList(ctx context.Context, cli *redis.Client) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		// [key, element]
+		ret, err := cli.BLPop(ctx, r.BlockTimeout, r.Keys...).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Error("blpop", zap.Error(err), zap.Strings("keys", r.Keys))
+			time.Sleep(defaultRetryWait)
+			continue
+		}
+
+		msg := r.msgPool.Get().(*library.FluentMsg)
+		if msg.Message, err = parseLineMsg(r.Format, []byte(ret[1]), r.MsgKey); err != nil {
+			r.logger.Warn("discard invalid element", zap.Error(err), zap.String("key", ret[0]), zap.String("element", ret[1]))
+			r.msgPool.Put(msg)
+			continue
+		}
+		r.sendMsg(msg, nil)
+	}
+}
+
+// runStream consume stream by consumer group,
+// entries pending on this consumer (delivered but not acked before exit) will be consumed first.
+func (r *RedisRecv) runStream(ctx context.Context, cli *redis.Client) {
+	for _, key := range r.Keys {
+		for {
+			err := cli.XGroupCreateMkStream(ctx, key, r.Group, "0").Err()
+			if err == nil || strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Error("create consumer group", zap.Error(err), zap.String("key", key), zap.String("group", r.Group))
+			time.Sleep(defaultRetryWait)
+		}
+	}
+
+	acks := &redisStreamAcks{
+		ids:    map[string][]string{},
+		signal: make(chan struct{}, 1),
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.runStreamAcker(ctx, cli, acks)
+	}()
+	defer wg.Wait()
+
+	var (
+		isPending = true
+		streams   = make([]string, len(r.Keys)*2)
+		// cursors of pending entries, entries are still pending until acked
+		cursors = map[string]string{}
+	)
+	copy(streams, r.Keys)
+	for _, key := range r.Keys {
+		cursors[key] = "0"
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		for i, key := range r.Keys {
+			if isPending {
+				streams[len(r.Keys)+i] = cursors[key]
+			} else {
+				streams[len(r.Keys)+i] = ">"
+			}
+		}
+
+		ret, err := cli.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    r.Group,
+			Consumer: r.Consumer,
+			Streams:  streams,
+			Count:    int64(r.BatchSize),
+			Block:    r.BlockTimeout,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Error("xreadgroup", zap.Error(err), zap.Strings("keys", r.Keys))
+			time.Sleep(defaultRetryWait)
+			continue
+		}
+
+		n := 0
+		for _, stream := range ret {
+			for _, entry := range stream.Messages {
+				msg := r.msgPool.Get().(*library.FluentMsg)
+				msg.Message = make(map[string]interface{}, len(entry.Values)+1)
+				for k, v := range entry.Values {
+					msg.Message[k] = v
+				}
+
+				key, id := stream.Stream, entry.ID
+				r.sendMsg(msg, func(isPersisted bool) {
+					if !isPersisted {
+						r.logger.Warn("entry not persisted, will be consumed again after restart",
+							zap.String("key", key), zap.String("id", id))
+						return
+					}
+					acks.add(key, id)
+				})
+			}
+
+			if len(stream.Messages) > 0 {
+				cursors[stream.Stream] = stream.Messages[len(stream.Messages)-1].ID
+			}
+			n += len(stream.Messages)
+		}
+
+		if isPending && n == 0 {
+			r.logger.Info("all pending entries consumed")
+			isPending = false
+		}
+	}
+}
+
+// redisStreamAcks collect ids of persisted entries
+type redisStreamAcks struct {
+	sync.Mutex
+	ids    map[string][]string // map[key][]id
+	signal chan struct{}
+}
+
+func (a *redisStreamAcks) add(key, id string) {
+	a.Lock()
+	a.ids[key] = append(a.ids[key], id)
+	a.Unlock()
+
+	select {
+	case a.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (a *redisStreamAcks) pop() (ids map[string][]string) {
+	a.Lock()
+	ids = a.ids
+	a.ids = map[string][]string{}
+	a.Unlock()
+	return ids
+}
+
+// runStreamAcker ack persisted entries in batch,
+// entries not acked before exit will be consumed again after restart.
+func (r *RedisRecv) runStreamAcker(ctx context.Context, cli *redis.Client, acks *redisStreamAcks) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-acks.signal:
+		}
+
+		for key, ids := range acks.pop() {
+			if err := cli.XAck(ctx, key, r.Group, ids...).Err(); err != nil {
+				// will be consumed again after restart
+				r.logger.Error("xack", zap.Error(err), zap.String("key", key), zap.Int("n", len(ids)))
+			}
+		}
+	}
+}
+
+// sendMsg put msg into syncOutChan,
+// onPersisted will be called after msg is persisted if not nil.
+func (r *RedisRecv) sendMsg(msg *library.FluentMsg, onPersisted func(isPersisted bool)) {
+	msg.ID = r.counter.Count()
+	msg.Tag = library.TemplateWithNestedFields(r.Tag, msg.Message)
+	msg.Message[r.TagKey] = msg.Tag
+	if onPersisted != nil {
+		r.waitPersisted([]int64{msg.ID}, onPersisted)
+	}
+
+	r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.syncOutChan <- msg // blockable
+}
@@ -0,0 +1,139 @@
+package recvs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRedisRecv(t *testing.T) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer cli.Close()
+
+	syncOutChan := make(chan *library.FluentMsg, 100)
+	notifier := library.NewPersistNotifier(ctx, time.Minute)
+	newRecv := func(ctx context.Context, cfg *RedisRecvCfg) (done chan struct{}) {
+		cfg.Addr = srv.Addr()
+		cfg.BlockTimeout = 100 * time.Millisecond
+		r := NewRedisRecv(cfg)
+		r.SetCounter(counter)
+		r.SetMsgPool(msgPool)
+		r.SetSyncOutChan(syncOutChan)
+		r.SetPersistNotifier(notifier)
+		done = make(chan struct{})
+		go func() {
+			r.Run(ctx)
+			close(done)
+		}()
+		return done
+	}
+	waitMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-syncOutChan:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	// list
+	if err = cli.RPush(ctx, "logs", `{"app":"a","log":"1"}`, `not json`, `{"app":"b","log":"2"}`).Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	newRecv(ctx, &RedisRecvCfg{Name: "redis-list", Keys: []string{"logs"}, Tag: "edge.${app}"})
+	for _, expect := range []string{"a", "b"} {
+		if msg := waitMsg(); msg.Tag != "edge."+expect || msg.Message["tag"] != msg.Tag {
+			t.Fatalf("got %+v", msg)
+		}
+	}
+	if n := cli.LLen(ctx, "logs").Val(); n != 0 {
+		t.Fatalf("got %d", n)
+	}
+
+	// stream, pending entries will be consumed first
+	if err = cli.XGroupCreateMkStream(ctx, "stream", "gofluentd", "0").Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	for _, v := range []string{"1", "2"} {
+		if err = cli.XAdd(ctx, &redis.XAddArgs{Stream: "stream", Values: map[string]interface{}{"log": v}}).Err(); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+	if err = cli.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "gofluentd",
+		Consumer: "test",
+		Streams:  []string{"stream", ">"},
+		Count:    1,
+	}).Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	streamCfg := func() *RedisRecvCfg {
+		return &RedisRecvCfg{
+			Name:     "redis-stream",
+			DataType: "stream",
+			Keys:     []string{"stream"},
+			Group:    "gofluentd",
+			Consumer: "test",
+			Tag:      "edge.stream",
+		}
+	}
+	loadPending := func() int64 {
+		pending, err := cli.XPending(ctx, "stream", "gofluentd").Result()
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		return pending.Count
+	}
+
+	// killed after entries are handed off, before they are persisted
+	recvCtx, recvCancel := context.WithCancel(ctx)
+	done := newRecv(recvCtx, streamCfg())
+	for _, expect := range []string{"1", "2"} {
+		if msg := waitMsg(); msg.Tag != "edge.stream" || msg.Message["log"] != expect {
+			t.Fatalf("got %+v", msg)
+		}
+	}
+	recvCancel()
+	<-done
+	if n := loadPending(); n != 2 {
+		t.Fatalf("got %d", n)
+	}
+
+	// pending entries are consumed again after restart, acked after persisted
+	var ids []int64
+	newRecv(ctx, streamCfg())
+	for _, expect := range []string{"1", "2"} {
+		msg := waitMsg()
+		if msg.Tag != "edge.stream" || msg.Message["log"] != expect {
+			t.Fatalf("got %+v", msg)
+		}
+		ids = append(ids, msg.ID)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := loadPending(); n != 2 {
+		t.Fatalf("got %d", n)
+	}
+	for _, id := range ids {
+		notifier.Notify(id, true)
+	}
+	for i := 0; loadPending() != 0; i++ {
+		if i > 100 {
+			t.Fatalf("got %d", loadPending())
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+}
@@ -2,6 +2,7 @@ package recvs
 
 import (
 	"context"
+	"net"
 	"time"
 
 	"gofluentd/library"
@@ -10,13 +11,14 @@ import (
 	"github.com/Laisky/go-syslog"
 	"github.com/Laisky/go-syslog/format"
 	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
 )
 
 var (
 	defaultRetryWait = 3 * time.Second
 )
 
-func NewRsyslogSrv(addr string) (*syslog.Server, syslog.LogPartsChannel, error) {
+func NewRsyslogSrv(addr string, f format.Format) (*syslog.Server, syslog.LogPartsChannel, error) {
 	var (
 		inchan  = make(syslog.LogPartsChannel, 1000)
 		handler = syslog.NewChannelHandler(inchan)
@@ -24,7 +26,7 @@ func NewRsyslogSrv(addr string) (*syslog.Server, syslog.LogPartsChannel, error)
 		err     error
 	)
 
-	server.SetFormat(syslog.Automatic)
+	server.SetFormat(f)
 	server.SetHandler(handler)
 	if err = server.ListenUDP(addr); err != nil {
 		log.Logger.Error("listen udp", zap.Error(err), zap.String("addr", addr))
@@ -43,19 +45,79 @@ type RsyslogCfg struct {
 	Name, Addr, TagKey, MsgKey,
 	Tag,
 	NewTimeFormat, TimeKey, NewTimeKey string
+	// SDKey: RFC5424 structured data will be set in `msg[SDKey][<sd-id>][<param>]`,
+	// or `msg[<SDKey>__<sd-id>__<param>]` if IsFlattenSD
+	SDKey       string
+	IsFlattenSD bool
+	// IsRFC3164NoHostname: some devices send RFC3164 without hostname,
+	// hostname will be set by client's address
+	IsRFC3164NoHostname bool
+	// RFC3164TimeZone: location of RFC3164 timestamp which contains no time zone, default `UTC`
+	RFC3164TimeZone string
 }
 
-// RsyslogRecv
+// RsyslogRecv recv syslog by UDP & TCP,
+// support RFC5424 & RFC3164, octet-counting & non-transparent framing
 type RsyslogRecv struct {
 	*BaseRecv
 	*RsyslogCfg
+	format *syslogFormat
 }
 
 func NewRsyslogRecv(cfg *RsyslogCfg) *RsyslogRecv {
-	return &RsyslogRecv{
+	r := &RsyslogRecv{
 		BaseRecv:   &BaseRecv{},
 		RsyslogCfg: cfg,
 	}
+	if err := r.valid(); err != nil {
+		log.Logger.Panic("rsyslog recv invalid", zap.Error(err), zap.String("name", r.Name))
+	}
+
+	log.Logger.Info("create rsyslog recv",
+		zap.String("name", r.Name),
+		zap.String("addr", r.Addr),
+		zap.String("tag", r.Tag),
+		zap.String("msg_key", r.MsgKey),
+		zap.String("time_key", r.TimeKey),
+		zap.String("sd_key", r.SDKey),
+		zap.Bool("is_flatten_sd", r.IsFlattenSD),
+		zap.Bool("is_rfc3164_no_hostname", r.IsRFC3164NoHostname),
+		zap.String("rfc3164_time_zone", r.RFC3164TimeZone),
+	)
+	return r
+}
+
+func (r *RsyslogRecv) valid() error {
+	if r.MsgKey == "" {
+		r.MsgKey = "content"
+		log.Logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+	if r.TimeKey == "" {
+		r.TimeKey = "timestamp"
+		log.Logger.Info("reset time_key", zap.String("time_key", r.TimeKey))
+	}
+	if r.SDKey == "" {
+		r.SDKey = "structured_data"
+		log.Logger.Info("reset sd_key", zap.String("sd_key", r.SDKey))
+	}
+	if r.RFC3164TimeZone == "" {
+		r.RFC3164TimeZone = "UTC"
+		log.Logger.Info("reset rfc3164_time_zone", zap.String("rfc3164_time_zone", r.RFC3164TimeZone))
+	}
+	location, err := time.LoadLocation(r.RFC3164TimeZone)
+	if err != nil {
+		return errors.Wrapf(err, "load rfc3164_time_zone `%v`", r.RFC3164TimeZone)
+	}
+
+	r.format = &syslogFormat{
+		msgKey:       r.MsgKey,
+		timeKey:      r.TimeKey,
+		sdKey:        r.SDKey,
+		isFlattenSD:  r.IsFlattenSD,
+		isNoHostname: r.IsRFC3164NoHostname,
+		location:     location,
+	}
+	return nil
 }
 
 func (r *RsyslogRecv) GetName() string {
@@ -83,7 +145,7 @@ func (r *RsyslogRecv) Run(ctx context.Context) {
 			default:
 			}
 
-			srv, inchan, err := NewRsyslogSrv(r.Addr)
+			srv, inchan, err := NewRsyslogSrv(r.Addr, r.format)
 			if err != nil {
 				log.Logger.Error("new rsyslog server", zap.String("addr", r.Addr), zap.Error(err))
 				time.Sleep(defaultRetryWait)
@@ -127,6 +189,10 @@ func (r *RsyslogRecv) Run(ctx context.Context) {
 					log.Logger.Error("discard log since unknown timestamp format")
 				}
 
+				if logPart["hostname"] == "" {
+					logPart["hostname"] = rsyslogClientHost(logPart["client"])
+				}
+
 				// rename to message because of the elasticsearch default query field is `message`
 				logPart["message"] = logPart[r.MsgKey]
 				delete(logPart, r.MsgKey)
@@ -154,3 +220,12 @@ func (r *RsyslogRecv) Run(ctx context.Context) {
 		}
 	}()
 }
+
+// rsyslogClientHost load host from client address like `1.2.3.4:514`
+func rsyslogClientHost(client interface{}) string {
+	addr, _ := client.(string)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,376 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/Laisky/go-syslog/format"
+	utils "github.com/Laisky/go-utils"
+)
+
+const (
+	// syslogMaxOctetCountingDigits max digits of the length prefix in octet-counting framing,
+	// longer prefix will be treat as non-transparent framing
+	syslogMaxOctetCountingDigits = 9
+	// syslogFutureTolerance RFC3164 timestamp without year later than now+tolerance
+	// will be treat as last year
+	syslogFutureTolerance = 24 * time.Hour
+)
+
+var (
+	// rfc3164TimestampRegexp like `Oct  9 12:00:00`, `Oct 9 2021 12:00:00.123:`
+	rfc3164TimestampRegexp = regexp.MustCompile(`^([A-Z][a-z]{2}) +(\d{1,2}) +(?:(\d{4}) +)?(\d{1,2}:\d{2}:\d{2}(?:\.\d{1,9})?):? *`)
+	utf8BOM                = []byte{0xef, 0xbb, 0xbf}
+)
+
+// syslogFormat parse RFC5424 & RFC3164 syslog frames,
+// implements `format.Format` of go-syslog
+type syslogFormat struct {
+	// msgKey & timeKey: keys of content & timestamp in parts
+	msgKey, timeKey string
+	// sdKey: RFC5424 structured data will be set in `msg[sdKey][<sd-id>][<param>]`,
+	// or `msg[<sdKey>__<sd-id>__<param>]` if isFlattenSD
+	sdKey       string
+	isFlattenSD bool
+	// isNoHostname: RFC3164 frames contain no hostname
+	isNoHostname bool
+	location     *time.Location
+}
+
+func (f *syslogFormat) GetParser(line []byte) format.LogParser {
+	return &syslogParser{
+		syslogFormat: f,
+		buf:          line,
+		location:     f.location,
+	}
+}
+
+func (f *syslogFormat) GetSplitFunc() bufio.SplitFunc {
+	return splitSyslogFrame
+}
+
+// splitSyslogFrame split TCP stream by octet-counting (RFC6587 3.4.1)
+// or non-transparent framing (RFC6587 3.4.2), detected per frame
+func splitSyslogFrame(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	var i int
+	for i < len(data) && i <= syslogMaxOctetCountingDigits && data[i] >= '0' && data[i] <= '9' {
+		i++
+	}
+	if i > 0 && i <= syslogMaxOctetCountingDigits {
+		if i == len(data) {
+			if !atEOF {
+				return 0, nil, nil // need more data
+			}
+		} else if data[i] == ' ' {
+			length, err := strconv.Atoi(string(data[:i]))
+			if err != nil {
+				return 0, nil, err
+			}
+			end := i + 1 + length
+			if len(data) < end {
+				if atEOF {
+					return len(data), data[i+1:], nil
+				}
+				return 0, nil, nil // need more data
+			}
+			return end, data[i+1 : end], nil
+		}
+	}
+
+	return bufio.ScanLines(data, atEOF)
+}
+
+type syslogParser struct {
+	*syslogFormat
+	buf      []byte
+	location *time.Location
+	parts    format.LogParts
+}
+
+func (p *syslogParser) Location(location *time.Location) {
+	p.location = location
+}
+
+func (p *syslogParser) Dump() format.LogParts {
+	return p.parts
+}
+
+// Parse parse frame into parts, unknown frame will be set into `msgKey` as a whole
+func (p *syslogParser) Parse() (err error) {
+	p.parts = format.LogParts{}
+	line := bytes.TrimRight(p.buf, "\r\n\x00")
+	pri, data, err := parseSyslogPriority(line)
+	if err != nil {
+		p.parts[p.timeKey] = utils.Clock.GetUTCNow()
+		p.parts[p.msgKey] = string(line)
+		return err
+	}
+	p.parts["priority"] = pri
+	p.parts["facility"] = pri / 8
+	p.parts["severity"] = pri % 8
+	p.parts["facility_name"] = library.SyslogFacilityNames[pri/8]
+	p.parts["severity_name"] = library.SyslogSeverityNames[pri%8]
+
+	if len(data) > 1 && data[0] >= '1' && data[0] <= '9' && data[1] == ' ' {
+		return p.parseRFC5424(data)
+	}
+
+	p.parseRFC3164(data)
+	return nil
+}
+
+// parseSyslogPriority parse `<PRI>`
+func parseSyslogPriority(line []byte) (pri int, rest []byte, err error) {
+	if len(line) < 3 || line[0] != '<' {
+		return 0, line, fmt.Errorf("no priority")
+	}
+
+	end := bytes.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return 0, line, fmt.Errorf("invalid priority")
+	}
+	if pri, err = strconv.Atoi(string(line[1:end])); err != nil || pri < 0 || pri > 191 {
+		return 0, line, fmt.Errorf("invalid priority `%s`", line[1:end])
+	}
+
+	return pri, line[end+1:], nil
+}
+
+// parseRFC5424 parse `VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP SD [SP MSG]`
+func (p *syslogParser) parseRFC5424(data []byte) (err error) {
+	header := make([]string, 6)
+	for i := range header {
+		idx := bytes.IndexByte(data, ' ')
+		if idx < 0 {
+			header[i] = string(data)
+			data = data[len(data):]
+			continue
+		}
+		header[i] = string(data[:idx])
+		data = data[idx+1:]
+	}
+
+	p.parts["version"], _ = strconv.Atoi(header[0])
+	p.parts["hostname"] = syslogNilValue(header[2])
+	p.parts["app_name"] = syslogNilValue(header[3])
+	p.parts["proc_id"] = syslogNilValue(header[4])
+	p.parts["msg_id"] = syslogNilValue(header[5])
+	if header[1] == "-" {
+		p.parts[p.timeKey] = utils.Clock.GetUTCNow()
+	} else if p.parts[p.timeKey], err = time.Parse(time.RFC3339Nano, header[1]); err != nil {
+		p.parts[p.timeKey] = utils.Clock.GetUTCNow()
+		err = fmt.Errorf("invalid timestamp `%v`", header[1])
+	}
+
+	sd, data, sdErr := parseStructuredData(data)
+	if sdErr != nil && err == nil {
+		err = sdErr
+	}
+	if len(sd) != 0 {
+		if p.isFlattenSD {
+			for id, params := range sd {
+				for k, v := range params.(map[string]interface{}) {
+					p.parts[p.sdKey+"__"+id+"__"+k] = v
+				}
+			}
+		} else {
+			p.parts[p.sdKey] = sd
+		}
+	}
+
+	if len(data) > 0 && data[0] == ' ' {
+		data = data[1:]
+	}
+	p.parts[p.msgKey] = string(bytes.TrimPrefix(data, utf8BOM))
+	return err
+}
+
+func syslogNilValue(v string) string {
+	if v == "-" {
+		return ""
+	}
+	return v
+}
+
+// parseStructuredData parse `-` or `[id param="value" ...][id2 ...]`,
+// repeated param will be collected into `[]string`
+func parseStructuredData(data []byte) (sd map[string]interface{}, rest []byte, err error) {
+	if len(data) == 0 {
+		return nil, data, nil
+	}
+	if data[0] == '-' {
+		return nil, data[1:], nil
+	}
+
+	sd = map[string]interface{}{}
+	for len(data) > 0 && data[0] == '[' {
+		data = data[1:]
+		end := bytes.IndexAny(data, " ]")
+		if end <= 0 {
+			return sd, data, fmt.Errorf("invalid structured data id")
+		}
+		id := string(data[:end])
+		data = data[end:]
+		params, ok := sd[id].(map[string]interface{})
+		if !ok {
+			params = map[string]interface{}{}
+			sd[id] = params
+		}
+
+		for {
+			if len(data) == 0 {
+				return sd, data, fmt.Errorf("unterminated structured data `%v`", id)
+			}
+			if data[0] == ']' {
+				data = data[1:]
+				break
+			}
+			if data[0] != ' ' {
+				return sd, data, fmt.Errorf("invalid structured data `%v`", id)
+			}
+
+			data = data[1:]
+			eq := bytes.IndexByte(data, '=')
+			if eq <= 0 || eq+1 >= len(data) || data[eq+1] != '"' {
+				return sd, data, fmt.Errorf("invalid param in structured data `%v`", id)
+			}
+			name := string(data[:eq])
+			data = data[eq+2:]
+
+			var (
+				value  []byte
+				closed bool
+			)
+			for i := 0; i < len(data); i++ {
+				switch data[i] {
+				case '\\':
+					if i+1 < len(data) && (data[i+1] == '"' || data[i+1] == '\\' || data[i+1] == ']') {
+						i++
+					}
+				case '"':
+					closed = true
+				}
+				if closed {
+					data = data[i+1:]
+					break
+				}
+				value = append(value, data[i])
+			}
+			if !closed {
+				return sd, data, fmt.Errorf("unterminated param `%v` in structured data `%v`", name, id)
+			}
+
+			switch v := params[name].(type) {
+			case nil:
+				params[name] = string(value)
+			case string:
+				params[name] = []string{v, string(value)}
+			case []string:
+				params[name] = append(v, string(value))
+			}
+		}
+	}
+
+	return sd, data, nil
+}
+
+// parseRFC3164 parse `TIMESTAMP SP HOSTNAME SP TAG[PID]: CONTENT`,
+// tolerant with quirks of network devices:
+//   - leading `*` or `.` before timestamp (cisco clock sync)
+//   - timestamp with year, milliseconds or trailing colon, or RFC3339 timestamp
+//   - missing timestamp, missing hostname
+func (p *syslogParser) parseRFC3164(data []byte) {
+	data = bytes.TrimLeft(data, "*.")
+	var (
+		ts   time.Time
+		isTS bool
+	)
+	if ts, data, isTS = p.parseRFC3164Timestamp(data); !isTS {
+		// RFC3164 4.3.2, whole frame is content
+		p.parts[p.timeKey] = utils.Clock.GetUTCNow()
+		p.parts["hostname"] = ""
+		p.parts[p.msgKey] = strings.TrimSpace(string(data))
+		return
+	}
+	p.parts[p.timeKey] = ts
+
+	var hostname string
+	if !p.isNoHostname {
+		if end := bytes.IndexByte(data, ' '); end > 0 {
+			hostname = string(data[:end])
+			if strings.HasSuffix(hostname, ":") || strings.Contains(hostname, "[") {
+				// it's tag
+				hostname = ""
+			} else {
+				data = data[end+1:]
+			}
+		}
+	}
+	p.parts["hostname"] = hostname
+
+	var tag, pid string
+	if end := bytes.IndexAny(data, "[: "); end > 0 {
+		tag = string(data[:end])
+		data = data[end:]
+		if data[0] == '[' {
+			if pidEnd := bytes.IndexByte(data, ']'); pidEnd > 0 {
+				pid = string(data[1:pidEnd])
+				data = data[pidEnd+1:]
+			}
+		}
+		if len(data) > 0 && data[0] == ':' {
+			data = data[1:]
+		}
+	}
+	p.parts["tag"] = tag
+	p.parts["app_name"] = tag
+	p.parts["proc_id"] = pid
+	p.parts[p.msgKey] = strings.TrimSpace(string(data))
+}
+
+func (p *syslogParser) parseRFC3164Timestamp(data []byte) (ts time.Time, rest []byte, ok bool) {
+	if len(data) > 0 && data[0] >= '0' && data[0] <= '9' {
+		end := bytes.IndexByte(data, ' ')
+		if end < 0 {
+			end = len(data)
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, strings.TrimSuffix(string(data[:end]), ":")); err == nil {
+			return ts, bytes.TrimLeft(data[end:], " "), true
+		}
+		return ts, data, false
+	}
+
+	matched := rfc3164TimestampRegexp.FindSubmatch(data)
+	if matched == nil {
+		return ts, data, false
+	}
+
+	year := string(matched[3])
+	now := utils.Clock.GetUTCNow().In(p.location)
+	if year == "" {
+		year = strconv.Itoa(now.Year())
+	}
+	ts, err := time.ParseInLocation("Jan 2 2006 15:04:05.999999999",
+		string(matched[1])+" "+string(matched[2])+" "+year+" "+string(matched[4]),
+		p.location)
+	if err != nil {
+		return ts, data, false
+	}
+	if len(matched[3]) == 0 && ts.Sub(now) > syslogFutureTolerance {
+		// logs of December received in January
+		ts = ts.AddDate(-1, 0, 0)
+	}
+
+	return ts, data[len(matched[0]):], true
+}
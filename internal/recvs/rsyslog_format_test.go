@@ -0,0 +1,180 @@
+package recvs
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitSyslogFrame(t *testing.T) {
+	stream := "<34>Oct 11 22:14:15 host su: a\n" +
+		"32 <34>Oct 11 22:14:15 host su: b\nc" +
+		"<34>Oct 11 22:14:15 host su: d\r\n" +
+		"10 0123456789"
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	scanner.Split(splitSyslogFrame)
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	expect := []string{
+		"<34>Oct 11 22:14:15 host su: a",
+		"<34>Oct 11 22:14:15 host su: b\nc",
+		"<34>Oct 11 22:14:15 host su: d",
+		"0123456789",
+	}
+	if len(frames) != len(expect) {
+		t.Fatalf("got %q", frames)
+	}
+	for i := range expect {
+		if frames[i] != expect[i] {
+			t.Fatalf("expect %q, got %q", expect[i], frames[i])
+		}
+	}
+
+	// incomplete octet-counting frame
+	if advance, token, err := splitSyslogFrame([]byte("30 <34>Oct"), false); advance != 0 || token != nil || err != nil {
+		t.Fatalf("got %v, %q, %+v", advance, token, err)
+	}
+	if advance, token, err := splitSyslogFrame([]byte("30"), false); advance != 0 || token != nil || err != nil {
+		t.Fatalf("got %v, %q, %+v", advance, token, err)
+	}
+}
+
+func TestSyslogParserRFC5424(t *testing.T) {
+	f := &syslogFormat{msgKey: "content", timeKey: "timestamp", sdKey: "sd", location: time.UTC}
+	p := f.GetParser([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high" ip="1.1.1.1" ip="2.2.2.2" note="a \"quoted\\\] \x"] ` + "\xef\xbb\xbfAn application event log entry..."))
+	if err := p.Parse(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	parts := p.Dump()
+
+	for k, v := range map[string]interface{}{
+		"facility":      20,
+		"severity":      5,
+		"facility_name": "local4",
+		"severity_name": "notice",
+		"version":       1,
+		"hostname":      "mymachine.example.com",
+		"app_name":      "evntslog",
+		"proc_id":       "",
+		"msg_id":        "ID47",
+		"content":       "An application event log entry...",
+	} {
+		if parts[k] != v {
+			t.Fatalf("expect %v=%v, got %v", k, v, parts[k])
+		}
+	}
+	if ts := parts["timestamp"].(time.Time); !ts.Equal(time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC)) {
+		t.Fatalf("got %v", ts)
+	}
+
+	sd := parts["sd"].(map[string]interface{})
+	if v := sd["exampleSDID@32473"].(map[string]interface{})["eventID"]; v != "1011" {
+		t.Fatalf("got %v", v)
+	}
+	pri := sd["examplePriority@32473"].(map[string]interface{})
+	if ips := pri["ip"].([]string); len(ips) != 2 || ips[1] != "2.2.2.2" {
+		t.Fatalf("got %v", ips)
+	}
+	if pri["note"] != `a "quoted\] \x` {
+		t.Fatalf("got %v", pri["note"])
+	}
+
+	// flatten & nil values
+	f.isFlattenSD = true
+	p = f.GetParser([]byte(`<14>1 - - - - - [a b="c"]`))
+	if err := p.Parse(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	parts = p.Dump()
+	if parts["sd__a__b"] != "c" || parts["hostname"] != "" || parts["content"] != "" {
+		t.Fatalf("got %+v", parts)
+	}
+
+	// no structured data
+	p = f.GetParser([]byte(`<14>1 2003-10-11T22:14:15Z host app 123 - - hello world`))
+	if err := p.Parse(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if parts = p.Dump(); parts["content"] != "hello world" || parts["proc_id"] != "123" {
+		t.Fatalf("got %+v", parts)
+	}
+
+	// invalid structured data
+	p = f.GetParser([]byte(`<14>1 2003-10-11T22:14:15Z host app 123 - [a b="c] hello`))
+	if err := p.Parse(); err == nil {
+		t.Fatal("should be invalid")
+	}
+}
+
+func TestSyslogParserRFC3164(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	// parts are set by configured keys
+	f := &syslogFormat{msgKey: "log", timeKey: "ts", location: loc}
+
+	for _, c := range []struct {
+		line, ts, hostname, tag, pid, content string
+	}{
+		{"<34>Oct 11 22:14:15 mymachine su: 'su root' failed", "10-11 22:14:15", "mymachine", "su", "", "'su root' failed"},
+		{"<34>Oct  1 22:14:15 mymachine sshd[123]: hello", "10-01 22:14:15", "mymachine", "sshd", "123", "hello"},
+		// cisco
+		{"<189>*Oct 11 2020 22:14:15.123: %SYS-5-CONFIG_I: Configured", "2020-10-11 22:14:15.123", "", "%SYS-5-CONFIG_I", "", "Configured"},
+		// no hostname
+		{"<13>Oct 11 22:14:15 app[1]: hello", "10-11 22:14:15", "", "app", "1", "hello"},
+		// rfc3339 timestamp
+		{"<13>2020-10-11T22:14:15.5+08:00 host app: hello", "2020-10-11 22:14:15.5", "host", "app", "", "hello"},
+		// no timestamp
+		{"<13>hello world", "", "", "", "", "hello world"},
+	} {
+		p := f.GetParser([]byte(c.line))
+		if err := p.Parse(); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		parts := p.Dump()
+		if parts["hostname"] != c.hostname || parts["log"] != c.content {
+			t.Fatalf("%v: got %+v", c.line, parts)
+		}
+		if c.ts == "" {
+			continue
+		}
+		if parts["tag"] != c.tag || parts["proc_id"] != c.pid {
+			t.Fatalf("%v: got %+v", c.line, parts)
+		}
+
+		ts := parts["ts"].(time.Time)
+		if !strings.HasPrefix(c.ts, "20") {
+			if got := ts.In(loc).Format("01-02 15:04:05"); got != c.ts {
+				t.Fatalf("%v: expect %v, got %v", c.line, c.ts, got)
+			}
+			continue
+		}
+		if expect, _ := time.ParseInLocation("2006-01-02 15:04:05.999", c.ts, loc); !ts.Equal(expect) {
+			t.Fatalf("%v: expect %v, got %v", c.line, expect, ts)
+		}
+	}
+
+	// fixed no hostname
+	f.isNoHostname = true
+	p := f.GetParser([]byte("<13>Oct 11 22:14:15 app hello"))
+	if err := p.Parse(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if parts := p.Dump(); parts["hostname"] != "" || parts["tag"] != "app" || parts["log"] != "hello" {
+		t.Fatalf("got %+v", parts)
+	}
+
+	// not syslog
+	p = f.GetParser([]byte("hello"))
+	if err := p.Parse(); err == nil {
+		t.Fatal("should be invalid")
+	}
+	if parts := p.Dump(); parts["log"] != "hello" {
+		t.Fatalf("got %+v", parts)
+	}
+}
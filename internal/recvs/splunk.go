@@ -0,0 +1,489 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultHECPath           = "/services/collector"
+	defaultHECMaxBodySize    = 10 * 1024 * 1024
+	defaultHECAckIdleTimeout = 10 * time.Minute
+	hecChannelHeader         = "X-Splunk-Request-Channel"
+)
+
+// HEC response codes
+const (
+	hecCodeSuccess        = 0
+	hecCodeTokenRequired  = 2
+	hecCodeInvalidToken   = 4
+	hecCodeNoData         = 5
+	hecCodeInvalidFormat  = 6
+	hecCodeChannelMissing = 10
+	hecCodeInvalidChannel = 11
+	hecCodeEventMissing   = 12
+	hecCodeAckDisabled    = 14
+	hecCodeHealthy        = 17
+)
+
+// HECRecvCfg configuration of HECRecv
+type HECRecvCfg struct {
+	HTTPSrv *gin.Engine
+	Name,
+	// Path: url prefix, default is `/services/collector`
+	Path,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = event` if event is string
+	MsgKey,
+	// TimeKey: set `msg.Message[TimeKey] = time`
+	TimeKey string
+	// Tokens: map[token]tag, token is case-insensitive, tag is template that
+	// `${host}`, `${source}`, `${sourcetype}` & `${index}` will be replaced by event's metadata
+	Tokens      map[string]string
+	MaxBodySize int
+	// IsAckEnabled: enable indexer acknowledgment, clients must send channel.
+	// ack is true after all events of request are persisted by journal.
+	IsAckEnabled bool
+	// AckIdleTimeout: remove channel that not active in this duration
+	AckIdleTimeout time.Duration
+}
+
+// HECRecv recv events by Splunk HTTP Event Collector compatible API
+type HECRecv struct {
+	*BaseRecv
+	*HECRecvCfg
+	logger *utils.LoggerType
+
+	channels     map[string]*hecChannel
+	channelsLock sync.Mutex
+}
+
+// hecChannel track ack ids of one channel
+type hecChannel struct {
+	nextAckID    int64
+	acked        map[int64]struct{}
+	lastActiveAt time.Time
+}
+
+// NewHECRecv create new HECRecv
+func NewHECRecv(cfg *HECRecvCfg) (r *HECRecv) {
+	r = &HECRecv{
+		BaseRecv:   &BaseRecv{},
+		HECRecvCfg: cfg,
+		logger:     log.Logger.Named(cfg.Name),
+		channels:   map[string]*hecChannel{},
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("hec recv invalid", zap.Error(err))
+	}
+
+	for _, p := range []string{"", "/event", "/event/1.0"} {
+		r.HTTPSrv.POST(r.Path+p, r.EventHandler)
+	}
+	for _, p := range []string{"/raw", "/raw/1.0"} {
+		r.HTTPSrv.POST(r.Path+p, r.RawHandler)
+	}
+	r.HTTPSrv.POST(r.Path+"/ack", r.AckHandler)
+	r.HTTPSrv.GET(r.Path+"/health", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, &hecResp{Text: "HEC is healthy", Code: hecCodeHealthy})
+	})
+
+	r.logger.Info("create hec recv",
+		zap.String("path", r.Path),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.String("time_key", r.TimeKey),
+		zap.Int("tokens", len(r.Tokens)),
+		zap.Int("max_body_byte", r.MaxBodySize),
+		zap.Bool("is_ack_enabled", r.IsAckEnabled),
+		zap.Duration("ack_idle_timeout_sec", r.AckIdleTimeout),
+	)
+	return r
+}
+
+func (r *HECRecv) valid() error {
+	if len(r.Tokens) == 0 {
+		return fmt.Errorf("tokens should not be empty")
+	}
+	// keys of map are lowercased by config loader, splunk's GUID tokens are often uppercase
+	tokens := map[string]string{}
+	for token, tag := range r.Tokens {
+		tokens[strings.ToLower(strings.TrimSpace(token))] = tag
+	}
+	r.Tokens = tokens
+
+	if r.Path == "" {
+		r.Path = defaultHECPath
+		r.logger.Info("reset path", zap.String("path", r.Path))
+	}
+	r.Path = strings.TrimRight(r.Path, "/")
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.TimeKey == "" {
+		r.TimeKey = "time"
+		r.logger.Info("reset time_key", zap.String("time_key", r.TimeKey))
+	}
+
+	if r.MaxBodySize <= 0 {
+		r.MaxBodySize = defaultHECMaxBodySize
+		r.logger.Info("reset max_body_byte", zap.Int("max_body_byte", r.MaxBodySize))
+	}
+
+	if r.AckIdleTimeout <= 0 {
+		r.AckIdleTimeout = defaultHECAckIdleTimeout
+		r.logger.Info("reset ack_idle_timeout_sec", zap.Duration("ack_idle_timeout_sec", r.AckIdleTimeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *HECRecv) GetName() string {
+	return r.Name
+}
+
+// Run useless, just capatable for RecvItf
+func (r *HECRecv) Run(ctx context.Context) {
+	r.logger.Info("run HECRecv")
+}
+
+type hecResp struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId,omitempty"`
+}
+
+// hecEvent is one event posted to `/event`
+type hecEvent struct {
+	Time       interface{}            `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	Sourcetype string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      interface{}            `json:"event"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+func (r *HECRecv) errResp(ctx *gin.Context, status, code int, text string) {
+	r.logger.Warn("bad request", zap.String("text", text), zap.String("remote", ctx.ClientIP()))
+	ctx.AbortWithStatusJSON(status, &hecResp{Text: text, Code: code})
+}
+
+// authenticate load tag template by token in `Authorization: Splunk <token>`
+func (r *HECRecv) authenticate(ctx *gin.Context) (tagTpl string, ok bool) {
+	auth := ctx.GetHeader("Authorization")
+	if auth == "" {
+		r.errResp(ctx, http.StatusUnauthorized, hecCodeTokenRequired, "Token is required")
+		return "", false
+	}
+
+	token := auth
+	for _, prefix := range []string{"Splunk ", "Bearer "} {
+		token = strings.TrimPrefix(token, prefix)
+	}
+	if tagTpl, ok = r.Tokens[strings.ToLower(strings.TrimSpace(token))]; !ok {
+		r.errResp(ctx, http.StatusForbidden, hecCodeInvalidToken, "Invalid token")
+		return "", false
+	}
+
+	return tagTpl, true
+}
+
+// loadChannel load channel id from header or query
+func (r *HECRecv) loadChannel(ctx *gin.Context) (channel string, ok bool) {
+	if channel = ctx.GetHeader(hecChannelHeader); channel == "" {
+		channel = ctx.Query("channel")
+	}
+	if r.IsAckEnabled && channel == "" {
+		r.errResp(ctx, http.StatusBadRequest, hecCodeChannelMissing, "Data channel is missing")
+		return "", false
+	}
+
+	return channel, true
+}
+
+func (r *HECRecv) readBody(ctx *gin.Context) ([]byte, bool) {
+	var reader io.Reader = ctx.Request.Body
+	if strings.Contains(ctx.GetHeader("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(ctx.Request.Body)
+		if err != nil {
+			r.errResp(ctx, http.StatusBadRequest, hecCodeInvalidFormat, "Invalid data format")
+			return nil, false
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(r.MaxBodySize)+1))
+	if err != nil {
+		r.errResp(ctx, http.StatusBadRequest, hecCodeInvalidFormat, "Invalid data format")
+		return nil, false
+	}
+	if len(body) > r.MaxBodySize {
+		r.errResp(ctx, http.StatusRequestEntityTooLarge, hecCodeInvalidFormat, "Content too large")
+		return nil, false
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		r.errResp(ctx, http.StatusBadRequest, hecCodeNoData, "No data")
+		return nil, false
+	}
+
+	return body, true
+}
+
+// EventHandler process `/event`, body is concatenated JSON events
+func (r *HECRecv) EventHandler(ctx *gin.Context) {
+	tagTpl, ok := r.authenticate(ctx)
+	if !ok {
+		return
+	}
+	channel, ok := r.loadChannel(ctx)
+	if !ok {
+		return
+	}
+	body, ok := r.readBody(ctx)
+	if !ok {
+		return
+	}
+
+	// parse all events before sending, avoid partial request in journal
+	var (
+		events  []*hecEvent
+		decoder = json.NewDecoder(bytes.NewReader(body))
+	)
+	for decoder.More() {
+		e := &hecEvent{}
+		if err := decoder.Decode(e); err != nil {
+			r.errResp(ctx, http.StatusBadRequest, hecCodeInvalidFormat, "Invalid data format")
+			return
+		}
+		if e.Event == nil {
+			r.errResp(ctx, http.StatusBadRequest, hecCodeEventMissing, "Event field is required")
+			return
+		}
+		events = append(events, e)
+	}
+
+	msgs := make([]*library.FluentMsg, 0, len(events))
+	for _, e := range events {
+		msg := r.msgPool.Get().(*library.FluentMsg)
+		msg.ID = r.counter.Count()
+		msg.Message = map[string]interface{}{}
+		switch v := e.Event.(type) {
+		case string:
+			msg.Message[r.MsgKey] = []byte(v)
+		case map[string]interface{}:
+			for k, fv := range v {
+				msg.Message[k] = fv
+			}
+		default:
+			msg.Message[r.MsgKey] = v
+		}
+		for k, v := range e.Fields {
+			msg.Message[k] = v
+		}
+		r.setMeta(msg, tagTpl, e.Time, e.Host, e.Source, e.Sourcetype, e.Index)
+		msgs = append(msgs, msg)
+	}
+
+	r.sendMsgs(ctx, channel, msgs)
+}
+
+// RawHandler process `/raw`, each line is an event,
+// metadata is loaded from query.
+func (r *HECRecv) RawHandler(ctx *gin.Context) {
+	tagTpl, ok := r.authenticate(ctx)
+	if !ok {
+		return
+	}
+	channel, ok := r.loadChannel(ctx)
+	if !ok {
+		return
+	}
+	body, ok := r.readBody(ctx)
+	if !ok {
+		return
+	}
+
+	var ts interface{}
+	if t := ctx.Query("time"); t != "" {
+		ts = t
+	}
+
+	var msgs []*library.FluentMsg
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		line := bytes.TrimRight(scanner.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+
+		msg := r.msgPool.Get().(*library.FluentMsg)
+		msg.ID = r.counter.Count()
+		msg.Message = map[string]interface{}{
+			r.MsgKey: append([]byte{}, line...),
+		}
+		r.setMeta(msg, tagTpl, ts, ctx.Query("host"), ctx.Query("source"), ctx.Query("sourcetype"), ctx.Query("index"))
+		msgs = append(msgs, msg)
+	}
+
+	r.sendMsgs(ctx, channel, msgs)
+}
+
+// setMeta set metadata & tag of msg
+func (r *HECRecv) setMeta(msg *library.FluentMsg, tagTpl string, ts interface{}, host, source, sourcetype, index string) {
+	switch v := ts.(type) {
+	case float64:
+		msg.Message[r.TimeKey] = v
+	case string: // epoch in string
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			msg.Message[r.TimeKey] = f
+		}
+	}
+
+	meta := map[string]interface{}{}
+	for k, v := range map[string]string{
+		"host":       host,
+		"source":     source,
+		"sourcetype": sourcetype,
+		"index":      index,
+	} {
+		meta[k] = v
+		if v != "" {
+			msg.Message[k] = v
+		}
+	}
+
+	msg.Tag = library.TemplateWithMap(tagTpl, meta)
+	msg.Message[r.TagKey] = msg.Tag
+}
+
+// sendMsgs put msgs into acceptor and response success.
+//
+// if ack enabled, ack id is returned in response,
+// and it will be acked after all msgs are persisted by journal.
+func (r *HECRecv) sendMsgs(ctx *gin.Context, channel string, msgs []*library.FluentMsg) {
+	resp := &hecResp{Text: "Success", Code: hecCodeSuccess}
+	if r.IsAckEnabled {
+		ids := make([]int64, len(msgs))
+		for i, msg := range msgs {
+			ids[i] = msg.ID
+		}
+
+		r.channelsLock.Lock()
+		ch := r.loadHECChannel(channel)
+		ackID := ch.nextAckID
+		ch.nextAckID++
+		r.channelsLock.Unlock()
+		resp.AckID = &ackID
+
+		// must wait before msgs are put into acceptor
+		r.waitPersisted(ids, func(isPersisted bool) {
+			if !isPersisted {
+				// client will resend events after its ack timeout
+				r.logger.Warn("events not persisted, will not be acked",
+					zap.String("channel", channel),
+					zap.Int64("ack_id", ackID))
+				return
+			}
+
+			r.channelsLock.Lock()
+			ch.acked[ackID] = struct{}{}
+			r.channelsLock.Unlock()
+		})
+	}
+
+	for _, msg := range msgs {
+		r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+		r.syncOutChan <- msg // blockable
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// loadHECChannel load or create channel, purge idle channels.
+// should be called with channelsLock.
+func (r *HECRecv) loadHECChannel(channel string) *hecChannel {
+	now := utils.Clock.GetUTCNow()
+	for id, ch := range r.channels {
+		if now.Sub(ch.lastActiveAt) > r.AckIdleTimeout {
+			delete(r.channels, id)
+		}
+	}
+
+	ch, ok := r.channels[channel]
+	if !ok {
+		ch = &hecChannel{acked: map[int64]struct{}{}}
+		r.channels[channel] = ch
+	}
+	ch.lastActiveAt = now
+	return ch
+}
+
+// AckHandler process `/ack`, acked ids are removed after queried
+func (r *HECRecv) AckHandler(ctx *gin.Context) {
+	if !r.IsAckEnabled {
+		r.errResp(ctx, http.StatusBadRequest, hecCodeAckDisabled, "ACK is disabled")
+		return
+	}
+	if _, ok := r.authenticate(ctx); !ok {
+		return
+	}
+	channel, ok := r.loadChannel(ctx)
+	if !ok {
+		return
+	}
+
+	req := &struct {
+		Acks []int64 `json:"acks"`
+	}{}
+	if err := ctx.ShouldBindJSON(req); err != nil {
+		r.errResp(ctx, http.StatusBadRequest, hecCodeInvalidFormat, "Invalid data format")
+		return
+	}
+
+	acks := map[string]bool{}
+	r.channelsLock.Lock()
+	ch, ok := r.channels[channel]
+	if !ok {
+		r.channelsLock.Unlock()
+		r.errResp(ctx, http.StatusBadRequest, hecCodeInvalidChannel, "Invalid data channel")
+		return
+	}
+	ch.lastActiveAt = utils.Clock.GetUTCNow()
+	for _, id := range req.Acks {
+		_, acks[strconv.FormatInt(id, 10)] = ch.acked[id]
+		delete(ch.acked, id)
+	}
+	r.channelsLock.Unlock()
+
+	ctx.JSON(http.StatusOK, map[string]interface{}{"acks": acks})
+}
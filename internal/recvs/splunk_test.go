@@ -0,0 +1,113 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHECRecv(t *testing.T) {
+	var (
+		srv         = gin.New()
+		syncOutChan = make(chan *library.FluentMsg, 1000)
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notifier := library.NewPersistNotifier(ctx, time.Minute)
+	recv := NewHECRecv(&HECRecvCfg{
+		Name:         "test-hec",
+		HTTPSrv:      srv,
+		Tokens:       map[string]string{"token-a": "appliance.${sourcetype}.sit"},
+		IsAckEnabled: true,
+	})
+	recv.SetCounter(counter)
+	recv.SetMsgPool(msgPool)
+	recv.SetSyncOutChan(syncOutChan)
+	recv.SetPersistNotifier(notifier)
+
+	post := func(path, token string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Splunk "+token)
+		}
+		req.Header.Set("X-Splunk-Request-Channel", "ch-1")
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("/services/collector/event", "", []byte(`{"event":"a"}`)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := post("/services/collector/event", "wrong", []byte(`{"event":"a"}`)); w.Code != http.StatusForbidden {
+		t.Fatalf("got %v", w.Code)
+	}
+	if w := post("/services/collector/event", "token-a", []byte(`{"event":"a"}{"time":1`)); w.Code != http.StatusBadRequest || len(syncOutChan) != 0 {
+		t.Fatalf("got %v", w.Code)
+	}
+
+	// concatenated events, token is case-insensitive
+	w := post("/services/collector/event", "TOKEN-A", []byte(`{"time":1600000000.5,"host":"h1","sourcetype":"fw","event":"hello","fields":{"zone":"a"}}
+{"time":"1600000001","source":"s","event":{"action":"deny"}}`))
+	if w.Code != http.StatusOK || w.Body.String() != `{"text":"Success","code":0,"ackId":0}` {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+	msg := <-syncOutChan
+	ids := []int64{msg.ID}
+	if msg.Tag != "appliance.fw.sit" || string(msg.Message["log"].([]byte)) != "hello" || msg.Message["host"] != "h1" ||
+		msg.Message["zone"] != "a" || msg.Message["time"] != 1600000000.5 || msg.Message["tag"] != "appliance.fw.sit" {
+		t.Fatalf("got %+v", msg)
+	}
+	msg = <-syncOutChan
+	ids = append(ids, msg.ID)
+	if msg.Tag != "appliance..sit" || msg.Message["action"] != "deny" || msg.Message["source"] != "s" || msg.Message["time"] != 1600000001.0 {
+		t.Fatalf("got %+v", msg)
+	}
+
+	// raw
+	w = post("/services/collector/raw?sourcetype=syslog", "token-a", []byte("line 1\r\nline 2\n"))
+	if w.Code != http.StatusOK || w.Body.String() != `{"text":"Success","code":0,"ackId":1}` {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+	var rawIDs []int64
+	for _, expect := range []string{"line 1", "line 2"} {
+		if msg = <-syncOutChan; string(msg.Message["log"].([]byte)) != expect || msg.Tag != "appliance.syslog.sit" {
+			t.Fatalf("got %+v", msg)
+		}
+		rawIDs = append(rawIDs, msg.ID)
+	}
+
+	// not acked before persisted
+	w = post("/services/collector/ack", "token-a", []byte(`{"acks":[0,1,2]}`))
+	if w.Code != http.StatusOK || w.Body.String() != `{"acks":{"0":false,"1":false,"2":false}}` {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+
+	// ack id 0 is persisted, ack id 1 is partially lost
+	for _, id := range ids {
+		notifier.Notify(id, true)
+	}
+	notifier.Notify(rawIDs[0], true)
+	notifier.Notify(rawIDs[1], false)
+	for notifier.Len() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond) // wait callbacks
+
+	w = post("/services/collector/ack", "token-a", []byte(`{"acks":[0,1,2]}`))
+	if w.Code != http.StatusOK || w.Body.String() != `{"acks":{"0":true,"1":false,"2":false}}` {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+	// acked ids are removed after queried
+	w = post("/services/collector/ack", "token-a", []byte(`{"acks":[0]}`))
+	if w.Code != http.StatusOK || w.Body.String() != `{"acks":{"0":false}}` {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+}
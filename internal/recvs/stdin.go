@@ -0,0 +1,143 @@
+package recvs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+)
+
+// StdinRecvCfg configuration of StdinRecv
+type StdinRecvCfg struct {
+	Name,
+	// Format: `json` (newline delimited JSON) or `raw` (lines)
+	Format,
+	// Tag: template of `msg.Tag`, `${<field>}` will be replaced by field in message
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = line` for `raw`
+	MsgKey string
+	// MaxLineSize: max bytes of each line
+	MaxLineSize int
+}
+
+// StdinRecv recv lines from stdin,
+// like `kubectl logs -f xxx | gofluentd ...`
+type StdinRecv struct {
+	*BaseRecv
+	*StdinRecvCfg
+	logger *utils.LoggerType
+	reader io.Reader
+}
+
+// NewStdinRecv create new StdinRecv
+func NewStdinRecv(cfg *StdinRecvCfg) (r *StdinRecv) {
+	r = &StdinRecv{
+		BaseRecv:     &BaseRecv{},
+		StdinRecvCfg: cfg,
+		logger:       log.Logger.Named(cfg.Name),
+		reader:       os.Stdin,
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("stdin recv invalid", zap.Error(err))
+	}
+
+	r.logger.Info("create stdin recv",
+		zap.String("format", r.Format),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.Int("max_line_byte", r.MaxLineSize),
+	)
+	return r
+}
+
+func (r *StdinRecv) valid() error {
+	if r.Tag == "" {
+		return fmt.Errorf("tag should not be empty")
+	}
+
+	switch r.Format {
+	case "":
+		r.Format = "raw"
+		r.logger.Info("reset format", zap.String("format", r.Format))
+	case "json", "raw":
+	default:
+		return fmt.Errorf("unknown format `%v`", r.Format)
+	}
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.MaxLineSize <= 0 {
+		r.MaxLineSize = defaultUnixMaxMessageSize
+		r.logger.Info("reset max_line_byte", zap.Int("max_line_byte", r.MaxLineSize))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *StdinRecv) GetName() string {
+	return r.Name
+}
+
+// Run read stdin until EOF
+func (r *StdinRecv) Run(ctx context.Context) {
+	r.logger.Info("run StdinRecv")
+	defer r.logger.Info("stdin recv exit")
+
+	var (
+		scanner = bufio.NewScanner(r.reader)
+		msg     *library.FluentMsg
+		err     error
+		n       int
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), r.MaxLineSize)
+	for scanner.Scan() {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		msg = r.msgPool.Get().(*library.FluentMsg)
+		if msg.Message, err = parseLineMsg(r.Format, line, r.MsgKey); err != nil {
+			r.logger.Warn("discard invalid line", zap.Error(err), zap.ByteString("line", line))
+			r.msgPool.Put(msg)
+			continue
+		}
+		msg.ID = r.counter.Count()
+		msg.Tag = library.TemplateWithNestedFields(r.Tag, msg.Message)
+		msg.Message[r.TagKey] = msg.Tag
+
+		r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+		r.syncOutChan <- msg // blockable
+		n++
+	}
+	if err = scanner.Err(); err != nil {
+		r.logger.Error("read stdin", zap.Error(err))
+	}
+
+	r.logger.Info("stdin closed", zap.Int("n", n))
+}
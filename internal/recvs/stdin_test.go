@@ -0,0 +1,41 @@
+package recvs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gofluentd/library"
+)
+
+func TestStdinRecv(t *testing.T) {
+	syncOutChan := make(chan *library.FluentMsg, 100)
+	for _, c := range []struct {
+		format, input string
+		expect        []string
+	}{
+		{"raw", "a\n\nb\r\nc", []string{"a", "b", "c"}},
+		{"json", "{\"log\":\"a\"}\nnot json\n{\"log\":\"b\"}\n", []string{"a", "b"}},
+	} {
+		r := NewStdinRecv(&StdinRecvCfg{
+			Name:   "stdin-test",
+			Format: c.format,
+			Tag:    "replay.${log}",
+		})
+		r.SetCounter(counter)
+		r.SetMsgPool(msgPool)
+		r.SetSyncOutChan(syncOutChan)
+		r.reader = strings.NewReader(c.input)
+		r.Run(context.Background())
+
+		if len(syncOutChan) != len(c.expect) {
+			t.Fatalf("%v: got %d msgs", c.format, len(syncOutChan))
+		}
+		for _, expect := range c.expect {
+			msg := <-syncOutChan
+			if msg.Tag != "replay."+expect || msg.Message["tag"] != msg.Tag {
+				t.Fatalf("%v: got %+v", c.format, msg)
+			}
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package recvs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	defaultUnixFileMode       = "0660"
+	defaultUnixMaxMessageSize = 1024 * 1024
+)
+
+// UnixRecvCfg configuration of UnixRecv
+type UnixRecvCfg struct {
+	Name,
+	// Path: path of socket file, existing socket file will be removed
+	Path,
+	// Network: `unix` (stream) or `unixgram` (datagram)
+	Network,
+	// Format: `forward` (fluentd forward msgpack), `json` (newline delimited JSON) or `raw` (lines)
+	Format,
+	// FileMode: permission of socket file in octal, like `0660`
+	FileMode,
+	// Tag: template of `msg.Tag` for `json` & `raw`, `${<field>}` will be replaced by field in message.
+	// `forward` messages use their own tag
+	Tag,
+	// TagKey: set `msg.Message[TagKey] = msg.Tag`
+	TagKey,
+	// MsgKey: set `msg.Message[MsgKey] = line` for `raw`
+	MsgKey string
+	// MaxMessageSize: max bytes of line or datagram
+	MaxMessageSize int
+}
+
+// UnixRecv recv messages from unix domain socket
+type UnixRecv struct {
+	*BaseRecv
+	*UnixRecvCfg
+	logger   *utils.LoggerType
+	fileMode os.FileMode
+}
+
+// NewUnixRecv create new UnixRecv
+func NewUnixRecv(cfg *UnixRecvCfg) (r *UnixRecv) {
+	r = &UnixRecv{
+		BaseRecv:    &BaseRecv{},
+		UnixRecvCfg: cfg,
+		logger:      log.Logger.Named(cfg.Name),
+	}
+	if err := r.valid(); err != nil {
+		r.logger.Panic("unix recv invalid", zap.Error(err))
+	}
+
+	r.logger.Info("create unix recv",
+		zap.String("path", r.Path),
+		zap.String("network", r.Network),
+		zap.String("format", r.Format),
+		zap.String("file_mode", r.FileMode),
+		zap.String("tag", r.Tag),
+		zap.String("tag_key", r.TagKey),
+		zap.String("msg_key", r.MsgKey),
+		zap.Int("max_message_byte", r.MaxMessageSize),
+	)
+	return r
+}
+
+func (r *UnixRecv) valid() error {
+	if r.Path == "" {
+		return fmt.Errorf("path should not be empty")
+	}
+
+	switch r.Network {
+	case "":
+		r.Network = "unix"
+		r.logger.Info("reset network", zap.String("network", r.Network))
+	case "unix", "unixgram":
+	default:
+		return fmt.Errorf("unknown network `%v`", r.Network)
+	}
+
+	switch r.Format {
+	case "":
+		r.Format = "forward"
+		r.logger.Info("reset format", zap.String("format", r.Format))
+	case "forward":
+	case "json", "raw":
+		if r.Tag == "" {
+			return fmt.Errorf("tag should not be empty for format `%v`", r.Format)
+		}
+	default:
+		return fmt.Errorf("unknown format `%v`", r.Format)
+	}
+
+	if r.FileMode == "" {
+		r.FileMode = defaultUnixFileMode
+		r.logger.Info("reset file_mode", zap.String("file_mode", r.FileMode))
+	}
+	mode, err := strconv.ParseUint(r.FileMode, 8, 32)
+	if err != nil {
+		return errors.Wrapf(err, "parse file_mode `%v`", r.FileMode)
+	}
+	r.fileMode = os.FileMode(mode)
+
+	if r.TagKey == "" {
+		r.TagKey = "tag"
+		r.logger.Info("reset tag_key", zap.String("tag_key", r.TagKey))
+	}
+
+	if r.MsgKey == "" {
+		r.MsgKey = "log"
+		r.logger.Info("reset msg_key", zap.String("msg_key", r.MsgKey))
+	}
+
+	if r.MaxMessageSize <= 0 {
+		r.MaxMessageSize = defaultUnixMaxMessageSize
+		r.logger.Info("reset max_message_byte", zap.Int("max_message_byte", r.MaxMessageSize))
+	}
+
+	return nil
+}
+
+// GetName return the name of this recv
+func (r *UnixRecv) GetName() string {
+	return r.Name
+}
+
+// Run starting to listen
+func (r *UnixRecv) Run(ctx context.Context) {
+	r.logger.Info("run UnixRecv")
+	defer r.logger.Info("unix recv exit")
+
+	if err := removeStaleSocket(r.Path); err != nil {
+		r.logger.Panic("remove socket file", zap.Error(err), zap.String("path", r.Path))
+	}
+
+	switch r.Network {
+	case "unix":
+		r.runStream(ctx)
+	case "unixgram":
+		r.runDatagram(ctx)
+	}
+}
+
+// removeStaleSocket remove socket file left by last run,
+// return error if path exists but is not socket
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "stat socket file")
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("`%v` exists and is not socket", path)
+	}
+	return os.Remove(path)
+}
+
+func (r *UnixRecv) runStream(ctx context.Context) {
+	ln, err := net.Listen("unix", r.Path)
+	if err != nil {
+		r.logger.Panic("try to listen socket got error", zap.Error(err), zap.String("path", r.Path))
+	}
+	if err = os.Chmod(r.Path, r.fileMode); err != nil {
+		r.logger.Panic("chmod socket file", zap.Error(err), zap.String("path", r.Path))
+	}
+	r.logger.Info("listening on unix socket...", zap.String("path", r.Path))
+	go func() {
+		<-ctx.Done()
+		ln.Close() // will unlink socket file
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			r.logger.Error("try to accept connection got error", zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		r.logger.Debug("accept new connection")
+		go r.handleConn(ctx, conn)
+	}
+}
+
+func (r *UnixRecv) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if r.Format == "forward" {
+		if err := r.decodeForward(conn); err != nil {
+			r.logger.Warn("decode forward message", zap.Error(err))
+		}
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), r.MaxMessageSize)
+	for scanner.Scan() {
+		r.processLine(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		r.logger.Warn("read connection", zap.Error(err))
+	}
+}
+
+func (r *UnixRecv) runDatagram(ctx context.Context) {
+	conn, err := net.ListenPacket("unixgram", r.Path)
+	if err != nil {
+		r.logger.Panic("try to listen socket got error", zap.Error(err), zap.String("path", r.Path))
+	}
+	if err = os.Chmod(r.Path, r.fileMode); err != nil {
+		r.logger.Panic("chmod socket file", zap.Error(err), zap.String("path", r.Path))
+	}
+	r.logger.Info("listening on unixgram socket...", zap.String("path", r.Path))
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		os.Remove(r.Path)
+	}()
+
+	var (
+		buf = make([]byte, r.MaxMessageSize)
+		n   int
+	)
+	for {
+		if n, _, err = conn.ReadFrom(buf); err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			r.logger.Error("read unixgram", zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if r.Format == "forward" {
+			if err = r.decodeForward(bytes.NewReader(buf[:n])); err != nil {
+				r.logger.Warn("decode forward message", zap.Error(err))
+			}
+			continue
+		}
+
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			r.processLine(line)
+		}
+	}
+}
+
+// decodeForward decode fluentd forward messages until EOF
+func (r *UnixRecv) decodeForward(reader io.Reader) error {
+	var (
+		mr  = msgp.NewReader(reader)
+		v   = library.FluentBatchMsg{nil, nil, nil}
+		eof = msgp.WrapError(io.EOF)
+	)
+	for {
+		if err := v.DecodeMsg(mr); err == eof {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		tag, records, err := loadForwardRecords(v)
+		if err != nil {
+			r.logger.Warn("discard msg since unknown message format", zap.Error(err), zap.String("msg", fmt.Sprint(v)))
+			continue
+		}
+		for _, record := range records {
+			msg := r.msgPool.Get().(*library.FluentMsg)
+			msg.Message = record
+			r.sendMsg(msg, tag)
+		}
+	}
+}
+
+// loadForwardRecords load tag & records from fluentd forward protocol message,
+// support Message, Forward & PackedForward modes
+func loadForwardRecords(v library.FluentBatchMsg) (tag string, records []map[string]interface{}, err error) {
+	if len(v) < 2 {
+		return "", nil, fmt.Errorf("length should not less than 2")
+	}
+
+	switch t := v[0].(type) {
+	case []byte:
+		tag = string(t)
+	case string:
+		tag = t
+	default:
+		return "", nil, fmt.Errorf("tag is not string")
+	}
+
+	loadRecord := func(entryI interface{}) error {
+		entry, ok := entryI.([]interface{})
+		if !ok || len(entry) < 2 {
+			return fmt.Errorf("entry should be `[time, record]`")
+		}
+		record, ok := entry[1].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("record is not map")
+		}
+		records = append(records, record)
+		return nil
+	}
+
+	switch body := v[1].(type) {
+	case []interface{}: // Forward
+		for _, entryI := range body {
+			if err = loadRecord(entryI); err != nil {
+				return "", nil, err
+			}
+		}
+	case []byte: // PackedForward
+		var (
+			reader = msgp.NewReader(bytes.NewReader(body))
+			eof    = msgp.WrapError(io.EOF)
+		)
+		for {
+			entry := library.FluentBatchMsg{nil, nil}
+			if err = entry.DecodeMsg(reader); err == eof {
+				break
+			} else if err != nil {
+				return "", nil, errors.Wrap(err, "decode packed entries")
+			}
+			if err = loadRecord([]interface{}(entry)); err != nil {
+				return "", nil, err
+			}
+		}
+	default: // Message
+		if len(v) < 3 {
+			return "", nil, fmt.Errorf("length of message mode should not less than 3")
+		}
+		if err = loadRecord([]interface{}{v[1], v[2]}); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return tag, records, nil
+}
+
+// processLine parse line by `json` or `raw`, then put into downstream
+func (r *UnixRecv) processLine(line []byte) {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+
+	msg := r.msgPool.Get().(*library.FluentMsg)
+	var err error
+	if msg.Message, err = parseLineMsg(r.Format, line, r.MsgKey); err != nil {
+		r.logger.Warn("discard invalid line", zap.Error(err), zap.ByteString("line", line))
+		r.msgPool.Put(msg)
+		return
+	}
+	r.sendMsg(msg, library.TemplateWithNestedFields(r.Tag, msg.Message))
+}
+
+// parseLineMsg parse line by format `json` or `raw`
+func parseLineMsg(format string, line []byte, msgKey string) (map[string]interface{}, error) {
+	if format == "raw" {
+		return map[string]interface{}{
+			msgKey: append([]byte{}, bytes.TrimRight(line, "\r")...),
+		}, nil
+	}
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(line, &m); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json line")
+	}
+	return m, nil
+}
+
+func (r *UnixRecv) sendMsg(msg *library.FluentMsg, tag string) {
+	msg.ID = r.counter.Count()
+	msg.Tag = tag
+	msg.Message[r.TagKey] = tag
+
+	r.logger.Debug("receive new msg", zap.String("tag", msg.Tag), zap.Int64("id", msg.ID))
+	r.syncOutChan <- msg // blockable
+}
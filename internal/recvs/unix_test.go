@@ -0,0 +1,143 @@
+package recvs
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestLoadForwardRecords(t *testing.T) {
+	// message
+	tag, records, err := loadForwardRecords(library.FluentBatchMsg{"test", 123, map[string]interface{}{"a": "1"}})
+	if err != nil || tag != "test" || len(records) != 1 || records[0]["a"] != "1" {
+		t.Fatalf("got %v, %+v, %+v", tag, records, err)
+	}
+
+	// forward
+	tag, records, err = loadForwardRecords(library.FluentBatchMsg{[]byte("test"), []interface{}{
+		[]interface{}{123, map[string]interface{}{"a": "1"}},
+		[]interface{}{123, map[string]interface{}{"a": "2"}},
+	}})
+	if err != nil || tag != "test" || len(records) != 2 || records[1]["a"] != "2" {
+		t.Fatalf("got %v, %+v, %+v", tag, records, err)
+	}
+
+	// packed forward
+	buf := &bytes.Buffer{}
+	w := msgp.NewWriter(buf)
+	for _, v := range []string{"1", "2", "3"} {
+		if err = (library.FluentBatchMsg{123, map[string]interface{}{"a": v}}).EncodeMsg(w); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+	w.Flush()
+	tag, records, err = loadForwardRecords(library.FluentBatchMsg{"test", buf.Bytes()})
+	if err != nil || tag != "test" || len(records) != 3 || records[2]["a"] != "3" {
+		t.Fatalf("got %v, %+v, %+v", tag, records, err)
+	}
+
+	// invalid
+	if _, _, err = loadForwardRecords(library.FluentBatchMsg{"test", []interface{}{"a"}}); err == nil {
+		t.Fatal("should be invalid")
+	}
+	if _, _, err = loadForwardRecords(library.FluentBatchMsg{123, []interface{}{}}); err == nil {
+		t.Fatal("should be invalid")
+	}
+}
+
+func TestUnixRecv(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gofluentd-unix")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	syncOutChan := make(chan *library.FluentMsg, 100)
+	newRecv := func(cfg *UnixRecvCfg) *UnixRecv {
+		r := NewUnixRecv(cfg)
+		r.SetCounter(counter)
+		r.SetMsgPool(msgPool)
+		r.SetSyncOutChan(syncOutChan)
+		go r.Run(ctx)
+		return r
+	}
+	waitMsg := func() *library.FluentMsg {
+		select {
+		case msg := <-syncOutChan:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+	dial := func(network, path string) net.Conn {
+		for i := 0; i < 30; i++ {
+			if conn, err := net.Dial(network, path); err == nil {
+				return conn
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("cannot dial %v", path)
+		return nil
+	}
+
+	// stream & forward
+	forwardPath := filepath.Join(dir, "forward.sock")
+	newRecv(&UnixRecvCfg{Name: "unix-forward", Path: forwardPath, FileMode: "0600"})
+	conn := dial("unix", forwardPath)
+	defer conn.Close()
+	enc := library.NewFluentEncoder(conn)
+	if err = enc.EncodeBatch("app.forward", []*library.FluentMsg{
+		{Message: map[string]interface{}{"log": "a"}},
+		{Message: map[string]interface{}{"log": "b"}},
+	}); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	enc.Flush()
+	for _, expect := range []string{"a", "b"} {
+		msg := waitMsg()
+		if msg.Tag != "app.forward" || msg.Message["tag"] != "app.forward" || msg.Message["log"] != expect {
+			t.Fatalf("got %+v", msg)
+		}
+	}
+	if fi, err := os.Stat(forwardPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("got %+v, %+v", fi, err)
+	}
+
+	// datagram & json
+	jsonPath := filepath.Join(dir, "json.sock")
+	newRecv(&UnixRecvCfg{Name: "unix-json", Path: jsonPath, Network: "unixgram", Format: "json", Tag: "app.${app}"})
+	gconn := dial("unixgram", jsonPath)
+	defer gconn.Close()
+	if _, err = gconn.Write([]byte("{\"app\":\"x\",\"log\":\"a\"}\nnot json\n{\"app\":\"y\",\"log\":\"b\"}")); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	for _, expect := range []string{"x", "y"} {
+		msg := waitMsg()
+		if msg.Tag != "app."+expect {
+			t.Fatalf("got %+v", msg)
+		}
+	}
+
+	// stale socket file
+	if err = removeStaleSocket(filepath.Join(dir, "not-exists.sock")); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	regular := filepath.Join(dir, "regular")
+	if err = os.WriteFile(regular, []byte("x"), 0600); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if err = removeStaleSocket(regular); err == nil {
+		t.Fatal("should not remove regular file")
+	}
+}
@@ -2,9 +2,14 @@ package senders
 
 import (
 	"context"
+	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
 	"gofluentd/library"
+
+	utils "github.com/Laisky/go-utils"
 )
 
 type SenderItf interface {
@@ -61,3 +66,63 @@ func (s *BaseSender) IsTagSupported(tag string) (ok bool) {
 	_, ok = s.tags[tag]
 	return ok
 }
+
+// renderMsgTemplate replace `${tag}` in template by `msg.Tag`,
+// and `${a.b}` by `msg.Message["a"]["b"]`
+func renderMsgTemplate(tpl string, msg *library.FluentMsg) string {
+	return renderMsgTemplateWithEscape(tpl, msg, nil)
+}
+
+// renderMsgTemplateWithEscape like renderMsgTemplate,
+// but every rendered value will be escaped by `escape` if it is not nil
+func renderMsgTemplateWithEscape(tpl string, msg *library.FluentMsg, escape func(string) string) string {
+	return library.TemplateWithFunc(tpl, func(key string) interface{} {
+		if key == "tag" {
+			return msg.Tag
+		}
+		return library.LoadNestedField(msg.Message, key)
+	}, escape)
+}
+
+// loadMsgTime parse `msg.Message[timeKey]` by layout,
+// return current time if timeKey is empty or failed to parse
+func loadMsgTime(msg *library.FluentMsg, timeKey, layout string) time.Time {
+	if timeKey != "" {
+		switch v := msg.Message[timeKey].(type) {
+		case time.Time:
+			return v.UTC()
+		case string:
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UTC()
+			}
+		case []byte:
+			if t, err := time.Parse(layout, string(v)); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+
+	return utils.Clock.GetUTCNow()
+}
+
+// httpStatusError response of backend with unexpected status code
+type httpStatusError struct {
+	code       int
+	body       []byte
+	retryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("got status %d: %s", e.code, e.body)
+}
+
+// isRetryable whether could succeed by retrying later
+func (e *httpStatusError) isRetryable() bool {
+	return e.code == http.StatusTooManyRequests || e.code >= 500
+}
+
+// isRejected whether messages are rejected as invalid by backend
+// (like out of order or too old), retrying will never succeed
+func (e *httpStatusError) isRejected() bool {
+	return e.code == http.StatusBadRequest
+}
@@ -0,0 +1,28 @@
+package senders
+
+import (
+	"testing"
+
+	"gofluentd/library"
+)
+
+func TestRenderMsgTemplate(t *testing.T) {
+	msg := &library.FluentMsg{
+		Tag: "iot.sit",
+		Message: map[string]interface{}{
+			"tag":    "origin",
+			"device": map[string]interface{}{"id": []byte("d-1")},
+			"n":      1,
+		},
+	}
+	for tpl, expect := range map[string]string{
+		"logs":                        "logs",
+		"${tag}":                      "iot.sit",
+		"${tag}.${device.id}.${n}":    "iot.sit.d-1.1",
+		"${tag}.${device.not_exists}": "iot.sit.",
+	} {
+		if got := renderMsgTemplate(tpl, msg); got != expect {
+			t.Fatalf("%v: expect %v, got %v", tpl, expect, got)
+		}
+	}
+}
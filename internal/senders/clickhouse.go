@@ -0,0 +1,441 @@
+package senders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultClickHouseTimeout       = 30 * time.Second
+	defaultClickHouseTimePrecision = 3
+)
+
+// ClickHouseSenderCfg configuration of ClickHouseSender
+type ClickHouseSenderCfg struct {
+	Name,
+	// Addr: HTTP interface like `http://127.0.0.1:8123`
+	Addr,
+	Username,
+	Password,
+	Database,
+	// Table: default table of tags not in TagTableMap
+	Table,
+	// TimeFormat: layout to parse string of TimeColumns, default RFC3339Nano
+	TimeFormat string
+	// TagTableMap: tag -> table
+	TagTableMap map[string]string
+	// Columns: whitelist of columns like `column` or `column=field` (field like `a.b`),
+	// all fields of message will be inserted (unknown fields skipped) if empty
+	Columns []string
+	// TimeColumns: DateTime64 columns, value will be converted to unix timestamp with TimePrecision
+	TimeColumns                  []string
+	TimePrecision                int
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait, Timeout             time.Duration
+	IsDiscardWhenBlocked         bool
+}
+
+// ClickHouseSender insert messages into ClickHouse by `INSERT ... FORMAT JSONEachRow` via HTTP,
+// messages of each table are inserted in one gzipped request.
+//
+// `insert_deduplication_token` is derived from hostname, table and sorted tag & msg.ID of messages,
+// msg.ID is kept when message is reloaded from journal, so retried insert will be deduplicated by ClickHouse
+// (requires Replicated*MergeTree or `non_replicated_deduplication_window`),
+// while different messages with identical rows are not deduplicated.
+type ClickHouseSender struct {
+	*BaseSender
+	*ClickHouseSenderCfg
+	logger     *utils.LoggerType
+	httpClient *http.Client
+	// columns column -> field
+	columns     [][2]string
+	timeColumns map[string]struct{}
+	hostname    string
+}
+
+// NewClickHouseSender create new ClickHouseSender
+func NewClickHouseSender(cfg *ClickHouseSenderCfg) *ClickHouseSender {
+	s := &ClickHouseSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		ClickHouseSenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("clickhouse sender invalid", zap.Error(err))
+	}
+	s.httpClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 20,
+		},
+		Timeout: s.Timeout,
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new clickhouse sender",
+		zap.String("addr", s.Addr),
+		zap.String("database", s.Database),
+		zap.String("table", s.Table),
+		zap.String("tag_table_map", fmt.Sprint(s.TagTableMap)),
+		zap.Strings("columns", s.Columns),
+		zap.Strings("time_columns", s.TimeColumns),
+		zap.Int("time_precision", s.TimePrecision),
+		zap.String("time_format", s.TimeFormat),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Duration("timeout_sec", s.Timeout),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *ClickHouseSender) valid() error {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+	if s.Table == "" && len(s.TagTableMap) == 0 {
+		return fmt.Errorf("table or tables should not be empty")
+	}
+
+	var err error
+	if s.hostname, err = os.Hostname(); err != nil {
+		return errors.Wrap(err, "load hostname for insert_deduplication_token")
+	}
+
+	for _, col := range s.Columns {
+		kv := strings.SplitN(col, "=", 2)
+		if kv[0] == "" {
+			return fmt.Errorf("invalid column `%v`", col)
+		}
+		if len(kv) == 1 {
+			kv = append(kv, kv[0])
+		}
+		s.columns = append(s.columns, [2]string{kv[0], kv[1]})
+	}
+
+	s.timeColumns = map[string]struct{}{}
+	for _, col := range s.TimeColumns {
+		s.timeColumns[col] = struct{}{}
+	}
+
+	if s.TimePrecision <= 0 {
+		s.TimePrecision = defaultClickHouseTimePrecision
+		s.logger.Info("reset time_precision", zap.Int("time_precision", s.TimePrecision))
+	}
+	if s.TimePrecision > 9 {
+		return fmt.Errorf("time_precision should not be greater than 9")
+	}
+
+	if s.TimeFormat == "" {
+		s.TimeFormat = time.RFC3339Nano
+		s.logger.Info("reset time_format", zap.String("time_format", s.TimeFormat))
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = defaultClickHouseTimeout
+		s.logger.Info("reset timeout_sec", zap.Duration("timeout_sec", s.Timeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *ClickHouseSender) GetName() string {
+	return s.Name
+}
+
+// Spawn starting senders
+func (s *ClickHouseSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn clickhouse sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				err              error
+				nRetry           int
+				ok               bool
+				table            string
+				msgs             []*library.FluentMsg
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+			NEXT_TABLE:
+				for table, msgs = range s.groupByTable(msgBatchDelivery) {
+					nRetry = 0
+					for {
+						if err = s.insert(ctx, table, msgs); err != nil {
+							nRetry++
+							if nRetry > maxRetry {
+								s.logger.Error("try send message",
+									zap.Error(err),
+									zap.String("table", table),
+									zap.Int("num", len(msgs)))
+								for _, msg = range msgs {
+									s.failedChan <- msg
+								}
+								continue NEXT_TABLE
+							}
+							continue
+						}
+
+						break
+					}
+
+					s.logger.Debug("success sent message to backend",
+						zap.String("table", table),
+						zap.Int("batch", len(msgs)))
+					for _, msg = range msgs {
+						s.successedChan <- msg
+					}
+				}
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// groupByTable split messages by table of their tag
+func (s *ClickHouseSender) groupByTable(msgs []*library.FluentMsg) map[string][]*library.FluentMsg {
+	groups := map[string][]*library.FluentMsg{}
+	for _, msg := range msgs {
+		table, ok := s.TagTableMap[msg.Tag]
+		if !ok {
+			if s.Table == "" {
+				s.logger.Warn("discard msg since no table for tag", zap.String("tag", msg.Tag))
+				s.successedChan <- msg
+				continue
+			}
+			table = s.Table
+		}
+		groups[table] = append(groups[table], msg)
+	}
+
+	return groups
+}
+
+// insertQuery like "INSERT INTO `db`.`table` (`a`, `b`) FORMAT JSONEachRow"
+func (s *ClickHouseSender) insertQuery(table string) string {
+	query := "INSERT INTO "
+	if s.Database != "" {
+		query += quoteClickHouseIdentifier(s.Database) + "."
+	}
+	query += quoteClickHouseIdentifier(table)
+	if len(s.columns) != 0 {
+		cols := make([]string, len(s.columns))
+		for i, col := range s.columns {
+			cols[i] = quoteClickHouseIdentifier(col[0])
+		}
+		query += " (" + strings.Join(cols, ", ") + ")"
+	}
+
+	return query + " FORMAT JSONEachRow"
+}
+
+func quoteClickHouseIdentifier(name string) string {
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(name) + "`"
+}
+
+// convertRow convert message to row of columns
+func (s *ClickHouseSender) convertRow(msg *library.FluentMsg) map[string]interface{} {
+	if len(s.columns) == 0 {
+		row := make(map[string]interface{}, len(msg.Message))
+		for k, v := range msg.Message {
+			row[k] = s.convertValue(k, v)
+		}
+		return row
+	}
+
+	row := make(map[string]interface{}, len(s.columns))
+	for _, col := range s.columns {
+		if v := library.LoadNestedField(msg.Message, col[1]); v != nil {
+			row[col[0]] = s.convertValue(col[0], v)
+		}
+	}
+
+	return row
+}
+
+// convertValue convert value of DateTime64 column to unix timestamp like `1609459200.123`,
+// []byte will be converted to string
+func (s *ClickHouseSender) convertValue(col string, v interface{}) interface{} {
+	if _, ok := s.timeColumns[col]; ok {
+		var (
+			t   time.Time
+			err error
+		)
+		switch v := v.(type) {
+		case time.Time:
+			t = v
+		case string:
+			t, err = time.Parse(s.TimeFormat, v)
+		case []byte:
+			t, err = time.Parse(s.TimeFormat, string(v))
+		default:
+			return v
+		}
+		if err != nil {
+			s.logger.Debug("parse time column", zap.Error(err), zap.String("column", col))
+			return v
+		}
+
+		frac := strconv.FormatInt(int64(t.Nanosecond())+1e9, 10)[1 : 1+s.TimePrecision]
+		return strconv.FormatInt(t.Unix(), 10) + "." + frac
+	}
+
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+// dedupToken stable token of batch, derived from hostname, table and sorted tag & msg.ID,
+// retried batch reloaded from journal may be in different order
+func (s *ClickHouseSender) dedupToken(table string, msgs []*library.FluentMsg) string {
+	keys := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		keys = append(keys, msg.Tag+"\x00"+strconv.FormatInt(msg.ID, 10))
+	}
+	sort.Strings(keys)
+
+	h := sha1.New()
+	h.Write([]byte(s.hostname + "\x00" + table + "\x00"))
+	for _, key := range keys {
+		h.Write([]byte(key + "\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// insert messages into table in one request
+func (s *ClickHouseSender) insert(ctx context.Context, table string, msgs []*library.FluentMsg) (err error) {
+	var (
+		buf      = &bytes.Buffer{}
+		gz       = gzip.NewWriter(buf)
+		inserted = make([]*library.FluentMsg, 0, len(msgs))
+		b        []byte
+	)
+	for _, msg := range msgs {
+		if b, err = utils.JSON.Marshal(s.convertRow(msg)); err != nil {
+			s.logger.Warn("discard msg since marshal error", zap.Error(err), zap.String("tag", msg.Tag))
+			continue
+		}
+		inserted = append(inserted, msg)
+		b = append(b, '\n')
+		if _, err = gz.Write(b); err != nil {
+			return errors.Wrap(err, "compress rows")
+		}
+	}
+	if err = gz.Close(); err != nil {
+		return errors.Wrap(err, "compress rows")
+	}
+
+	params := url.Values{}
+	params.Set("query", s.insertQuery(table))
+	params.Set("insert_deduplication_token", s.dedupToken(table, inserted))
+	params.Set("input_format_skip_unknown_fields", "1")
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(s.Addr, "/")+"/?"+params.Encode(), buf)
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "gzip")
+	if s.Username != "" {
+		req.Header.Set("X-ClickHouse-User", s.Username)
+		req.Header.Set("X-ClickHouse-Key", s.Password)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request")
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %d: %s", resp.StatusCode, respBody)
+	}
+
+	return nil
+}
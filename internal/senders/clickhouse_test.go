@@ -0,0 +1,145 @@
+package senders
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func TestClickHouseSender(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		nRequest int
+		tokens   []string
+		body     string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		nRequest++
+		tokens = append(tokens, r.URL.Query().Get("insert_deduplication_token"))
+		if nRequest == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if q := r.URL.Query().Get("query"); q != "INSERT INTO `analytics`.`app_logs` (`ts`, `pod`, `log`) FORMAT JSONEachRow" {
+			t.Errorf("got %v", q)
+		}
+		if r.Header.Get("X-ClickHouse-User") != "default" || r.Header.Get("X-ClickHouse-Key") != "pwd" {
+			t.Errorf("got %+v", r.Header)
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+			return
+		}
+		b, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		body = string(b)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	s := NewClickHouseSender(&ClickHouseSenderCfg{
+		Name:        "clickhouse-test",
+		Addr:        srv.URL,
+		Username:    "default",
+		Password:    "pwd",
+		Database:    "analytics",
+		TagTableMap: map[string]string{"app.sit": "app_logs"},
+		Columns:     []string{"ts=@timestamp", "pod=kubernetes.pod_name", "log"},
+		TimeColumns: []string{"ts"},
+		Tags:        []string{"app.sit"},
+		BatchSize:   2,
+		MaxWait:     time.Second,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(make(chan *library.FluentMsg, 100))
+	inChan := s.Spawn(ctx)
+	inChan <- &library.FluentMsg{
+		Tag: "app.sit",
+		ID:  1,
+		Message: map[string]interface{}{
+			"@timestamp": "2021-01-01T00:00:01.123456Z",
+			"kubernetes": map[string]interface{}{"pod_name": "app-1"},
+			"log":        []byte("hello"),
+			"other":      "x",
+		},
+	}
+	select {
+	case <-successedChan:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if body != `{"log":"hello","pod":"app-1","ts":"1609459201.123"}`+"\n" {
+		t.Fatalf("got %v", body)
+	}
+	// retried insert should have same token
+	if len(tokens) != 2 || tokens[0] == "" || tokens[0] != tokens[1] {
+		t.Fatalf("got %+v", tokens)
+	}
+	mu.Unlock()
+
+	// different ID with same content should not be deduplicated
+	inChan <- &library.FluentMsg{
+		Tag: "app.sit",
+		ID:  2,
+		Message: map[string]interface{}{
+			"@timestamp": "2021-01-01T00:00:01.123456Z",
+			"kubernetes": map[string]interface{}{"pod_name": "app-1"},
+			"log":        []byte("hello"),
+			"other":      "x",
+		},
+	}
+	select {
+	case <-successedChan:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	mu.Lock()
+	if len(tokens) != 3 || tokens[2] == tokens[1] {
+		t.Fatalf("got %+v", tokens)
+	}
+}
+
+func TestClickHouseSenderDedupToken(t *testing.T) {
+	s := &ClickHouseSender{hostname: "host-1"}
+	var (
+		m1 = &library.FluentMsg{Tag: "app.sit", ID: 1, Message: map[string]interface{}{"log": "a"}}
+		m2 = &library.FluentMsg{Tag: "app.sit", ID: 2, Message: map[string]interface{}{"log": "b"}}
+		m3 = &library.FluentMsg{Tag: "app.sit", ID: 2, Message: map[string]interface{}{"log": "c"}}
+	)
+
+	token := s.dedupToken("app_logs", []*library.FluentMsg{m1, m2})
+	// token only depends on ids, not order or content
+	if s.dedupToken("app_logs", []*library.FluentMsg{m2, m1}) != token ||
+		s.dedupToken("app_logs", []*library.FluentMsg{m1, m3}) != token {
+		t.Fatal("token should be same")
+	}
+	if s.dedupToken("other_logs", []*library.FluentMsg{m1, m2}) == token ||
+		s.dedupToken("app_logs", []*library.FluentMsg{m1}) == token {
+		t.Fatal("token should be different")
+	}
+
+	s.hostname = "host-2"
+	if s.dedupToken("app_logs", []*library.FluentMsg{m1, m2}) == token {
+		t.Fatal("token should be different")
+	}
+}
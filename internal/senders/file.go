@@ -0,0 +1,604 @@
+package senders
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	// defaultFileIdleTimeout file not written for this duration will be closed
+	defaultFileIdleTimeout = time.Minute
+	fileRotateTimeLayout   = "20060102T150405.000"
+	defaultFileMode        = "0644"
+)
+
+// FileSenderCfg configuration of FileSender
+type FileSenderCfg struct {
+	Name,
+	// Path: template of file path,
+	// `${tag}` will be replaced by `msg.Tag`, `${<field>}` will be replaced by field in message
+	// (message will be failed if value contains path separator or is `..`),
+	// `%Y %m %d %H %M %S` will be replaced by event time
+	Path,
+	// Format: `json` (JSON lines), `msgpack` (msgpack stream) or `raw` (value of MsgKey per line)
+	Format,
+	MsgKey,
+	// TimeKey: field to load event time, use current time if empty or failed to parse
+	TimeKey,
+	// TimeFormat: layout to parse TimeKey if it is string, default RFC3339Nano
+	TimeFormat,
+	// Compress: compress rotated files by `gzip` or `zstd`, empty means no compression
+	Compress,
+	// FileMode: permission of created files in octal, like `0644`
+	FileMode string
+	// MaxSize: rotate file when exceeds MaxSize bytes, 0 means no limit
+	MaxSize int64
+	// RotateInterval: rotate file opened for more than RotateInterval, 0 means no limit
+	RotateInterval               time.Duration
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait                      time.Duration
+	IsDiscardWhenBlocked         bool
+}
+
+// FileSender write messages into local files,
+// message is successed only after file fsynced,
+// messages could not be written (invalid path or marshal error) are failed.
+//
+// rotated file will be renamed with suffix of rotating time (then compressed if configured).
+type FileSender struct {
+	*BaseSender
+	*FileSenderCfg
+	logger   *utils.LoggerType
+	fileMode os.FileMode
+
+	sync.Mutex
+	files map[string]*fileSenderWriter
+	// compressWG wait compressing rotated files when shutdown
+	compressWG sync.WaitGroup
+}
+
+type fileSenderWriter struct {
+	path                string
+	f                   *os.File
+	w                   *bufio.Writer
+	size                int64
+	openAt, lastWriteAt time.Time
+}
+
+// NewFileSender create new FileSender
+func NewFileSender(cfg *FileSenderCfg) *FileSender {
+	s := &FileSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		FileSenderCfg: cfg,
+		files:         map[string]*fileSenderWriter{},
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("file sender invalid", zap.Error(err))
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new file sender",
+		zap.String("path", s.Path),
+		zap.String("format", s.Format),
+		zap.String("msg_key", s.MsgKey),
+		zap.String("time_key", s.TimeKey),
+		zap.String("time_format", s.TimeFormat),
+		zap.String("compress", s.Compress),
+		zap.String("file_mode", s.FileMode),
+		zap.Int64("max_size", s.MaxSize),
+		zap.Duration("rotate_interval_sec", s.RotateInterval),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *FileSender) valid() error {
+	if s.Path == "" {
+		return fmt.Errorf("path should not be empty")
+	}
+
+	switch s.Format {
+	case "":
+		s.Format = "json"
+		s.logger.Info("reset format", zap.String("format", s.Format))
+	case "json", "msgpack", "raw":
+	default:
+		return fmt.Errorf("unknown format `%v`", s.Format)
+	}
+
+	if s.MsgKey == "" {
+		s.MsgKey = "log"
+		s.logger.Info("reset msg_key", zap.String("msg_key", s.MsgKey))
+	}
+
+	if s.TimeFormat == "" {
+		s.TimeFormat = time.RFC3339Nano
+		s.logger.Info("reset time_format", zap.String("time_format", s.TimeFormat))
+	}
+
+	switch s.Compress {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("unknown compress `%v`", s.Compress)
+	}
+
+	if s.MaxSize < 0 {
+		return fmt.Errorf("max_size should not be negative")
+	}
+	if s.RotateInterval < 0 {
+		return fmt.Errorf("rotate_interval_sec should not be negative")
+	}
+
+	if s.FileMode == "" {
+		s.FileMode = defaultFileMode
+		s.logger.Info("reset file_mode", zap.String("file_mode", s.FileMode))
+	}
+	mode, err := strconv.ParseUint(s.FileMode, 8, 32)
+	if err != nil {
+		return errors.Wrapf(err, "parse file_mode `%v`", s.FileMode)
+	}
+	s.fileMode = os.FileMode(mode)
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *FileSender) GetName() string {
+	return s.Name
+}
+
+// Spawn starting senders
+func (s *FileSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn file sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < s.NFork; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				skipped          []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				err              error
+				nRetry           int
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+
+		NEW_MSG_LOOP:
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					s.closeExpiredFiles()
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				nRetry = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				for {
+					if skipped, err = s.write(msgBatchDelivery); err != nil {
+						nRetry++
+						if nRetry > maxRetry {
+							s.logger.Error("try write message",
+								zap.Error(err),
+								zap.Int("num", len(msgBatchDelivery)))
+							for _, msg = range msgBatchDelivery {
+								s.failedChan <- msg
+							}
+							continue NEW_MSG_LOOP
+						}
+						continue
+					}
+
+					break
+				}
+
+				s.logger.Debug("success write message to file",
+					zap.Int("batch", len(msgBatchDelivery)),
+					zap.Int("skipped", len(skipped)))
+				for _, msg = range msgBatchDelivery {
+					if isFileMsgSkipped(skipped, msg) {
+						s.failedChan <- msg
+						continue
+					}
+					s.successedChan <- msg
+				}
+			}
+		}(i)
+	}
+
+	go func() {
+		wg.Wait()
+		s.closeAllFiles()
+		s.compressWG.Wait()
+		s.logger.Info("all files closed")
+	}()
+	return inChan
+}
+
+// isFileMsgSkipped check whether msg is in skipped,
+// skipped is in the same order as batch
+func isFileMsgSkipped(skipped []*library.FluentMsg, msg *library.FluentMsg) bool {
+	for _, m := range skipped {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+// write append batch into files then fsync them,
+// return messages skipped since invalid path or marshal error
+func (s *FileSender) write(msgs []*library.FluentMsg) (skipped []*library.FluentMsg, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		now     = utils.Clock.GetUTCNow()
+		touched = map[string]*fileSenderWriter{}
+		path    string
+		b       []byte
+		fw      *fileSenderWriter
+	)
+	for _, msg := range msgs {
+		if path, err = s.renderPath(msg); err != nil {
+			s.logger.Warn("skip msg since invalid path", zap.Error(err), zap.String("tag", msg.Tag))
+			skipped = append(skipped, msg)
+			continue
+		}
+		if b, err = s.encode(msg); err != nil {
+			s.logger.Warn("skip msg since marshal error", zap.Error(err), zap.String("tag", msg.Tag))
+			skipped = append(skipped, msg)
+			continue
+		}
+
+		if fw, err = s.getFile(path, now); err != nil {
+			return nil, err
+		}
+		if _, err = fw.w.Write(b); err != nil {
+			return nil, errors.Wrapf(err, "write file `%v`", path)
+		}
+		fw.size += int64(len(b))
+		fw.lastWriteAt = now
+		touched[path] = fw
+	}
+
+	for path, fw = range touched {
+		if err = fw.w.Flush(); err != nil {
+			return nil, errors.Wrapf(err, "flush file `%v`", path)
+		}
+		if err = fw.f.Sync(); err != nil {
+			return nil, errors.Wrapf(err, "fsync file `%v`", path)
+		}
+	}
+
+	return skipped, nil
+}
+
+// getFile load opened file of path, rotate it if exceeds size or interval
+func (s *FileSender) getFile(path string, now time.Time) (fw *fileSenderWriter, err error) {
+	if fw = s.files[path]; fw != nil {
+		if (s.MaxSize > 0 && fw.size >= s.MaxSize) ||
+			(s.RotateInterval > 0 && now.Sub(fw.openAt) >= s.RotateInterval) {
+			if err = s.closeFile(fw, true); err != nil {
+				return nil, err
+			}
+		} else {
+			return fw, nil
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrapf(err, "create dir of `%v`", path)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, s.fileMode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open file `%v`", path)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "stat file `%v`", path)
+	}
+
+	fw = &fileSenderWriter{
+		path:        path,
+		f:           f,
+		w:           bufio.NewWriter(f),
+		size:        stat.Size(),
+		openAt:      now,
+		lastWriteAt: now,
+	}
+	s.files[path] = fw
+	s.logger.Info("open file", zap.String("path", path))
+	return fw, nil
+}
+
+// closeFile flush and close file,
+// file will be renamed and compressed if isRotate or compression enabled,
+// since compressed file could not be appended.
+func (s *FileSender) closeFile(fw *fileSenderWriter, isRotate bool) (err error) {
+	delete(s.files, fw.path)
+	if err = fw.w.Flush(); err != nil {
+		fw.f.Close()
+		return errors.Wrapf(err, "flush file `%v`", fw.path)
+	}
+	if err = fw.f.Sync(); err != nil {
+		fw.f.Close()
+		return errors.Wrapf(err, "fsync file `%v`", fw.path)
+	}
+	if err = fw.f.Close(); err != nil {
+		return errors.Wrapf(err, "close file `%v`", fw.path)
+	}
+	if !isRotate && s.Compress == "" {
+		return nil
+	}
+
+	rotated := s.rotatedPath(fw.path)
+	if err = os.Rename(fw.path, rotated); err != nil {
+		return errors.Wrapf(err, "rotate file `%v`", fw.path)
+	}
+	s.logger.Info("rotate file", zap.String("path", fw.path), zap.String("rotated", rotated))
+
+	if s.Compress != "" {
+		s.compressWG.Add(1)
+		go func() {
+			defer s.compressWG.Done()
+			if err := s.compressFile(rotated); err != nil {
+				s.logger.Error("compress file", zap.Error(err), zap.String("path", rotated))
+			}
+		}()
+	}
+
+	return nil
+}
+
+// rotatedPath return `<path>.<time>[.<n>]` not used by rotated or compressed files
+func (s *FileSender) rotatedPath(path string) string {
+	base := path + "." + utils.Clock.GetUTCNow().Format(fileRotateTimeLayout)
+	rotated := base
+	for n := 1; ; n++ {
+		if !isFileExists(rotated) && !isFileExists(rotated+s.compressedExt()) {
+			return rotated
+		}
+		rotated = base + "." + strconv.Itoa(n)
+	}
+}
+
+func (s *FileSender) compressedExt() string {
+	switch s.Compress {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+func isFileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// closeExpiredFiles close idle files and rotate files exceed interval
+func (s *FileSender) closeExpiredFiles() {
+	s.Lock()
+	defer s.Unlock()
+
+	now := utils.Clock.GetUTCNow()
+	for _, fw := range s.files {
+		var err error
+		switch {
+		case s.RotateInterval > 0 && now.Sub(fw.openAt) >= s.RotateInterval:
+			err = s.closeFile(fw, true)
+		case now.Sub(fw.lastWriteAt) >= defaultFileIdleTimeout:
+			err = s.closeFile(fw, false)
+		}
+		if err != nil {
+			s.logger.Error("close file", zap.Error(err), zap.String("path", fw.path))
+		}
+	}
+}
+
+func (s *FileSender) closeAllFiles() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, fw := range s.files {
+		if err := s.closeFile(fw, false); err != nil {
+			s.logger.Error("close file", zap.Error(err), zap.String("path", fw.path))
+		}
+	}
+}
+
+// compressFile compress file into `<path>.gz` or `<path>.zst`, then remove the original one
+func (s *FileSender) compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "open file")
+	}
+	defer src.Close()
+
+	var (
+		dstPath string
+		dst     *os.File
+		w       io.WriteCloser
+	)
+	dstPath = path + s.compressedExt()
+	if dst, err = os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, s.fileMode); err != nil {
+		return errors.Wrap(err, "create compressed file")
+	}
+	defer dst.Close()
+
+	switch s.Compress {
+	case "gzip":
+		w = gzip.NewWriter(dst)
+	case "zstd":
+		if w, err = zstd.NewWriter(dst); err != nil {
+			return errors.Wrap(err, "new zstd writer")
+		}
+	}
+
+	if _, err = io.Copy(w, src); err != nil {
+		w.Close()
+		return errors.Wrap(err, "compress file")
+	}
+	if err = w.Close(); err != nil {
+		return errors.Wrap(err, "compress file")
+	}
+	if err = dst.Sync(); err != nil {
+		return errors.Wrap(err, "fsync compressed file")
+	}
+
+	return os.Remove(path)
+}
+
+// renderPath render path template by message and its event time,
+// rendered values should not contain path separator or be `..`
+func (s *FileSender) renderPath(msg *library.FluentMsg) (string, error) {
+	var invalid *string
+	path := renderMsgTemplateWithEscape(strftime(s.Path, loadMsgTime(msg, s.TimeKey, s.TimeFormat)), msg, func(v string) string {
+		if v == ".." || strings.ContainsAny(v, `/\`) {
+			invalid = &v
+		}
+		return v
+	})
+	if invalid != nil {
+		return "", fmt.Errorf("value `%v` in path should not contain path separator or be `..`", *invalid)
+	}
+
+	return filepath.Clean(path), nil
+}
+
+func (s *FileSender) encode(msg *library.FluentMsg) (b []byte, err error) {
+	switch s.Format {
+	case "msgpack":
+		// msgpack stream is self-delimited
+		return msgp.AppendIntf(nil, msg.Message)
+	case "raw":
+		switch v := msg.Message[s.MsgKey].(type) {
+		case []byte:
+			b = append(b, v...)
+		case string:
+			b = append(b, v...)
+		default:
+			return nil, fmt.Errorf("`%v` should be string or bytes, got %T", s.MsgKey, v)
+		}
+	default:
+		if b, err = utils.JSON.Marshal(msg.Message); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(b) == 0 || b[len(b)-1] != '\n' {
+		b = append(b, '\n')
+	}
+	return b, nil
+}
+
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'm': "01",
+	'd': "02",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+}
+
+// strftime replace `%Y %m %d %H %M %S` in tpl by t
+func strftime(tpl string, t time.Time) string {
+	if !strings.Contains(tpl, "%") {
+		return tpl
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(tpl); i++ {
+		if tpl[i] == '%' && i+1 < len(tpl) {
+			if layout, ok := strftimeLayouts[tpl[i+1]]; ok {
+				sb.WriteString(t.Format(layout))
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(tpl[i])
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,157 @@
+package senders
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestStrftime(t *testing.T) {
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	for tpl, expect := range map[string]string{
+		"/data/logs":              "/data/logs",
+		"/data/%Y%m%d/%H%M%S.log": "/data/20210304/050607.log",
+		"/data/%Y/100%%/%x.log":   "/data/2021/100%%/%x.log",
+		"/data/${tag}/%Y-%m-%d%":  "/data/${tag}/2021-03-04%",
+	} {
+		if got := strftime(tpl, ts); got != expect {
+			t.Fatalf("%v: expect %v, got %v", tpl, expect, got)
+		}
+	}
+}
+
+func TestFileSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gofluentd-file-sender")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewFileSender(&FileSenderCfg{
+		Name:      "file-test",
+		Path:      dir + "/${tag}/%Y%m%d/%H.log",
+		Format:    "raw",
+		TimeKey:   "@timestamp",
+		Compress:  "zstd",
+		MaxSize:   10,
+		Tags:      []string{"audit"},
+		BatchSize: 3,
+		MaxWait:   100 * time.Millisecond,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+	// 123 could not be written as raw
+	for i, line := range []interface{}{"hello", "world", 123, "12345678901", "bye"} {
+		inChan <- &library.FluentMsg{
+			Tag: "audit",
+			ID:  int64(i),
+			Message: map[string]interface{}{
+				"log":        line,
+				"@timestamp": "2021-03-04T05:06:07.000Z",
+			},
+		}
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case msg := <-successedChan:
+			if msg.ID == 2 {
+				t.Fatal("skipped msg should not be successed")
+			}
+		case msg := <-failedChan:
+			if msg.ID != 2 {
+				t.Fatalf("msg %v should not be failed", msg.ID)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	cancel()
+
+	// files are closed (and compressed) asynchronously
+	var content []string
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		matched, err := filepath.Glob(dir + "/audit/20210304/05.log.*.zst")
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if len(matched) != 3 {
+			continue
+		}
+
+		content = content[:0]
+		for _, fpath := range matched {
+			fp, err := os.Open(fpath)
+			if err != nil {
+				t.Fatalf("got error: %+v", err)
+			}
+			r, err := zstd.NewReader(fp)
+			if err != nil {
+				t.Fatalf("got error: %+v", err)
+			}
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			fp.Close()
+			if err != nil {
+				continue
+			}
+			content = append(content, string(b))
+		}
+		break
+	}
+
+	// rotated by size
+	sort.Strings(content)
+	if strings.Join(content, "|") != "12345678901\n|bye\n|hello\nworld\n" {
+		t.Fatalf("got %q", content)
+	}
+}
+
+func TestFileSenderRenderPath(t *testing.T) {
+	s := NewFileSender(&FileSenderCfg{
+		Name:    "file-path",
+		Path:    "/data/${tag}/${app}.log",
+		TimeKey: "@timestamp",
+		Tags:    []string{"audit"},
+	})
+	for app, expect := range map[string]string{
+		"web":       "/data/audit/web.log",
+		"..web":     "/data/audit/..web.log",
+		"..":        "",
+		"../../etc": "",
+		`..\etc`:    "",
+	} {
+		path, err := s.renderPath(&library.FluentMsg{
+			Tag:     "audit",
+			Message: map[string]interface{}{"app": app},
+		})
+		if expect == "" {
+			if err == nil {
+				t.Fatalf("%v: should got error, got %v", app, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if path != expect {
+			t.Fatalf("%v: got %v", app, path)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package senders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	gelfVersion = "1.1"
+	// defaultGELFChunkSize recommended by Graylog for WAN
+	defaultGELFChunkSize = 1420
+	defaultGELFTimeout   = 30 * time.Second
+	gelfMaxChunks        = 128
+	gelfChunkHeadSize    = 12
+	gelfMinChunkSize     = gelfChunkHeadSize + 1
+)
+
+var (
+	gelfChunkMagic              = []byte{0x1e, 0x0f}
+	gelfInvalidFieldCharRegexp  = regexp.MustCompile(`[^\w.\-]`)
+	gelfReservedAdditionalField = "_id"
+)
+
+// GELFSenderCfg configuration of GELFSender
+type GELFSenderCfg struct {
+	Name,
+	// Addr: like `127.0.0.1:12201`
+	Addr,
+	// Network: `udp` or `tcp`
+	Network,
+	// Compress: `gzip`, `zlib` or `none`, only for udp
+	Compress,
+	// Host, Level: templates,
+	// `${tag}` will be replaced by `msg.Tag`, `${<field>}` will be replaced by field in message.
+	// Level could be syslog severity name (like `info`) or number
+	Host,
+	Level,
+	// MsgKey: field as `short_message`, whole message will be marshaled as JSON if not exists
+	MsgKey,
+	// FullMsgKey: field as `full_message`, optional
+	FullMsgKey,
+	// TimeKey: field to load timestamp, use current time if empty or failed to parse
+	TimeKey,
+	// TimeFormat: layout to parse TimeKey if it is string, default RFC3339Nano
+	TimeFormat string
+	// Fields: map[name]template, additional fields,
+	// other fields in message are also sent as additional fields
+	Fields map[string]string
+	Tags   []string
+	// ChunkSize: max size of udp datagram, message is chunked if larger than it
+	ChunkSize                    int
+	BatchSize, InChanSize, NFork int
+	MaxWait, Timeout             time.Duration
+	IsDiscardWhenBlocked         bool
+}
+
+// GELFSender send messages to Graylog by GELF,
+// udp messages are compressed and chunked, tcp messages are uncompressed and null-delimited.
+type GELFSender struct {
+	*BaseSender
+	*GELFSenderCfg
+	logger *utils.LoggerType
+}
+
+// NewGELFSender create new GELFSender
+func NewGELFSender(cfg *GELFSenderCfg) *GELFSender {
+	s := &GELFSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		GELFSenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("gelf sender invalid", zap.Error(err))
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new gelf sender",
+		zap.String("addr", s.Addr),
+		zap.String("network", s.Network),
+		zap.String("compress", s.Compress),
+		zap.String("host", s.Host),
+		zap.String("level", s.Level),
+		zap.String("msg_key", s.MsgKey),
+		zap.String("full_msg_key", s.FullMsgKey),
+		zap.String("time_key", s.TimeKey),
+		zap.String("time_format", s.TimeFormat),
+		zap.Any("fields", s.Fields),
+		zap.Int("chunk_size", s.ChunkSize),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Duration("timeout_sec", s.Timeout),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *GELFSender) valid() (err error) {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+
+	switch s.Network {
+	case "":
+		s.Network = "udp"
+		s.logger.Info("reset network", zap.String("network", s.Network))
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("unknown network `%v`", s.Network)
+	}
+
+	switch s.Compress {
+	case "":
+		s.Compress = "gzip"
+		s.logger.Info("reset compress", zap.String("compress", s.Compress))
+	case "gzip", "zlib", "none":
+	default:
+		return fmt.Errorf("unknown compress `%v`", s.Compress)
+	}
+
+	if s.Host == "" {
+		if s.Host, err = os.Hostname(); err != nil {
+			return errors.Wrap(err, "load hostname")
+		}
+		s.logger.Info("reset host", zap.String("host", s.Host))
+	}
+
+	if s.Level == "" {
+		s.Level = "info"
+		s.logger.Info("reset level", zap.String("level", s.Level))
+	}
+
+	if s.MsgKey == "" {
+		s.MsgKey = "log"
+		s.logger.Info("reset msg_key", zap.String("msg_key", s.MsgKey))
+	}
+
+	if s.TimeFormat == "" {
+		s.TimeFormat = time.RFC3339Nano
+		s.logger.Info("reset time_format", zap.String("time_format", s.TimeFormat))
+	}
+
+	if s.ChunkSize <= 0 {
+		s.ChunkSize = defaultGELFChunkSize
+		s.logger.Info("reset chunk_size", zap.Int("chunk_size", s.ChunkSize))
+	} else if s.ChunkSize < gelfMinChunkSize {
+		return fmt.Errorf("chunk_size should not less than %d", gelfMinChunkSize)
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = defaultGELFTimeout
+		s.logger.Info("reset timeout_sec", zap.Duration("timeout_sec", s.Timeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *GELFSender) GetName() string {
+	return s.Name
+}
+
+// Spawn starting senders
+func (s *GELFSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn gelf sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				conn             net.Conn
+				err              error
+				nRetry           int
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+			defer func() {
+				if conn != nil {
+					conn.Close()
+				}
+			}()
+
+		NEW_MSG_LOOP:
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				nRetry = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				for {
+					if conn == nil {
+						conn, err = net.DialTimeout(s.Network, s.Addr, s.Timeout)
+					}
+					if err == nil {
+						err = s.send(conn, msgBatchDelivery)
+					}
+					if err != nil {
+						if conn != nil {
+							conn.Close()
+							conn = nil
+						}
+
+						nRetry++
+						if nRetry > maxRetry {
+							s.logger.Error("try send message",
+								zap.Error(err),
+								zap.Int("num", len(msgBatchDelivery)))
+							for _, msg = range msgBatchDelivery {
+								s.failedChan <- msg
+							}
+							continue NEW_MSG_LOOP
+						}
+						continue
+					}
+
+					break
+				}
+
+				s.logger.Debug("success sent message to backend",
+					zap.String("addr", s.Addr),
+					zap.Int("batch", len(msgBatchDelivery)))
+				for _, msg = range msgBatchDelivery {
+					s.successedChan <- msg
+				}
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// send write batch to conn
+func (s *GELFSender) send(conn net.Conn, msgs []*library.FluentMsg) (err error) {
+	if err = conn.SetWriteDeadline(utils.Clock.GetUTCNow().Add(s.Timeout)); err != nil {
+		return errors.Wrap(err, "set write deadline")
+	}
+
+	var (
+		buf     = &bytes.Buffer{}
+		payload []byte
+	)
+	for _, msg := range msgs {
+		if payload, err = utils.JSON.Marshal(s.convertMsg(msg)); err != nil {
+			s.logger.Warn("discard msg since marshal error", zap.Error(err), zap.String("tag", msg.Tag))
+			continue
+		}
+
+		if s.Network == "tcp" {
+			buf.Write(payload)
+			buf.WriteByte(0)
+			continue
+		}
+
+		if payload, err = s.compress(payload); err != nil {
+			s.logger.Warn("discard msg since compress error", zap.Error(err), zap.String("tag", msg.Tag))
+			continue
+		}
+		if err = s.writeChunks(conn, payload); err != nil {
+			return err
+		}
+	}
+
+	if buf.Len() != 0 {
+		if _, err = conn.Write(buf.Bytes()); err != nil {
+			return errors.Wrap(err, "write")
+		}
+	}
+
+	return nil
+}
+
+// convertMsg convert message to GELF,
+// fields are prefixed by `_`, invalid chars in name are replaced by `_`,
+// nested fields are marshaled as JSON string since GELF only accept string or number.
+func (s *GELFSender) convertMsg(msg *library.FluentMsg) map[string]interface{} {
+	m := make(map[string]interface{}, len(msg.Message)+len(s.Fields)+6)
+	for k, v := range msg.Message {
+		if k == s.MsgKey || k == s.FullMsgKey {
+			continue
+		}
+
+		k = "_" + gelfInvalidFieldCharRegexp.ReplaceAllString(k, "_")
+		if k == gelfReservedAdditionalField {
+			continue
+		}
+		switch val := v.(type) {
+		case string, int, int64, int32, float64, float32, uint, uint64, uint32, bool:
+			m[k] = val
+		case []byte:
+			m[k] = string(val)
+		case nil:
+		default:
+			if b, err := utils.JSON.Marshal(val); err == nil {
+				m[k] = string(b)
+			}
+		}
+	}
+	for name, tpl := range s.Fields {
+		m["_"+name] = renderMsgTemplate(tpl, msg)
+	}
+
+	m["version"] = gelfVersion
+	m["host"] = renderMsgTemplate(s.Host, msg)
+	m["level"] = parseSyslogSeverity(renderMsgTemplate(s.Level, msg))
+	m["timestamp"] = float64(loadMsgTime(msg, s.TimeKey, s.TimeFormat).UnixNano()/1e6) / 1e3
+	if _, ok := m["_tag"]; !ok {
+		m["_tag"] = msg.Tag
+	}
+
+	switch v := msg.Message[s.MsgKey].(type) {
+	case []byte:
+		m["short_message"] = string(v)
+	case string:
+		m["short_message"] = v
+	default:
+		b, _ := utils.JSON.Marshal(msg.Message)
+		m["short_message"] = string(b)
+	}
+	if s.FullMsgKey != "" {
+		switch v := msg.Message[s.FullMsgKey].(type) {
+		case []byte:
+			m["full_message"] = string(v)
+		case string:
+			m["full_message"] = v
+		}
+	}
+
+	return m
+}
+
+func (s *GELFSender) compress(payload []byte) ([]byte, error) {
+	var (
+		buf = &bytes.Buffer{}
+		w   io.WriteCloser
+	)
+	switch s.Compress {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "zlib":
+		w = zlib.NewWriter(buf)
+	default:
+		return payload, nil
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, errors.Wrap(err, "write")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "close")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeChunks write payload as one datagram, or chunks if larger than ChunkSize:
+//
+//	magic (2 bytes) | message id (8 bytes) | sequence number (1 byte) | sequence count (1 byte) | data
+func (s *GELFSender) writeChunks(conn net.Conn, payload []byte) (err error) {
+	if len(payload) <= s.ChunkSize {
+		if _, err = conn.Write(payload); err != nil {
+			return errors.Wrap(err, "write datagram")
+		}
+		return nil
+	}
+
+	dataSize := s.ChunkSize - gelfChunkHeadSize
+	nChunks := (len(payload) + dataSize - 1) / dataSize
+	if nChunks > gelfMaxChunks {
+		s.logger.Warn("discard msg since too many chunks",
+			zap.Int("size", len(payload)),
+			zap.Int("chunks", nChunks))
+		return nil
+	}
+
+	chunk := make([]byte, 0, s.ChunkSize)
+	chunk = append(chunk, gelfChunkMagic...)
+	chunk = chunk[:gelfChunkHeadSize]
+	binary.BigEndian.PutUint64(chunk[2:10], rand.Uint64())
+	chunk[11] = byte(nChunks)
+	for i := 0; i < nChunks; i++ {
+		chunk = chunk[:gelfChunkHeadSize]
+		chunk[10] = byte(i)
+		if len(payload) > dataSize {
+			chunk = append(chunk, payload[:dataSize]...)
+			payload = payload[dataSize:]
+		} else {
+			chunk = append(chunk, payload...)
+		}
+
+		if _, err = conn.Write(chunk); err != nil {
+			return errors.Wrap(err, "write chunk "+strconv.Itoa(i))
+		}
+	}
+
+	return nil
+}
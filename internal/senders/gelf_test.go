@@ -0,0 +1,211 @@
+package senders
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func TestGELFSenderConvertMsg(t *testing.T) {
+	s := NewGELFSender(&GELFSenderCfg{
+		Name:       "gelf-test",
+		Addr:       "127.0.0.1:12201",
+		Host:       "${host}",
+		Level:      "${level}",
+		FullMsgKey: "stack",
+		TimeKey:    "ts",
+		Fields:     map[string]string{"app": "${tag}"},
+	})
+	m := s.convertMsg(&library.FluentMsg{Tag: "app.spring", Message: map[string]interface{}{
+		"log":        []byte("hello"),
+		"stack":      "line1\nline2",
+		"host":       "web-1",
+		"level":      "WARN",
+		"ts":         "2021-01-02T03:04:05.123Z",
+		"id":         1,
+		"user-name":  "laisky",
+		"kubernetes": map[string]interface{}{"pod": "spring-1"},
+	}})
+	for k, v := range map[string]interface{}{
+		"version":       "1.1",
+		"short_message": "hello",
+		"full_message":  "line1\nline2",
+		"host":          "web-1",
+		"level":         4,
+		"timestamp":     1609556645.123,
+		"_app":          "app.spring",
+		"_tag":          "app.spring",
+		"_user-name":    "laisky",
+		"_kubernetes":   `{"pod":"spring-1"}`,
+	} {
+		if m[k] != v {
+			t.Errorf("%v: expect %v, got %v", k, v, m[k])
+		}
+	}
+	for _, k := range []string{"_id", "_log", "_stack"} {
+		if _, ok := m[k]; ok {
+			t.Errorf("should not contain %v", k)
+		}
+	}
+}
+
+func TestGELFSenderUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewGELFSender(&GELFSenderCfg{
+		Name:      "gelf-test",
+		Addr:      conn.LocalAddr().String(),
+		ChunkSize: 100,
+		Tags:      []string{"app.spring"},
+		BatchSize: 1,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	// random content could not be compressed, so will be chunked
+	content := make([]byte, 300)
+	for i := range content {
+		content[i] = byte('a' + rand.Intn(26))
+	}
+	inChan <- &library.FluentMsg{Tag: "app.spring", Message: map[string]interface{}{"log": content}}
+	select {
+	case <-successedChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	var (
+		buf    = make([]byte, 65536)
+		chunks = map[byte][]byte{}
+		nChunk byte
+		msgID  []byte
+	)
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if n > 100 || !bytes.Equal(buf[:2], gelfChunkMagic) {
+			t.Fatalf("invalid chunk: %x", buf[:n])
+		}
+		if msgID == nil {
+			msgID = append([]byte{}, buf[2:10]...)
+		} else if !bytes.Equal(msgID, buf[2:10]) {
+			t.Fatalf("got different message id %x", buf[2:10])
+		}
+		nChunk = buf[11]
+		chunks[buf[10]] = append([]byte{}, buf[gelfChunkHeadSize:n]...)
+		if len(chunks) == int(nChunk) {
+			break
+		}
+	}
+	if nChunk < 2 {
+		t.Fatalf("should be chunked, got %d", nChunk)
+	}
+
+	payload := []byte{}
+	for i := byte(0); i < nChunk; i++ {
+		payload = append(payload, chunks[i]...)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if payload, err = ioutil.ReadAll(gz); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	m := map[string]interface{}{}
+	if err = json.Unmarshal(payload, &m); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if m["short_message"] != string(content) || m["_tag"] != "app.spring" {
+		t.Fatalf("got %+v", m)
+	}
+}
+
+func TestGELFSenderTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer ln.Close()
+
+	msgs := make(chan map[string]interface{}, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			b, err := r.ReadBytes(0)
+			if err != nil {
+				return
+			}
+			m := map[string]interface{}{}
+			if err = json.Unmarshal(b[:len(b)-1], &m); err != nil {
+				t.Errorf("got error: %+v", err)
+				return
+			}
+			msgs <- m
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewGELFSender(&GELFSenderCfg{
+		Name:      "gelf-test",
+		Addr:      ln.Addr().String(),
+		Network:   "tcp",
+		Tags:      []string{"app.spring"},
+		BatchSize: 2,
+		MaxWait:   3 * time.Second,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	for _, log := range []string{"0", "1", "2"} {
+		inChan <- &library.FluentMsg{Tag: "app.spring", Message: map[string]interface{}{"log": log}}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		select {
+		case m := <-msgs:
+			if m["short_message"] != []string{"0", "1", "2"}[i] {
+				t.Fatalf("got %+v", m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
@@ -1,9 +1,17 @@
 package senders
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"gofluentd/library"
@@ -11,78 +19,214 @@ import (
 
 	utils "github.com/Laisky/go-utils"
 	"github.com/Laisky/zap"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
 )
 
+const defaultHTTPSenderTimeout = 30 * time.Second
+
+// HTTPSenderCfg configuration of HTTPSender
 type HTTPSenderCfg struct {
-	Name, Addr                                  string
-	Tags                                        []string
-	BatchSize, InChanSize, RetryChanSize, NFork int
-	MaxWait                                     time.Duration
-	IsDiscardWhenBlocked                        bool
+	Name,
+	// Addr: URL template, `${tag}` will be replaced by `msg.Tag`,
+	// `${<field>}` will be replaced by field in message (escaped as path segment or query value)
+	Addr,
+	// Method: default `POST`
+	Method,
+	// Encoding: `json` (array), `ndjson` or `msgpack` (array)
+	Encoding,
+	// AuthType: empty, `basic`, `bearer` or `hmac`
+	AuthType,
+	Username,
+	Password,
+	// Token: bearer token
+	Token,
+	// HMACKey: body actually sent is signed by HMAC-SHA256 with timestamp & nonce,
+	// same as signature verified by http recvs, see library.HTTPHMACValidator for details
+	HMACKey,
+	// HMACKeyID: set `X-Gofluentd-Key-Id` if not empty
+	HMACKeyID string
+	Headers map[string]string
+	// SuccessCodes: status code like `200` or class like `2xx`, default `2xx`
+	SuccessCodes                 []string
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait, Timeout             time.Duration
+	IsGzip, IsDiscardWhenBlocked bool
 }
 
+// HTTPSender send batch of messages to HTTP endpoint,
+// messages with different rendered URL will be sent in different requests.
 type HTTPSender struct {
 	*BaseSender
 	*HTTPSenderCfg
-	retryMsgChan chan *library.FluentMsg
-	httpClient   *http.Client
+	logger     *utils.LoggerType
+	httpClient *http.Client
 }
 
+// NewHTTPSender create new HTTPSender
 func NewHTTPSender(cfg *HTTPSenderCfg) *HTTPSender {
-	log.Logger.Info("new http sender",
-		zap.String("addr", cfg.Addr),
-		zap.Strings("tags", cfg.Tags))
-
-	if cfg.Addr == "" {
-		panic(fmt.Errorf("addr should not be empty: %v", cfg.Addr))
-	}
-
 	s := &HTTPSender{
+		logger: log.Logger.Named(cfg.Name),
 		BaseSender: &BaseSender{
 			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
 		},
 		HTTPSenderCfg: cfg,
-		retryMsgChan:  make(chan *library.FluentMsg, cfg.RetryChanSize),
-		httpClient: &http.Client{ // default http client
-			Transport: &http.Transport{
-				MaxIdleConnsPerHost: 30,
-			},
-			Timeout: 3 * time.Second,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("http sender invalid", zap.Error(err))
+	}
+	s.httpClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 30,
 		},
+		Timeout: s.Timeout,
 	}
+
 	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new http sender",
+		zap.String("addr", s.Addr),
+		zap.String("method", s.Method),
+		zap.String("encoding", s.Encoding),
+		zap.Bool("is_gzip", s.IsGzip),
+		zap.String("auth_type", s.AuthType),
+		zap.Strings("success_codes", s.SuccessCodes),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Duration("timeout_sec", s.Timeout),
+		zap.Strings("tags", s.Tags),
+	)
 	return s
 }
 
+func (s *HTTPSender) valid() error {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+
+	if s.Method == "" {
+		s.Method = http.MethodPost
+		s.logger.Info("reset method", zap.String("method", s.Method))
+	}
+	s.Method = strings.ToUpper(s.Method)
+
+	switch s.Encoding {
+	case "":
+		s.Encoding = "json"
+		s.logger.Info("reset encoding", zap.String("encoding", s.Encoding))
+	case "json", "ndjson", "msgpack":
+	default:
+		return fmt.Errorf("unknown encoding `%v`", s.Encoding)
+	}
+
+	switch s.AuthType {
+	case "":
+	case "basic":
+		if s.Username == "" {
+			return fmt.Errorf("username should not be empty for basic auth")
+		}
+	case "bearer":
+		if s.Token == "" {
+			return fmt.Errorf("token should not be empty for bearer auth")
+		}
+	case "hmac":
+		if s.HMACKey == "" {
+			return fmt.Errorf("hmac_key should not be empty for hmac auth")
+		}
+	default:
+		return fmt.Errorf("unknown auth_type `%v`", s.AuthType)
+	}
+
+	if len(s.SuccessCodes) == 0 {
+		s.SuccessCodes = []string{"2xx"}
+		s.logger.Info("reset success_codes", zap.Strings("success_codes", s.SuccessCodes))
+	}
+	for _, code := range s.SuccessCodes {
+		if !isValidStatusCodeRule(code) {
+			return fmt.Errorf("invalid success code `%v`", code)
+		}
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = defaultHTTPSenderTimeout
+		s.logger.Info("reset timeout_sec", zap.Duration("timeout_sec", s.Timeout))
+	}
+
+	return nil
+}
+
+// isValidStatusCodeRule check rule like `200` or `2xx`
+func isValidStatusCodeRule(rule string) bool {
+	if len(rule) != 3 || rule[0] < '1' || rule[0] > '5' {
+		return false
+	}
+	if strings.ToLower(rule[1:]) == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(rule)
+	return err == nil
+}
+
+// isSuccessStatus check whether status code matches any of SuccessCodes
+func (s *HTTPSender) isSuccessStatus(code int) bool {
+	codeStr := strconv.Itoa(code)
+	for _, rule := range s.SuccessCodes {
+		if rule == codeStr ||
+			(strings.ToLower(rule[1:]) == "xx" && rule[0] == codeStr[0]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetName return the name of this sender
 func (s *HTTPSender) GetName() string {
 	return s.Name
 }
 
+// Spawn starting senders
 func (s *HTTPSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
-	log.Logger.Info("SpawnForTag")
-	inChan := make(chan *library.FluentMsg, s.InChanSize) // for each tag
+	s.logger.Info("spawn http sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
 
-	for i := 0; i < s.NFork; i++ { // parallel to each tag
+	for i := 0; i < s.NFork; i++ {
 		go func(i int) {
-			defer log.Logger.Info("producer exits",
-				zap.Int("i", i),
-				zap.String("name", s.GetName()))
-
 			var (
-				ok               bool
-				nRetry           int
 				maxRetry         = 3
 				msg              *library.FluentMsg
 				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
 				msgBatchDelivery []*library.FluentMsg
 				iBatch           = 0
 				lastT            = time.Unix(0, 0)
-				bulkCtx          = &bulkOpCtx{}
 				err              error
+				nRetry           int
+				ok               bool
+				addr             string
+				msgs             []*library.FluentMsg
 				ticker           = time.NewTicker(s.MaxWait)
 			)
 			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
 
 			for {
 				select {
@@ -90,7 +234,7 @@ func (s *HTTPSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
 					return
 				case msg, ok = <-inChan:
 					if !ok {
-						log.Logger.Info("inChan closed")
+						s.logger.Info("inChan closed")
 						return
 					}
 					msgBatch[iBatch] = msg
@@ -99,7 +243,6 @@ func (s *HTTPSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
 					if iBatch == 0 {
 						continue
 					}
-					msg = msgBatch[iBatch-1]
 				}
 
 				if iBatch < s.BatchSize &&
@@ -109,41 +252,43 @@ func (s *HTTPSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
 				lastT = utils.Clock.GetUTCNow()
 				msgBatchDelivery = msgBatch[:iBatch]
 				iBatch = 0
-
-				nRetry = 0
 				if utils.Settings.GetBool("dry") {
-					log.Logger.Info("send message to backend",
-						zap.Int("batch", len(msgBatchDelivery)),
-						zap.String("log", fmt.Sprint(msgBatch[0].Message)))
 					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
 						s.successedChan <- msg
 					}
 					continue
 				}
 
-			SEND_MSG:
-				if err = s.SendBulkMsgs(bulkCtx, msgBatchDelivery); err != nil {
-					nRetry++
-					if nRetry > maxRetry {
-						log.Logger.Error("discard msg since of sender err",
-							zap.Error(err),
-							zap.String("tag", msg.Tag),
-							zap.Int("num", len(msgBatchDelivery)))
-						for _, msg = range msgBatchDelivery {
-							s.failedChan <- msg
+			NEXT_ADDR:
+				for addr, msgs = range s.groupByAddr(msgBatchDelivery) {
+					nRetry = 0
+					for {
+						if err = s.send(ctx, addr, msgs); err != nil {
+							nRetry++
+							if nRetry > maxRetry {
+								s.logger.Error("try send message",
+									zap.Error(err),
+									zap.String("addr", addr),
+									zap.Int("num", len(msgs)))
+								for _, msg = range msgs {
+									s.failedChan <- msg
+								}
+								continue NEXT_ADDR
+							}
+							continue
 						}
 
-						continue
+						break
 					}
-					goto SEND_MSG
-				}
 
-				log.Logger.Debug("success sent message to backend",
-					zap.String("backend", s.Addr),
-					zap.Int("batch", len(msgBatchDelivery)),
-					zap.String("tag", msg.Tag))
-				for _, msg = range msgBatchDelivery {
-					s.successedChan <- msg
+					s.logger.Debug("success sent message to backend",
+						zap.String("addr", addr),
+						zap.Int("batch", len(msgs)))
+					for _, msg = range msgs {
+						s.successedChan <- msg
+					}
 				}
 			}
 		}(i)
@@ -152,37 +297,121 @@ func (s *HTTPSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
 	return inChan
 }
 
-func (s *HTTPSender) SendBulkMsgs(bulkCtx *bulkOpCtx, msgs []*library.FluentMsg) (err error) {
-	msgCnts := make([]map[string]interface{}, len(msgs))
-	for i, m := range msgs {
-		msgCnts[i] = m.Message
+// groupByAddr split messages by rendered URL
+func (s *HTTPSender) groupByAddr(msgs []*library.FluentMsg) map[string][]*library.FluentMsg {
+	groups := map[string][]*library.FluentMsg{}
+	for _, msg := range msgs {
+		addr := s.renderAddr(msg)
+		groups[addr] = append(groups[addr], msg)
 	}
 
-	bulkCtx.buf.Reset()
-	bulkCtx.gzWriter.Reset(bulkCtx.buf)
-	var jb []byte
-	if jb, err = utils.JSON.Marshal(msgCnts); err != nil {
-		return errors.Wrap(err, "try to marshal messages got error")
+	return groups
+}
+
+// renderAddr render URL template, values are escaped to avoid
+// injecting path segments or query params
+func (s *HTTPSender) renderAddr(msg *library.FluentMsg) string {
+	path, query := s.Addr, ""
+	if i := strings.IndexByte(s.Addr, '?'); i >= 0 {
+		path, query = s.Addr[:i], s.Addr[i:]
 	}
 
-	if _, err = bulkCtx.gzWriter.Write(jb); err != nil {
-		return errors.Wrap(err, "try to compress messages got error")
+	return renderMsgTemplateWithEscape(path, msg, url.PathEscape) +
+		renderMsgTemplateWithEscape(query, msg, url.QueryEscape)
+}
+
+// encode marshal messages into request body
+func (s *HTTPSender) encode(msgs []*library.FluentMsg) (body []byte, contentType string, err error) {
+	switch s.Encoding {
+	case "ndjson":
+		var b []byte
+		for _, msg := range msgs {
+			if b, err = utils.JSON.Marshal(msg.Message); err != nil {
+				return nil, "", errors.Wrap(err, "marshal message")
+			}
+			body = append(body, b...)
+			body = append(body, '\n')
+		}
+		return body, "application/x-ndjson", nil
+	case "msgpack":
+		body = msgp.AppendArrayHeader(body, uint32(len(msgs)))
+		for _, msg := range msgs {
+			if body, err = msgp.AppendIntf(body, msg.Message); err != nil {
+				return nil, "", errors.Wrap(err, "marshal message")
+			}
+		}
+		return body, "application/msgpack", nil
+	default:
+		cnts := make([]map[string]interface{}, len(msgs))
+		for i, msg := range msgs {
+			cnts[i] = msg.Message
+		}
+		if body, err = utils.JSON.Marshal(cnts); err != nil {
+			return nil, "", errors.Wrap(err, "marshal messages")
+		}
+		return body, "application/json", nil
 	}
+}
 
-	bulkCtx.gzWriter.Flush()
-	req, err := http.NewRequest("POST", s.Addr, bulkCtx.buf)
+// send messages to addr in one request
+func (s *HTTPSender) send(ctx context.Context, addr string, msgs []*library.FluentMsg) (err error) {
+	body, contentType, err := s.encode(msgs)
 	if err != nil {
-		return errors.Wrap(err, "try to init es request got error")
+		return err
+	}
+
+	if s.IsGzip {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		if _, err = gz.Write(body); err != nil {
+			return errors.Wrap(err, "compress body")
+		}
+		if err = gz.Close(); err != nil {
+			return errors.Wrap(err, "compress body")
+		}
+		body = buf.Bytes()
 	}
-	req.Header.Set("Content-encoding", "gzip")
+
+	req, err := http.NewRequest(s.Method, addr, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if s.IsGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	switch s.AuthType {
+	case "basic":
+		req.SetBasicAuth(s.Username, s.Password)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	case "hmac":
+		// sign the body actually sent (after compression),
+		// every retry is signed with new timestamp & nonce
+		ts := strconv.FormatInt(utils.Clock.GetUTCNow().Unix(), 10)
+		nonce := uuid.New().String()
+		req.Header.Set(library.HTTPSignTimestampHeader, ts)
+		req.Header.Set(library.HTTPSignNonceHeader, nonce)
+		if s.HMACKeyID != "" {
+			req.Header.Set(library.HTTPSignKeyIDHeader, s.HMACKeyID)
+		}
+		req.Header.Set(library.HTTPSignSignatureHeader, hex.EncodeToString(library.SignHTTPBody([]byte(s.HMACKey), ts, nonce, body)))
+	}
+
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return errors.Wrap(err, "try to request es got error")
+		return errors.Wrap(err, "request")
 	}
-	if err = utils.CheckResp(resp); err != nil {
-		return errors.Wrap(err, "request es got error")
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if !s.isSuccessStatus(resp.StatusCode) {
+		return fmt.Errorf("got status %d: %s", resp.StatusCode, respBody)
 	}
 
-	log.Logger.Debug("httpforward bulk all done", zap.Int("batch", len(msgs)))
 	return nil
 }
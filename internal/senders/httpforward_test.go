@@ -0,0 +1,148 @@
+package senders
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func TestHTTPSender(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		bodies   = map[string]string{}
+		nRequest int
+	)
+	validator, err := library.NewHTTPHMACValidator(map[string][]byte{
+		"v1": []byte("old-secret"),
+		"v2": []byte("secret"),
+	}, time.Minute, time.Minute)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		nRequest++
+		if nRequest == 1 {
+			// should be retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		raw, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		// verified same as http recvs
+		if err = validator.Validate(r.Header, raw); err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		if r.Method != http.MethodPut ||
+			r.Header.Get(library.HTTPSignKeyIDHeader) != "v2" ||
+			r.Header.Get("X-App") != "gofluentd" ||
+			r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("got %+v", r.Header)
+		}
+
+		gz, err := gzip.NewReader(strings.NewReader(string(raw)))
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		body, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		bodies[r.URL.Path] += string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	s := NewHTTPSender(&HTTPSenderCfg{
+		Name:         "http-test",
+		Addr:         srv.URL + "/hooks/${tag}",
+		Method:       "put",
+		Encoding:     "ndjson",
+		IsGzip:       true,
+		AuthType:     "hmac",
+		HMACKey:      "secret",
+		HMACKeyID:    "v2",
+		Headers:      map[string]string{"X-App": "gofluentd"},
+		SuccessCodes: []string{"200", "202"},
+		Tags:         []string{"a", "b"},
+		BatchSize:    3,
+		MaxWait:      100 * time.Millisecond,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(make(chan *library.FluentMsg, 100))
+	inChan := s.Spawn(ctx)
+	for i, tag := range []string{"a", "b", "a"} {
+		inChan <- &library.FluentMsg{Tag: tag, ID: int64(i), Message: map[string]interface{}{"n": i}}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if bodies["/hooks/a"] != "{\"n\":0}\n{\"n\":2}\n" || bodies["/hooks/b"] != "{\"n\":1}\n" {
+		t.Fatalf("got %+v", bodies)
+	}
+}
+
+func TestHTTPSenderEncode(t *testing.T) {
+	msgs := []*library.FluentMsg{
+		{Message: map[string]interface{}{"a": 1}},
+		{Message: map[string]interface{}{"b": "x"}},
+	}
+	for encoding, expect := range map[string]string{
+		"json":    `[{"a":1},{"b":"x"}]`,
+		"msgpack": "\x92\x81\xa1a\x01\x81\xa1b\xa1x",
+	} {
+		s := NewHTTPSender(&HTTPSenderCfg{Name: "http-" + encoding, Addr: "http://127.0.0.1", Encoding: encoding})
+		body, _, err := s.encode(msgs)
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		if string(body) != expect {
+			t.Fatalf("%v: got %q", encoding, body)
+		}
+	}
+
+	s := NewHTTPSender(&HTTPSenderCfg{Name: "http-code", Addr: "http://127.0.0.1"})
+	for code, expect := range map[int]bool{200: true, 204: true, 301: false, 500: false} {
+		if s.isSuccessStatus(code) != expect {
+			t.Fatalf("%d should be %v", code, expect)
+		}
+	}
+}
+
+func TestHTTPSenderRenderAddr(t *testing.T) {
+	s := NewHTTPSender(&HTTPSenderCfg{Name: "http-addr", Addr: "http://127.0.0.1/hooks/${app}?env=${env}&tag=${tag}"})
+	msg := &library.FluentMsg{
+		Tag: "app.sit",
+		Message: map[string]interface{}{
+			"app": []byte("../admin?x=1"),
+			"env": "a&b=c",
+		},
+	}
+	expect := "http://127.0.0.1/hooks/..%2Fadmin%3Fx=1?env=a%26b%3Dc&tag=app.sit"
+	if addr := s.renderAddr(msg); addr != expect {
+		t.Fatalf("got %v", addr)
+	}
+}
@@ -0,0 +1,440 @@
+package senders
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	lokiPushPath           = "/loki/api/v1/push"
+	defaultLokiTimeout     = 30 * time.Second
+	defaultLokiRetryWait   = time.Second
+	maxLokiRetryAfter      = time.Minute
+	lokiTenantHeader       = "X-Scope-OrgID"
+	lokiTagLabel           = "tag"
+	lokiInvalidLabelPrefix = "_"
+)
+
+var lokiInvalidLabelCharRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// LokiSenderCfg configuration of LokiSender
+type LokiSenderCfg struct {
+	Name,
+	// Addr: like `http://127.0.0.1:3100`
+	Addr,
+	// TenantID: set as `X-Scope-OrgID` if not empty
+	TenantID,
+	// Format: `json` (whole message) or `raw` (value of MsgKey) as log line
+	Format,
+	MsgKey,
+	// TimeKey: field to load timestamp of entry, use current time if empty or failed to parse
+	TimeKey,
+	// TimeFormat: layout to parse TimeKey if it is string, default RFC3339Nano
+	TimeFormat string
+	// LabelFields: fields (like `a.b`) to be labels of stream, label `tag` is always set by `msg.Tag`
+	LabelFields                  []string
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait, Timeout             time.Duration
+	IsDiscardWhenBlocked         bool
+}
+
+// LokiSender push messages to Loki by snappy compressed protobuf,
+// messages with same labels are grouped into one stream.
+//
+// 429 and 5xx will be retried after a while,
+// messages rejected by 400 (like out-of-order or too old) will be dropped since retrying will never succeed,
+// other 4xx (like 401, 403, 404, 413) are treated as failed.
+type LokiSender struct {
+	*BaseSender
+	*LokiSenderCfg
+	logger     *utils.LoggerType
+	httpClient *http.Client
+	pushURL    string
+}
+
+// lokiEntry entry in stream
+type lokiEntry struct {
+	ts   time.Time
+	line []byte
+}
+
+// NewLokiSender create new LokiSender
+func NewLokiSender(cfg *LokiSenderCfg) *LokiSender {
+	s := &LokiSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		LokiSenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("loki sender invalid", zap.Error(err))
+	}
+	s.pushURL = strings.TrimRight(s.Addr, "/") + lokiPushPath
+	s.httpClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 20,
+		},
+		Timeout: s.Timeout,
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new loki sender",
+		zap.String("push_url", s.pushURL),
+		zap.String("tenant_id", s.TenantID),
+		zap.String("format", s.Format),
+		zap.String("msg_key", s.MsgKey),
+		zap.String("time_key", s.TimeKey),
+		zap.String("time_format", s.TimeFormat),
+		zap.Strings("label_fields", s.LabelFields),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Duration("timeout_sec", s.Timeout),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *LokiSender) valid() error {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+
+	switch s.Format {
+	case "":
+		s.Format = "json"
+		s.logger.Info("reset format", zap.String("format", s.Format))
+	case "json", "raw":
+	default:
+		return fmt.Errorf("unknown format `%v`", s.Format)
+	}
+
+	if s.MsgKey == "" {
+		s.MsgKey = "log"
+		s.logger.Info("reset msg_key", zap.String("msg_key", s.MsgKey))
+	}
+
+	for _, field := range s.LabelFields {
+		if field == "" {
+			return fmt.Errorf("label_fields should not contain empty field")
+		}
+	}
+
+	if s.TimeFormat == "" {
+		s.TimeFormat = time.RFC3339Nano
+		s.logger.Info("reset time_format", zap.String("time_format", s.TimeFormat))
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = defaultLokiTimeout
+		s.logger.Info("reset timeout_sec", zap.Duration("timeout_sec", s.Timeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *LokiSender) GetName() string {
+	return s.Name
+}
+
+// Spawn starting senders
+func (s *LokiSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn loki sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				body             []byte
+				err              error
+				statusErr        *httpStatusError
+				nRetry           int
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+
+		NEW_MSG_LOOP:
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				nRetry = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				body = s.encode(msgBatchDelivery)
+				for {
+					if err = s.push(ctx, body); err != nil {
+						statusErr, ok = err.(*httpStatusError)
+						if ok && statusErr.isRejected() {
+							// retrying will never succeed (like out of order or too old)
+							s.logger.Warn("drop messages rejected by loki",
+								zap.Error(err),
+								zap.Int("num", len(msgBatchDelivery)))
+							break
+						}
+
+						nRetry++
+						if nRetry > maxRetry || (ok && !statusErr.isRetryable()) {
+							s.logger.Error("try send message",
+								zap.Error(err),
+								zap.Int("num", len(msgBatchDelivery)))
+							for _, msg = range msgBatchDelivery {
+								s.failedChan <- msg
+							}
+							continue NEW_MSG_LOOP
+						}
+
+						wait := defaultLokiRetryWait * time.Duration(nRetry)
+						if ok && statusErr.retryAfter > 0 {
+							wait = statusErr.retryAfter
+						}
+						s.logger.Warn("push to loki, retry later", zap.Error(err), zap.Duration("wait", wait))
+						select {
+						case <-ctx.Done():
+							return
+						case <-time.After(wait):
+						}
+						continue
+					}
+
+					break
+				}
+
+				s.logger.Debug("success sent message to backend",
+					zap.String("push_url", s.pushURL),
+					zap.Int("batch", len(msgBatchDelivery)))
+				for _, msg = range msgBatchDelivery {
+					s.successedChan <- msg
+				}
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// push send snappy compressed PushRequest
+func (s *LokiSender) push(ctx context.Context, body []byte) (err error) {
+	req, err := http.NewRequest(http.MethodPost, s.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if s.TenantID != "" {
+		req.Header.Set(lokiTenantHeader, s.TenantID)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request")
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	statusErr := &httpStatusError{
+		code: resp.StatusCode,
+		body: respBody,
+	}
+	if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+		statusErr.retryAfter = time.Duration(sec) * time.Second
+		if statusErr.retryAfter > maxLokiRetryAfter {
+			statusErr.retryAfter = maxLokiRetryAfter
+		}
+	}
+	return statusErr
+}
+
+// encode group messages into streams by labels,
+// sort entries of each stream by timestamp, then marshal to snappy compressed protobuf.
+func (s *LokiSender) encode(msgs []*library.FluentMsg) []byte {
+	var (
+		streams = map[string][]*lokiEntry{}
+		labels  string
+		line    []byte
+		err     error
+	)
+	for _, msg := range msgs {
+		if line, err = s.marshalLine(msg); err != nil {
+			s.logger.Warn("discard msg since marshal error", zap.Error(err), zap.String("tag", msg.Tag))
+			continue
+		}
+
+		labels = s.renderLabels(msg)
+		streams[labels] = append(streams[labels], &lokiEntry{
+			ts:   loadMsgTime(msg, s.TimeKey, s.TimeFormat),
+			line: line,
+		})
+	}
+
+	return snappy.Encode(nil, marshalLokiPushRequest(streams))
+}
+
+func (s *LokiSender) marshalLine(msg *library.FluentMsg) ([]byte, error) {
+	if s.Format == "json" {
+		return utils.JSON.Marshal(msg.Message)
+	}
+
+	switch v := msg.Message[s.MsgKey].(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("`%v` should be string or bytes, got %T", s.MsgKey, v)
+	}
+}
+
+// renderLabels render labels like `{a="1", tag="app"}` in sorted order,
+// invalid chars in label name will be replaced by `_`
+func (s *LokiSender) renderLabels(msg *library.FluentMsg) string {
+	kvs := make([]string, 0, len(s.LabelFields)+1)
+	kvs = append(kvs, lokiTagLabel+"="+strconv.Quote(msg.Tag))
+	for _, field := range s.LabelFields {
+		var val string
+		switch v := library.LoadNestedField(msg.Message, field).(type) {
+		case nil:
+			continue
+		case string:
+			val = v
+		case []byte:
+			val = string(v)
+		default:
+			val = fmt.Sprint(v)
+		}
+
+		name := lokiInvalidLabelCharRegexp.ReplaceAllString(field, "_")
+		if name[0] >= '0' && name[0] <= '9' {
+			name = lokiInvalidLabelPrefix + name
+		}
+		if name == lokiTagLabel {
+			continue
+		}
+		kvs = append(kvs, name+"="+strconv.Quote(val))
+	}
+
+	sort.Strings(kvs)
+	return "{" + strings.Join(kvs, ", ") + "}"
+}
+
+// marshalLokiPushRequest marshal streams as `logproto.PushRequest`:
+//
+//	message PushRequest { repeated Stream streams = 1; }
+//	message Stream { string labels = 1; repeated Entry entries = 2; }
+//	message Entry { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func marshalLokiPushRequest(streams map[string][]*lokiEntry) (b []byte) {
+	labelsList := make([]string, 0, len(streams))
+	for labels := range streams {
+		labelsList = append(labelsList, labels)
+	}
+	sort.Strings(labelsList)
+
+	var stream, entry, ts []byte
+	for _, labels := range labelsList {
+		entries := streams[labels]
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].ts.Before(entries[j].ts)
+		})
+
+		stream = stream[:0]
+		stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+		stream = protowire.AppendString(stream, labels)
+		for _, e := range entries {
+			ts = ts[:0]
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts.Unix()))
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts.Nanosecond()))
+
+			entry = entry[:0]
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, ts)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, e.line)
+
+			stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+			stream = protowire.AppendBytes(stream, entry)
+		}
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, stream)
+	}
+
+	return b
+}
@@ -0,0 +1,180 @@
+package senders
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// parseLokiPushRequest return labels -> lines
+func parseLokiPushRequest(t *testing.T, b []byte) map[string][]string {
+	fields := func(b []byte) (ret map[protowire.Number][][]byte) {
+		ret = map[protowire.Number][][]byte{}
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 || typ != protowire.BytesType {
+				t.Fatalf("invalid tag: %d, %v", n, typ)
+			}
+			b = b[n:]
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("invalid bytes: %d", n)
+			}
+			b = b[n:]
+			ret[num] = append(ret[num], v)
+		}
+		return ret
+	}
+
+	streams := map[string][]string{}
+	for _, stream := range fields(b)[1] {
+		sf := fields(stream)
+		labels := string(sf[1][0])
+		for _, entry := range sf[2] {
+			streams[labels] = append(streams[labels], string(fields(entry)[2][0]))
+		}
+	}
+	return streams
+}
+
+func TestLokiSender(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		nRequest int
+		streams  map[string][]string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		nRequest++
+		switch nRequest {
+		case 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		case 3:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("entry out of order"))
+			return
+		case 5:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path != "/loki/api/v1/push" || r.Header.Get("X-Scope-OrgID") != "debug" {
+			t.Errorf("got %v, %+v", r.URL, r.Header)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		if body, err = snappy.Decode(nil, body); err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		streams = parseLokiPushRequest(t, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewLokiSender(&LokiSenderCfg{
+		Name:        "loki-test",
+		Addr:        srv.URL + "/",
+		TenantID:    "debug",
+		Format:      "raw",
+		TimeKey:     "ts",
+		LabelFields: []string{"kubernetes.pod-name", "level"},
+		Tags:        []string{"app.debug"},
+		BatchSize:   3,
+		MaxWait:     3 * time.Second,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	// first msg will be sent immediately, retried after 429
+	inChan <- &library.FluentMsg{Tag: "app.debug", Message: map[string]interface{}{"log": "0"}}
+	select {
+	case <-successedChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	for i, ts := range []string{"2021-01-01T00:00:03Z", "2021-01-01T00:00:01Z", "2021-01-01T00:00:02Z"} {
+		inChan <- &library.FluentMsg{
+			Tag: "app.debug",
+			ID:  int64(i),
+			Message: map[string]interface{}{
+				"log":        []byte(ts),
+				"ts":         ts,
+				"level":      "debug",
+				"kubernetes": map[string]interface{}{"pod-name": "app-1"},
+			},
+		}
+	}
+	// out of order, dropped without retry
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+		case <-failedChan:
+			t.Fatal("rejected msg should be dropped")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	for i, ts := range []string{"2021-01-01T00:00:03Z", "2021-01-01T00:00:01Z", "2021-01-01T00:00:02Z"} {
+		msg := &library.FluentMsg{Tag: "app.debug", ID: int64(i), Message: map[string]interface{}{"log": ts, "ts": ts}}
+		if i != 1 {
+			msg.Message["level"] = "debug"
+			msg.Message["kubernetes"] = map[string]interface{}{"pod-name": "app-1"}
+		}
+		inChan <- msg
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// unauthorized, failed without retry
+	for i := 0; i < 3; i++ {
+		inChan <- &library.FluentMsg{Tag: "app.debug", ID: int64(i), Message: map[string]interface{}{"log": "x"}}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+			t.Fatal("unauthorized msg should be failed")
+		case <-failedChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nRequest != 5 {
+		t.Fatalf("got %d requests", nRequest)
+	}
+	if len(streams) != 2 ||
+		len(streams[`{kubernetes_pod_name="app-1", level="debug", tag="app.debug"}`]) != 2 ||
+		streams[`{kubernetes_pod_name="app-1", level="debug", tag="app.debug"}`][0] != "2021-01-01T00:00:02Z" ||
+		streams[`{tag="app.debug"}`][0] != "2021-01-01T00:00:01Z" {
+		t.Fatalf("got %+v", streams)
+	}
+}
@@ -0,0 +1,555 @@
+package senders
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultMetricsTimeout   = 30 * time.Second
+	defaultMetricsRetryWait = time.Second
+	prometheusMetricName    = "__name__"
+)
+
+var (
+	prometheusInvalidMetricCharRegexp = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	influxMeasurementEscaper          = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	influxKeyEscaper                  = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+)
+
+// MetricsSenderCfg configuration of MetricsSender
+type MetricsSenderCfg struct {
+	Name,
+	// Addr: like `http://127.0.0.1:8086/api/v2/write?org=org&bucket=logs` for influx,
+	// `http://127.0.0.1:9090/api/v1/write` for prometheus
+	Addr,
+	// Protocol: `influx` (line protocol) or `prometheus` (remote-write)
+	Protocol,
+	// Measurement: template of measurement (metric name prefix for prometheus),
+	// `${tag}` will be replaced by `msg.Tag`, `${<field>}` will be replaced by field in message.
+	Measurement,
+	// TimeKey: field to load timestamp, use current time if empty or failed to parse
+	TimeKey,
+	// TimeFormat: layout to parse TimeKey if it is string, default RFC3339Nano
+	TimeFormat string
+	// TagFields: map[name]template, tags of influx or labels of prometheus, empty value is skipped
+	TagFields map[string]string
+	// ValueFields: fields like `name` or `name=field` (field like `a.b`), numeric string will be parsed,
+	// all numeric fields in message are used if empty
+	ValueFields []string
+	// Headers: like `Authorization`
+	Headers                      map[string]string
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait, Timeout             time.Duration
+	IsDiscardWhenBlocked         bool
+}
+
+// MetricsSender convert messages into points and write to InfluxDB or Prometheus,
+// messages without any values are discarded.
+//
+// 429 and 5xx will be retried, points rejected by 400 (like out-of-order samples) are dropped
+// since they will never be accepted, other 4xx (like 401, 403, 404, 413) are treated as failed.
+type MetricsSender struct {
+	*BaseSender
+	*MetricsSenderCfg
+	logger     *utils.LoggerType
+	httpClient *http.Client
+	// valueFields name -> field
+	valueFields [][2]string
+}
+
+// metricsPoint point with sorted tags and values
+type metricsPoint struct {
+	measurement string
+	tags        [][2]string
+	values      []*metricsValue
+	ts          time.Time
+}
+
+// metricsValue field of point
+type metricsValue struct {
+	name  string
+	value float64
+}
+
+// prometheusSample sample of time series
+type prometheusSample struct {
+	value float64
+	ts    time.Time
+}
+
+// NewMetricsSender create new MetricsSender
+func NewMetricsSender(cfg *MetricsSenderCfg) *MetricsSender {
+	s := &MetricsSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		MetricsSenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("metrics sender invalid", zap.Error(err))
+	}
+	s.httpClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 20,
+		},
+		Timeout: s.Timeout,
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new metrics sender",
+		zap.String("addr", s.Addr),
+		zap.String("protocol", s.Protocol),
+		zap.String("measurement", s.Measurement),
+		zap.String("time_key", s.TimeKey),
+		zap.String("time_format", s.TimeFormat),
+		zap.Any("tag_fields", s.TagFields),
+		zap.Strings("value_fields", s.ValueFields),
+		zap.Int("headers", len(s.Headers)),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Duration("timeout_sec", s.Timeout),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *MetricsSender) valid() error {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+
+	switch s.Protocol {
+	case "":
+		s.Protocol = "influx"
+		s.logger.Info("reset protocol", zap.String("protocol", s.Protocol))
+	case "influx", "prometheus":
+	default:
+		return fmt.Errorf("unknown protocol `%v`", s.Protocol)
+	}
+
+	if s.Measurement == "" {
+		s.Measurement = "${tag}"
+		s.logger.Info("reset measurement", zap.String("measurement", s.Measurement))
+	}
+
+	for _, f := range s.ValueFields {
+		kv := strings.SplitN(f, "=", 2)
+		if kv[0] == "" {
+			return fmt.Errorf("invalid value field `%v`", f)
+		}
+		if len(kv) == 1 {
+			kv = append(kv, kv[0])
+		}
+		s.valueFields = append(s.valueFields, [2]string{kv[0], kv[1]})
+	}
+
+	if s.TimeFormat == "" {
+		s.TimeFormat = time.RFC3339Nano
+		s.logger.Info("reset time_format", zap.String("time_format", s.TimeFormat))
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = defaultMetricsTimeout
+		s.logger.Info("reset timeout_sec", zap.Duration("timeout_sec", s.Timeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *MetricsSender) GetName() string {
+	return s.Name
+}
+
+// Spawn starting senders
+func (s *MetricsSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn metrics sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				body             []byte
+				err              error
+				statusErr        *httpStatusError
+				nRetry           int
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+
+		NEW_MSG_LOOP:
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				nRetry = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				if body = s.encode(msgBatchDelivery); len(body) != 0 {
+					for {
+						if err = s.write(ctx, body); err != nil {
+							statusErr, ok = err.(*httpStatusError)
+							if ok && statusErr.isRejected() {
+								// retrying will never succeed (like out-of-order samples)
+								s.logger.Warn("drop points rejected by backend",
+									zap.Error(err),
+									zap.Int("num", len(msgBatchDelivery)))
+								break
+							}
+
+							nRetry++
+							if nRetry > maxRetry || (ok && !statusErr.isRetryable()) {
+								s.logger.Error("try send message",
+									zap.Error(err),
+									zap.Int("num", len(msgBatchDelivery)))
+								for _, msg = range msgBatchDelivery {
+									s.failedChan <- msg
+								}
+								continue NEW_MSG_LOOP
+							}
+
+							s.logger.Warn("write metrics, retry later", zap.Error(err))
+							select {
+							case <-ctx.Done():
+								return
+							case <-time.After(defaultMetricsRetryWait * time.Duration(nRetry)):
+							}
+							continue
+						}
+
+						break
+					}
+				}
+
+				s.logger.Debug("success sent message to backend",
+					zap.String("addr", s.Addr),
+					zap.Int("batch", len(msgBatchDelivery)))
+				for _, msg = range msgBatchDelivery {
+					s.successedChan <- msg
+				}
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// write send body to backend
+func (s *MetricsSender) write(ctx context.Context, body []byte) (err error) {
+	req, err := http.NewRequest(http.MethodPost, s.Addr, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.Protocol == "prometheus" {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	} else {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request")
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	return &httpStatusError{code: resp.StatusCode, body: respBody}
+}
+
+// encode convert messages to points, return empty if no point
+func (s *MetricsSender) encode(msgs []*library.FluentMsg) []byte {
+	points := make([]*metricsPoint, 0, len(msgs))
+	for _, msg := range msgs {
+		if p := s.convertMsg(msg); p != nil {
+			points = append(points, p)
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	if s.Protocol == "prometheus" {
+		return snappy.Encode(nil, marshalPrometheusWriteRequest(points))
+	}
+	return marshalInfluxLines(points)
+}
+
+// convertMsg convert message to point, return nil if there is no value
+func (s *MetricsSender) convertMsg(msg *library.FluentMsg) *metricsPoint {
+	p := &metricsPoint{
+		measurement: renderMsgTemplate(s.Measurement, msg),
+		ts:          loadMsgTime(msg, s.TimeKey, s.TimeFormat),
+	}
+	if len(s.valueFields) == 0 {
+		for k, v := range msg.Message {
+			switch v.(type) {
+			case int, int32, int64, uint, uint32, uint64, float32, float64:
+				if val, ok := parseMetricsValue(v); ok {
+					p.values = append(p.values, &metricsValue{name: k, value: val})
+				}
+			}
+		}
+	} else {
+		for _, f := range s.valueFields {
+			if val, ok := parseMetricsValue(library.LoadNestedField(msg.Message, f[1])); ok {
+				p.values = append(p.values, &metricsValue{name: f[0], value: val})
+			}
+		}
+	}
+	if len(p.values) == 0 {
+		s.logger.Debug("discard msg since no value", zap.String("tag", msg.Tag))
+		return nil
+	}
+	sort.Slice(p.values, func(i, j int) bool {
+		return p.values[i].name < p.values[j].name
+	})
+
+	for name, tpl := range s.TagFields {
+		if val := renderMsgTemplate(tpl, msg); val != "" {
+			p.tags = append(p.tags, [2]string{name, val})
+		}
+	}
+	sort.Slice(p.tags, func(i, j int) bool {
+		return p.tags[i][0] < p.tags[j][0]
+	})
+
+	return p
+}
+
+// parseMetricsValue load float from number or numeric string
+func parseMetricsValue(v interface{}) (val float64, ok bool) {
+	switch v := v.(type) {
+	case int:
+		val = float64(v)
+	case int32:
+		val = float64(v)
+	case int64:
+		val = float64(v)
+	case uint:
+		val = float64(v)
+	case uint32:
+		val = float64(v)
+	case uint64:
+		val = float64(v)
+	case float32:
+		val = float64(v)
+	case float64:
+		val = v
+	case string:
+		var err error
+		if val, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+			return 0, false
+		}
+	case []byte:
+		var err error
+		if val, err = strconv.ParseFloat(strings.TrimSpace(string(v)), 64); err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, false
+	}
+	return val, true
+}
+
+// marshalInfluxLines marshal points as line protocol with nanosecond timestamp:
+//
+//	measurement,tag1=v1,tag2=v2 field1=1.5,field2=3 1609459200000000000
+func marshalInfluxLines(points []*metricsPoint) []byte {
+	buf := &bytes.Buffer{}
+	for _, p := range points {
+		buf.WriteString(influxMeasurementEscaper.Replace(p.measurement))
+		for _, kv := range p.tags {
+			buf.WriteByte(',')
+			buf.WriteString(influxKeyEscaper.Replace(kv[0]))
+			buf.WriteByte('=')
+			buf.WriteString(influxKeyEscaper.Replace(kv[1]))
+		}
+		for i, v := range p.values {
+			if i == 0 {
+				buf.WriteByte(' ')
+			} else {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(influxKeyEscaper.Replace(v.name))
+			buf.WriteByte('=')
+			buf.WriteString(strconv.FormatFloat(v.value, 'g', -1, 64))
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(p.ts.UnixNano(), 10))
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
+
+// sanitizePrometheusName replace invalid chars by `_`, add prefix `_` if starts with digit
+func sanitizePrometheusName(name string) string {
+	name = prometheusInvalidMetricCharRegexp.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// marshalPrometheusWriteRequest marshal points as `prometheus.WriteRequest`,
+// each value is a series named `<measurement>_<value name>`:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func marshalPrometheusWriteRequest(points []*metricsPoint) (b []byte) {
+	var (
+		series = map[string][]*prometheusSample{}
+		labels = map[string][][2]string{}
+		key    string
+	)
+	for _, p := range points {
+		for _, v := range p.values {
+			ls := make([][2]string, 0, len(p.tags)+1)
+			ls = append(ls, [2]string{prometheusMetricName, sanitizePrometheusName(p.measurement + "_" + v.name)})
+			for _, tag := range p.tags {
+				if name := sanitizePrometheusName(tag[0]); name != prometheusMetricName {
+					ls = append(ls, [2]string{name, tag[1]})
+				}
+			}
+			sort.Slice(ls, func(i, j int) bool {
+				return ls[i][0] < ls[j][0]
+			})
+
+			key = fmt.Sprint(ls)
+			labels[key] = ls
+			series[key] = append(series[key], &prometheusSample{value: v.value, ts: p.ts})
+		}
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var ts, item []byte
+	for _, k := range keys {
+		samples := series[k]
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].ts.Before(samples[j].ts)
+		})
+
+		ts = ts[:0]
+		for _, l := range labels[k] {
+			item = item[:0]
+			item = protowire.AppendTag(item, 1, protowire.BytesType)
+			item = protowire.AppendString(item, l[0])
+			item = protowire.AppendTag(item, 2, protowire.BytesType)
+			item = protowire.AppendString(item, l[1])
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, item)
+		}
+		for _, sample := range samples {
+			item = item[:0]
+			item = protowire.AppendTag(item, 1, protowire.Fixed64Type)
+			item = protowire.AppendFixed64(item, math.Float64bits(sample.value))
+			item = protowire.AppendTag(item, 2, protowire.VarintType)
+			item = protowire.AppendVarint(item, uint64(sample.ts.UnixNano()/int64(time.Millisecond)))
+
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, item)
+		}
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+
+	return b
+}
@@ -0,0 +1,217 @@
+package senders
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestMetricsSenderInflux(t *testing.T) {
+	s := NewMetricsSender(&MetricsSenderCfg{
+		Name:        "metrics-test",
+		Addr:        "http://127.0.0.1:8086/write?db=gateway",
+		TimeKey:     "ts",
+		TagFields:   map[string]string{"path": "${path}", "host": "${upstream.host}", "empty": "${missing}"},
+		ValueFields: []string{"latency=upstream.latency", "status", "size"},
+	})
+	body := s.encode([]*library.FluentMsg{
+		{Tag: "gateway access", Message: map[string]interface{}{
+			"ts":       "2021-01-02T03:04:05.123Z",
+			"path":     "/api,v1",
+			"status":   float64(200),
+			"size":     "1024",
+			"upstream": map[string]interface{}{"host": "order=1", "latency": []byte("0.25")},
+		}},
+		// no value
+		{Tag: "gateway", Message: map[string]interface{}{"status": "-"}},
+	})
+	expect := `gateway\ access,host=order\=1,path=/api\,v1 latency=0.25,size=1024,status=200 1609556645123000000` + "\n"
+	if string(body) != expect {
+		t.Fatalf("expect %q, got %q", expect, body)
+	}
+
+	// all numeric fields
+	s = NewMetricsSender(&MetricsSenderCfg{
+		Name:        "metrics-test",
+		Addr:        "http://127.0.0.1:8086/write?db=gateway",
+		Measurement: "access",
+	})
+	p := s.convertMsg(&library.FluentMsg{Tag: "gateway", Message: map[string]interface{}{
+		"status":  200,
+		"latency": 0.5,
+		"size":    "1024",
+		"nan":     math.NaN(),
+	}})
+	if len(p.values) != 2 || p.values[0].name != "latency" || p.values[1].name != "status" {
+		t.Fatalf("got %+v", p.values)
+	}
+}
+
+// parsePrometheusWriteRequest return labels -> values
+func parsePrometheusWriteRequest(t *testing.T, b []byte) map[string][]float64 {
+	fields := func(b []byte) (ret map[protowire.Number][][]byte) {
+		ret = map[protowire.Number][][]byte{}
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid tag: %d", n)
+			}
+			b = b[n:]
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				t.Fatalf("invalid field: %d", n)
+			}
+			if typ == protowire.BytesType {
+				v, _ := protowire.ConsumeBytes(b)
+				ret[num] = append(ret[num], v)
+			} else {
+				ret[num] = append(ret[num], b[:n])
+			}
+			b = b[n:]
+		}
+		return ret
+	}
+
+	series := map[string][]float64{}
+	for _, ts := range fields(b)[1] {
+		tsFields := fields(ts)
+		labels := []string{}
+		for _, l := range tsFields[1] {
+			lf := fields(l)
+			labels = append(labels, string(lf[1][0])+"="+string(lf[2][0]))
+		}
+		key := strings.Join(labels, ",")
+		for _, sample := range tsFields[2] {
+			v, _ := protowire.ConsumeFixed64(fields(sample)[1][0])
+			series[key] = append(series[key], math.Float64frombits(v))
+		}
+	}
+	return series
+}
+
+func TestMetricsSenderPrometheus(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		nRequest int
+		series   map[string][]float64
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		nRequest++
+		switch nRequest {
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case 2:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("out of order sample"))
+			return
+		case 4:
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Authorization") != "Bearer abc" {
+			t.Errorf("got %+v", r.Header)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		if body, err = snappy.Decode(nil, body); err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		series = parsePrometheusWriteRequest(t, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewMetricsSender(&MetricsSenderCfg{
+		Name:        "metrics-test",
+		Addr:        srv.URL + "/api/v1/write",
+		Protocol:    "prometheus",
+		Measurement: "gateway.access",
+		TimeKey:     "ts",
+		TagFields:   map[string]string{"route-name": "${route}"},
+		ValueFields: []string{"latency_seconds=latency"},
+		Headers:     map[string]string{"Authorization": "Bearer abc"},
+		Tags:        []string{"gateway"},
+		BatchSize:   3,
+		MaxWait:     3 * time.Second,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	// first msg will be sent immediately, retried after 500 then dropped after 400
+	inChan <- &library.FluentMsg{Tag: "gateway", Message: map[string]interface{}{"latency": 1}}
+	select {
+	case <-successedChan:
+	case <-failedChan:
+		t.Fatal("should not fail")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	for _, c := range []struct{ ts, route, latency string }{
+		{"2021-01-01T00:00:02Z", "order", "0.2"},
+		{"2021-01-01T00:00:01Z", "order", "0.1"},
+		{"2021-01-01T00:00:01Z", "pay", "0.3"},
+	} {
+		inChan <- &library.FluentMsg{Tag: "gateway", Message: map[string]interface{}{
+			"ts":      c.ts,
+			"route":   c.route,
+			"latency": c.latency,
+		}}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+		case <-failedChan:
+			t.Fatal("should not fail")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// forbidden, failed without retry
+	inChan <- &library.FluentMsg{Tag: "gateway", Message: map[string]interface{}{"latency": 1}}
+	inChan <- &library.FluentMsg{Tag: "gateway", Message: map[string]interface{}{"latency": 2}}
+	inChan <- &library.FluentMsg{Tag: "gateway", Message: map[string]interface{}{"latency": 3}}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+			t.Fatal("forbidden msg should be failed")
+		case <-failedChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	order := series["__name__=gateway_access_latency_seconds,route_name=order"]
+	pay := series["__name__=gateway_access_latency_seconds,route_name=pay"]
+	if nRequest != 4 || len(series) != 2 ||
+		len(order) != 2 || order[0] != 0.1 || order[1] != 0.2 ||
+		len(pay) != 1 || pay[0] != 0.3 {
+		t.Fatalf("got %d requests, %+v", nRequest, series)
+	}
+}
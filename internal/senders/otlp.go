@@ -0,0 +1,640 @@
+package senders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultOTLPTimeout   = 30 * time.Second
+	defaultOTLPRetryWait = time.Second
+)
+
+// otlpSeverityNumbers severity text -> the first number of its range,
+// https://opentelemetry.io/docs/reference/specification/logs/data-model/#field-severitynumber
+var otlpSeverityNumbers = map[string]logspb.SeverityNumber{
+	"trace":    logspb.SeverityNumber_SEVERITY_NUMBER_TRACE,
+	"debug":    logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+	"info":     logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+	"notice":   logspb.SeverityNumber_SEVERITY_NUMBER_INFO2,
+	"warn":     logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+	"warning":  logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+	"err":      logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	"error":    logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	"crit":     logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	"critical": logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	"alert":    logspb.SeverityNumber_SEVERITY_NUMBER_FATAL2,
+	"emerg":    logspb.SeverityNumber_SEVERITY_NUMBER_FATAL3,
+	"fatal":    logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	"panic":    logspb.SeverityNumber_SEVERITY_NUMBER_FATAL3,
+}
+
+// OTLPSenderCfg configuration of OTLPSender
+type OTLPSenderCfg struct {
+	Name,
+	// Addr: like `127.0.0.1:4317` for grpc, `http://127.0.0.1:4318/v1/logs` for http
+	Addr,
+	// Protocol: `grpc` or `http`
+	Protocol,
+	// Severity: template of severity text,
+	// `${tag}` will be replaced by `msg.Tag`, `${<field>}` will be replaced by field in message.
+	// severity number is parsed from text, like `warn` or `ERROR`, or number 1~24
+	Severity,
+	// MsgKey: field as body
+	MsgKey,
+	// TraceIDKey, SpanIDKey: fields of hex encoded trace id & span id
+	TraceIDKey,
+	SpanIDKey,
+	// TimeKey: field to load timestamp, use current time if empty or failed to parse
+	TimeKey,
+	// TimeFormat: layout to parse TimeKey if it is string, default RFC3339Nano
+	TimeFormat string
+	// ResourceAttributes: map[name]template, records with same resource are grouped into one `ResourceLogs`
+	ResourceAttributes map[string]string
+	// Headers: http headers or grpc metadata, like `Authorization`
+	Headers                      map[string]string
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait, Timeout             time.Duration
+	// IsTLS: connect grpc by TLS, for http it is decided by scheme of Addr
+	IsTLS,
+	IsGzip,
+	IsDiscardWhenBlocked bool
+}
+
+// OTLPSender export messages as OpenTelemetry log records over gRPC or HTTP,
+// messages in batch are grouped by tag, each tag is exported by one request.
+//
+// fields except MsgKey, TraceIDKey, SpanIDKey and TimeKey are exported as log attributes.
+//
+// retryable failures will be retried after a while,
+// messages rejected as invalid (400 or InvalidArgument) will be dropped,
+// other non-retryable failures (like auth or endpoint errors) are treated as failed.
+type OTLPSender struct {
+	*BaseSender
+	*OTLPSenderCfg
+	logger     *utils.LoggerType
+	httpClient *http.Client
+	grpcConn   *grpc.ClientConn
+	grpcClient collogspb.LogsServiceClient
+}
+
+// NewOTLPSender create new OTLPSender
+func NewOTLPSender(cfg *OTLPSenderCfg) *OTLPSender {
+	s := &OTLPSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		OTLPSenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("otlp sender invalid", zap.Error(err))
+	}
+
+	if s.Protocol == "http" {
+		s.httpClient = &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: 20,
+			},
+			Timeout: s.Timeout,
+		}
+	} else {
+		opts := []grpc.DialOption{grpc.WithInsecure()}
+		if s.IsTLS {
+			opts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))}
+		}
+		if s.IsGzip {
+			opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(grpcgzip.Name)))
+		}
+		// dial is non-blocking, connection will be established when exporting
+		var err error
+		if s.grpcConn, err = grpc.Dial(s.Addr, opts...); err != nil {
+			s.logger.Panic("dial grpc", zap.Error(err), zap.String("addr", s.Addr))
+		}
+		s.grpcClient = collogspb.NewLogsServiceClient(s.grpcConn)
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new otlp sender",
+		zap.String("addr", s.Addr),
+		zap.String("protocol", s.Protocol),
+		zap.String("severity", s.Severity),
+		zap.String("msg_key", s.MsgKey),
+		zap.String("trace_id_key", s.TraceIDKey),
+		zap.String("span_id_key", s.SpanIDKey),
+		zap.String("time_key", s.TimeKey),
+		zap.String("time_format", s.TimeFormat),
+		zap.Any("resource_attributes", s.ResourceAttributes),
+		zap.Int("headers", len(s.Headers)),
+		zap.Bool("is_tls", s.IsTLS),
+		zap.Bool("is_gzip", s.IsGzip),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Duration("timeout_sec", s.Timeout),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *OTLPSender) valid() error {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+
+	switch s.Protocol {
+	case "":
+		s.Protocol = "grpc"
+		s.logger.Info("reset protocol", zap.String("protocol", s.Protocol))
+	case "grpc":
+	case "http":
+		if !strings.HasPrefix(s.Addr, "http://") && !strings.HasPrefix(s.Addr, "https://") {
+			return fmt.Errorf("addr should be url for http, got `%v`", s.Addr)
+		}
+	default:
+		return fmt.Errorf("unknown protocol `%v`", s.Protocol)
+	}
+
+	if s.MsgKey == "" {
+		s.MsgKey = "log"
+		s.logger.Info("reset msg_key", zap.String("msg_key", s.MsgKey))
+	}
+
+	if s.TraceIDKey == "" {
+		s.TraceIDKey = "trace_id"
+		s.logger.Info("reset trace_id_key", zap.String("trace_id_key", s.TraceIDKey))
+	}
+
+	if s.SpanIDKey == "" {
+		s.SpanIDKey = "span_id"
+		s.logger.Info("reset span_id_key", zap.String("span_id_key", s.SpanIDKey))
+	}
+
+	if s.TimeFormat == "" {
+		s.TimeFormat = time.RFC3339Nano
+		s.logger.Info("reset time_format", zap.String("time_format", s.TimeFormat))
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = defaultOTLPTimeout
+		s.logger.Info("reset timeout_sec", zap.Duration("timeout_sec", s.Timeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *OTLPSender) GetName() string {
+	return s.Name
+}
+
+// Spawn starting senders
+func (s *OTLPSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn otlp sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+	if s.grpcConn != nil {
+		go func() {
+			<-ctx.Done()
+			s.grpcConn.Close()
+		}()
+	}
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				tagMsgs          map[string][]*library.FluentMsg
+				req              *collogspb.ExportLogsServiceRequest
+				err              error
+				nRetry           int
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				tagMsgs = map[string][]*library.FluentMsg{}
+				for _, msg = range msgBatchDelivery {
+					tagMsgs[msg.Tag] = append(tagMsgs[msg.Tag], msg)
+				}
+
+			TAG_LOOP:
+				for tag, msgs := range tagMsgs {
+					req = s.convertMsgs(msgs)
+					nRetry = 0
+					for {
+						if err = s.export(ctx, req); err != nil {
+							if isOTLPRejected(err) {
+								// retrying will never succeed
+								s.logger.Warn("drop messages rejected by otlp",
+									zap.Error(err),
+									zap.String("tag", tag),
+									zap.Int("num", len(msgs)))
+								break
+							}
+
+							nRetry++
+							if nRetry > maxRetry || !isOTLPRetryable(err) {
+								s.logger.Error("try send message",
+									zap.Error(err),
+									zap.String("tag", tag),
+									zap.Int("num", len(msgs)))
+								for _, msg = range msgs {
+									s.failedChan <- msg
+								}
+								continue TAG_LOOP
+							}
+
+							s.logger.Warn("export to otlp, retry later", zap.Error(err))
+							select {
+							case <-ctx.Done():
+								return
+							case <-time.After(defaultOTLPRetryWait * time.Duration(nRetry)):
+							}
+							continue
+						}
+
+						break
+					}
+
+					s.logger.Debug("success sent message to backend",
+						zap.String("addr", s.Addr),
+						zap.String("tag", tag),
+						zap.Int("batch", len(msgs)))
+					for _, msg = range msgs {
+						s.successedChan <- msg
+					}
+				}
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// export send request by grpc or http
+func (s *OTLPSender) export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (err error) {
+	var resp *collogspb.ExportLogsServiceResponse
+	if s.Protocol == "grpc" {
+		ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+		if len(s.Headers) != 0 {
+			ctx = metadata.NewOutgoingContext(ctx, metadata.New(s.Headers))
+		}
+		if resp, err = s.grpcClient.Export(ctx, req); err != nil {
+			return errors.Wrap(err, "export")
+		}
+	} else if resp, err = s.exportHTTP(ctx, req); err != nil {
+		return err
+	}
+
+	// rejected records should not be retried
+	if n := resp.GetPartialSuccess().GetRejectedLogRecords(); n != 0 {
+		s.logger.Warn("log records rejected by otlp",
+			zap.Int64("rejected", n),
+			zap.String("error", resp.GetPartialSuccess().GetErrorMessage()))
+	}
+
+	return nil
+}
+
+func (s *OTLPSender) exportHTTP(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal request")
+	}
+	if s.IsGzip {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		if _, err = gz.Write(body); err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		if err = gz.Close(); err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		body = buf.Bytes()
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, s.Addr, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	httpReq = httpReq.WithContext(ctx)
+	for k, v := range s.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	if s.IsGzip {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+
+	httpResp, err := s.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, errors.Wrap(err, "request")
+	}
+	defer httpResp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1024*1024))
+	if httpResp.StatusCode/100 != 2 {
+		return nil, &httpStatusError{code: httpResp.StatusCode, body: respBody}
+	}
+
+	resp := &collogspb.ExportLogsServiceResponse{}
+	if strings.HasPrefix(httpResp.Header.Get("Content-Type"), "application/x-protobuf") {
+		if err = proto.Unmarshal(respBody, resp); err != nil {
+			s.logger.Warn("unmarshal response", zap.Error(err))
+		}
+	}
+
+	return resp, nil
+}
+
+// isOTLPRejected whether messages are rejected as invalid (400 or InvalidArgument),
+// retrying will never succeed
+func isOTLPRejected(err error) bool {
+	if statusErr, ok := errors.Cause(err).(*httpStatusError); ok {
+		return statusErr.isRejected()
+	}
+
+	if st, ok := status.FromError(errors.Cause(err)); ok {
+		return st.Code() == codes.InvalidArgument
+	}
+
+	return false
+}
+
+// isOTLPRetryable whether could succeed by retrying later,
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#failures
+func isOTLPRetryable(err error) bool {
+	if statusErr, ok := errors.Cause(err).(*httpStatusError); ok {
+		switch statusErr.code {
+		case http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if st, ok := status.FromError(errors.Cause(err)); ok {
+		switch st.Code() {
+		case codes.InvalidArgument,
+			codes.Unauthenticated,
+			codes.PermissionDenied,
+			codes.NotFound,
+			codes.Unimplemented,
+			codes.FailedPrecondition,
+			codes.AlreadyExists,
+			codes.Internal:
+			return false
+		}
+	}
+
+	return true
+}
+
+// convertMsgs convert messages into request,
+// records with same resource attributes are grouped into one `ResourceLogs`
+func (s *OTLPSender) convertMsgs(msgs []*library.FluentMsg) *collogspb.ExportLogsServiceRequest {
+	var (
+		req       = &collogspb.ExportLogsServiceRequest{}
+		resources = map[string]*logspb.ScopeLogs{}
+		attrs     []*commonpb.KeyValue
+		key       string
+	)
+	for _, msg := range msgs {
+		attrs, key = s.renderResource(msg)
+		sl, ok := resources[key]
+		if !ok {
+			sl = &logspb.ScopeLogs{}
+			resources[key] = sl
+			req.ResourceLogs = append(req.ResourceLogs, &logspb.ResourceLogs{
+				Resource:  &resourcepb.Resource{Attributes: attrs},
+				ScopeLogs: []*logspb.ScopeLogs{sl},
+			})
+		}
+
+		sl.LogRecords = append(sl.LogRecords, s.convertMsg(msg))
+	}
+
+	return req
+}
+
+// renderResource render resource attributes in sorted order, return attributes and key to group
+func (s *OTLPSender) renderResource(msg *library.FluentMsg) (attrs []*commonpb.KeyValue, key string) {
+	names := make([]string, 0, len(s.ResourceAttributes))
+	for name := range s.ResourceAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	kvs := make([]string, 0, len(names))
+	for _, name := range names {
+		val := renderMsgTemplate(s.ResourceAttributes[name], msg)
+		attrs = append(attrs, &commonpb.KeyValue{Key: name, Value: newOTLPStringValue(val)})
+		kvs = append(kvs, name+"="+strconv.Quote(val))
+	}
+
+	return attrs, strings.Join(kvs, ",")
+}
+
+// convertMsg convert message to log record
+func (s *OTLPSender) convertMsg(msg *library.FluentMsg) *logspb.LogRecord {
+	now := utils.Clock.GetUTCNow()
+	lr := &logspb.LogRecord{
+		TimeUnixNano:         uint64(loadMsgTime(msg, s.TimeKey, s.TimeFormat).UnixNano()),
+		ObservedTimeUnixNano: uint64(now.UnixNano()),
+		Body:                 newOTLPValue(msg.Message[s.MsgKey]),
+		Attributes:           make([]*commonpb.KeyValue, 0, len(msg.Message)),
+	}
+	if s.Severity != "" {
+		lr.SeverityText = renderMsgTemplate(s.Severity, msg)
+		lr.SeverityNumber = parseOTLPSeverity(lr.SeverityText)
+	}
+	if id, err := loadOTLPID(msg.Message[s.TraceIDKey], 16); err == nil {
+		lr.TraceId = id
+	}
+	if id, err := loadOTLPID(msg.Message[s.SpanIDKey], 8); err == nil {
+		lr.SpanId = id
+	}
+
+	for k, v := range msg.Message {
+		switch k {
+		case s.MsgKey, s.TimeKey, s.TraceIDKey, s.SpanIDKey:
+			continue
+		}
+		lr.Attributes = append(lr.Attributes, &commonpb.KeyValue{Key: k, Value: newOTLPValue(v)})
+	}
+	sort.Slice(lr.Attributes, func(i, j int) bool {
+		return lr.Attributes[i].Key < lr.Attributes[j].Key
+	})
+
+	return lr
+}
+
+// parseOTLPSeverity parse severity text or number, return unspecified if unknown
+func parseOTLPSeverity(v string) logspb.SeverityNumber {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if n, err := strconv.Atoi(v); err == nil &&
+		n >= int(logspb.SeverityNumber_SEVERITY_NUMBER_TRACE) &&
+		n <= int(logspb.SeverityNumber_SEVERITY_NUMBER_FATAL4) {
+		return logspb.SeverityNumber(n)
+	}
+
+	return otlpSeverityNumbers[v]
+}
+
+// loadOTLPID load hex encoded id with specified length
+func loadOTLPID(v interface{}, length int) (id []byte, err error) {
+	switch val := v.(type) {
+	case string:
+		id, err = hex.DecodeString(val)
+	case []byte:
+		id, err = hex.DecodeString(string(val))
+	default:
+		return nil, fmt.Errorf("unknown type %T", v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(id) != length {
+		return nil, fmt.Errorf("length should be %d, got %d", length, len(id))
+	}
+
+	return id, nil
+}
+
+func newOTLPStringValue(v string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+}
+
+// newOTLPValue convert go value into AnyValue, bytes are treated as string
+func newOTLPValue(v interface{}) *commonpb.AnyValue {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return newOTLPStringValue(val)
+	case []byte:
+		return newOTLPStringValue(string(val))
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: val}}
+	case int:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(val)}}
+	case int32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(val)}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: val}}
+	case uint32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(val)}}
+	case uint64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(val)}}
+	case float32:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: float64(val)}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: val}}
+	case []interface{}:
+		arr := &commonpb.ArrayValue{Values: make([]*commonpb.AnyValue, 0, len(val))}
+		for _, item := range val {
+			arr.Values = append(arr.Values, newOTLPValue(item))
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: arr}}
+	case map[string]interface{}:
+		kvs := &commonpb.KeyValueList{Values: make([]*commonpb.KeyValue, 0, len(val))}
+		for k, item := range val {
+			kvs.Values = append(kvs.Values, &commonpb.KeyValue{Key: k, Value: newOTLPValue(item)})
+		}
+		sort.Slice(kvs.Values, func(i, j int) bool {
+			return kvs.Values[i].Key < kvs.Values[j].Key
+		})
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: kvs}}
+	default:
+		return newOTLPStringValue(fmt.Sprint(val))
+	}
+}
@@ -0,0 +1,268 @@
+package senders
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/pkg/errors"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type fakeOTLPLogsServer struct {
+	collogspb.UnimplementedLogsServiceServer
+	sync.Mutex
+	reqs    []*collogspb.ExportLogsServiceRequest
+	headers []string
+}
+
+func (srv *fakeOTLPLogsServer) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	srv.Lock()
+	defer srv.Unlock()
+	md, _ := metadata.FromIncomingContext(ctx)
+	srv.headers = append(srv.headers, md.Get("authorization")...)
+	srv.reqs = append(srv.reqs, req)
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func TestParseOTLPSeverity(t *testing.T) {
+	for v, expect := range map[string]logspb.SeverityNumber{
+		"ERROR":   logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+		"warning": logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+		"3":       logspb.SeverityNumber_SEVERITY_NUMBER_TRACE3,
+		"25":      logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED,
+		"unknown": logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED,
+	} {
+		if got := parseOTLPSeverity(v); got != expect {
+			t.Errorf("%v: expect %v, got %v", v, expect, got)
+		}
+	}
+}
+
+func TestOTLPSenderGRPC(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	fakeSrv := &fakeOTLPLogsServer{}
+	grpcSrv := grpc.NewServer()
+	collogspb.RegisterLogsServiceServer(grpcSrv, fakeSrv)
+	go grpcSrv.Serve(ln)
+	defer grpcSrv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewOTLPSender(&OTLPSenderCfg{
+		Name:               "otlp-test",
+		Addr:               ln.Addr().String(),
+		Severity:           "${level}",
+		TimeKey:            "ts",
+		ResourceAttributes: map[string]string{"service.name": "${tag}", "host.name": "${host}"},
+		Headers:            map[string]string{"Authorization": "Bearer abc"},
+		Tags:               []string{"app.order", "app.pay"},
+		IsGzip:             true,
+		BatchSize:          4,
+		MaxWait:            3 * time.Second,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	// first msg will be sent immediately
+	inChan <- &library.FluentMsg{Tag: "app.order", Message: map[string]interface{}{"log": "0"}}
+	for _, msg := range []*library.FluentMsg{
+		{Tag: "app.order", Message: map[string]interface{}{
+			"log":      []byte("hello"),
+			"level":    "ERROR",
+			"host":     "web-1",
+			"ts":       "2021-01-02T03:04:05.123Z",
+			"trace_id": "5b8efff798038103d269b633813fc60c",
+			"span_id":  "eee19b7ec3c1b174",
+			"user":     map[string]interface{}{"id": 3},
+		}},
+		{Tag: "app.order", Message: map[string]interface{}{"log": "2", "host": "web-2"}},
+		{Tag: "app.order", Message: map[string]interface{}{"log": "3", "host": "web-1"}},
+		{Tag: "app.pay", Message: map[string]interface{}{"log": "4"}},
+	} {
+		inChan <- msg
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-successedChan:
+		case <-failedChan:
+			t.Fatal("should not fail")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	fakeSrv.Lock()
+	defer fakeSrv.Unlock()
+	// 1 for first msg, then 1 for each tag
+	if len(fakeSrv.reqs) != 3 || len(fakeSrv.headers) != 3 || fakeSrv.headers[0] != "Bearer abc" {
+		t.Fatalf("got %d requests, headers %v", len(fakeSrv.reqs), fakeSrv.headers)
+	}
+
+	var orderReq *collogspb.ExportLogsServiceRequest
+	for _, req := range fakeSrv.reqs[1:] {
+		if len(req.GetResourceLogs()) == 2 {
+			orderReq = req
+		}
+	}
+	if orderReq == nil {
+		t.Fatalf("got %+v", fakeSrv.reqs)
+	}
+	rl := orderReq.GetResourceLogs()[0]
+	attrs := rl.GetResource().GetAttributes()
+	if len(attrs) != 2 ||
+		attrs[0].GetKey() != "host.name" || attrs[0].GetValue().GetStringValue() != "web-1" ||
+		attrs[1].GetKey() != "service.name" || attrs[1].GetValue().GetStringValue() != "app.order" ||
+		len(rl.GetScopeLogs()[0].GetLogRecords()) != 2 {
+		t.Fatalf("got %+v", rl)
+	}
+
+	lr := rl.GetScopeLogs()[0].GetLogRecords()[0]
+	if lr.GetBody().GetStringValue() != "hello" ||
+		lr.GetSeverityText() != "ERROR" ||
+		lr.GetSeverityNumber() != logspb.SeverityNumber_SEVERITY_NUMBER_ERROR ||
+		hex.EncodeToString(lr.GetTraceId()) != "5b8efff798038103d269b633813fc60c" ||
+		hex.EncodeToString(lr.GetSpanId()) != "eee19b7ec3c1b174" ||
+		lr.GetTimeUnixNano() != 1609556645123000000 ||
+		len(lr.GetAttributes()) != 3 ||
+		lr.GetAttributes()[2].GetKey() != "user" ||
+		lr.GetAttributes()[2].GetValue().GetKvlistValue().GetValues()[0].GetValue().GetIntValue() != 3 {
+		t.Fatalf("got %+v", lr)
+	}
+}
+
+func TestOTLPSenderHTTP(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		nRequest int
+		req      = &collogspb.ExportLogsServiceRequest{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		nRequest++
+		switch nRequest {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case 3:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case 4:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("got %v, %+v", r.URL, r.Header)
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		if err = proto.Unmarshal(body, req); err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewOTLPSender(&OTLPSenderCfg{
+		Name:      "otlp-test",
+		Addr:      srv.URL + "/v1/logs",
+		Protocol:  "http",
+		Tags:      []string{"app.order"},
+		BatchSize: 1,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	// 503 will be retried
+	inChan <- &library.FluentMsg{Tag: "app.order", Message: map[string]interface{}{"log": "hello"}}
+	select {
+	case <-successedChan:
+	case <-failedChan:
+		t.Fatal("should not fail")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	mu.Lock()
+	if nRequest != 2 ||
+		req.GetResourceLogs()[0].GetScopeLogs()[0].GetLogRecords()[0].GetBody().GetStringValue() != "hello" {
+		t.Fatalf("got %d requests, %+v", nRequest, req)
+	}
+	mu.Unlock()
+
+	// 400 will be dropped without retry
+	inChan <- &library.FluentMsg{Tag: "app.order", Message: map[string]interface{}{"log": "invalid"}}
+	select {
+	case <-successedChan:
+	case <-failedChan:
+		t.Fatal("rejected msg should be dropped")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// 401 will be failed without retry
+	inChan <- &library.FluentMsg{Tag: "app.order", Message: map[string]interface{}{"log": "unauthorized"}}
+	select {
+	case <-successedChan:
+		t.Fatal("unauthorized msg should be failed")
+	case <-failedChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nRequest != 4 {
+		t.Fatalf("got %d requests", nRequest)
+	}
+}
+
+func TestIsOTLPRejected(t *testing.T) {
+	for err, expect := range map[error]bool{
+		&httpStatusError{code: http.StatusBadRequest}:             true,
+		&httpStatusError{code: http.StatusUnauthorized}:           false,
+		&httpStatusError{code: http.StatusNotFound}:               false,
+		&httpStatusError{code: http.StatusInternalServerError}:    false,
+		status.Error(codes.InvalidArgument, "invalid"):            true,
+		status.Error(codes.Unauthenticated, "unauthenticated"):    false,
+		status.Error(codes.PermissionDenied, "denied"):            false,
+		status.Error(codes.Unimplemented, "unimplemented"):        false,
+		errors.Wrap(status.Error(codes.Internal, "internal"), ""): false,
+	} {
+		if isOTLPRejected(err) != expect {
+			t.Fatalf("%v should be %v", err, expect)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package senders
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// RedisSenderCfg configuration of RedisSender
+type RedisSenderCfg struct {
+	Name,
+	// Addr: like `127.0.0.1:6379`
+	Addr,
+	Password,
+	// DataType: `list` (RPUSH) or `stream` (XADD)
+	DataType,
+	Key string
+	DB int
+	// MaxLen: approximately trim stream by `MAXLEN ~`, or keep the last MaxLen elements of list,
+	// 0 means no limit
+	MaxLen                       int64
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait                      time.Duration
+	IsDiscardWhenBlocked         bool
+}
+
+// RedisSender send messages to redis list or stream.
+//
+// message will be marshaled as JSON element of list,
+// or each field of message will be field of stream entry,
+// non-string value will be marshaled as JSON.
+type RedisSender struct {
+	*BaseSender
+	*RedisSenderCfg
+	logger *utils.LoggerType
+	cli    *redis.Client
+}
+
+// NewRedisSender create new RedisSender
+func NewRedisSender(cfg *RedisSenderCfg) *RedisSender {
+	s := &RedisSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		RedisSenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("redis sender invalid", zap.Error(err))
+	}
+	s.cli = redis.NewClient(&redis.Options{
+		Addr:     s.Addr,
+		Password: s.Password,
+		DB:       s.DB,
+	})
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new redis sender",
+		zap.String("addr", s.Addr),
+		zap.Int("db", s.DB),
+		zap.String("data_type", s.DataType),
+		zap.String("key", s.Key),
+		zap.Int64("max_len", s.MaxLen),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *RedisSender) valid() error {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+	if s.Key == "" {
+		return fmt.Errorf("key should not be empty")
+	}
+
+	switch s.DataType {
+	case "":
+		s.DataType = "list"
+		s.logger.Info("reset data_type", zap.String("data_type", s.DataType))
+	case "list", "stream":
+	default:
+		return fmt.Errorf("unknown data_type `%v`", s.DataType)
+	}
+
+	if s.MaxLen < 0 {
+		return fmt.Errorf("max_len should not be negative")
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *RedisSender) GetName() string {
+	return s.Name
+}
+
+// Spawn starting senders
+func (s *RedisSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn redis sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				err              error
+				nRetry           int
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+
+		NEW_MSG_LOOP:
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				nRetry = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				for {
+					if err = s.send(ctx, msgBatchDelivery); err != nil {
+						nRetry++
+						if nRetry > maxRetry {
+							s.logger.Error("try send message",
+								zap.Error(err),
+								zap.Int("num", len(msgBatchDelivery)))
+							for _, msg = range msgBatchDelivery {
+								s.failedChan <- msg
+							}
+							continue NEW_MSG_LOOP
+						}
+						continue
+					}
+
+					break
+				}
+
+				s.logger.Debug("success sent message to backend",
+					zap.String("key", s.Key),
+					zap.Int("batch", len(msgBatchDelivery)))
+				for _, msg = range msgBatchDelivery {
+					s.successedChan <- msg
+				}
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// send write batch in one pipeline
+func (s *RedisSender) send(ctx context.Context, msgs []*library.FluentMsg) (err error) {
+	pipe := s.cli.Pipeline()
+	switch s.DataType {
+	case "list":
+		elements := make([]interface{}, 0, len(msgs))
+		for _, msg := range msgs {
+			b, err := utils.JSON.Marshal(msg.Message)
+			if err != nil {
+				s.logger.Warn("discard msg since marshal error", zap.Error(err), zap.String("tag", msg.Tag))
+				continue
+			}
+			elements = append(elements, b)
+		}
+		if len(elements) == 0 {
+			return nil
+		}
+
+		pipe.RPush(ctx, s.Key, elements...)
+		if s.MaxLen > 0 {
+			pipe.LTrim(ctx, s.Key, -s.MaxLen, -1)
+		}
+	case "stream":
+		for _, msg := range msgs {
+			values, err := streamValues(msg.Message)
+			if err != nil {
+				s.logger.Warn("discard msg since marshal error", zap.Error(err), zap.String("tag", msg.Tag))
+				continue
+			}
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: s.Key,
+				MaxLen: s.MaxLen,
+				Approx: s.MaxLen > 0,
+				Values: values,
+			})
+		}
+	}
+
+	if _, err = pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "exec redis pipeline")
+	}
+	return nil
+}
+
+// streamValues convert message to fields of stream entry
+func streamValues(message map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(message))
+	for k, v := range message {
+		switch v := v.(type) {
+		case string, []byte:
+			values[k] = v
+		default:
+			b, err := utils.JSON.Marshal(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "marshal field `%v`", k)
+			}
+			values[k] = b
+		}
+	}
+
+	return values, nil
+}
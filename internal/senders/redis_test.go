@@ -0,0 +1,82 @@
+package senders
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRedisSender(t *testing.T) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cli := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer cli.Close()
+
+	for _, dataType := range []string{"list", "stream"} {
+		successedChan := make(chan *library.FluentMsg, 100)
+		s := NewRedisSender(&RedisSenderCfg{
+			Name:      "redis-" + dataType,
+			Addr:      srv.Addr(),
+			DataType:  dataType,
+			Key:       dataType,
+			MaxLen:    3,
+			Tags:      []string{"test"},
+			BatchSize: 5,
+			MaxWait:   100 * time.Millisecond,
+		})
+		s.SetMsgPool(&sync.Pool{})
+		s.SetSuccessedChan(successedChan)
+		s.SetFailedChan(make(chan *library.FluentMsg, 100))
+		inChan := s.Spawn(ctx)
+		for i := 0; i < 5; i++ {
+			inChan <- &library.FluentMsg{
+				Tag:     "test",
+				ID:      int64(i),
+				Message: map[string]interface{}{"log": "hello", "n": i, "nested": map[string]interface{}{"a": 1}},
+			}
+		}
+		for i := 0; i < 5; i++ {
+			select {
+			case <-successedChan:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("%v: timeout", dataType)
+			}
+		}
+
+		switch dataType {
+		case "list":
+			elements, err := cli.LRange(ctx, "list", 0, -1).Result()
+			if err != nil {
+				t.Fatalf("got error: %+v", err)
+			}
+			if len(elements) != 3 || elements[2] != `{"log":"hello","n":4,"nested":{"a":1}}` {
+				t.Fatalf("got %+v", elements)
+			}
+		case "stream":
+			entries, err := cli.XRange(ctx, "stream", "-", "+").Result()
+			if err != nil {
+				t.Fatalf("got error: %+v", err)
+			}
+			// trimmed approximately
+			if len(entries) < 3 || len(entries) > 5 {
+				t.Fatalf("got %+v", entries)
+			}
+			last := entries[len(entries)-1].Values
+			if last["log"] != "hello" || last["n"] != "4" || last["nested"] != `{"a":1}` {
+				t.Fatalf("got %+v", last)
+			}
+		}
+	}
+}
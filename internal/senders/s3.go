@@ -0,0 +1,414 @@
+package senders
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultS3Key           = "${tag}/dt=%Y-%m-%d/${host}-${uuid}.json.gz"
+	defaultS3ChunkSize     = 64 * 1024 * 1024
+	defaultS3ChunkInterval = 10 * time.Minute
+	defaultS3PartSize      = 16 * 1024 * 1024
+	s3ChunkFileExt         = ".chunk"
+)
+
+// S3SenderCfg configuration of S3Sender
+type S3SenderCfg struct {
+	Name,
+	// Endpoint: like `s3.amazonaws.com` or `127.0.0.1:9000`
+	Endpoint,
+	AccessKey,
+	SecretKey,
+	Region,
+	Bucket,
+	// Key: template of object key,
+	// `${tag}`, `${host}` (hostname) and `${uuid}` will be replaced,
+	// `%Y %m %d %H %M %S` will be replaced by time of chunk created
+	Key,
+	// BufDir: directory to buffer chunk files
+	BufDir string
+	// ChunkSize: upload chunk when uncompressed size exceeds ChunkSize bytes
+	ChunkSize int64
+	// PartSize: part size of multipart upload
+	PartSize uint64
+	// ChunkInterval: upload chunk created for more than ChunkInterval
+	ChunkInterval                  time.Duration
+	Tags                           []string
+	BatchSize, InChanSize, NFork   int
+	MaxWait                        time.Duration
+	IsSecure, IsDiscardWhenBlocked bool
+}
+
+// S3Sender buffer messages of each tag into gzipped JSON lines chunk file,
+// then upload chunk to S3 compatible storage (like MinIO).
+//
+// messages are successed only after their chunk uploaded.
+// chunk files left by last run will be removed at startup,
+// since their messages are not committed and will be reloaded from journal.
+type S3Sender struct {
+	*BaseSender
+	*S3SenderCfg
+	logger   *utils.LoggerType
+	cli      *minio.Client
+	hostname string
+}
+
+// s3Chunk buffer of one tag
+type s3Chunk struct {
+	tag, path string
+	f         *os.File
+	gz        *gzip.Writer
+	size      int64
+	createdAt time.Time
+	msgs      []*library.FluentMsg
+}
+
+// NewS3Sender create new S3Sender
+func NewS3Sender(cfg *S3SenderCfg) *S3Sender {
+	s := &S3Sender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		S3SenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("s3 sender invalid", zap.Error(err))
+	}
+
+	var err error
+	if s.cli, err = minio.New(s.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(s.AccessKey, s.SecretKey, ""),
+		Secure: s.IsSecure,
+		Region: s.Region,
+	}); err != nil {
+		s.logger.Panic("new s3 client", zap.Error(err))
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new s3 sender",
+		zap.String("endpoint", s.Endpoint),
+		zap.Bool("is_secure", s.IsSecure),
+		zap.String("region", s.Region),
+		zap.String("bucket", s.Bucket),
+		zap.String("key", s.Key),
+		zap.String("buf_dir", s.BufDir),
+		zap.Int64("chunk_size", s.ChunkSize),
+		zap.Uint64("part_size", s.PartSize),
+		zap.Duration("chunk_interval_sec", s.ChunkInterval),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *S3Sender) valid() (err error) {
+	if s.Endpoint == "" {
+		return fmt.Errorf("endpoint should not be empty")
+	}
+	if s.Bucket == "" {
+		return fmt.Errorf("bucket should not be empty")
+	}
+	if s.BufDir == "" {
+		return fmt.Errorf("buf_dir should not be empty")
+	}
+
+	if s.Key == "" {
+		s.Key = defaultS3Key
+		s.logger.Info("reset key", zap.String("key", s.Key))
+	}
+
+	if s.ChunkSize <= 0 {
+		s.ChunkSize = defaultS3ChunkSize
+		s.logger.Info("reset chunk_size", zap.Int64("chunk_size", s.ChunkSize))
+	}
+
+	if s.PartSize == 0 {
+		s.PartSize = defaultS3PartSize
+		s.logger.Info("reset part_size", zap.Uint64("part_size", s.PartSize))
+	}
+
+	if s.ChunkInterval <= 0 {
+		s.ChunkInterval = defaultS3ChunkInterval
+		s.logger.Info("reset chunk_interval_sec", zap.Duration("chunk_interval_sec", s.ChunkInterval))
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.hostname, err = os.Hostname(); err != nil {
+		return errors.Wrap(err, "load hostname")
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *S3Sender) GetName() string {
+	return s.Name
+}
+
+// Spawn starting senders
+func (s *S3Sender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn s3 sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+	if err := s.cleanBufDir(); err != nil {
+		s.logger.Panic("clean buf_dir", zap.Error(err))
+	}
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				chunks           = map[string]*s3Chunk{}
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+			defer func() {
+				// msgs in chunks are not successed, will be reloaded from journal
+				for _, c := range chunks {
+					s.removeChunk(c)
+				}
+			}()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					s.uploadChunks(ctx, chunks)
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				for _, msg = range msgBatchDelivery {
+					s.appendChunk(i, chunks, msg)
+				}
+				s.uploadChunks(ctx, chunks)
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// cleanBufDir remove chunk files left by last run
+func (s *S3Sender) cleanBufDir() error {
+	if err := os.MkdirAll(s.BufDir, 0755); err != nil {
+		return errors.Wrap(err, "create buf_dir")
+	}
+	matched, err := filepath.Glob(filepath.Join(s.BufDir, s.Name+".*"+s3ChunkFileExt))
+	if err != nil {
+		return errors.Wrap(err, "list chunk files")
+	}
+	for _, fpath := range matched {
+		s.logger.Info("remove stale chunk file", zap.String("path", fpath))
+		if err = os.Remove(fpath); err != nil {
+			return errors.Wrap(err, "remove chunk file")
+		}
+	}
+
+	return nil
+}
+
+// appendChunk write msg into chunk of its tag,
+// msg will be put into failedChan if failed.
+func (s *S3Sender) appendChunk(i int, chunks map[string]*s3Chunk, msg *library.FluentMsg) {
+	b, err := utils.JSON.Marshal(msg.Message)
+	if err != nil {
+		s.logger.Warn("discard msg since marshal error", zap.Error(err), zap.String("tag", msg.Tag))
+		s.successedChan <- msg
+		return
+	}
+	b = append(b, '\n')
+
+	c := chunks[msg.Tag]
+	if c == nil {
+		if c, err = s.newChunk(i, msg.Tag); err != nil {
+			s.logger.Error("create chunk", zap.Error(err), zap.String("tag", msg.Tag))
+			s.failedChan <- msg
+			return
+		}
+		chunks[msg.Tag] = c
+	}
+
+	if _, err = c.gz.Write(b); err != nil {
+		s.logger.Error("write chunk", zap.Error(err), zap.String("path", c.path))
+		s.failedChan <- msg
+		return
+	}
+	c.size += int64(len(b))
+	c.msgs = append(c.msgs, msg)
+}
+
+func (s *S3Sender) newChunk(i int, tag string) (c *s3Chunk, err error) {
+	c = &s3Chunk{
+		tag:       tag,
+		createdAt: utils.Clock.GetUTCNow(),
+	}
+	c.path = filepath.Join(s.BufDir, fmt.Sprintf("%v.%d.%v%v", s.Name, i, uuid.New().String(), s3ChunkFileExt))
+	if c.f, err = os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644); err != nil {
+		return nil, errors.Wrap(err, "create chunk file")
+	}
+	c.gz = gzip.NewWriter(c.f)
+	return c, nil
+}
+
+func (s *S3Sender) removeChunk(c *s3Chunk) {
+	c.f.Close()
+	if err := os.Remove(c.path); err != nil {
+		s.logger.Error("remove chunk file", zap.Error(err), zap.String("path", c.path))
+	}
+}
+
+// uploadChunks upload chunks exceed size or interval,
+// messages of chunk will be put into successedChan or failedChan.
+func (s *S3Sender) uploadChunks(ctx context.Context, chunks map[string]*s3Chunk) {
+	var (
+		now      = utils.Clock.GetUTCNow()
+		maxRetry = 3
+		err      error
+		msg      *library.FluentMsg
+	)
+	for tag, c := range chunks {
+		if c.size < s.ChunkSize &&
+			now.Sub(c.createdAt) < s.ChunkInterval {
+			continue
+		}
+		delete(chunks, tag)
+
+		key := s.renderKey(c)
+		for nRetry := 0; ; nRetry++ {
+			if err = s.upload(ctx, c, key); err == nil || nRetry >= maxRetry {
+				break
+			}
+		}
+		s.removeChunk(c)
+		if err != nil {
+			s.logger.Error("try upload chunk",
+				zap.Error(err),
+				zap.String("key", key),
+				zap.Int("num", len(c.msgs)))
+			for _, msg = range c.msgs {
+				s.failedChan <- msg
+			}
+			continue
+		}
+
+		s.logger.Debug("success upload chunk",
+			zap.String("key", key),
+			zap.Int64("size", c.size),
+			zap.Int("num", len(c.msgs)))
+		for _, msg = range c.msgs {
+			s.successedChan <- msg
+		}
+	}
+}
+
+// upload close gzip writer then upload chunk file,
+// multipart upload will be used if file larger than PartSize.
+func (s *S3Sender) upload(ctx context.Context, c *s3Chunk, key string) (err error) {
+	if c.gz != nil {
+		if err = c.gz.Close(); err != nil {
+			return errors.Wrap(err, "close gzip writer")
+		}
+		c.gz = nil
+	}
+	stat, err := c.f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat chunk file")
+	}
+
+	// chunk file is write only
+	f, err := os.Open(c.path)
+	if err != nil {
+		return errors.Wrap(err, "open chunk file")
+	}
+	defer f.Close()
+	if _, err = s.cli.PutObject(ctx, s.Bucket, key, f, stat.Size(), minio.PutObjectOptions{
+		ContentType:     "application/x-ndjson",
+		ContentEncoding: "gzip",
+		PartSize:        s.PartSize,
+	}); err != nil {
+		return errors.Wrap(err, "put object")
+	}
+
+	return nil
+}
+
+// renderKey render key template by chunk
+func (s *S3Sender) renderKey(c *s3Chunk) string {
+	return library.TemplateWithFunc(strftime(s.Key, c.createdAt), func(key string) interface{} {
+		switch key {
+		case "tag":
+			return c.tag
+		case "host":
+			return s.hostname
+		case "uuid":
+			return uuid.New().String()
+		default:
+			return nil
+		}
+	}, nil)
+}
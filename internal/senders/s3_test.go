@@ -0,0 +1,150 @@
+package senders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func TestS3Sender(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		objects = map[string]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = decodeAWSChunked(t, body)
+		}
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("got %+v", r.Header)
+		}
+		gz, err := gzip.NewReader(strings.NewReader(string(body)))
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+			return
+		}
+		cnt, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+		}
+
+		mu.Lock()
+		objects[r.URL.Path] = string(cnt)
+		mu.Unlock()
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "gofluentd-s3-sender")
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	// stale chunk
+	if err = ioutil.WriteFile(filepath.Join(dir, "s3-test.0.stale.chunk"), []byte("stale"), 0644); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	s := NewS3Sender(&S3SenderCfg{
+		Name:      "s3-test",
+		Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		AccessKey: "key",
+		SecretKey: "secret",
+		Region:    "us-east-1",
+		Bucket:    "logs",
+		Key:       "${tag}/dt=%Y-%m-%d/${host}.json.gz",
+		BufDir:    dir,
+		ChunkSize: 30,
+		Tags:      []string{"a", "b"},
+		BatchSize: 4,
+		MaxWait:   100 * time.Millisecond,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(make(chan *library.FluentMsg, 100))
+	inChan := s.Spawn(ctx)
+	if _, err = os.Stat(filepath.Join(dir, "s3-test.0.stale.chunk")); !os.IsNotExist(err) {
+		t.Fatalf("stale chunk should be removed, got %+v", err)
+	}
+
+	for i, tag := range []string{"a", "a", "b", "a"} {
+		inChan <- &library.FluentMsg{Tag: tag, ID: int64(i), Message: map[string]interface{}{"log": "hello world"}}
+	}
+	// tag `b` does not exceed chunk size
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-successedChan:
+			if msg.Tag != "a" {
+				t.Fatalf("got %+v", msg)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	select {
+	case msg := <-successedChan:
+		t.Fatalf("got %+v", msg)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	hostname, _ := os.Hostname()
+	mu.Lock()
+	defer mu.Unlock()
+	var cnt string
+	for key, v := range objects {
+		if !strings.HasPrefix(key, "/logs/a/dt=") || !strings.HasSuffix(key, "/"+hostname+".json.gz") {
+			t.Fatalf("got %v", key)
+		}
+		cnt += v
+	}
+	if cnt != strings.Repeat(`{"log":"hello world"}`+"\n", 3) {
+		t.Fatalf("got %q", cnt)
+	}
+}
+
+// decodeAWSChunked decode body of `STREAMING-AWS4-HMAC-SHA256-PAYLOAD`,
+// chunk like `<hex size>;chunk-signature=<sig>\r\n<data>\r\n`
+func decodeAWSChunked(t *testing.T, body []byte) (data []byte) {
+	for len(body) > 0 {
+		i := bytes.Index(body, []byte("\r\n"))
+		if i < 0 {
+			t.Errorf("invalid chunk: %q", body)
+			return nil
+		}
+		size, err := strconv.ParseInt(strings.SplitN(string(body[:i]), ";", 2)[0], 16, 64)
+		if err != nil {
+			t.Errorf("got error: %+v", err)
+			return nil
+		}
+		body = body[i+2:]
+		data = append(data, body[:size]...)
+		body = body[size+2:]
+	}
+
+	return data
+}
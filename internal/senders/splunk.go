@@ -0,0 +1,642 @@
+package senders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	hecEventPath             = "/services/collector/event"
+	hecAckPath               = "/services/collector/ack"
+	hecChannelHeader         = "X-Splunk-Request-Channel"
+	defaultHECTimeout        = 30 * time.Second
+	defaultHECRetryWait      = time.Second
+	defaultHECAckInterval    = time.Second
+	defaultHECAckTimeout     = time.Minute
+	hecCodeServerBusy        = 9
+	maxHECRespBodyReadLength = 4096
+	// maxHECAcksPerQuery max ack ids in each ack query
+	maxHECAcksPerQuery = 100
+	// maxHECAckRespBodyReadLength is far larger than response of maxHECAcksPerQuery ids
+	maxHECAckRespBodyReadLength = 1024 * 1024
+)
+
+// HECSenderCfg configuration of HECSender
+type HECSenderCfg struct {
+	Name,
+	// Addr: like `https://127.0.0.1:8088`
+	Addr,
+	// Token: default HEC token, could be overwritten by TagTokenMap
+	Token,
+	// Channel: sent as `X-Splunk-Request-Channel`, generated if empty and ack is enabled
+	Channel,
+	// Format: `json` (whole message) or `raw` (value of MsgKey) as event
+	Format,
+	MsgKey,
+	// TimeKey: field to load timestamp of event, use current time if empty or failed to parse
+	TimeKey,
+	// TimeFormat: layout to parse TimeKey if it is string, default RFC3339Nano
+	TimeFormat,
+	// Host, Source, SourceType, Index: templates of event's metadata,
+	// `${tag}` will be replaced by `msg.Tag`, `${<field>}` will be replaced by field in message.
+	// metadata will not be set if empty.
+	Host,
+	Source,
+	SourceType,
+	Index string
+	// TagTokenMap: map[tag]token
+	TagTokenMap map[string]string
+	// Fields: map[name]template, indexed fields of event
+	Fields                       map[string]string
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait, Timeout             time.Duration
+	// AckInterval, AckTimeout: interval to poll acks, and messages are failed if not acked in AckTimeout
+	AckInterval, AckTimeout time.Duration
+	// IsAckEnabled: messages are committed after indexer acknowledgment,
+	// acks of all pending batches are polled in bulk asynchronously
+	IsAckEnabled         bool
+	IsGzip               bool
+	IsDiscardWhenBlocked bool
+}
+
+// HECSender send messages to Splunk HTTP Event Collector,
+// messages in batch are grouped by token.
+//
+// if ack is enabled, forks keep sending without waiting for ack,
+// pending batches are committed or failed by ack poller once their acks are resolved.
+type HECSender struct {
+	*BaseSender
+	*HECSenderCfg
+	logger     *utils.LoggerType
+	httpClient *http.Client
+	eventURL,
+	ackURL string
+	// ackChan batches waiting for indexer acknowledgment
+	ackChan chan *hecPendingAck
+}
+
+// hecPendingAck batch waiting for indexer acknowledgment
+type hecPendingAck struct {
+	token    string
+	ackID    int64
+	msgs     []*library.FluentMsg
+	deadline time.Time
+}
+
+// hecEvent event of HEC, metadata is omitted if empty
+type hecEvent struct {
+	Time       json.Number            `json:"time"`
+	Host       string                 `json:"host,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	Sourcetype string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Event      interface{}            `json:"event"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+}
+
+// hecResp response of HEC
+type hecResp struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId,omitempty"`
+}
+
+// hecStatusError response of HEC with unexpected status code
+type hecStatusError struct {
+	code int
+	body []byte
+}
+
+func (e *hecStatusError) Error() string {
+	return fmt.Sprintf("got status %d: %s", e.code, e.body)
+}
+
+// NewHECSender create new HECSender
+func NewHECSender(cfg *HECSenderCfg) *HECSender {
+	s := &HECSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		HECSenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("hec sender invalid", zap.Error(err))
+	}
+	s.ackChan = make(chan *hecPendingAck, s.NFork)
+	s.eventURL = strings.TrimRight(s.Addr, "/") + hecEventPath
+	s.ackURL = strings.TrimRight(s.Addr, "/") + hecAckPath
+	s.httpClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 20,
+		},
+		Timeout: s.Timeout,
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new hec sender",
+		zap.String("event_url", s.eventURL),
+		zap.String("channel", s.Channel),
+		zap.String("format", s.Format),
+		zap.String("msg_key", s.MsgKey),
+		zap.String("time_key", s.TimeKey),
+		zap.String("time_format", s.TimeFormat),
+		zap.String("host", s.Host),
+		zap.String("source", s.Source),
+		zap.String("sourcetype", s.SourceType),
+		zap.String("index", s.Index),
+		zap.Int("tag_tokens", len(s.TagTokenMap)),
+		zap.Any("fields", s.Fields),
+		zap.Bool("is_ack_enabled", s.IsAckEnabled),
+		zap.Duration("ack_interval_sec", s.AckInterval),
+		zap.Duration("ack_timeout_sec", s.AckTimeout),
+		zap.Bool("is_gzip", s.IsGzip),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Duration("timeout_sec", s.Timeout),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *HECSender) valid() error {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+
+	if s.Token == "" {
+		for _, tag := range s.Tags {
+			if s.TagTokenMap[tag] == "" {
+				return fmt.Errorf("token of tag `%v` should not be empty", tag)
+			}
+		}
+	}
+
+	switch s.Format {
+	case "":
+		s.Format = "json"
+		s.logger.Info("reset format", zap.String("format", s.Format))
+	case "json", "raw":
+	default:
+		return fmt.Errorf("unknown format `%v`", s.Format)
+	}
+
+	if s.MsgKey == "" {
+		s.MsgKey = "log"
+		s.logger.Info("reset msg_key", zap.String("msg_key", s.MsgKey))
+	}
+
+	if s.TimeFormat == "" {
+		s.TimeFormat = time.RFC3339Nano
+		s.logger.Info("reset time_format", zap.String("time_format", s.TimeFormat))
+	}
+
+	if s.IsAckEnabled {
+		if s.Channel == "" {
+			s.Channel = uuid.New().String()
+			s.logger.Info("reset channel", zap.String("channel", s.Channel))
+		}
+
+		if s.AckInterval <= 0 {
+			s.AckInterval = defaultHECAckInterval
+			s.logger.Info("reset ack_interval_sec", zap.Duration("ack_interval_sec", s.AckInterval))
+		}
+
+		if s.AckTimeout <= 0 {
+			s.AckTimeout = defaultHECAckTimeout
+			s.logger.Info("reset ack_timeout_sec", zap.Duration("ack_timeout_sec", s.AckTimeout))
+		}
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = defaultHECTimeout
+		s.logger.Info("reset timeout_sec", zap.Duration("timeout_sec", s.Timeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *HECSender) GetName() string {
+	return s.Name
+}
+
+func (s *HECSender) getToken(tag string) string {
+	if token, ok := s.TagTokenMap[tag]; ok {
+		return token
+	}
+
+	return s.Token
+}
+
+// Spawn starting senders
+func (s *HECSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn hec sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+	if s.IsAckEnabled {
+		go s.runAckPoller(ctx)
+	}
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				token            string
+				tokenMsgs        map[string][]*library.FluentMsg
+				body             []byte
+				ackID            int64
+				err              error
+				nRetry           int
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				tokenMsgs = map[string][]*library.FluentMsg{}
+				for _, msg = range msgBatchDelivery {
+					token = s.getToken(msg.Tag)
+					tokenMsgs[token] = append(tokenMsgs[token], msg)
+				}
+
+			TOKEN_LOOP:
+				for token, msgs := range tokenMsgs {
+					body = s.encode(msgs)
+					nRetry = 0
+					for {
+						if ackID, err = s.post(ctx, token, body); err != nil {
+							nRetry++
+							if nRetry > maxRetry {
+								s.logger.Error("try send message",
+									zap.Error(err),
+									zap.Int("num", len(msgs)))
+								for _, msg = range msgs {
+									s.failedChan <- msg
+								}
+								continue TOKEN_LOOP
+							}
+
+							s.logger.Warn("send to hec, retry later", zap.Error(err))
+							select {
+							case <-ctx.Done():
+								return
+							case <-time.After(defaultHECRetryWait * time.Duration(nRetry)):
+							}
+							continue
+						}
+
+						break
+					}
+
+					if s.IsAckEnabled {
+						select {
+						case <-ctx.Done():
+							return
+						case s.ackChan <- &hecPendingAck{
+							token:    token,
+							ackID:    ackID,
+							msgs:     msgs,
+							deadline: utils.Clock.GetUTCNow().Add(s.AckTimeout),
+						}: // blockable
+						}
+						continue
+					}
+
+					s.logger.Debug("success sent message to backend",
+						zap.String("event_url", s.eventURL),
+						zap.Int("batch", len(msgs)))
+					for _, msg = range msgs {
+						s.successedChan <- msg
+					}
+				}
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// encode marshal messages into concatenated HEC events
+func (s *HECSender) encode(msgs []*library.FluentMsg) []byte {
+	var (
+		buf   = &bytes.Buffer{}
+		event *hecEvent
+		b     []byte
+		err   error
+	)
+	for _, msg := range msgs {
+		event = &hecEvent{
+			Time:       json.Number(strconv.FormatFloat(float64(loadMsgTime(msg, s.TimeKey, s.TimeFormat).UnixNano()/1e6)/1e3, 'f', 3, 64)),
+			Host:       renderMsgTemplate(s.Host, msg),
+			Source:     renderMsgTemplate(s.Source, msg),
+			Sourcetype: renderMsgTemplate(s.SourceType, msg),
+			Index:      renderMsgTemplate(s.Index, msg),
+		}
+		if s.Format == "json" {
+			event.Event = msg.Message
+		} else {
+			switch v := msg.Message[s.MsgKey].(type) {
+			case []byte:
+				event.Event = string(v)
+			case string:
+				event.Event = v
+			default:
+				s.logger.Warn("discard msg since marshal error",
+					zap.String("tag", msg.Tag),
+					zap.String("msg_key", s.MsgKey))
+				continue
+			}
+		}
+		if len(s.Fields) != 0 {
+			event.Fields = make(map[string]interface{}, len(s.Fields))
+			for name, tpl := range s.Fields {
+				event.Fields[name] = renderMsgTemplate(tpl, msg)
+			}
+		}
+
+		if b, err = utils.JSON.Marshal(event); err != nil {
+			s.logger.Warn("discard msg since marshal error", zap.Error(err), zap.String("tag", msg.Tag))
+			continue
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
+
+// request send body to HEC, return response
+func (s *HECSender) request(ctx context.Context, url, token string, body []byte, isGzip bool) (resp *hecResp, err error) {
+	if isGzip {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		if _, err = gz.Write(body); err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		if err = gz.Close(); err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+token)
+	if s.Channel != "" {
+		req.Header.Set(hecChannelHeader, s.Channel)
+	}
+	if isGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	httpResp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "request")
+	}
+	defer httpResp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxHECRespBodyReadLength))
+	if httpResp.StatusCode/100 != 2 {
+		return nil, &hecStatusError{code: httpResp.StatusCode, body: respBody}
+	}
+
+	resp = &hecResp{}
+	if err = utils.JSON.Unmarshal(respBody, resp); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal response `%s`", respBody)
+	}
+	if resp.Code == hecCodeServerBusy {
+		return nil, fmt.Errorf("server is busy: %v", resp.Text)
+	}
+
+	return resp, nil
+}
+
+// post send events, return ack id if ack is enabled
+func (s *HECSender) post(ctx context.Context, token string, body []byte) (ackID int64, err error) {
+	resp, err := s.request(ctx, s.eventURL, token, body, s.IsGzip)
+	if err != nil {
+		return 0, err
+	}
+
+	if s.IsAckEnabled {
+		if resp.AckID == nil {
+			return 0, fmt.Errorf("ackId is missing, ack should be enabled for token")
+		}
+		return *resp.AckID, nil
+	}
+
+	return 0, nil
+}
+
+// runAckPoller poll acks of all pending batches every AckInterval,
+// batch is committed once acked, or failed if not acked in AckTimeout
+func (s *HECSender) runAckPoller(ctx context.Context) {
+	var (
+		pending = map[string]map[int64]*hecPendingAck{} // map[token]map[ackID]batch
+		ticker  = time.NewTicker(s.AckInterval)
+		p       *hecPendingAck
+		acks    map[int64]bool
+		err     error
+		now     time.Time
+		msg     *library.FluentMsg
+	)
+	defer ticker.Stop()
+	defer s.logger.Info("ack poller exits")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p = <-s.ackChan:
+			if pending[p.token] == nil {
+				pending[p.token] = map[int64]*hecPendingAck{}
+			}
+			pending[p.token][p.ackID] = p
+			continue
+		case <-ticker.C:
+		}
+
+		for token, batches := range pending {
+			if acks, err = s.queryAcks(ctx, token, batches); err != nil {
+				s.logger.Warn("query acks", zap.Error(err), zap.Int("num", len(batches)))
+			}
+
+			now = utils.Clock.GetUTCNow()
+			for ackID, p := range batches {
+				switch {
+				case acks[ackID]:
+					s.logger.Debug("success sent message to backend",
+						zap.String("event_url", s.eventURL),
+						zap.Int64("ack_id", ackID),
+						zap.Int("batch", len(p.msgs)))
+					for _, msg = range p.msgs {
+						s.successedChan <- msg
+					}
+				case now.After(p.deadline):
+					s.logger.Error("ack timeout",
+						zap.Int64("ack_id", ackID),
+						zap.Int("num", len(p.msgs)))
+					for _, msg = range p.msgs {
+						s.failedChan <- msg
+					}
+				default:
+					continue
+				}
+				delete(batches, ackID)
+			}
+			if len(batches) == 0 {
+				delete(pending, token)
+			}
+		}
+	}
+}
+
+// queryAcks query acks of batches in chunks, return map[ackID]isAcked.
+// acks of succeeded chunks are returned even if some chunks failed.
+func (s *HECSender) queryAcks(ctx context.Context, token string, batches map[int64]*hecPendingAck) (acks map[int64]bool, err error) {
+	ids := make([]int64, 0, len(batches))
+	for ackID := range batches {
+		ids = append(ids, ackID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	acks = make(map[int64]bool, len(ids))
+	for start := 0; start < len(ids); start += maxHECAcksPerQuery {
+		end := start + maxHECAcksPerQuery
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if chunkErr := s.queryAcksChunk(ctx, token, ids[start:end], acks); chunkErr != nil {
+			err = chunkErr
+		}
+	}
+
+	return acks, err
+}
+
+// queryAcksChunk query acks of ids in one request, set results into acks
+func (s *HECSender) queryAcksChunk(ctx context.Context, token string, ids []int64, acks map[int64]bool) (err error) {
+	var (
+		strIDs = make([]string, len(ids))
+		resp   struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		req      *http.Request
+		httpResp *http.Response
+		respBody []byte
+		ackID    int64
+	)
+	for i, id := range ids {
+		strIDs[i] = strconv.FormatInt(id, 10)
+	}
+
+	body := []byte(`{"acks":[` + strings.Join(strIDs, ",") + `]}`)
+	if req, err = http.NewRequest(http.MethodPost, s.ackURL, bytes.NewReader(body)); err != nil {
+		return errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Splunk "+token)
+	req.Header.Set(hecChannelHeader, s.Channel)
+	if httpResp, err = s.httpClient.Do(req); err != nil {
+		return errors.Wrap(err, "request")
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode/100 != 2 {
+		respBody, _ = ioutil.ReadAll(io.LimitReader(httpResp.Body, maxHECRespBodyReadLength))
+		return &hecStatusError{code: httpResp.StatusCode, body: respBody}
+	}
+	if respBody, err = ioutil.ReadAll(io.LimitReader(httpResp.Body, maxHECAckRespBodyReadLength+1)); err != nil {
+		return errors.Wrap(err, "read response")
+	}
+	if len(respBody) > maxHECAckRespBodyReadLength {
+		return fmt.Errorf("ack response exceeds %d bytes", maxHECAckRespBodyReadLength)
+	}
+	if err = utils.JSON.Unmarshal(respBody, &resp); err != nil {
+		return errors.Wrapf(err, "unmarshal response `%s`", respBody)
+	}
+
+	for id, ok := range resp.Acks {
+		if ackID, err = strconv.ParseInt(id, 10, 64); err == nil {
+			acks[ackID] = ok
+		}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package senders
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func TestHECSender(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		nAckQueries int
+		events      = map[string][]map[string]interface{}{} // map[token]events
+		ackIDs      = map[string]int64{}                    // map[token]next ack id
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get(hecChannelHeader) != "ch-1" {
+			t.Errorf("got channel %v", r.Header.Get(hecChannelHeader))
+		}
+		token := r.Header.Get("Authorization")
+
+		switch r.URL.Path {
+		case hecEventPath:
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("got error: %+v", err)
+				return
+			}
+			decoder := json.NewDecoder(bufio.NewReader(gz))
+			for decoder.More() {
+				event := map[string]interface{}{}
+				if err = decoder.Decode(&event); err != nil {
+					t.Errorf("got error: %+v", err)
+					return
+				}
+				events[token] = append(events[token], event)
+			}
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":` + strconv.FormatInt(ackIDs[token], 10) + `}`))
+			ackIDs[token]++
+		case hecAckPath:
+			nAckQueries++
+			req := struct {
+				Acks []int64 `json:"acks"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("got error: %+v", err)
+				return
+			}
+			// acks of default token are acked only if queried in bulk,
+			// acks of lost token are never acked
+			isAcked := token == "Splunk gateway-token" ||
+				(token == "Splunk default-token" && len(req.Acks) == 2)
+			acks := map[string]bool{}
+			for _, id := range req.Acks {
+				acks[strconv.FormatInt(id, 10)] = isAcked
+			}
+			b, _ := json.Marshal(map[string]interface{}{"acks": acks})
+			w.Write(b)
+		default:
+			t.Errorf("got path %v", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewHECSender(&HECSenderCfg{
+		Name:         "hec-test",
+		Addr:         srv.URL,
+		Token:        "default-token",
+		TagTokenMap:  map[string]string{"app.gateway": "gateway-token", "app.lost": "lost-token"},
+		Channel:      "ch-1",
+		Format:       "raw",
+		TimeKey:      "ts",
+		Host:         "${host}",
+		SourceType:   "${tag}",
+		Index:        "main",
+		Fields:       map[string]string{"pod": "${kubernetes.pod}"},
+		Tags:         []string{"app.spring", "app.gateway", "app.lost"},
+		IsAckEnabled: true,
+		AckInterval:  10 * time.Millisecond,
+		AckTimeout:   time.Second,
+		IsGzip:       true,
+		BatchSize:    2,
+		MaxWait:      3 * time.Second,
+	})
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	// first msg will be sent immediately
+	inChan <- &library.FluentMsg{Tag: "app.spring", Message: map[string]interface{}{
+		"log":        []byte("0"),
+		"ts":         "2021-01-02T03:04:05.123Z",
+		"host":       "web-1",
+		"kubernetes": map[string]interface{}{"pod": "spring-1"},
+	}}
+	inChan <- &library.FluentMsg{Tag: "app.spring", Message: map[string]interface{}{"log": "1"}}
+	inChan <- &library.FluentMsg{Tag: "app.gateway", Message: map[string]interface{}{"log": "2"}}
+	inChan <- &library.FluentMsg{Tag: "app.lost", Message: map[string]interface{}{"log": "3"}}
+	inChan <- &library.FluentMsg{Tag: "app.lost", Message: map[string]interface{}{"log": "4"}}
+	var nSuccessed, nFailed int
+	for i := 0; i < 5; i++ {
+		select {
+		case msg := <-successedChan:
+			if msg.Tag == "app.lost" {
+				t.Fatalf("got %+v", msg)
+			}
+			nSuccessed++
+		case msg := <-failedChan:
+			if msg.Tag != "app.lost" {
+				t.Fatalf("got %+v", msg)
+			}
+			nFailed++
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	if nSuccessed != 3 || nFailed != 2 {
+		t.Fatalf("got %d successed, %d failed", nSuccessed, nFailed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nAckQueries < 3 ||
+		len(events["Splunk default-token"]) != 2 ||
+		len(events["Splunk lost-token"]) != 2 ||
+		len(events["Splunk gateway-token"]) != 1 {
+		t.Fatalf("got %d acks, %+v", nAckQueries, events)
+	}
+
+	event := events["Splunk default-token"][0]
+	if event["event"] != "0" ||
+		event["time"] != 1609556645.123 ||
+		event["host"] != "web-1" ||
+		event["sourcetype"] != "app.spring" ||
+		event["index"] != "main" ||
+		event["fields"].(map[string]interface{})["pod"] != "spring-1" {
+		t.Fatalf("got %+v", event)
+	}
+	if _, ok := events["Splunk gateway-token"][0]["host"]; ok {
+		t.Fatalf("got %+v", events["Splunk gateway-token"][0])
+	}
+}
+
+func TestHECSenderQueryAcks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		nQueries int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Acks []int64 `json:"acks"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("got error: %+v", err)
+			return
+		}
+		if len(req.Acks) > maxHECAcksPerQuery {
+			t.Errorf("got %d ids in one query", len(req.Acks))
+		}
+		mu.Lock()
+		nQueries++
+		mu.Unlock()
+
+		// odd ids are not acked yet
+		acks := map[string]bool{}
+		for _, id := range req.Acks {
+			acks[strconv.FormatInt(id, 10)] = id%2 == 0
+		}
+		b, _ := json.Marshal(map[string]interface{}{"acks": acks})
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	s := NewHECSender(&HECSenderCfg{
+		Name:         "hec-test",
+		Addr:         srv.URL,
+		Token:        "default-token",
+		Channel:      "ch-1",
+		Tags:         []string{"app.spring"},
+		IsAckEnabled: true,
+	})
+
+	// large ack ids make response far larger than maxHECRespBodyReadLength
+	batches := map[int64]*hecPendingAck{}
+	for i := int64(0); i < 350; i++ {
+		batches[1e15+i] = &hecPendingAck{}
+	}
+	acks, err := s.queryAcks(context.Background(), "default-token", batches)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	if len(acks) != len(batches) {
+		t.Fatalf("got %d acks", len(acks))
+	}
+	for id, isAcked := range acks {
+		if isAcked != (id%2 == 0) {
+			t.Fatalf("got %d: %v", id, isAcked)
+		}
+	}
+	if nQueries != 4 {
+		t.Fatalf("got %d queries", nQueries)
+	}
+}
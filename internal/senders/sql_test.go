@@ -0,0 +1,300 @@
+package senders
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+// fakeSQLDriver record statements of committed transactions
+type fakeSQLDriver struct {
+	sync.Mutex
+	nFailExec int
+	committed [][]*fakeSQLExec
+	nRollback int
+	pending   []*fakeSQLExec
+}
+
+type fakeSQLExec struct {
+	query string
+	args  []driver.Value
+}
+
+type fakeSQLConn struct{ d *fakeSQLDriver }
+type fakeSQLStmt struct {
+	d     *fakeSQLDriver
+	query string
+}
+type fakeSQLTx struct{ d *fakeSQLDriver }
+
+var (
+	fakeSQLDrivers     = map[string]*fakeSQLDriver{}
+	fakeSQLDriversLock sync.Mutex
+)
+
+func init() {
+	sql.Register("sqlsender-fake", &fakeSQLDriver{})
+}
+
+// Open return conn of driver registered by name
+func (*fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	fakeSQLDriversLock.Lock()
+	defer fakeSQLDriversLock.Unlock()
+	return &fakeSQLConn{d: fakeSQLDrivers[name]}, nil
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{d: c.d, query: query}, nil
+}
+func (c *fakeSQLConn) Close() error              { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return &fakeSQLTx{d: c.d}, nil }
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.Lock()
+	defer s.d.Unlock()
+	if s.d.nFailExec > 0 {
+		s.d.nFailExec--
+		return nil, fmt.Errorf("connection reset")
+	}
+	s.d.pending = append(s.d.pending, &fakeSQLExec{query: s.query, args: args})
+	return driver.RowsAffected(1), nil
+}
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (tx *fakeSQLTx) Commit() error {
+	tx.d.Lock()
+	defer tx.d.Unlock()
+	tx.d.committed = append(tx.d.committed, tx.d.pending)
+	tx.d.pending = nil
+	return nil
+}
+func (tx *fakeSQLTx) Rollback() error {
+	tx.d.Lock()
+	defer tx.d.Unlock()
+	tx.d.nRollback++
+	tx.d.pending = nil
+	return nil
+}
+
+// newFakeSQLDB open db by fake driver
+func newFakeSQLDB(t *testing.T, name string) (*sql.DB, *fakeSQLDriver) {
+	d := &fakeSQLDriver{}
+	fakeSQLDriversLock.Lock()
+	fakeSQLDrivers[name] = d
+	fakeSQLDriversLock.Unlock()
+	db, err := sql.Open("sqlsender-fake", name)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	return db, d
+}
+
+func TestSQLSenderInsertQuery(t *testing.T) {
+	for _, c := range []struct {
+		driver, dsn, expect string
+	}{
+		{
+			driver: "postgres",
+			dsn:    "postgres://127.0.0.1/db",
+			expect: `INSERT INTO "audit"."logs" ("ts", "user", "msgid") VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT ("msgid") DO NOTHING`,
+		},
+		{
+			driver: "mysql",
+			dsn:    "user:pwd@tcp(127.0.0.1:3306)/db",
+			expect: "INSERT INTO `audit`.`logs` (`ts`, `user`, `msgid`) VALUES (?, ?, ?), (?, ?, ?) ON DUPLICATE KEY UPDATE `msgid` = `msgid`",
+		},
+	} {
+		s := NewSQLSender(&SQLSenderCfg{
+			Name:        "sql-test",
+			Driver:      c.driver,
+			DSN:         c.dsn,
+			Table:       "audit.logs",
+			Columns:     []string{"ts", "user"},
+			MsgIDColumn: "msgid",
+		})
+		if got := s.insertQuery(s.Table, 2); got != c.expect {
+			t.Errorf("expect %v, got %v", c.expect, got)
+		}
+		s.db.Close()
+	}
+}
+
+func TestSQLSender(t *testing.T) {
+	db, d := newFakeSQLDB(t, t.Name())
+	d.nFailExec = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewSQLSender(&SQLSenderCfg{
+		Name:        "sql-test",
+		Driver:      "postgres",
+		DSN:         "postgres://127.0.0.1/db",
+		TagTableMap: map[string]string{"audit.order": "order_audit", "audit.pay": "pay_audit"},
+		Columns:     []string{"ts=@timestamp", "user=user.name", "detail"},
+		TimeColumns: []string{"ts"},
+		TimeFormat:  "2006-01-02T15:04:05.000Z",
+		MsgIDColumn: "msgid",
+		Tags:        []string{"audit.order", "audit.pay"},
+		BatchSize:   3,
+		MaxWait:     3 * time.Second,
+	})
+	s.db.Close()
+	s.db = db
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	// first msg will be sent immediately, failed once then retried
+	inChan <- &library.FluentMsg{Tag: "audit.order", ID: 1, Message: map[string]interface{}{
+		"@timestamp": "2021-01-02T03:04:05.123Z",
+		"user":       map[string]interface{}{"name": []byte("laisky")},
+		"detail":     map[string]interface{}{"action": "refund"},
+	}}
+	select {
+	case <-successedChan:
+	case <-failedChan:
+		t.Fatal("should not fail")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	for i, tag := range []string{"audit.order", "audit.pay", "audit.order"} {
+		inChan <- &library.FluentMsg{Tag: tag, ID: int64(i + 2), Message: map[string]interface{}{"detail": "x"}}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+		case <-failedChan:
+			t.Fatal("should not fail")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.nRollback != 1 || len(d.committed) != 2 || len(d.committed[0]) != 1 || len(d.committed[1]) != 2 {
+		t.Fatalf("got %d rollback, %+v", d.nRollback, d.committed)
+	}
+
+	exec := d.committed[0][0]
+	if exec.query != `INSERT INTO "order_audit" ("ts", "user", "detail", "msgid") VALUES ($1, $2, $3, $4) ON CONFLICT ("msgid") DO NOTHING` ||
+		!exec.args[0].(time.Time).Equal(time.Date(2021, 1, 2, 3, 4, 5, 123e6, time.UTC)) ||
+		exec.args[1] != "laisky" ||
+		exec.args[2] != `{"action":"refund"}` ||
+		len(exec.args[3].(string)) != 40 {
+		t.Fatalf("got %+v", exec)
+	}
+
+	for _, exec = range d.committed[1] {
+		switch {
+		case strings.HasPrefix(exec.query, `INSERT INTO "order_audit"`):
+			// same content with different msg.ID should have different key
+			if len(exec.args) != 8 || exec.args[0] != nil || exec.args[2] != "x" || exec.args[3] == exec.args[7] {
+				t.Fatalf("got %+v", exec)
+			}
+		case strings.HasPrefix(exec.query, `INSERT INTO "pay_audit"`):
+			if len(exec.args) != 4 || len(exec.args[3].(string)) != 40 {
+				t.Fatalf("got %+v", exec)
+			}
+		default:
+			t.Fatalf("got %+v", exec)
+		}
+	}
+}
+
+func TestSQLSenderMsgKey(t *testing.T) {
+	s := NewSQLSender(&SQLSenderCfg{
+		Name:        "sql-test",
+		Driver:      "postgres",
+		DSN:         "postgres://127.0.0.1/db",
+		Table:       "logs",
+		Columns:     []string{"log"},
+		MsgIDColumn: "msgid",
+	})
+	defer s.db.Close()
+
+	msg := &library.FluentMsg{Tag: "audit", ID: 1, Message: map[string]interface{}{"log": "a"}}
+	key := s.convertRow(msg)[1]
+	if s.convertRow(msg)[1] != key {
+		t.Fatal("key should be stable")
+	}
+	for _, other := range []*library.FluentMsg{
+		{Tag: "audit", ID: 1, Message: map[string]interface{}{"log": "b"}},
+		{Tag: "audit", ID: 2, Message: map[string]interface{}{"log": "a"}},
+		{Tag: "audit.pay", ID: 1, Message: map[string]interface{}{"log": "a"}},
+	} {
+		if s.convertRow(other)[1] == key {
+			t.Fatalf("%+v should have different key", other)
+		}
+	}
+
+	// messages from other instances
+	s.hostname += "-2"
+	if s.convertRow(msg)[1] == key {
+		t.Fatal("key should contain hostname")
+	}
+}
+
+func TestSQLSenderCopy(t *testing.T) {
+	db, d := newFakeSQLDB(t, t.Name())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	successedChan := make(chan *library.FluentMsg, 100)
+	failedChan := make(chan *library.FluentMsg, 100)
+	s := NewSQLSender(&SQLSenderCfg{
+		Name:      "sql-test",
+		Driver:    "postgres",
+		DSN:       "postgres://127.0.0.1/db",
+		Table:     "audit.logs",
+		Mode:      "copy",
+		Columns:   []string{"detail"},
+		Tags:      []string{"audit.order"},
+		BatchSize: 2,
+		MaxWait:   3 * time.Second,
+	})
+	s.db.Close()
+	s.db = db
+	s.SetMsgPool(&sync.Pool{})
+	s.SetSuccessedChan(successedChan)
+	s.SetFailedChan(failedChan)
+	inChan := s.Spawn(ctx)
+
+	for _, detail := range []string{"0", "1", "2"} {
+		inChan <- &library.FluentMsg{Tag: "audit.order", Message: map[string]interface{}{"detail": detail}}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-successedChan:
+		case <-failedChan:
+			t.Fatal("should not fail")
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	// rows and flush
+	if len(d.committed) != 2 || len(d.committed[1]) != 3 ||
+		d.committed[1][0].query != `COPY "audit"."logs" ("detail") FROM STDIN` ||
+		d.committed[1][1].args[0] != "2" ||
+		len(d.committed[1][2].args) != 0 {
+		t.Fatalf("got %+v", d.committed)
+	}
+}
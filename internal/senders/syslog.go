@@ -0,0 +1,505 @@
+package senders
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gofluentd/library"
+	"gofluentd/library/log"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/Laisky/zap"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSyslogTimeout = 30 * time.Second
+	// syslogMaxAppNameLen https://tools.ietf.org/html/rfc5424#section-6
+	syslogMaxAppNameLen  = 48
+	syslogMaxHostnameLen = 255
+	// syslogMaxTagLen https://tools.ietf.org/html/rfc3164#section-4.1.3
+	syslogMaxTagLen = 32
+)
+
+// syslogSeverityAliases aliases of severity names used by applications
+var syslogSeverityAliases = map[string]int{
+	"emergency":     0,
+	"panic":         0,
+	"critical":      2,
+	"fatal":         2,
+	"error":         3,
+	"warn":          4,
+	"informational": 6,
+}
+
+// SyslogSenderCfg configuration of SyslogSender
+type SyslogSenderCfg struct {
+	Name,
+	// Addr: like `127.0.0.1:514`
+	Addr,
+	// Network: `udp`, `tcp` or `tls`
+	Network,
+	// Format: `rfc5424` or `rfc3164`
+	Format,
+	// Framing: `octet-counting` or `newline` for `tcp` and `tls`,
+	// each message is sent in one datagram for `udp`
+	Framing,
+	// AppName, Hostname, Severity, Facility: templates,
+	// `${tag}` will be replaced by `msg.Tag`, `${<field>}` will be replaced by field in message.
+	// Severity and Facility could be name (like `info`, `local0`) or number
+	AppName,
+	Hostname,
+	Severity,
+	Facility,
+	// MsgKey: field as content of syslog message, whole message will be marshaled as JSON if not exists
+	MsgKey,
+	// TimeKey: field to load timestamp, use current time if empty or failed to parse
+	TimeKey,
+	// TimeFormat: layout to parse TimeKey if it is string, default RFC3339Nano
+	TimeFormat,
+	// TLSCAFile: CA to verify server, use system CAs if empty
+	TLSCAFile string
+	Tags                         []string
+	BatchSize, InChanSize, NFork int
+	MaxWait, Timeout             time.Duration
+	IsTLSInsecureSkipVerify      bool
+	IsDiscardWhenBlocked         bool
+}
+
+// SyslogSender send messages to syslog server (like SIEM or rsyslog)
+type SyslogSender struct {
+	*BaseSender
+	*SyslogSenderCfg
+	logger    *utils.LoggerType
+	tlsConfig *tls.Config
+}
+
+// NewSyslogSender create new SyslogSender
+func NewSyslogSender(cfg *SyslogSenderCfg) *SyslogSender {
+	s := &SyslogSender{
+		logger: log.Logger.Named(cfg.Name),
+		BaseSender: &BaseSender{
+			IsDiscardWhenBlocked: cfg.IsDiscardWhenBlocked,
+		},
+		SyslogSenderCfg: cfg,
+	}
+	if err := s.valid(); err != nil {
+		s.logger.Panic("syslog sender invalid", zap.Error(err))
+	}
+
+	s.SetSupportedTags(cfg.Tags)
+	s.logger.Info("new syslog sender",
+		zap.String("addr", s.Addr),
+		zap.String("network", s.Network),
+		zap.String("format", s.Format),
+		zap.String("framing", s.Framing),
+		zap.String("app_name", s.AppName),
+		zap.String("hostname", s.Hostname),
+		zap.String("severity", s.Severity),
+		zap.String("facility", s.Facility),
+		zap.String("msg_key", s.MsgKey),
+		zap.String("time_key", s.TimeKey),
+		zap.String("time_format", s.TimeFormat),
+		zap.Int("batch_size", s.BatchSize),
+		zap.Int("n_fork", s.NFork),
+		zap.Duration("max_wait_sec", s.MaxWait),
+		zap.Duration("timeout_sec", s.Timeout),
+		zap.Strings("tags", s.Tags),
+	)
+	return s
+}
+
+func (s *SyslogSender) valid() (err error) {
+	if s.Addr == "" {
+		return fmt.Errorf("addr should not be empty")
+	}
+
+	switch s.Network {
+	case "":
+		s.Network = "tcp"
+		s.logger.Info("reset network", zap.String("network", s.Network))
+	case "udp", "tcp":
+	case "tls":
+		s.tlsConfig = &tls.Config{
+			InsecureSkipVerify: s.IsTLSInsecureSkipVerify,
+		}
+		if s.TLSCAFile != "" {
+			ca, err := ioutil.ReadFile(s.TLSCAFile)
+			if err != nil {
+				return errors.Wrap(err, "read tls_ca_file")
+			}
+			s.tlsConfig.RootCAs = x509.NewCertPool()
+			if !s.tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return fmt.Errorf("invalid tls_ca_file `%v`", s.TLSCAFile)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown network `%v`", s.Network)
+	}
+
+	switch s.Format {
+	case "":
+		s.Format = "rfc5424"
+		s.logger.Info("reset format", zap.String("format", s.Format))
+	case "rfc5424", "rfc3164":
+	default:
+		return fmt.Errorf("unknown format `%v`", s.Format)
+	}
+
+	switch s.Framing {
+	case "":
+		s.Framing = "octet-counting"
+		s.logger.Info("reset framing", zap.String("framing", s.Framing))
+	case "octet-counting", "newline":
+	default:
+		return fmt.Errorf("unknown framing `%v`", s.Framing)
+	}
+
+	if s.AppName == "" {
+		s.AppName = "${tag}"
+		s.logger.Info("reset app_name", zap.String("app_name", s.AppName))
+	}
+
+	if s.Hostname == "" {
+		if s.Hostname, err = os.Hostname(); err != nil {
+			return errors.Wrap(err, "load hostname")
+		}
+		s.logger.Info("reset hostname", zap.String("hostname", s.Hostname))
+	}
+
+	if s.Severity == "" {
+		s.Severity = "info"
+		s.logger.Info("reset severity", zap.String("severity", s.Severity))
+	}
+
+	if s.Facility == "" {
+		s.Facility = "local0"
+		s.logger.Info("reset facility", zap.String("facility", s.Facility))
+	}
+	if !strings.Contains(s.Facility, "${") && parseSyslogFacility(s.Facility) < 0 {
+		return fmt.Errorf("unknown facility `%v`", s.Facility)
+	}
+
+	if s.MsgKey == "" {
+		s.MsgKey = "log"
+		s.logger.Info("reset msg_key", zap.String("msg_key", s.MsgKey))
+	}
+
+	if s.TimeFormat == "" {
+		s.TimeFormat = time.RFC3339Nano
+		s.logger.Info("reset time_format", zap.String("time_format", s.TimeFormat))
+	}
+
+	if s.NFork <= 0 {
+		s.NFork = 1
+		s.logger.Info("reset forks", zap.Int("forks", s.NFork))
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = 500
+		s.logger.Info("reset msg_batch_size", zap.Int("msg_batch_size", s.BatchSize))
+	}
+
+	if s.MaxWait <= 0 {
+		s.MaxWait = 5 * time.Second
+		s.logger.Info("reset max_wait_sec", zap.Duration("max_wait_sec", s.MaxWait))
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = defaultSyslogTimeout
+		s.logger.Info("reset timeout_sec", zap.Duration("timeout_sec", s.Timeout))
+	}
+
+	return nil
+}
+
+// GetName return the name of this sender
+func (s *SyslogSender) GetName() string {
+	return s.Name
+}
+
+func (s *SyslogSender) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.Timeout}
+	if s.Network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", s.Addr, s.tlsConfig)
+	}
+
+	return dialer.Dial(s.Network, s.Addr)
+}
+
+// Spawn starting senders
+func (s *SyslogSender) Spawn(ctx context.Context) chan<- *library.FluentMsg {
+	s.logger.Info("spawn syslog sender")
+	inChan := make(chan *library.FluentMsg, s.InChanSize)
+
+	for i := 0; i < s.NFork; i++ {
+		go func(i int) {
+			var (
+				maxRetry         = 3
+				msg              *library.FluentMsg
+				msgBatch         = make([]*library.FluentMsg, s.BatchSize)
+				msgBatchDelivery []*library.FluentMsg
+				iBatch           = 0
+				lastT            = time.Unix(0, 0)
+				conn             net.Conn
+				err              error
+				nRetry           int
+				ok               bool
+				ticker           = time.NewTicker(s.MaxWait)
+			)
+			defer ticker.Stop()
+			defer s.logger.Info("producer exits",
+				zap.Int("i", i),
+				zap.String("name", s.GetName()))
+			defer func() {
+				if conn != nil {
+					conn.Close()
+				}
+			}()
+
+		NEW_MSG_LOOP:
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case msg, ok = <-inChan:
+					if !ok {
+						s.logger.Info("inChan closed")
+						return
+					}
+					msgBatch[iBatch] = msg
+					iBatch++
+				case <-ticker.C:
+					if iBatch == 0 {
+						continue
+					}
+				}
+
+				if iBatch < s.BatchSize &&
+					utils.Clock.GetUTCNow().Sub(lastT) < s.MaxWait {
+					continue
+				}
+				lastT = utils.Clock.GetUTCNow()
+				msgBatchDelivery = msgBatch[:iBatch]
+				iBatch = 0
+				nRetry = 0
+				if utils.Settings.GetBool("dry") {
+					for _, msg = range msgBatchDelivery {
+						s.logger.Info("send message to backend",
+							zap.String("log", fmt.Sprint(msg.Message)))
+						s.successedChan <- msg
+					}
+					continue
+				}
+
+				for {
+					if conn == nil {
+						conn, err = s.dial()
+					}
+					if err == nil {
+						err = s.send(conn, msgBatchDelivery)
+					}
+					if err != nil {
+						if conn != nil {
+							conn.Close()
+							conn = nil
+						}
+
+						nRetry++
+						if nRetry > maxRetry {
+							s.logger.Error("try send message",
+								zap.Error(err),
+								zap.Int("num", len(msgBatchDelivery)))
+							for _, msg = range msgBatchDelivery {
+								s.failedChan <- msg
+							}
+							continue NEW_MSG_LOOP
+						}
+						continue
+					}
+
+					break
+				}
+
+				s.logger.Debug("success sent message to backend",
+					zap.String("addr", s.Addr),
+					zap.Int("batch", len(msgBatchDelivery)))
+				for _, msg = range msgBatchDelivery {
+					s.successedChan <- msg
+				}
+			}
+		}(i)
+	}
+
+	return inChan
+}
+
+// send write batch to conn,
+// for udp, each message is written as one datagram.
+func (s *SyslogSender) send(conn net.Conn, msgs []*library.FluentMsg) (err error) {
+	if err = conn.SetWriteDeadline(utils.Clock.GetUTCNow().Add(s.Timeout)); err != nil {
+		return errors.Wrap(err, "set write deadline")
+	}
+
+	var (
+		buf   = &bytes.Buffer{}
+		frame []byte
+	)
+	for _, msg := range msgs {
+		frame = s.formatMsg(msg)
+		if s.Network == "udp" {
+			if _, err = conn.Write(frame); err != nil {
+				return errors.Wrap(err, "write datagram")
+			}
+			continue
+		}
+
+		if s.Framing == "octet-counting" {
+			buf.WriteString(strconv.Itoa(len(frame)))
+			buf.WriteByte(' ')
+			buf.Write(frame)
+		} else {
+			buf.Write(bytes.ReplaceAll(frame, []byte{'\n'}, []byte{' '}))
+			buf.WriteByte('\n')
+		}
+	}
+
+	if buf.Len() != 0 {
+		if _, err = conn.Write(buf.Bytes()); err != nil {
+			return errors.Wrap(err, "write")
+		}
+	}
+
+	return nil
+}
+
+// formatMsg format message as syslog line without framing
+func (s *SyslogSender) formatMsg(msg *library.FluentMsg) []byte {
+	var (
+		ts       = loadMsgTime(msg, s.TimeKey, s.TimeFormat)
+		severity = parseSyslogSeverity(renderMsgTemplate(s.Severity, msg))
+		facility = parseSyslogFacility(renderMsgTemplate(s.Facility, msg))
+		hostname = sanitizeSyslogField(renderMsgTemplate(s.Hostname, msg), syslogMaxHostnameLen)
+		content  []byte
+	)
+	if facility < 0 {
+		facility = 16 // local0
+	}
+
+	switch v := msg.Message[s.MsgKey].(type) {
+	case []byte:
+		content = v
+	case string:
+		content = []byte(v)
+	default:
+		var err error
+		if content, err = utils.JSON.Marshal(msg.Message); err != nil {
+			s.logger.Warn("marshal message", zap.Error(err), zap.String("tag", msg.Tag))
+		}
+	}
+	content = bytes.TrimRight(content, "\n")
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('<')
+	buf.WriteString(strconv.Itoa(facility*8 + severity))
+	buf.WriteByte('>')
+	if s.Format == "rfc3164" {
+		buf.WriteString(ts.Format(time.Stamp))
+		buf.WriteByte(' ')
+		buf.WriteString(hostname)
+		buf.WriteByte(' ')
+		buf.WriteString(sanitizeSyslogTag(renderMsgTemplate(s.AppName, msg)))
+		buf.WriteString(": ")
+	} else {
+		buf.WriteString("1 ")
+		buf.WriteString(ts.Format("2006-01-02T15:04:05.000000Z07:00"))
+		buf.WriteByte(' ')
+		buf.WriteString(hostname)
+		buf.WriteByte(' ')
+		buf.WriteString(sanitizeSyslogField(renderMsgTemplate(s.AppName, msg), syslogMaxAppNameLen))
+		// PROCID MSGID STRUCTURED-DATA
+		buf.WriteString(" - - - ")
+	}
+	buf.Write(content)
+
+	return buf.Bytes()
+}
+
+// parseSyslogSeverity parse severity name or number, return `info` if unknown
+func parseSyslogSeverity(v string) int {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < len(library.SyslogSeverityNames) {
+		return n
+	}
+	for i, name := range library.SyslogSeverityNames {
+		if name == v {
+			return i
+		}
+	}
+	if n, ok := syslogSeverityAliases[v]; ok {
+		return n
+	}
+
+	return 6
+}
+
+// parseSyslogFacility parse facility name or number, return -1 if unknown
+func parseSyslogFacility(v string) int {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < len(library.SyslogFacilityNames) {
+		return n
+	}
+	for i, name := range library.SyslogFacilityNames {
+		if name == v {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// sanitizeSyslogField replace non-printable ASCII and space by `_`,
+// return `-` (nil value) if empty
+func sanitizeSyslogField(v string, maxLen int) string {
+	if v == "" {
+		return "-"
+	}
+
+	b := []byte(v)
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			b[i] = '_'
+		}
+	}
+	if len(b) > maxLen {
+		b = b[:maxLen]
+	}
+
+	return string(b)
+}
+
+// sanitizeSyslogTag keep alphanumeric and `-_.` chars of RFC3164 TAG
+func sanitizeSyslogTag(v string) string {
+	b := make([]byte, 0, len(v))
+	for i := 0; i < len(v) && len(b) < syslogMaxTagLen; i++ {
+		c := v[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' {
+			b = append(b, c)
+		}
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+
+	return string(b)
+}
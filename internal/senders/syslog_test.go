@@ -0,0 +1,206 @@
+package senders
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gofluentd/library"
+)
+
+func TestSyslogSenderFormatMsg(t *testing.T) {
+	for _, c := range []struct {
+		cfg    *SyslogSenderCfg
+		msg    map[string]interface{}
+		expect string
+	}{
+		{
+			cfg: &SyslogSenderCfg{
+				Hostname: "${host}",
+				Severity: "${level}",
+				Facility: "auth",
+			},
+			msg: map[string]interface{}{
+				"host":  "web 1",
+				"level": "ERROR",
+				"ts":    "2021-01-02T03:04:05.123456Z",
+				"log":   "login failed\n",
+			},
+			expect: "<35>1 2021-01-02T03:04:05.123456Z web_1 security.auth - - - login failed",
+		},
+		{
+			cfg: &SyslogSenderCfg{
+				Format:   "rfc3164",
+				AppName:  "sshd[${pid}]",
+				Hostname: "web-1",
+				Severity: "4",
+			},
+			msg: map[string]interface{}{
+				"pid": "12",
+				"ts":  "2021-01-02T03:04:05Z",
+				"log": []byte("hello"),
+			},
+			expect: "<132>Jan  2 03:04:05 web-1 sshd12: hello",
+		},
+		{
+			cfg: &SyslogSenderCfg{
+				Hostname: "web-1",
+				MsgKey:   "content",
+			},
+			msg: map[string]interface{}{
+				"ts": "2021-01-02T03:04:05Z",
+			},
+			expect: `<134>1 2021-01-02T03:04:05.000000Z web-1 security.auth - - - {"ts":"2021-01-02T03:04:05Z"}`,
+		},
+	} {
+		c.cfg.Name = "syslog-test"
+		c.cfg.Addr = "127.0.0.1:514"
+		c.cfg.TimeKey = "ts"
+		s := NewSyslogSender(c.cfg)
+		got := string(s.formatMsg(&library.FluentMsg{Tag: "security.auth", Message: c.msg}))
+		if got != c.expect {
+			t.Errorf("expect %q, got %q", c.expect, got)
+		}
+	}
+}
+
+func TestParseSyslogSeverityAndFacility(t *testing.T) {
+	for v, expect := range map[string]int{
+		"emerg":   0,
+		"Warning": 4,
+		"warn":    4,
+		"fatal":   2,
+		"7":       7,
+		"9":       6,
+		"unknown": 6,
+	} {
+		if got := parseSyslogSeverity(v); got != expect {
+			t.Errorf("severity %v: expect %d, got %d", v, expect, got)
+		}
+	}
+
+	for v, expect := range map[string]int{
+		"kern":    0,
+		"LOCAL7":  23,
+		"10":      10,
+		"24":      -1,
+		"unknown": -1,
+	} {
+		if got := parseSyslogFacility(v); got != expect {
+			t.Errorf("facility %v: expect %d, got %d", v, expect, got)
+		}
+	}
+}
+
+// readSyslogOctetCountingFrame read one `MSG-LEN SP SYSLOG-MSG` frame
+func readSyslogOctetCountingFrame(r *bufio.Reader) (string, error) {
+	l, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(l))
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func TestSyslogSender(t *testing.T) {
+	for _, framing := range []string{"octet-counting", "newline"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+
+		var (
+			mu     sync.Mutex
+			frames []string
+		)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func(conn net.Conn) {
+					defer conn.Close()
+					r := bufio.NewReader(conn)
+					for {
+						var frame string
+						if framing == "newline" {
+							frame, err = r.ReadString('\n')
+							frame = strings.TrimSuffix(frame, "\n")
+						} else {
+							frame, err = readSyslogOctetCountingFrame(r)
+						}
+						if err != nil {
+							return
+						}
+						mu.Lock()
+						frames = append(frames, frame)
+						mu.Unlock()
+					}
+				}(conn)
+			}
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		successedChan := make(chan *library.FluentMsg, 100)
+		failedChan := make(chan *library.FluentMsg, 100)
+		s := NewSyslogSender(&SyslogSenderCfg{
+			Name:      "syslog-test",
+			Addr:      ln.Addr().String(),
+			Framing:   framing,
+			Hostname:  "web-1",
+			Tags:      []string{"security.auth"},
+			BatchSize: 2,
+			MaxWait:   3 * time.Second,
+		})
+		s.SetMsgPool(&sync.Pool{})
+		s.SetSuccessedChan(successedChan)
+		s.SetFailedChan(failedChan)
+		inChan := s.Spawn(ctx)
+
+		for _, log := range []string{"first", "second\nline", "third"} {
+			inChan <- &library.FluentMsg{Tag: "security.auth", Message: map[string]interface{}{"log": log}}
+		}
+		for i := 0; i < 3; i++ {
+			select {
+			case <-successedChan:
+			case <-failedChan:
+				t.Fatal("should not fail")
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+		}
+		cancel()
+
+		// wait server to read frames
+		time.Sleep(100 * time.Millisecond)
+		ln.Close()
+		mu.Lock()
+		if len(frames) != 3 {
+			t.Fatalf("[%v] got %q", framing, frames)
+		}
+		expect := "second\nline"
+		if framing == "newline" {
+			expect = "second line"
+		}
+		if !strings.HasPrefix(frames[0], "<134>1 ") ||
+			!strings.HasSuffix(frames[0], " web-1 security.auth - - - first") ||
+			!strings.HasSuffix(frames[1], " - - - "+expect) {
+			t.Fatalf("[%v] got %q", framing, frames)
+		}
+		mu.Unlock()
+	}
+}
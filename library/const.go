@@ -14,4 +14,15 @@ var (
 		"level",
 		"datasource",
 	}
+
+	// SyslogFacilityNames https://tools.ietf.org/html/rfc5424#section-6.2.1
+	SyslogFacilityNames = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	// SyslogSeverityNames https://tools.ietf.org/html/rfc5424#section-6.2.1
+	SyslogSeverityNames = []string{
+		"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+	}
 )
@@ -60,7 +60,8 @@ func (e *FluentEncoder) EncodeBatch(tag string, msgBatch []*FluentMsg) (err erro
 
 	// recycle
 	for _, tmpWrapI := range e.batchWrap[1].([]interface{}) {
-		tmpWrap = tmpWrapI.([]interface{})
+		tmpWrap := tmpWrapI.([]interface{}) // should not reuse the pointer of outer variable
+		tmpWrap[1] = nil
 		fluentdWrapMsgPool.Put(&tmpWrap)
 	}
 
@@ -0,0 +1,44 @@
+package library
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/tinylib/msgp/msgp"
+)
+
+func TestFluentEncoderEncodeBatch(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewFluentEncoder(buf)
+	// encode twice to reuse wraps recycled by the first batch
+	for i := 0; i < 2; i++ {
+		batch := []*FluentMsg{}
+		for j := 0; j < 3; j++ {
+			batch = append(batch, &FluentMsg{Message: map[string]interface{}{"log": fmt.Sprint(i, j)}})
+		}
+		if err := enc.EncodeBatch("test", batch); err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	reader := msgp.NewReader(buf)
+	for i := 0; i < 2; i++ {
+		v, err := reader.ReadIntf()
+		if err != nil {
+			t.Fatalf("got error: %+v", err)
+		}
+		entries := v.([]interface{})[1].([]interface{})
+		if len(entries) != 3 {
+			t.Fatalf("got %+v", v)
+		}
+		for j, entry := range entries {
+			if log := entry.([]interface{})[1].(map[string]interface{})["log"]; log != fmt.Sprint(i, j) {
+				t.Fatalf("expect %v, got %v", fmt.Sprint(i, j), log)
+			}
+		}
+	}
+}
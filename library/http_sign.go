@@ -0,0 +1,155 @@
+package library
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	utils "github.com/Laisky/go-utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HTTPSignTimestampHeader header of unix timestamp in seconds
+	HTTPSignTimestampHeader = "X-Gofluentd-Timestamp"
+	// HTTPSignNonceHeader header of random string that can only be used once
+	HTTPSignNonceHeader = "X-Gofluentd-Nonce"
+	// HTTPSignKeyIDHeader header of key id, optional, will try all keys if missing
+	HTTPSignKeyIDHeader = "X-Gofluentd-Key-Id"
+	// HTTPSignSignatureHeader header of `hex(hmac_sha256(key, <ts>\n<nonce>\n<body>))`
+	HTTPSignSignatureHeader = "X-Gofluentd-Signature"
+
+	httpSignMaxNonceLen = 128
+)
+
+// HTTPHMACValidator validate HMAC-SHA256 signature of request,
+// multiple keys can be active at the same time for rotation.
+type HTTPHMACValidator struct {
+	keys map[string][]byte
+	maxAllowedDelay,
+	maxAllowedAhead time.Duration
+	nonces *nonceCache
+}
+
+// NewHTTPHMACValidator create new HTTPHMACValidator,
+// timestamp should be in window `[now - maxAllowedDelay, now + maxAllowedAhead]`
+func NewHTTPHMACValidator(keys map[string][]byte, maxAllowedDelay, maxAllowedAhead time.Duration) (*HTTPHMACValidator, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("hmac keys should not be empty")
+	}
+	for id, key := range keys {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("hmac key `%v` should not be empty", id)
+		}
+	}
+
+	return &HTTPHMACValidator{
+		keys:            keys,
+		maxAllowedDelay: maxAllowedDelay,
+		maxAllowedAhead: maxAllowedAhead,
+		// nonce expires after timestamp out of window
+		nonces: newNonceCache(maxAllowedDelay + maxAllowedAhead),
+	}, nil
+}
+
+// Validate check timestamp, signature & nonce of request
+func (v *HTTPHMACValidator) Validate(header http.Header, body []byte) error {
+	tsStr := header.Get(HTTPSignTimestampHeader)
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "parse header `%v`", HTTPSignTimestampHeader)
+	}
+	now := utils.Clock.GetUTCNow()
+	if t := time.Unix(ts, 0); now.Sub(t) > v.maxAllowedDelay {
+		return fmt.Errorf("signature expires")
+	} else if t.Sub(now) > v.maxAllowedAhead {
+		return fmt.Errorf("signature come from future")
+	}
+
+	nonce := header.Get(HTTPSignNonceHeader)
+	if nonce == "" || len(nonce) > httpSignMaxNonceLen {
+		return fmt.Errorf("header `%v` should not be empty or longer than %d", HTTPSignNonceHeader, httpSignMaxNonceLen)
+	}
+
+	sig, err := hex.DecodeString(header.Get(HTTPSignSignatureHeader))
+	if err != nil {
+		return errors.Wrapf(err, "decode header `%v`", HTTPSignSignatureHeader)
+	}
+
+	var keys [][]byte
+	if id := header.Get(HTTPSignKeyIDHeader); id != "" {
+		key, ok := v.keys[id]
+		if !ok {
+			return fmt.Errorf("unknown key id `%v`", id)
+		}
+		keys = append(keys, key)
+	} else {
+		for _, key := range v.keys {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		if !hmac.Equal(sig, SignHTTPBody(key, tsStr, nonce, body)) {
+			continue
+		}
+
+		// only check nonce after signature passed, avoid nonce cache being flooded
+		if !v.nonces.CheckAndAdd(nonce, now) {
+			return fmt.Errorf("nonce `%v` already used", nonce)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("signature error")
+}
+
+// SignHTTPBody calculate `hmac_sha256(key, <ts>\n<nonce>\n<body>)`
+func SignHTTPBody(key []byte, ts, nonce string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ts + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// nonceCache remember used nonces until they expire
+type nonceCache struct {
+	sync.Mutex
+	ttl       time.Duration
+	lastPurge time.Time
+	nonces    map[string]time.Time // map[nonce]expireAt
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{
+		ttl:    ttl,
+		nonces: map[string]time.Time{},
+	}
+}
+
+// CheckAndAdd return false if nonce already used
+func (c *nonceCache) CheckAndAdd(nonce string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if now.Sub(c.lastPurge) > c.ttl {
+		for n, expireAt := range c.nonces {
+			if now.After(expireAt) {
+				delete(c.nonces, n)
+			}
+		}
+		c.lastPurge = now
+	}
+
+	if expireAt, ok := c.nonces[nonce]; ok && !now.After(expireAt) {
+		return false
+	}
+
+	c.nonces[nonce] = now.Add(c.ttl)
+	return true
+}
@@ -0,0 +1,89 @@
+package library
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Laisky/go-utils"
+)
+
+func TestHTTPHMACValidator(t *testing.T) {
+	var (
+		body = []byte(`{"a":1}`)
+		keys = map[string][]byte{"v1": []byte("old-key"), "v2": []byte("new-key")}
+	)
+	v, err := NewHTTPHMACValidator(keys, 5*time.Minute, time.Minute)
+	if err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	newHeader := func(key []byte, ts time.Time, nonce string) http.Header {
+		tsStr := strconv.FormatInt(ts.Unix(), 10)
+		h := http.Header{}
+		h.Set(HTTPSignTimestampHeader, tsStr)
+		h.Set(HTTPSignNonceHeader, nonce)
+		h.Set(HTTPSignSignatureHeader, hex.EncodeToString(SignHTTPBody(key, tsStr, nonce, body)))
+		return h
+	}
+	now := utils.Clock.GetUTCNow()
+
+	// both keys are active
+	if err = v.Validate(newHeader(keys["v1"], now, "n1"), body); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+	h := newHeader(keys["v2"], now, "n2")
+	h.Set(HTTPSignKeyIDHeader, "v2")
+	if err = v.Validate(h, body); err != nil {
+		t.Fatalf("got error: %+v", err)
+	}
+
+	// replay
+	if err = v.Validate(newHeader(keys["v1"], now, "n1"), body); err == nil {
+		t.Fatal("replay should be rejected")
+	}
+
+	// wrong key id
+	h = newHeader(keys["v2"], now, "n3")
+	h.Set(HTTPSignKeyIDHeader, "v1")
+	if err = v.Validate(h, body); err == nil {
+		t.Fatal("should be rejected")
+	}
+
+	// body changed
+	if err = v.Validate(newHeader(keys["v2"], now, "n4"), []byte(`{"a":2}`)); err == nil {
+		t.Fatal("should be rejected")
+	}
+
+	// expires & ahead
+	if err = v.Validate(newHeader(keys["v2"], now.Add(-10*time.Minute), "n5"), body); err == nil {
+		t.Fatal("should be rejected")
+	}
+	if err = v.Validate(newHeader(keys["v2"], now.Add(10*time.Minute), "n6"), body); err == nil {
+		t.Fatal("should be rejected")
+	}
+
+	// missing nonce
+	if err = v.Validate(newHeader(keys["v2"], now, ""), body); err == nil {
+		t.Fatal("should be rejected")
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache(time.Minute)
+	now := time.Now()
+	if !c.CheckAndAdd("a", now) {
+		t.Fatal("should accept")
+	}
+	if c.CheckAndAdd("a", now.Add(30*time.Second)) {
+		t.Fatal("should reject")
+	}
+	if !c.CheckAndAdd("a", now.Add(2*time.Minute)) {
+		t.Fatal("should accept after expired")
+	}
+	if len(c.nonces) != 1 {
+		t.Fatalf("got %d nonces", len(c.nonces))
+	}
+}
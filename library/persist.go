@@ -0,0 +1,153 @@
+package library
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	utils "github.com/Laisky/go-utils"
+)
+
+const (
+	defaultPersistNotifierCbChanLen = 10000
+	persistNotifierExpireInterval   = time.Second
+)
+
+// PersistNotifier notify recvs whether messages are persisted by journal,
+// so recvs could ack upstream after messages are persisted,
+// and messages will not be lost if process crashes.
+//
+// message is treated as persisted if it is written into journal,
+// or discarded by acceptor filters on purpose (nothing need to be persisted).
+// message that skips journal (like journal is busy) or not notified in timeout
+// is treated as not persisted.
+type PersistNotifier struct {
+	sync.Mutex
+	ctx     context.Context
+	timeout time.Duration
+	waiters map[int64]*persistWaiter
+	cbChan  chan func()
+}
+
+type persistWaiter struct {
+	cb       func(isPersisted bool)
+	deadline time.Time
+}
+
+// NewPersistNotifier create new PersistNotifier,
+// waiter will be notified as not persisted if not notified in timeout
+func NewPersistNotifier(ctx context.Context, timeout time.Duration) *PersistNotifier {
+	n := &PersistNotifier{
+		ctx:     ctx,
+		timeout: timeout,
+		waiters: map[int64]*persistWaiter{},
+		cbChan:  make(chan func(), defaultPersistNotifierCbChanLen),
+	}
+	go n.run(ctx)
+	return n
+}
+
+// Wait register cb for message id, cb will be called once with whether message is persisted.
+//
+// should be registered before message is put into acceptor.
+// all callbacks are called one by one in the same goroutine, so cb should not block.
+func (n *PersistNotifier) Wait(id int64, cb func(isPersisted bool)) {
+	n.Lock()
+	n.waiters[id] = &persistWaiter{
+		cb:       cb,
+		deadline: utils.Clock.GetUTCNow().Add(n.timeout),
+	}
+	n.Unlock()
+}
+
+// WaitAll register cb for messages, cb will be called once,
+// isPersisted is true only if all messages are persisted
+func (n *PersistNotifier) WaitAll(ids []int64, cb func(isPersisted bool)) {
+	if len(ids) == 0 {
+		n.callback(func() { cb(true) })
+		return
+	}
+
+	var (
+		nLeft  = len(ids)
+		isDone bool
+	)
+	for _, id := range ids {
+		// callbacks are called in the same goroutine, no need to lock
+		n.Wait(id, func(isPersisted bool) {
+			if isDone {
+				return
+			}
+
+			nLeft--
+			if !isPersisted || nLeft == 0 {
+				isDone = true
+				cb(isPersisted)
+			}
+		})
+	}
+}
+
+// Notify notify whether message is persisted, do nothing if no waiter
+func (n *PersistNotifier) Notify(id int64, isPersisted bool) {
+	n.Lock()
+	w, ok := n.waiters[id]
+	if ok {
+		delete(n.waiters, id)
+	}
+	n.Unlock()
+
+	if ok {
+		n.callback(func() { w.cb(isPersisted) })
+	}
+}
+
+// Len return the number of waiting messages
+func (n *PersistNotifier) Len() int {
+	n.Lock()
+	defer n.Unlock()
+	return len(n.waiters)
+}
+
+func (n *PersistNotifier) callback(f func()) {
+	select {
+	case n.cbChan <- f:
+	case <-n.ctx.Done():
+	}
+}
+
+func (n *PersistNotifier) run(ctx context.Context) {
+	ticker := time.NewTicker(persistNotifierExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case f := <-n.cbChan:
+			f()
+		case <-ticker.C:
+			n.expire()
+		}
+	}
+}
+
+// expire notify expired waiters as not persisted
+func (n *PersistNotifier) expire() {
+	var (
+		now     = utils.Clock.GetUTCNow()
+		expired []*persistWaiter
+	)
+	n.Lock()
+	for id, w := range n.waiters {
+		if now.After(w.deadline) {
+			expired = append(expired, w)
+			delete(n.waiters, id)
+		}
+	}
+	n.Unlock()
+
+	for _, w := range expired {
+		w.cb(false)
+	}
+}
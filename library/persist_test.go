@@ -0,0 +1,62 @@
+package library
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPersistNotifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := NewPersistNotifier(ctx, 500*time.Millisecond)
+
+	results := make(chan bool, 10)
+	waitResult := func(expect bool) {
+		select {
+		case got := <-results:
+			if got != expect {
+				t.Fatalf("expect %v, got %v", expect, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	cb := func(isPersisted bool) { results <- isPersisted }
+
+	n.Wait(1, cb)
+	n.Notify(2, true) // no waiter
+	n.Notify(1, true)
+	waitResult(true)
+	n.Notify(1, true) // already notified
+	n.Wait(1, cb)
+	n.Notify(1, false)
+	waitResult(false)
+
+	n.WaitAll([]int64{3, 4}, cb)
+	n.Notify(3, true)
+	n.Notify(4, true)
+	waitResult(true)
+
+	// failed if any one is not persisted
+	n.WaitAll([]int64{5, 6}, cb)
+	n.Notify(5, false)
+	waitResult(false)
+	n.Notify(6, true)
+
+	n.WaitAll(nil, cb)
+	waitResult(true)
+
+	// expired
+	n.Wait(7, cb)
+	waitResult(false)
+	if n.Len() != 0 {
+		t.Fatalf("got %d waiters", n.Len())
+	}
+
+	select {
+	case got := <-results:
+		t.Fatalf("got unexpected %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -84,6 +84,27 @@ func FlattenMap(data map[string]interface{}, delimiter string) {
 	}
 }
 
+// LoadNestedField load field from nested map by dot separated path,
+// return nil if not found
+func LoadNestedField(data map[string]interface{}, path string) interface{} {
+	if v, ok := data[path]; ok {
+		return v
+	}
+
+	var cur interface{} = data
+	for _, k := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if cur, ok = m[k]; !ok {
+			return nil
+		}
+	}
+
+	return cur
+}
+
 var defaultTemplateWithMappReg = regexp.MustCompile(`(?sm)\$\{([^}]+)\}`)
 
 // TemplateWithMap replace `${var}` in template string
@@ -93,29 +114,60 @@ func TemplateWithMap(tpl string, data map[string]interface{}) string {
 
 // TemplateWithMapAndRegexp replace `${var}` in template string
 func TemplateWithMapAndRegexp(tplReg *regexp.Regexp, tpl string, data map[string]interface{}) string {
-	var (
-		k, vs string
-	)
+	var k string
 	for _, kg := range tplReg.FindAllStringSubmatch(tpl, -1) {
 		k = kg[1]
-		switch v := data[k].(type) {
-		case string:
-			vs = v
-		case []byte:
-			vs = string(v)
-		case int:
-			vs = strconv.FormatInt(int64(v), 10)
-		case int64:
-			vs = strconv.FormatInt(v, 10)
-		case float64:
-			vs = strconv.FormatFloat(v, 'f', -1, 64)
-		}
-		tpl = strings.ReplaceAll(tpl, fmt.Sprintf("${%v}", k), vs)
+		tpl = strings.ReplaceAll(tpl, fmt.Sprintf("${%v}", k), templateValue(data[k]))
 	}
 
 	return tpl
 }
 
+// TemplateWithNestedFields replace `${a.b}` in template string by `data["a"]["b"]`,
+// see LoadNestedField for details
+func TemplateWithNestedFields(tpl string, data map[string]interface{}) string {
+	return TemplateWithFunc(tpl, func(key string) interface{} {
+		return LoadNestedField(data, key)
+	}, nil)
+}
+
+// TemplateWithFunc replace `${var}` in template string by `load(var)` in one pass,
+// so `${var}` in loaded values will not be replaced again.
+// every replaced value will be escaped by `escape` if it is not nil
+func TemplateWithFunc(tpl string, load func(key string) interface{}, escape func(string) string) string {
+	if !strings.Contains(tpl, "${") {
+		return tpl
+	}
+
+	return defaultTemplateWithMappReg.ReplaceAllStringFunc(tpl, func(matched string) string {
+		vs := templateValue(load(matched[2 : len(matched)-1]))
+		if escape != nil {
+			vs = escape(vs)
+		}
+		return vs
+	})
+}
+
+// templateValue format value to replace variable in template, nil will be empty
+func templateValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
 // AbsInt return abs(int)
 func AbsInt(n int) int {
 	if n < 0 {
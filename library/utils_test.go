@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -109,6 +110,47 @@ func TestTemplateWithMap(t *testing.T) {
 	}
 }
 
+func TestTemplateWithMapTypes(t *testing.T) {
+	tpl := `${b}-${u}-${i32}-${nil}-${miss}`
+	data := map[string]interface{}{
+		"b":   true,
+		"u":   uint(3),
+		"i32": int32(-4),
+		"nil": nil,
+	}
+	if got := TemplateWithMap(tpl, data); got != `true-3--4--` {
+		t.Fatalf("got `%v`", got)
+	}
+}
+
+func TestTemplateWithNestedFields(t *testing.T) {
+	data := map[string]interface{}{
+		"app": "web",
+		"k8s": map[string]interface{}{"ns": "prod", "replicas": uint8(2)},
+		"tpl": "${app}",
+	}
+	if got := TemplateWithNestedFields(`${k8s.ns}.${app}.${k8s.replicas}.${tpl}.${miss}`, data); got != `prod.web.2.${app}.` {
+		t.Fatalf("got `%v`", got)
+	}
+	if got := TemplateWithFunc(`/${a}/${b}`, func(key string) interface{} {
+		return key + "/x"
+	}, func(v string) string {
+		return strings.ReplaceAll(v, "/", "%2F")
+	}); got != `/a%2Fx/b%2Fx` {
+		t.Fatalf("got `%v`", got)
+	}
+}
+
+func TestLoadNestedField(t *testing.T) {
+	data := map[string]interface{}{
+		"a.b": "flat",
+		"c":   map[string]interface{}{"d": "nested"},
+	}
+	if LoadNestedField(data, "a.b") != "flat" || LoadNestedField(data, "c.d") != "nested" || LoadNestedField(data, "c.e") != nil {
+		t.Fatal("load nested field error")
+	}
+}
+
 func TestLoadTagsReplaceEnv(t *testing.T) {
 	type args struct {
 		env  string